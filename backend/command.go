@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/importer"
+	"github.com/spagettikod/opent1d/scraper"
+)
+
+const usage = `usage: opent1d [command]
+
+Starts the OpenT1D server when no command is given.
+
+commands:
+  migrate status        list migrations and the current schema version
+  migrate up            apply all pending migrations
+  migrate down [steps]  revert the latest, or the given number of, migrations
+  payloads list [id]    list archived LibreLinkUp payloads, 100 at a time after the given id
+  payloads show <id>    print the body of an archived payload as it was received
+  payloads replay <id>  print what the payload is parsed into, without storing anything
+  reprocess             store readings, sensors and alarms missing from archived payloads
+  import libreview|clarity [--dry-run] <patient> <file> [time zone]
+                        import a LibreView glucose data or Dexcom Clarity CSV export, timestamps
+                        in the file are local time in the IANA time zone, the server's time zone
+                        if not given. A dry run reports what would be stored without storing it,
+                        pending database migrations are still applied.
+                        The patient must already be followed through one of the sources
+`
+
+// RunCommand runs the command line command given in args, which excludes the program name.
+func RunCommand(store datastore.Store, args []string, out io.Writer) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(store, args[1:], out)
+	case "payloads":
+		return runPayloads(store, args[1:], out)
+	case "import":
+		return runImport(store, args[1:], out)
+	case "reprocess":
+		result, err := openArchive(store).Reprocess()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "reprocessed %v payloads, %v could not be parsed\n", result.Payloads, result.Failed)
+		fmt.Fprintf(out, "stored %v new readings and %v new alarm events\n", result.Readings, result.Alarms)
+		return nil
+	default:
+		return fmt.Errorf("unknown command '%s'\n\n%s", args[0], usage)
+	}
+}
+
+func runMigrate(store datastore.Store, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("migrate requires a subcommand\n\n%s", usage)
+	}
+	switch args[0] {
+	case "status":
+		return migrateStatus(store, out)
+	case "up":
+		if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+			return err
+		}
+		return migrateStatus(store, out)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("steps must be a positive number, got '%s'", args[1])
+			}
+		}
+		current, err := store.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		to := current - steps
+		if to < 0 {
+			to = 0
+		}
+		if err := store.Migrate(to); err != nil {
+			return err
+		}
+		return migrateStatus(store, out)
+	default:
+		return fmt.Errorf("unknown migrate subcommand '%s'\n\n%s", args[0], usage)
+	}
+}
+
+// payloadListSize is the number of payloads listed at a time
+const payloadListSize = 100
+
+func runPayloads(store datastore.Store, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("payloads requires a subcommand\n\n%s", usage)
+	}
+	id := int64(0)
+	if len(args) > 1 {
+		var err error
+		if id, err = strconv.ParseInt(args[1], 10, 64); err != nil || id < 0 {
+			return fmt.Errorf("id must be a positive number, got '%s'", args[1])
+		}
+	} else if args[0] != "list" {
+		return fmt.Errorf("payloads %s requires an id\n\n%s", args[0], usage)
+	}
+	archive := openArchive(store)
+	switch args[0] {
+	case "list":
+		payloads, err := store.LoadRawPayloads("", id, payloadListSize)
+		if err != nil {
+			return err
+		}
+		for _, p := range payloads {
+			fmt.Fprintf(out, "%6d  %s  %-11s  %3d  %6v  %6d  %s %s\n", p.ID, p.Requested.Local().Format(time.RFC3339), p.Source, p.StatusCode, p.Duration, p.Size(), p.Method, p.URL)
+		}
+		return nil
+	case "show":
+		p, err := store.RawPayload(id)
+		if err != nil {
+			return err
+		}
+		body, err := archive.Open(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(body))
+		return nil
+	case "replay":
+		replay, err := archive.Replay(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s payload from %s, %v sensors, %v readings and %v alarm events\n", replay.Kind, replay.Payload.Requested.Local().Format(time.RFC3339), len(replay.Sensors), len(replay.Readings), len(replay.Alarms))
+		for _, s := range replay.Sensors {
+			fmt.Fprintf(out, "sensor  %s  activated %s\n", s.SerialNumber, s.Activated.Local().Format(time.RFC3339))
+		}
+		for _, cgm := range replay.Readings {
+			fmt.Fprintf(out, "reading %s  %s  %3d mg/dL  type %v  trend %v  sensor %s\n", cgm.PatientID, cgm.Timestamp.Local().Format(time.RFC3339), cgm.MgPerDl, cgm.Type, cgm.Trend, cgm.SensorSerial)
+		}
+		for _, ae := range replay.Alarms {
+			fmt.Fprintf(out, "alarm   %s  %s  %3d mg/dL  kind %v\n", ae.PatientID, ae.Timestamp.Local().Format(time.RFC3339), ae.MgPerDl, ae.Kind)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown payloads subcommand '%s'\n\n%s", args[0], usage)
+	}
+}
+
+// importers are the importers of the import command by the name of their subcommand.
+var importers = map[string]func(datastore.Store, io.Reader, string, importer.Options) (importer.Report, error){
+	"libreview": importer.LibreView,
+	"clarity":   importer.Clarity,
+}
+
+func runImport(store datastore.Store, args []string, out io.Writer) error {
+	opts := importer.Options{Location: time.Local}
+	positional := []string{}
+	for _, arg := range args {
+		if arg == "--dry-run" {
+			opts.DryRun = true
+		} else {
+			positional = append(positional, arg)
+		}
+	}
+	args = positional
+	if len(args) == 0 {
+		return fmt.Errorf("import requires a subcommand\n\n%s", usage)
+	}
+	importFn, ok := importers[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown import subcommand '%s'\n\n%s", args[0], usage)
+	}
+	if len(args) < 3 {
+		return fmt.Errorf("import %s requires a patient and a file\n\n%s", args[0], usage)
+	}
+	patientID, filename := args[1], args[2]
+	if len(args) > 3 {
+		var err error
+		if opts.Location, err = time.LoadLocation(args[3]); err != nil {
+			return fmt.Errorf("unknown time zone '%s'", args[3])
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := importFn(store, f, patientID, opts)
+	if err != nil {
+		return err
+	}
+	if report.DryRun {
+		fmt.Fprintf(out, "dry run, would store %v new readings, %v new treatments and %v new alarm events, skip %v records\n", report.Readings, report.Treatments, report.Alarms, report.Skipped)
+	} else {
+		fmt.Fprintf(out, "stored %v new readings, %v new treatments and %v new alarm events, skipped %v records\n", report.Readings, report.Treatments, report.Alarms, report.Skipped)
+	}
+	if report.Conflicted > 0 {
+		fmt.Fprintf(out, "%v readings differ from the reading stored for the same minute:\n", report.Conflicted)
+		for _, c := range report.Conflicts {
+			fmt.Fprintf(out, "line %6d  %s  %3d mg/dL, stored %3d mg/dL from %s\n", c.Line, c.Reading.Timestamp.Local().Format(time.RFC3339), c.Reading.MgPerDl, c.Stored.MgPerDl, c.Stored.Source)
+		}
+	}
+	if report.Rejected > 0 {
+		fmt.Fprintf(out, "rejected %v records:\n", report.Rejected)
+		for _, r := range report.Rejections {
+			fmt.Fprintf(out, "line %6d  %s\n", r.Line, r.Reason)
+		}
+	}
+	return nil
+}
+
+// openArchive returns the archive of the database, payloads are opened with the key used by the
+// server.
+func openArchive(store datastore.Store) *scraper.Archive {
+	return scraper.NewArchive(store, GetSealer(store), 0, log.Logger)
+}
+
+func migrateStatus(store datastore.Store, out io.Writer) error {
+	current, err := store.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	status, err := store.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "schema version %v, latest version %v\n", current, datastore.LatestSchemaVersion())
+	for _, ms := range status {
+		applied := "pending"
+		if ms.IsApplied() {
+			applied = "applied " + ms.Applied.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%4d  %-28s  %s\n", ms.Version, applied, ms.Description)
+	}
+	if current > datastore.LatestSchemaVersion() {
+		fmt.Fprintln(out, datastore.ErrSchemaTooNew)
+	}
+	return nil
+}
@@ -0,0 +1,471 @@
+package datastore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrSchemaTooNew        = errors.New("database schema is newer than this version of OpenT1D supports")
+	ErrInvalidVersion      = errors.New("schema version is not valid")
+	createSchemaVersionDDL = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	applied INTEGER NOT NULL
+)`
+)
+
+// Migration is a single step changing the database schema. Up applies the change and Down
+// reverts it. A migration's version is its position in the migrations list, starting at 1.
+type Migration struct {
+	Version     int
+	Description string
+	Up          []string
+	Down        []string
+}
+
+// MigrationStatus describes a migration and when, if ever, it was applied to the database.
+type MigrationStatus struct {
+	Migration
+	Applied time.Time
+}
+
+// IsApplied returns true if the migration has been applied to the database.
+func (ms MigrationStatus) IsApplied() bool {
+	return !ms.Applied.IsZero()
+}
+
+// LatestSchemaVersion returns the schema version this version of OpenT1D expects.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns the version the database schema is at, 0 means nothing has been applied.
+func (sls SQLiteStore) SchemaVersion() (int, error) {
+	if _, err := sls.db.Exec(createSchemaVersionDDL); err != nil {
+		return 0, fmt.Errorf("error while creating schema version table: %w", err)
+	}
+	var version int
+	if err := sls.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("error while reading schema version: %w", err)
+	}
+	return version, nil
+}
+
+// MigrationStatus returns all known migrations and when they were applied.
+func (sls SQLiteStore) MigrationStatus() ([]MigrationStatus, error) {
+	if _, err := sls.db.Exec(createSchemaVersionDDL); err != nil {
+		return nil, fmt.Errorf("error while creating schema version table: %w", err)
+	}
+	rows, err := sls.db.Query("SELECT version, applied FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("error while reading schema versions: %w", err)
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var ts int64
+		if err := rows.Scan(&version, &ts); err != nil {
+			return nil, fmt.Errorf("error while reading schema versions: %w", err)
+		}
+		applied[version] = time.Unix(ts, 0)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, m := range migrations {
+		status = append(status, MigrationStatus{Migration: m, Applied: applied[m.Version]})
+	}
+	return status, nil
+}
+
+// Migrate applies, or reverts, migrations until the database is at the given schema version.
+// Each migration is run in its own transaction. ErrSchemaTooNew is returned if the database
+// has a version this version of OpenT1D does not know about.
+func (sls SQLiteStore) Migrate(to int) error {
+	if to < 0 || to > LatestSchemaVersion() {
+		return fmt.Errorf("%w: %v", ErrInvalidVersion, to)
+	}
+	current, err := sls.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		return fmt.Errorf("%w: database is at version %v, latest known version is %v", ErrSchemaTooNew, current, LatestSchemaVersion())
+	}
+	for v := current + 1; v <= to; v++ {
+		m := migrations[v-1]
+		if err := sls.migrate(m.Up, "INSERT INTO schema_version (version, applied) VALUES (?, ?)", v, time.Now().Unix()); err != nil {
+			return fmt.Errorf("error while applying migration %v, %s: %w", v, m.Description, err)
+		}
+	}
+	for v := current; v > to; v-- {
+		m := migrations[v-1]
+		if err := sls.migrate(m.Down, "DELETE FROM schema_version WHERE version = ?", v); err != nil {
+			return fmt.Errorf("error while reverting migration %v, %s: %w", v, m.Description, err)
+		}
+	}
+	return nil
+}
+
+// migrate executes the statements followed by the version statement in a single transaction.
+func (sls SQLiteStore) migrate(stmts []string, versionStmt string, args ...any) error {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := execAll(tx, stmts); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+	if _, err := tx.Exec(versionStmt, args...); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func execAll(tx *sql.Tx, stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	migrations = []Migration{
+		{
+			Version:     1,
+			Description: "create cgm and kv tables",
+			Up: []string{
+				`CREATE TABLE IF NOT EXISTS cgm (
+	ts INTEGER PRIMARY KEY,
+	mmoll REAL NOT NULL
+)`,
+				`CREATE TABLE IF NOT EXISTS kv (
+	key TEXT PRIMARY KEY,
+	value TEXT
+)`,
+			},
+			Down: []string{
+				`DROP TABLE cgm`,
+				`DROP TABLE kv`,
+			},
+		},
+		{
+			Version:     2,
+			Description: "add measurement metadata to cgm",
+			Up: []string{
+				`ALTER TABLE cgm ADD COLUMN mgdl INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE cgm ADD COLUMN type INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE cgm ADD COLUMN color INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE cgm ADD COLUMN is_high INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE cgm ADD COLUMN is_low INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE cgm ADD COLUMN utc_offset INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE cgm ADD COLUMN trend INTEGER NOT NULL DEFAULT 0`,
+				`UPDATE cgm SET mgdl = CAST(ROUND(mmoll * 18.0) AS INTEGER)`,
+			},
+			Down: []string{
+				`ALTER TABLE cgm DROP COLUMN trend`,
+				`ALTER TABLE cgm DROP COLUMN utc_offset`,
+				`ALTER TABLE cgm DROP COLUMN is_low`,
+				`ALTER TABLE cgm DROP COLUMN is_high`,
+				`ALTER TABLE cgm DROP COLUMN color`,
+				`ALTER TABLE cgm DROP COLUMN type`,
+				`ALTER TABLE cgm DROP COLUMN mgdl`,
+			},
+		},
+		{
+			Version:     3,
+			Description: "add patients and scope cgm by patient",
+			Up: []string{
+				`CREATE TABLE patients (
+	id TEXT PRIMARY KEY,
+	first_name TEXT NOT NULL,
+	last_name TEXT NOT NULL,
+	target_low INTEGER NOT NULL,
+	target_high INTEGER NOT NULL,
+	updated INTEGER NOT NULL
+)`,
+				`CREATE TABLE cgm_new (
+	patient_id TEXT NOT NULL DEFAULT '',
+	ts INTEGER NOT NULL,
+	mmoll REAL NOT NULL,
+	mgdl INTEGER NOT NULL DEFAULT 0,
+	type INTEGER NOT NULL DEFAULT 0,
+	color INTEGER NOT NULL DEFAULT 0,
+	is_high INTEGER NOT NULL DEFAULT 0,
+	is_low INTEGER NOT NULL DEFAULT 0,
+	utc_offset INTEGER NOT NULL DEFAULT 0,
+	trend INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (patient_id, ts)
+)`,
+				`INSERT INTO cgm_new (ts, mmoll, mgdl, type, color, is_high, is_low, utc_offset, trend)
+SELECT ts, mmoll, mgdl, type, color, is_high, is_low, utc_offset, trend FROM cgm`,
+				`DROP TABLE cgm`,
+				`ALTER TABLE cgm_new RENAME TO cgm`,
+			},
+			Down: []string{
+				`CREATE TABLE cgm_old (
+	ts INTEGER PRIMARY KEY,
+	mmoll REAL NOT NULL,
+	mgdl INTEGER NOT NULL DEFAULT 0,
+	type INTEGER NOT NULL DEFAULT 0,
+	color INTEGER NOT NULL DEFAULT 0,
+	is_high INTEGER NOT NULL DEFAULT 0,
+	is_low INTEGER NOT NULL DEFAULT 0,
+	utc_offset INTEGER NOT NULL DEFAULT 0,
+	trend INTEGER NOT NULL DEFAULT 0
+)`,
+				`INSERT OR IGNORE INTO cgm_old SELECT ts, mmoll, mgdl, type, color, is_high, is_low, utc_offset, trend FROM cgm ORDER BY patient_id`,
+				`DROP TABLE cgm`,
+				`ALTER TABLE cgm_old RENAME TO cgm`,
+				`DROP TABLE patients`,
+			},
+		},
+		{
+			Version:     4,
+			Description: "add sensors and link cgm to sensors",
+			Up: []string{
+				`CREATE TABLE sensors (
+	serial_number TEXT PRIMARY KEY,
+	patient_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	activated INTEGER NOT NULL,
+	expected_end INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL
+)`,
+				`CREATE INDEX sensors_patient_id ON sensors (patient_id, activated)`,
+				`ALTER TABLE cgm ADD COLUMN sensor_serial TEXT NOT NULL DEFAULT ''`,
+				`CREATE INDEX cgm_sensor_serial ON cgm (sensor_serial)`,
+			},
+			Down: []string{
+				`DROP INDEX cgm_sensor_serial`,
+				`ALTER TABLE cgm DROP COLUMN sensor_serial`,
+				`DROP TABLE sensors`,
+			},
+		},
+		{
+			Version:     5,
+			Description: "tag cgm with the source it was fetched from",
+			Up: []string{
+				`ALTER TABLE cgm ADD COLUMN source TEXT NOT NULL DEFAULT ''`,
+				// LibreLinkUp was the only source before sources were tracked
+				`UPDATE cgm SET source = 'librelinkup'`,
+			},
+			Down: []string{
+				`ALTER TABLE cgm DROP COLUMN source`,
+			},
+		},
+		{
+			Version:     6,
+			Description: "add uploading device to cgm",
+			Up: []string{
+				`ALTER TABLE cgm ADD COLUMN device TEXT NOT NULL DEFAULT ''`,
+			},
+			Down: []string{
+				`ALTER TABLE cgm DROP COLUMN device`,
+			},
+		},
+		{
+			Version:     7,
+			Description: "add alarm events",
+			Up: []string{
+				`CREATE TABLE alarm_events (
+	patient_id TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	kind INTEGER NOT NULL,
+	mmoll REAL NOT NULL,
+	mgdl INTEGER NOT NULL,
+	trend INTEGER NOT NULL DEFAULT 0,
+	utc_offset INTEGER NOT NULL DEFAULT 0,
+	source TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (patient_id, ts, kind)
+)`,
+			},
+			Down: []string{
+				`DROP TABLE alarm_events`,
+			},
+		},
+		{
+			Version:     8,
+			Description: "add scrape runs",
+			Up: []string{
+				`CREATE TABLE scrape_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	source TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	finished INTEGER NOT NULL,
+	readings INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT ''
+)`,
+				`CREATE INDEX scrape_runs_source_started ON scrape_runs (source, started)`,
+			},
+			Down: []string{
+				`DROP TABLE scrape_runs`,
+			},
+		},
+		{
+			Version:     9,
+			Description: "add raw payload archive",
+			Up: []string{
+				`CREATE TABLE raw_payloads (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	source TEXT NOT NULL,
+	method TEXT NOT NULL,
+	url TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	requested INTEGER NOT NULL,
+	duration_ms INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	body BLOB NOT NULL
+)`,
+				`CREATE INDEX raw_payloads_source ON raw_payloads (source, id)`,
+			},
+			Down: []string{
+				`DROP TABLE raw_payloads`,
+			},
+		},
+		{
+			Version:     10,
+			Description: "add treatments and device statuses",
+			Up: []string{
+				`CREATE TABLE treatments (
+	patient_id TEXT NOT NULL,
+	identifier TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	event_type TEXT NOT NULL DEFAULT '',
+	insulin REAL NOT NULL DEFAULT 0,
+	carbs REAL NOT NULL DEFAULT 0,
+	utc_offset INTEGER NOT NULL DEFAULT 0,
+	source TEXT NOT NULL DEFAULT '',
+	document TEXT NOT NULL,
+	PRIMARY KEY (patient_id, identifier)
+)`,
+				`CREATE INDEX treatments_patient_ts ON treatments (patient_id, ts)`,
+				`CREATE TABLE device_status (
+	patient_id TEXT NOT NULL,
+	identifier TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	device TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL DEFAULT '',
+	document TEXT NOT NULL,
+	PRIMARY KEY (patient_id, identifier)
+)`,
+				`CREATE INDEX device_status_patient_ts ON device_status (patient_id, ts)`,
+			},
+			Down: []string{
+				`DROP TABLE device_status`,
+				`DROP TABLE treatments`,
+			},
+		},
+		{
+			Version:     11,
+			Description: "add outbox",
+			Up: []string{
+				`CREATE TABLE outbox (
+	sink TEXT NOT NULL,
+	patient_id TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (sink, patient_id, ts)
+)`,
+				`CREATE INDEX outbox_sink_next_attempt ON outbox (sink, next_attempt)`,
+			},
+			Down: []string{
+				`DROP TABLE outbox`,
+			},
+		},
+		{
+			Version:     12,
+			Description: "key cgm and outbox by measurement type",
+			Up: []string{
+				`CREATE TABLE cgm_new (
+	patient_id TEXT NOT NULL DEFAULT '',
+	ts INTEGER NOT NULL,
+	mmoll REAL NOT NULL,
+	mgdl INTEGER NOT NULL DEFAULT 0,
+	type INTEGER NOT NULL DEFAULT 0,
+	color INTEGER NOT NULL DEFAULT 0,
+	is_high INTEGER NOT NULL DEFAULT 0,
+	is_low INTEGER NOT NULL DEFAULT 0,
+	utc_offset INTEGER NOT NULL DEFAULT 0,
+	trend INTEGER NOT NULL DEFAULT 0,
+	sensor_serial TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL DEFAULT '',
+	device TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (patient_id, ts, type)
+)`,
+				`INSERT INTO cgm_new SELECT patient_id, ts, mmoll, mgdl, type, color, is_high, is_low, utc_offset, trend, sensor_serial, source, device FROM cgm`,
+				`DROP INDEX cgm_sensor_serial`,
+				`DROP TABLE cgm`,
+				`ALTER TABLE cgm_new RENAME TO cgm`,
+				`CREATE INDEX cgm_sensor_serial ON cgm (sensor_serial)`,
+				`CREATE TABLE outbox_new (
+	sink TEXT NOT NULL,
+	patient_id TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	type INTEGER NOT NULL DEFAULT 0,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (sink, patient_id, ts, type)
+)`,
+				`INSERT INTO outbox_new (sink, patient_id, ts, type, attempts, next_attempt, error)
+SELECT o.sink, o.patient_id, o.ts, COALESCE(c.type, 0), o.attempts, o.next_attempt, o.error FROM outbox o LEFT JOIN cgm c ON c.patient_id = o.patient_id AND c.ts = o.ts`,
+				`DROP TABLE outbox`,
+				`ALTER TABLE outbox_new RENAME TO outbox`,
+				`CREATE INDEX outbox_sink_next_attempt ON outbox (sink, next_attempt)`,
+			},
+			Down: []string{
+				`CREATE TABLE outbox_old (
+	sink TEXT NOT NULL,
+	patient_id TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (sink, patient_id, ts)
+)`,
+				`INSERT OR IGNORE INTO outbox_old SELECT sink, patient_id, ts, attempts, next_attempt, error FROM outbox ORDER BY type`,
+				`DROP TABLE outbox`,
+				`ALTER TABLE outbox_old RENAME TO outbox`,
+				`CREATE INDEX outbox_sink_next_attempt ON outbox (sink, next_attempt)`,
+				`CREATE TABLE cgm_old (
+	patient_id TEXT NOT NULL DEFAULT '',
+	ts INTEGER NOT NULL,
+	mmoll REAL NOT NULL,
+	mgdl INTEGER NOT NULL DEFAULT 0,
+	type INTEGER NOT NULL DEFAULT 0,
+	color INTEGER NOT NULL DEFAULT 0,
+	is_high INTEGER NOT NULL DEFAULT 0,
+	is_low INTEGER NOT NULL DEFAULT 0,
+	utc_offset INTEGER NOT NULL DEFAULT 0,
+	trend INTEGER NOT NULL DEFAULT 0,
+	sensor_serial TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL DEFAULT '',
+	device TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (patient_id, ts)
+)`,
+				`INSERT OR IGNORE INTO cgm_old SELECT patient_id, ts, mmoll, mgdl, type, color, is_high, is_low, utc_offset, trend, sensor_serial, source, device FROM cgm ORDER BY type`,
+				`DROP INDEX cgm_sensor_serial`,
+				`DROP TABLE cgm`,
+				`ALTER TABLE cgm_old RENAME TO cgm`,
+				`CREATE INDEX cgm_sensor_serial ON cgm (sensor_serial)`,
+			},
+		},
+	}
+)
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/spagettikod/opent1d/glucose"
 )
 
 var (
@@ -14,18 +16,128 @@ var (
 )
 
 type Store interface {
-	Migrate(from int) error
+	// Migrate applies, or reverts, migrations until the schema is at the given version
+	Migrate(to int) error
+	SchemaVersion() (int, error)
+	MigrationStatus() ([]MigrationStatus, error)
 	Close() error
 	GetSettings() (Settings, error)
 	SaveSettings(settings Settings) error
-	SaveCGM(cgms ...CGMEntry) error
-	LoadCGMInterval(from, to time.Time) ([]CGMEntry, error)
+	// GetValue returns the value stored in the key-value table or ErrNotFound
+	GetValue(key string) (string, error)
+	SaveValue(key, value string) error
+	DeleteValue(key string) error
+	// SaveCGM stores the entries and returns those that were not already stored
+	SaveCGM(cgms ...CGMEntry) ([]CGMEntry, error)
+	// LatestCGM returns the patient's most recent entry or ErrNotFound if there are none
+	LatestCGM(patientID string) (CGMEntry, error)
+	// LoadCGMInterval returns the patient's entries with a timestamp in the half-open interval
+	// [from, to) ordered by timestamp and measurement type. At most limit entries are returned, a
+	// limit less than one means no limit. Only entries of the given measurement types are
+	// returned, if any are given.
+	LoadCGMInterval(patientID string, from, to time.Time, limit int, types ...MeasurementType) ([]CGMEntry, error)
+	// LoadCGMAfter works like LoadCGMInterval but returns the entries ordered after the entry with
+	// timestamp ts and measurement type typ, up to but not including to.
+	LoadCGMAfter(patientID string, ts time.Time, typ MeasurementType, to time.Time, limit int, types ...MeasurementType) ([]CGMEntry, error)
+	// LatestCGMInterval returns at most limit of the patient's most recent entries with a
+	// timestamp in the half-open interval [from, to), latest first. A limit less than one means
+	// no limit.
+	LatestCGMInterval(patientID string, from, to time.Time, limit int) ([]CGMEntry, error)
+	// AssignCGM assigns entries stored before patients were tracked to the given patient and
+	// returns the number of entries assigned
+	AssignCGM(patientID string) (int64, error)
+	// SavePatients adds new patients and updates existing ones
+	SavePatients(patients ...Patient) error
+	Patients() ([]Patient, error)
+	// SaveSensor adds a new sensor or updates when an existing sensor was last seen
+	SaveSensor(sensor Sensor) error
+	// Sensors returns the patient's sensors, the most recently activated first
+	Sensors(patientID string) ([]Sensor, error)
+	// SaveAlarmEvents stores the alarm events and returns those that were not already stored
+	SaveAlarmEvents(events ...AlarmEvent) ([]AlarmEvent, error)
+	// LoadAlarmEvents returns the patient's alarm events in the interval [from, to), ordered by time
+	LoadAlarmEvents(patientID string, from, to time.Time) ([]AlarmEvent, error)
+	// SaveScrapeRun records a run of a source, runs older than ScrapeRunRetention are removed
+	SaveScrapeRun(run ScrapeRun) error
+	// LoadScrapeRuns returns the most recent runs, latest first, of the source or of all sources
+	// if source is empty. At most limit runs are returned, a limit less than one means no limit.
+	LoadScrapeRuns(source string, limit int) ([]ScrapeRun, error)
+	// LatestFailedScrapeRun returns the source's most recent failed run or ErrNotFound
+	LatestFailedScrapeRun(source string) (ScrapeRun, error)
+	// SaveRawPayload archives the payload and returns its ID. The oldest payloads are removed
+	// while all payloads together are larger than maxSize bytes, a maxSize less than one means
+	// no limit.
+	SaveRawPayload(payload RawPayload, maxSize int64) (int64, error)
+	// LoadRawPayloads returns at most limit of the source's payloads, or of all sources, with an
+	// ID greater than afterID in the order they were archived. A limit less than one means no
+	// limit.
+	LoadRawPayloads(source string, afterID int64, limit int) ([]RawPayload, error)
+	// RawPayload returns the archived payload with the given ID or ErrNotFound
+	RawPayload(id int64) (RawPayload, error)
+	// SaveTreatments stores the treatments and returns those that were not already stored
+	SaveTreatments(treatments ...Treatment) ([]Treatment, error)
+	// LoadTreatments returns the patient's treatments in the interval [from, to), ordered by time
+	LoadTreatments(patientID string, from, to time.Time) ([]Treatment, error)
+	// SaveDeviceStatuses stores the statuses and returns those that were not already stored
+	SaveDeviceStatuses(statuses ...DeviceStatus) ([]DeviceStatus, error)
+	// LoadDeviceStatuses returns the patient's device statuses in the interval [from, to),
+	// ordered by time
+	LoadDeviceStatuses(patientID string, from, to time.Time) ([]DeviceStatus, error)
+	// EnqueueOutbox adds stored entries to the sink's outbox, entries already waiting are left
+	// as they are. Entries at or before the high-water mark stored under markKey, the time in
+	// milliseconds of the latest uploaded entry, are left out in the same transaction, so an
+	// entry uploaded while it was being published is not added again.
+	EnqueueOutbox(sink, markKey string, cgms ...CGMEntry) error
+	// LoadOutbox returns at most limit of the sink's waiting entries that are due at the given
+	// time, oldest first. A limit less than one means no limit.
+	LoadOutbox(sink string, due time.Time, limit int) ([]OutboxEntry, error)
+	// UpdateOutbox saves the attempts, next attempt and error of waiting entries
+	UpdateOutbox(entries ...OutboxEntry) error
+	// DeleteOutbox removes uploaded entries from the outbox
+	DeleteOutbox(entries ...OutboxEntry) error
+	// OutboxSize returns the number of entries waiting in the sink's outbox
+	OutboxSize(sink string) (int, error)
 }
 
 type Settings struct {
 	LibreLinkUpUsername string `json:"libreLinkUpUsername"`
 	LibreLinkUpPassword string `json:"libreLinkUpPassword"`
 	LibreLinkUpRegion   string `json:"libreLinkUpRegion"`
+	// LibreLinkUpPatients are the identifiers of the patients to scrape, all patients the
+	// account follows are scraped if empty
+	LibreLinkUpPatients []string `json:"libreLinkUpPatients"`
+	// LibreLinkUpInterval is the time between polls of the current LibreLinkUp readings, the
+	// default interval is used if zero
+	LibreLinkUpInterval time.Duration `json:"libreLinkUpInterval"`
+	// LibreLinkUpBackfillInterval is the time between fetches of the LibreLinkUp graph and
+	// logbook, the default interval is used if zero
+	LibreLinkUpBackfillInterval time.Duration `json:"libreLinkUpBackfillInterval"`
+
+	DexcomUsername string `json:"dexcomUsername"`
+	DexcomPassword string `json:"dexcomPassword"`
+	// DexcomRegion is the Dexcom Share server the account belongs to, us or ous
+	DexcomRegion string `json:"dexcomRegion"`
+	// DexcomInterval is the time between Dexcom Share scrapes, the default interval is used if zero
+	DexcomInterval time.Duration `json:"dexcomInterval"`
+
+	// NightscoutURL is the base URL of the Nightscout site to poll, such as https://example.herokuapp.com
+	NightscoutURL string `json:"nightscoutUrl"`
+	// NightscoutAPISecret and NightscoutToken authenticate requests to the site, either can be used
+	NightscoutAPISecret string `json:"nightscoutApiSecret"`
+	NightscoutToken     string `json:"nightscoutToken"`
+	// NightscoutInterval is the time between Nightscout polls, the Nightscout default is used if zero
+	NightscoutInterval time.Duration `json:"nightscoutInterval"`
+	// NightscoutBackfillDays is how many days of entries are fetched on the first poll, the
+	// Nightscout default is used if zero
+	NightscoutBackfillDays int `json:"nightscoutBackfillDays"`
+
+	// NightscoutUploadURL is the base URL of the Nightscout site LibreLinkUp readings are
+	// uploaded to, nothing is uploaded if empty
+	NightscoutUploadURL       string `json:"nightscoutUploadUrl"`
+	NightscoutUploadAPISecret string `json:"nightscoutUploadApiSecret"`
+	// NightscoutUploadPatient is the patient whose readings are uploaded, the readings of all
+	// patients are uploaded if empty
+	NightscoutUploadPatient string `json:"nightscoutUploadPatient"`
 }
 
 func SettingsFromJson(jsn string) (Settings, error) {
@@ -34,7 +146,8 @@ func SettingsFromJson(jsn string) (Settings, error) {
 	return settings, err
 }
 
-func (s Settings) IsValid() bool {
+// LibreLinkUpConfigured returns true if the settings needed to scrape LibreLinkUp are set.
+func (s Settings) LibreLinkUpConfigured() bool {
 	if strings.TrimSpace(s.LibreLinkUpUsername) == "" {
 		return false
 	}
@@ -47,6 +160,34 @@ func (s Settings) IsValid() bool {
 	return true
 }
 
+// DexcomConfigured returns true if the settings needed to scrape Dexcom Share are set.
+func (s Settings) DexcomConfigured() bool {
+	return strings.TrimSpace(s.DexcomUsername) != "" && strings.TrimSpace(s.DexcomPassword) != "" && strings.TrimSpace(s.DexcomRegion) != ""
+}
+
+// NightscoutUploadConfigured returns true if the settings needed to upload to Nightscout are set.
+func (s Settings) NightscoutUploadConfigured() bool {
+	return strings.TrimSpace(s.NightscoutUploadURL) != "" && strings.TrimSpace(s.NightscoutUploadAPISecret) != ""
+}
+
+// NightscoutConfigured returns true if the settings needed to poll Nightscout are set.
+func (s Settings) NightscoutConfigured() bool {
+	return strings.TrimSpace(s.NightscoutURL) != ""
+}
+
+// ScrapesPatient returns true if the patient is selected for scraping.
+func (s Settings) ScrapesPatient(patientID string) bool {
+	if len(s.LibreLinkUpPatients) == 0 {
+		return true
+	}
+	for _, id := range s.LibreLinkUpPatients {
+		if id == patientID {
+			return true
+		}
+	}
+	return false
+}
+
 func (s Settings) ToJson() (string, error) {
 	b, err := json.Marshal(s)
 	if err != nil {
@@ -55,15 +196,254 @@ func (s Settings) ToJson() (string, error) {
 	return string(b), nil
 }
 
+// Patient is a person whose CGM data is collected, for example a LibreLinkUp connection.
+type Patient struct {
+	ID        string
+	FirstName string
+	LastName  string
+	// TargetLow is the lower bound of the patient's target range in mg/dL
+	TargetLow int
+	// TargetHigh is the upper bound of the patient's target range in mg/dL
+	TargetHigh int
+	Updated    time.Time
+}
+
+// AlarmKind is the kind of glucose alarm.
+type AlarmKind int
+
+const (
+	AlarmKindUnknown AlarmKind = iota
+	AlarmKindLow
+	AlarmKindHigh
+	// AlarmKindUrgentLow is the low alarm at a fixed level which can not be turned off
+	AlarmKindUrgentLow
+)
+
+// AlarmEvent is a glucose alarm that fired on the patient's phone.
+type AlarmEvent struct {
+	PatientID string
+	// Timestamp is the time the alarm fired in UTC
+	Timestamp time.Time
+	Kind      AlarmKind
+	// Mmoll and MgPerDl are the glucose level that set off the alarm
+	Mmoll   Mmoll
+	MgPerDl int
+	Trend   glucose.Trend
+	// UTCOffset is the offset, in seconds, from UTC of the time zone where the alarm fired
+	UTCOffset int
+	// Source is the name of the source the event was fetched from
+	Source string
+}
+
+// LocalTimestamp returns the time of the alarm in the time zone where it fired.
+func (ae AlarmEvent) LocalTimestamp() time.Time {
+	return ae.Timestamp.In(time.FixedZone("", ae.UTCOffset))
+}
+
+// ScrapeRunRetention is how long scrape runs are kept.
+const ScrapeRunRetention = 30 * 24 * time.Hour
+
+// ScrapeRun is a single fetch made by a source.
+type ScrapeRun struct {
+	ID     int64
+	Source string
+	// Kind tells what was fetched, such as a poll of the latest readings or a backfill
+	Kind     string
+	Started  time.Time
+	Finished time.Time
+	// Readings is the number of new readings stored by the run
+	Readings int
+	// Error is the error the run failed with, empty if it succeeded
+	Error string
+}
+
+// Failed returns true if the run failed.
+func (sr ScrapeRun) Failed() bool {
+	return sr.Error != ""
+}
+
+// RawPayload is an archived response from an upstream API.
+type RawPayload struct {
+	ID         int64
+	Source     string
+	Method     string
+	URL        string
+	StatusCode int
+	Requested  time.Time
+	Duration   time.Duration
+	// Body is the response body the way the archive stores it, such as compressed and encrypted
+	Body []byte
+}
+
+// Size returns the number of bytes the payload takes up in the archive.
+func (rp RawPayload) Size() int64 {
+	return int64(len(rp.Body))
+}
+
+// Treatment is a therapy event, such as a bolus or a meal, uploaded by an app.
+type Treatment struct {
+	PatientID string
+	// Identifier is given by the uploader, a treatment with the same identifier is a duplicate
+	Identifier string
+	// Timestamp is the time of the treatment in UTC
+	Timestamp time.Time
+	// EventType is the kind of treatment in the names Nightscout uses, such as Meal Bolus
+	EventType string
+	// Insulin is the units of insulin given
+	Insulin float64
+	// Carbs is the grams of carbohydrates eaten
+	Carbs float64
+	// UTCOffset is the offset, in seconds, from UTC of the time zone where the treatment was given
+	UTCOffset int
+	// Source is the name of the source the treatment was received from
+	Source string
+	// Document is the treatment as uploaded, in JSON, keeping the fields OpenT1D does not use
+	Document []byte
+}
+
+// DeviceStatus is the state of a device, such as the pump or the uploading phone, uploaded by
+// an app.
+type DeviceStatus struct {
+	PatientID string
+	// Identifier is given by the uploader, a status with the same identifier is a duplicate
+	Identifier string
+	// Timestamp is the time of the status in UTC
+	Timestamp time.Time
+	Device    string
+	// Source is the name of the source the status was received from
+	Source string
+	// Document is the status as uploaded, in JSON
+	Document []byte
+}
+
+// OutboxEntry is a stored entry waiting to be uploaded by a sink.
+type OutboxEntry struct {
+	Sink string
+	CGM  CGMEntry
+	// Attempts is the number of failed uploads of the entry
+	Attempts int
+	// NextAttempt is when the entry is due to be uploaded
+	NextAttempt time.Time
+	// Error is the error of the latest failed upload
+	Error string
+}
+
+// Sensor is a CGM sensor session, from activation until the sensor expires or is replaced.
+type Sensor struct {
+	SerialNumber string
+	PatientID    string
+	DeviceID     string
+	Activated    time.Time
+	// ExpectedEnd is when the sensor is expected to stop delivering readings
+	ExpectedEnd time.Time
+	// LastSeen is the last time the sensor was reported as active
+	LastSeen time.Time
+	// FirstReading and LastReading are the times of the first and last stored reading made by
+	// the sensor, they are zero if there are no readings
+	FirstReading time.Time
+	LastReading  time.Time
+}
+
+// IsActive returns true if the sensor has not reached its expected end at the given time.
+func (s Sensor) IsActive(at time.Time) bool {
+	return !at.Before(s.Activated) && at.Before(s.ExpectedEnd)
+}
+
+// Remaining returns the time left until the sensor's expected end, zero if it has passed.
+func (s Sensor) Remaining(at time.Time) time.Duration {
+	if !s.IsActive(at) {
+		return 0
+	}
+	return s.ExpectedEnd.Sub(at)
+}
+
+// Lasted returns the time between activation and the last reading made by the sensor.
+func (s Sensor) Lasted() time.Duration {
+	if s.LastReading.IsZero() {
+		return 0
+	}
+	return s.LastReading.Sub(s.Activated)
+}
+
+// SensorAt returns the serial number of the sensor, among the given, that was used at the given
+// time. An empty string is returned if no sensor was used.
+func SensorAt(sensors []Sensor, at time.Time) string {
+	var found *Sensor
+	for i, s := range sensors {
+		if at.Before(s.Activated) {
+			continue
+		}
+		if found == nil || s.Activated.After(found.Activated) {
+			found = &sensors[i]
+		}
+	}
+	if found == nil {
+		return ""
+	}
+	return found.SerialNumber
+}
+
 type Mmoll float32
 
+// MeasurementType tells how a measurement was made, values follow the ones used by LibreLinkUp.
+type MeasurementType int
+
+const (
+	// MeasurementTypeHistoric is a reading from the sensor history, usually every 15 minutes
+	MeasurementTypeHistoric MeasurementType = 0
+	// MeasurementTypeCurrent is a real-time reading, usually every minute
+	MeasurementTypeCurrent MeasurementType = 1
+)
+
+// StaleAfter is the age at which a reading no longer tells the current glucose level, the apps
+// stop showing the trend arrow after the same time.
+const StaleAfter = 15 * time.Minute
+
+// MeasurementColor is the color LibreLinkUp uses to display a measurement relative to the
+// patient's target range.
+type MeasurementColor int
+
+const (
+	MeasurementColorUnknown MeasurementColor = iota
+	MeasurementColorGreen
+	MeasurementColorYellow
+	MeasurementColorOrange
+	MeasurementColorRed
+)
+
 type CGMEntry struct {
+	PatientID string
+	// Timestamp is the time of the measurement in UTC
 	Timestamp time.Time
 	Mmoll     Mmoll
+	MgPerDl   int
+	Type      MeasurementType
+	Color     MeasurementColor
+	IsHigh    bool
+	IsLow     bool
+	// UTCOffset is the offset, in seconds, from UTC of the time zone where the measurement was made
+	UTCOffset int
+	Trend     glucose.Trend
+	// SensorSerial is the serial number of the sensor that made the measurement, if known
+	SensorSerial string
+	// Source is the name of the source the entry was fetched from
+	Source string
+	// Device is the name of the device or app that uploaded the entry, if known
+	Device string
 }
 
 func NewCGMEntry(timestamp time.Time, mmoll Mmoll) CGMEntry {
-	return CGMEntry{Timestamp: timestamp, Mmoll: mmoll}
+	return CGMEntry{Timestamp: timestamp, Mmoll: mmoll, MgPerDl: glucose.MmolToMg(float32(mmoll))}
+}
+
+// LocalTimestamp returns the time of the measurement in the time zone where it was made.
+func (cgme CGMEntry) LocalTimestamp() time.Time {
+	return cgme.Timestamp.In(time.FixedZone("", cgme.UTCOffset))
+}
+
+// IsStale returns true if the measurement is at least StaleAfter old at the given time.
+func (cgme CGMEntry) IsStale(at time.Time) bool {
+	return at.Sub(cgme.Timestamp) >= StaleAfter
 }
 
 func (cgme CGMEntry) String() string {
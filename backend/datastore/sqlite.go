@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,8 +13,28 @@ import (
 const (
 	// KeySettings is the used in the kv-table to store settings in JSON
 	KeySettings = "settings"
+	// KeySecretKey was used in the kv-table to store the generated key sealing secrets, when
+	// no key is given in the environment. The key is now kept in a file of its own and is moved
+	// there from the kv-table on startup
+	KeySecretKey = "secret_key"
+	// KeyLibreLinkUpTicket is used in the kv-table to store the sealed LibreLinkUp auth ticket
+	KeyLibreLinkUpTicket = "librelinkup_ticket"
+	// KeyLibreLinkUpStep is used in the kv-table to store the type of the step LibreLinkUp
+	// requires the user to complete before signing in, such as accepting new terms of use
+	KeyLibreLinkUpStep = "librelinkup_step"
 )
 
+// KeyHighWaterMark returns the key used in the kv-table to store the time of the latest entry
+// fetched by the source.
+func KeyHighWaterMark(source string) string {
+	return "high_water_mark_" + source
+}
+
+// KeyPaused returns the key used in the kv-table to mark the source as paused.
+func KeyPaused(source string) string {
+	return "paused_" + source
+}
+
 type SQLiteStore struct {
 	db *sql.DB
 }
@@ -30,30 +51,17 @@ func NewSQLiteStore(uri string) (SQLiteStore, error) {
 	return store, store.db.QueryRow("SELECT 1").Err()
 }
 
-func (sls SQLiteStore) Migrate(from int) error {
-	for i := from; i < len(migrations); i++ {
-		for _, stmt := range migrations[i] {
-			if _, err := sls.db.Exec(stmt); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
 func (sls SQLiteStore) Close() error {
 	return sls.db.Close()
 }
 
 func (sls SQLiteStore) GetSettings() (Settings, error) {
-	row := sls.db.QueryRow("SELECT value FROM kv WHERE key = ?", KeySettings)
-	var jsn string
-	if err := row.Scan(&jsn); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+	jsn, err := sls.GetValue(KeySettings)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
 			return Settings{}, ErrNotFound
-		} else {
-			return Settings{}, fmt.Errorf("error while loading settings from SQLite: %w", err)
 		}
+		return Settings{}, fmt.Errorf("error while loading settings from SQLite: %w", err)
 	}
 	return SettingsFromJson(jsn)
 }
@@ -63,11 +71,27 @@ func (sls SQLiteStore) SaveSettings(settings Settings) error {
 	if err != nil {
 		return err
 	}
+	return sls.SaveValue(KeySettings, json)
+}
+
+func (sls SQLiteStore) GetValue(key string) (string, error) {
+	row := sls.db.QueryRow("SELECT value FROM kv WHERE key = ?", key)
+	var value string
+	if err := row.Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("error while loading '%s' from SQLite: %w", key, err)
+	}
+	return value, nil
+}
+
+func (sls SQLiteStore) SaveValue(key, value string) error {
 	tx, err := sls.db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = tx.Exec("INSERT INTO kv (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = ?", KeySettings, json, json)
+	_, err = tx.Exec("INSERT INTO kv (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = ?", key, value, value)
 	if err != nil {
 		if err := tx.Rollback(); err != nil {
 			return err
@@ -77,14 +101,107 @@ func (sls SQLiteStore) SaveSettings(settings Settings) error {
 	return tx.Commit()
 }
 
-func (sls SQLiteStore) SaveCGM(cgms ...CGMEntry) error {
+func (sls SQLiteStore) DeleteValue(key string) error {
+	if _, err := sls.db.Exec("DELETE FROM kv WHERE key = ?", key); err != nil {
+		return fmt.Errorf("error while deleting '%s' from SQLite: %w", key, err)
+	}
+	return nil
+}
+
+func (sls SQLiteStore) SaveCGM(cgms ...CGMEntry) ([]CGMEntry, error) {
 	tx, err := sls.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	saved := []CGMEntry{}
 	for _, cgm := range cgms {
-		_, err = tx.Exec("INSERT INTO cgm VALUES (?, ?) ON CONFLICT DO NOTHING", cgm.Timestamp.Unix(), cgm.Mmoll)
+		res, err := tx.Exec("INSERT INTO cgm ("+cgmColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			cgm.PatientID, cgm.Timestamp.Unix(), cgm.Mmoll, cgm.MgPerDl, cgm.Type, cgm.Color, cgm.IsHigh, cgm.IsLow, cgm.UTCOffset, cgm.Trend, cgm.SensorSerial, cgm.Source, cgm.Device)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return nil, err
+			}
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			saved = append(saved, cgm)
+		}
+	}
+	return saved, tx.Commit()
+}
+
+func (sls SQLiteStore) LatestCGM(patientID string) (CGMEntry, error) {
+	cgm, err := scanCGM(sls.db.QueryRow("SELECT "+cgmColumns+" FROM cgm WHERE patient_id = ? ORDER BY ts DESC, type DESC LIMIT 1", patientID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return CGMEntry{}, ErrNotFound
+		}
+		return CGMEntry{}, fmt.Errorf("error while loading latest CGM entry from SQLite: %w", err)
+	}
+	return cgm, nil
+}
+
+func (sls SQLiteStore) LoadCGMInterval(patientID string, from, to time.Time, limit int, types ...MeasurementType) ([]CGMEntry, error) {
+	return sls.loadCGM("ASC", "patient_id = ? AND ts >= ? AND ts < ?", []any{patientID, from.Unix(), to.Unix()}, limit, types)
+}
+
+func (sls SQLiteStore) LoadCGMAfter(patientID string, ts time.Time, typ MeasurementType, to time.Time, limit int, types ...MeasurementType) ([]CGMEntry, error) {
+	return sls.loadCGM("ASC", "patient_id = ? AND (ts > ? OR (ts = ? AND type > ?)) AND ts < ?", []any{patientID, ts.Unix(), ts.Unix(), typ, to.Unix()}, limit, types)
+}
+
+func (sls SQLiteStore) LatestCGMInterval(patientID string, from, to time.Time, limit int) ([]CGMEntry, error) {
+	return sls.loadCGM("DESC", "patient_id = ? AND ts >= ? AND ts < ?", []any{patientID, from.Unix(), to.Unix()}, limit, nil)
+}
+
+// loadCGM loads the patient's entries matching the where clause ordered by timestamp and
+// measurement type in the given order, ASC or DESC.
+func (sls SQLiteStore) loadCGM(order string, where string, args []any, limit int, types []MeasurementType) ([]CGMEntry, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	if len(types) > 0 {
+		where += " AND type IN (?" + strings.Repeat(", ?", len(types)-1) + ")"
+		for _, t := range types {
+			args = append(args, t)
+		}
+	}
+	rows, err := sls.db.Query("SELECT "+cgmColumns+" FROM cgm WHERE "+where+" ORDER BY ts "+order+", type "+order+" LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading CGM data from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	cgms := []CGMEntry{}
+	for rows.Next() {
+		cgm, err := scanCGM(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading CGM data from SQLite: %w", err)
+		}
+		cgms = append(cgms, cgm)
+	}
+	return cgms, rows.Err()
+}
+
+// AssignCGM assigns entries stored before patients were tracked to the given patient.
+func (sls SQLiteStore) AssignCGM(patientID string) (int64, error) {
+	res, err := sls.db.Exec("UPDATE OR IGNORE cgm SET patient_id = ? WHERE patient_id = ''", patientID)
+	if err != nil {
+		return 0, fmt.Errorf("error while assigning CGM data to patient in SQLite: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (sls SQLiteStore) SavePatients(patients ...Patient) error {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range patients {
+		_, err = tx.Exec(`INSERT INTO patients (id, first_name, last_name, target_low, target_high, updated) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(id) DO UPDATE SET first_name = excluded.first_name, last_name = excluded.last_name, target_low = excluded.target_low, target_high = excluded.target_high, updated = excluded.updated`,
+			p.ID, p.FirstName, p.LastName, p.TargetLow, p.TargetHigh, p.Updated.Unix())
 		if err != nil {
 			if err := tx.Rollback(); err != nil {
 				return err
@@ -95,23 +212,446 @@ func (sls SQLiteStore) SaveCGM(cgms ...CGMEntry) error {
 	return tx.Commit()
 }
 
-func (sls SQLiteStore) LoadCGMInterval(from, to time.Time) ([]CGMEntry, error) {
-	cgms := []CGMEntry{}
-	// row := sls.db.Query("SELECT ts,mmoll FROM cgm WHERE ts  = ?", setting.key)
-	return cgms, nil
-}
-
-var (
-	migrations = [][]string{
-		{
-			`CREATE TABLE IF NOT EXISTS cgm (
-	ts INTEGER PRIMARY KEY,
-	mmoll REAL NOT NULL
-)`,
-			`CREATE TABLE IF NOT EXISTS kv (
-	key TEXT PRIMARY KEY,
-	value TEXT
-)`,
-		},
+func (sls SQLiteStore) Patients() ([]Patient, error) {
+	rows, err := sls.db.Query("SELECT id, first_name, last_name, target_low, target_high, updated FROM patients ORDER BY first_name, last_name")
+	if err != nil {
+		return nil, fmt.Errorf("error while loading patients from SQLite: %w", err)
 	}
-)
+	defer rows.Close()
+
+	patients := []Patient{}
+	for rows.Next() {
+		var updated int64
+		p := Patient{}
+		if err := rows.Scan(&p.ID, &p.FirstName, &p.LastName, &p.TargetLow, &p.TargetHigh, &updated); err != nil {
+			return nil, fmt.Errorf("error while reading patients from SQLite: %w", err)
+		}
+		p.Updated = time.Unix(updated, 0).UTC()
+		patients = append(patients, p)
+	}
+	return patients, rows.Err()
+}
+
+func (sls SQLiteStore) SaveSensor(sensor Sensor) error {
+	_, err := sls.db.Exec(`INSERT INTO sensors (serial_number, patient_id, device_id, activated, expected_end, last_seen) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(serial_number) DO UPDATE SET last_seen = MAX(last_seen, excluded.last_seen)`,
+		sensor.SerialNumber, sensor.PatientID, sensor.DeviceID, sensor.Activated.Unix(), sensor.ExpectedEnd.Unix(), sensor.LastSeen.Unix())
+	if err != nil {
+		return fmt.Errorf("error while saving sensor to SQLite: %w", err)
+	}
+	return nil
+}
+
+func (sls SQLiteStore) Sensors(patientID string) ([]Sensor, error) {
+	rows, err := sls.db.Query(`SELECT s.serial_number, s.patient_id, s.device_id, s.activated, s.expected_end, s.last_seen, COALESCE(MIN(c.ts), 0), COALESCE(MAX(c.ts), 0)
+FROM sensors s LEFT JOIN cgm c ON c.sensor_serial = s.serial_number
+WHERE s.patient_id = ? GROUP BY s.serial_number ORDER BY s.activated DESC`, patientID)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading sensors from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	sensors := []Sensor{}
+	for rows.Next() {
+		var activated, expectedEnd, lastSeen, firstReading, lastReading int64
+		s := Sensor{}
+		if err := rows.Scan(&s.SerialNumber, &s.PatientID, &s.DeviceID, &activated, &expectedEnd, &lastSeen, &firstReading, &lastReading); err != nil {
+			return nil, fmt.Errorf("error while reading sensors from SQLite: %w", err)
+		}
+		s.Activated = time.Unix(activated, 0).UTC()
+		s.ExpectedEnd = time.Unix(expectedEnd, 0).UTC()
+		s.LastSeen = time.Unix(lastSeen, 0).UTC()
+		if firstReading > 0 {
+			s.FirstReading = time.Unix(firstReading, 0).UTC()
+			s.LastReading = time.Unix(lastReading, 0).UTC()
+		}
+		sensors = append(sensors, s)
+	}
+	return sensors, rows.Err()
+}
+
+func (sls SQLiteStore) SaveAlarmEvents(events ...AlarmEvent) ([]AlarmEvent, error) {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	saved := []AlarmEvent{}
+	for _, e := range events {
+		res, err := tx.Exec("INSERT INTO alarm_events (patient_id, ts, kind, mmoll, mgdl, trend, utc_offset, source) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			e.PatientID, e.Timestamp.Unix(), e.Kind, e.Mmoll, e.MgPerDl, e.Trend, e.UTCOffset, e.Source)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("error while saving alarm event to SQLite: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			saved = append(saved, e)
+		}
+	}
+	return saved, tx.Commit()
+}
+
+func (sls SQLiteStore) LoadAlarmEvents(patientID string, from, to time.Time) ([]AlarmEvent, error) {
+	rows, err := sls.db.Query("SELECT patient_id, ts, kind, mmoll, mgdl, trend, utc_offset, source FROM alarm_events WHERE patient_id = ? AND ts >= ? AND ts < ? ORDER BY ts ASC", patientID, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("error while loading alarm events from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	events := []AlarmEvent{}
+	for rows.Next() {
+		var ts int64
+		e := AlarmEvent{}
+		if err := rows.Scan(&e.PatientID, &ts, &e.Kind, &e.Mmoll, &e.MgPerDl, &e.Trend, &e.UTCOffset, &e.Source); err != nil {
+			return nil, fmt.Errorf("error while reading alarm events from SQLite: %w", err)
+		}
+		e.Timestamp = time.Unix(ts, 0).UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (sls SQLiteStore) SaveScrapeRun(run ScrapeRun) error {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO scrape_runs (source, kind, started, finished, readings, error) VALUES (?, ?, ?, ?, ?, ?)",
+		run.Source, run.Kind, run.Started.Unix(), run.Finished.Unix(), run.Readings, run.Error); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return fmt.Errorf("error while saving scrape run to SQLite: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM scrape_runs WHERE source = ? AND started < ?", run.Source, run.Started.Add(-ScrapeRunRetention).Unix()); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return fmt.Errorf("error while removing old scrape runs from SQLite: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (sls SQLiteStore) LoadScrapeRuns(source string, limit int) ([]ScrapeRun, error) {
+	if limit < 1 {
+		limit = -1
+	}
+	rows, err := sls.db.Query("SELECT "+scrapeRunColumns+" FROM scrape_runs WHERE ? = '' OR source = ? ORDER BY started DESC, id DESC LIMIT ?", source, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading scrape runs from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []ScrapeRun{}
+	for rows.Next() {
+		run, err := scanScrapeRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading scrape runs from SQLite: %w", err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (sls SQLiteStore) LatestFailedScrapeRun(source string) (ScrapeRun, error) {
+	row := sls.db.QueryRow("SELECT "+scrapeRunColumns+" FROM scrape_runs WHERE source = ? AND error != '' ORDER BY started DESC, id DESC LIMIT 1", source)
+	run, err := scanScrapeRun(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ScrapeRun{}, ErrNotFound
+	}
+	if err != nil {
+		return ScrapeRun{}, fmt.Errorf("error while loading failed scrape run from SQLite: %w", err)
+	}
+	return run, nil
+}
+
+func (sls SQLiteStore) SaveRawPayload(payload RawPayload, maxSize int64) (int64, error) {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO raw_payloads (source, method, url, status, requested, duration_ms, size, body) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		payload.Source, payload.Method, payload.URL, payload.StatusCode, payload.Requested.UnixMilli(), payload.Duration.Milliseconds(), payload.Size(), payload.Body)
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("error while saving raw payload to SQLite: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			return 0, err
+		}
+		return 0, err
+	}
+	if maxSize > 0 {
+		// remove the oldest payloads that do not fit within the size together with the newer ones
+		_, err := tx.Exec(`DELETE FROM raw_payloads WHERE id IN (
+	SELECT id FROM (SELECT id, SUM(size) OVER (ORDER BY id DESC) AS total FROM raw_payloads) WHERE total > ?
+)`, maxSize)
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return 0, err
+			}
+			return 0, fmt.Errorf("error while removing old raw payloads from SQLite: %w", err)
+		}
+	}
+	return id, tx.Commit()
+}
+
+func (sls SQLiteStore) LoadRawPayloads(source string, afterID int64, limit int) ([]RawPayload, error) {
+	if limit < 1 {
+		limit = -1
+	}
+	rows, err := sls.db.Query("SELECT "+rawPayloadColumns+" FROM raw_payloads WHERE (? = '' OR source = ?) AND id > ? ORDER BY id ASC LIMIT ?", source, source, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading raw payloads from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	payloads := []RawPayload{}
+	for rows.Next() {
+		payload, err := scanRawPayload(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading raw payloads from SQLite: %w", err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, rows.Err()
+}
+
+func (sls SQLiteStore) RawPayload(id int64) (RawPayload, error) {
+	payload, err := scanRawPayload(sls.db.QueryRow("SELECT "+rawPayloadColumns+" FROM raw_payloads WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return RawPayload{}, ErrNotFound
+	}
+	if err != nil {
+		return RawPayload{}, fmt.Errorf("error while loading raw payload from SQLite: %w", err)
+	}
+	return payload, nil
+}
+
+func (sls SQLiteStore) SaveTreatments(treatments ...Treatment) ([]Treatment, error) {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	saved := []Treatment{}
+	for _, t := range treatments {
+		res, err := tx.Exec("INSERT INTO treatments ("+treatmentColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			t.PatientID, t.Identifier, t.Timestamp.Unix(), t.EventType, t.Insulin, t.Carbs, t.UTCOffset, t.Source, string(t.Document))
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("error while saving treatment to SQLite: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			saved = append(saved, t)
+		}
+	}
+	return saved, tx.Commit()
+}
+
+func (sls SQLiteStore) LoadTreatments(patientID string, from, to time.Time) ([]Treatment, error) {
+	rows, err := sls.db.Query("SELECT "+treatmentColumns+" FROM treatments WHERE patient_id = ? AND ts >= ? AND ts < ? ORDER BY ts ASC", patientID, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("error while loading treatments from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	treatments := []Treatment{}
+	for rows.Next() {
+		var ts int64
+		var document string
+		t := Treatment{}
+		if err := rows.Scan(&t.PatientID, &t.Identifier, &ts, &t.EventType, &t.Insulin, &t.Carbs, &t.UTCOffset, &t.Source, &document); err != nil {
+			return nil, fmt.Errorf("error while reading treatments from SQLite: %w", err)
+		}
+		t.Timestamp = time.Unix(ts, 0).UTC()
+		t.Document = []byte(document)
+		treatments = append(treatments, t)
+	}
+	return treatments, rows.Err()
+}
+
+func (sls SQLiteStore) SaveDeviceStatuses(statuses ...DeviceStatus) ([]DeviceStatus, error) {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	saved := []DeviceStatus{}
+	for _, ds := range statuses {
+		res, err := tx.Exec("INSERT INTO device_status ("+deviceStatusColumns+") VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			ds.PatientID, ds.Identifier, ds.Timestamp.Unix(), ds.Device, ds.Source, string(ds.Document))
+		if err != nil {
+			if err := tx.Rollback(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("error while saving device status to SQLite: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			saved = append(saved, ds)
+		}
+	}
+	return saved, tx.Commit()
+}
+
+func (sls SQLiteStore) LoadDeviceStatuses(patientID string, from, to time.Time) ([]DeviceStatus, error) {
+	rows, err := sls.db.Query("SELECT "+deviceStatusColumns+" FROM device_status WHERE patient_id = ? AND ts >= ? AND ts < ? ORDER BY ts ASC", patientID, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("error while loading device statuses from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	statuses := []DeviceStatus{}
+	for rows.Next() {
+		var ts int64
+		var document string
+		ds := DeviceStatus{}
+		if err := rows.Scan(&ds.PatientID, &ds.Identifier, &ts, &ds.Device, &ds.Source, &document); err != nil {
+			return nil, fmt.Errorf("error while reading device statuses from SQLite: %w", err)
+		}
+		ds.Timestamp = time.Unix(ts, 0).UTC()
+		ds.Document = []byte(document)
+		statuses = append(statuses, ds)
+	}
+	return statuses, rows.Err()
+}
+
+func (sls SQLiteStore) EnqueueOutbox(sink, markKey string, cgms ...CGMEntry) error {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, cgm := range cgms {
+		if _, err := tx.Exec("INSERT INTO outbox (sink, patient_id, ts, type) SELECT ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM kv WHERE key = ? AND CAST(value AS INTEGER) >= ?) ON CONFLICT DO NOTHING",
+			sink, cgm.PatientID, cgm.Timestamp.Unix(), cgm.Type, markKey, cgm.Timestamp.UnixMilli()); err != nil {
+			if err := tx.Rollback(); err != nil {
+				return err
+			}
+			return fmt.Errorf("error while adding entry to outbox in SQLite: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (sls SQLiteStore) LoadOutbox(sink string, due time.Time, limit int) ([]OutboxEntry, error) {
+	if limit < 1 {
+		limit = -1
+	}
+	columns := "c." + strings.ReplaceAll(cgmColumns, ", ", ", c.")
+	rows, err := sls.db.Query("SELECT o.sink, o.attempts, o.next_attempt, o.error, "+columns+" FROM outbox o JOIN cgm c ON c.patient_id = o.patient_id AND c.ts = o.ts AND c.type = o.type WHERE o.sink = ? AND o.next_attempt <= ? ORDER BY o.ts ASC, o.type ASC LIMIT ?", sink, due.Unix(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading outbox from SQLite: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		var ts, nextAttempt int64
+		e := OutboxEntry{}
+		cgm := &e.CGM
+		if err := rows.Scan(&e.Sink, &e.Attempts, &nextAttempt, &e.Error, &cgm.PatientID, &ts, &cgm.Mmoll, &cgm.MgPerDl, &cgm.Type, &cgm.Color, &cgm.IsHigh, &cgm.IsLow, &cgm.UTCOffset, &cgm.Trend, &cgm.SensorSerial, &cgm.Source, &cgm.Device); err != nil {
+			return nil, fmt.Errorf("error while reading outbox from SQLite: %w", err)
+		}
+		cgm.Timestamp = time.Unix(ts, 0).UTC()
+		e.NextAttempt = time.Unix(nextAttempt, 0).UTC()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (sls SQLiteStore) UpdateOutbox(entries ...OutboxEntry) error {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := tx.Exec("UPDATE outbox SET attempts = ?, next_attempt = ?, error = ? WHERE sink = ? AND patient_id = ? AND ts = ? AND type = ?",
+			e.Attempts, e.NextAttempt.Unix(), e.Error, e.Sink, e.CGM.PatientID, e.CGM.Timestamp.Unix(), e.CGM.Type); err != nil {
+			if err := tx.Rollback(); err != nil {
+				return err
+			}
+			return fmt.Errorf("error while updating outbox in SQLite: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (sls SQLiteStore) DeleteOutbox(entries ...OutboxEntry) error {
+	tx, err := sls.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := tx.Exec("DELETE FROM outbox WHERE sink = ? AND patient_id = ? AND ts = ? AND type = ?", e.Sink, e.CGM.PatientID, e.CGM.Timestamp.Unix(), e.CGM.Type); err != nil {
+			if err := tx.Rollback(); err != nil {
+				return err
+			}
+			return fmt.Errorf("error while deleting from outbox in SQLite: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (sls SQLiteStore) OutboxSize(sink string) (int, error) {
+	var size int
+	if err := sls.db.QueryRow("SELECT COUNT(*) FROM outbox WHERE sink = ?", sink).Scan(&size); err != nil {
+		return 0, fmt.Errorf("error while counting outbox in SQLite: %w", err)
+	}
+	return size, nil
+}
+
+// treatmentColumns are the columns of the treatments table, in the order they are scanned
+const treatmentColumns = "patient_id, identifier, ts, event_type, insulin, carbs, utc_offset, source, document"
+
+// deviceStatusColumns are the columns of the device_status table, in the order they are scanned
+const deviceStatusColumns = "patient_id, identifier, ts, device, source, document"
+
+// rawPayloadColumns are the columns scanRawPayload expects, in order
+const rawPayloadColumns = "id, source, method, url, status, requested, duration_ms, body"
+
+func scanRawPayload(row scanner) (RawPayload, error) {
+	var requested, duration int64
+	payload := RawPayload{}
+	if err := row.Scan(&payload.ID, &payload.Source, &payload.Method, &payload.URL, &payload.StatusCode, &requested, &duration, &payload.Body); err != nil {
+		return RawPayload{}, err
+	}
+	payload.Requested = time.UnixMilli(requested).UTC()
+	payload.Duration = time.Duration(duration) * time.Millisecond
+	return payload, nil
+}
+
+// scrapeRunColumns are the columns scanScrapeRun expects, in order
+const scrapeRunColumns = "id, source, kind, started, finished, readings, error"
+
+func scanScrapeRun(row scanner) (ScrapeRun, error) {
+	var started, finished int64
+	run := ScrapeRun{}
+	if err := row.Scan(&run.ID, &run.Source, &run.Kind, &started, &finished, &run.Readings, &run.Error); err != nil {
+		return ScrapeRun{}, err
+	}
+	run.Started = time.Unix(started, 0).UTC()
+	run.Finished = time.Unix(finished, 0).UTC()
+	return run, nil
+}
+
+// cgmColumns are the columns scanCGM expects, in order
+const cgmColumns = "patient_id, ts, mmoll, mgdl, type, color, is_high, is_low, utc_offset, trend, sensor_serial, source, device"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCGM(row scanner) (CGMEntry, error) {
+	var ts int64
+	cgm := CGMEntry{}
+	if err := row.Scan(&cgm.PatientID, &ts, &cgm.Mmoll, &cgm.MgPerDl, &cgm.Type, &cgm.Color, &cgm.IsHigh, &cgm.IsLow, &cgm.UTCOffset, &cgm.Trend, &cgm.SensorSerial, &cgm.Source, &cgm.Device); err != nil {
+		return CGMEntry{}, err
+	}
+	cgm.Timestamp = time.Unix(ts, 0).UTC()
+	return cgm, nil
+}
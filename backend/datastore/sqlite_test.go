@@ -1,6 +1,8 @@
 package datastore
 
 import (
+	"errors"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -10,7 +12,7 @@ func setupStore() (Store, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := store.Migrate(0); err != nil {
+	if err := store.Migrate(LatestSchemaVersion()); err != nil {
 		return nil, err
 	}
 	return store, nil
@@ -59,8 +61,567 @@ func TestSaveCGM(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		if err := store.SaveCGM(test); err != nil {
+		if _, err := store.SaveCGM(test); err != nil {
 			t.Fatalf("failed to save, %s: %v", test, err)
 		}
 	}
 }
+
+func TestSaveCGMReturnsNewEntries(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.LatestCGM(""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v from empty store but got %v", ErrNotFound, err)
+	}
+	first := NewCGMEntry(time.Date(2023, 06, 01, 10, 05, 35, 0, time.UTC), 3.7)
+	second := NewCGMEntry(time.Date(2023, 06, 01, 10, 10, 35, 0, time.UTC), 4.8)
+	second.Source = "librelinkup"
+	if _, err := store.SaveCGM(first); err != nil {
+		t.Fatalf("failed to save, %s: %v", first, err)
+	}
+	saved, err := store.SaveCGM(first, second)
+	if err != nil {
+		t.Fatalf("failed to save, %s: %v", second, err)
+	}
+	if len(saved) != 1 || saved[0] != second {
+		t.Fatalf("expected only %s to be saved but got %v", second, saved)
+	}
+	latest, err := store.LatestCGM("")
+	if err != nil {
+		t.Fatalf("failed to load latest entry: %v", err)
+	}
+	if latest != second {
+		t.Fatalf("expected latest entry %s but got %s", second, latest)
+	}
+}
+
+func TestLoadCGMInterval(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	start := time.Date(2023, 06, 01, 10, 0, 0, 0, time.UTC)
+	cgms := []CGMEntry{
+		NewCGMEntry(start.Add(30*time.Minute), 6.1),
+		NewCGMEntry(start, 5.2),
+		NewCGMEntry(start.Add(15*time.Minute), 5.8),
+		NewCGMEntry(start.Add(45*time.Minute), 6.6),
+	}
+	for i := range cgms {
+		cgms[i].PatientID = "p1"
+	}
+	current := NewCGMEntry(start.Add(46*time.Minute), 6.7)
+	current.PatientID = "p1"
+	current.Type = MeasurementTypeCurrent
+	cgms = append(cgms, current)
+	// same time but another patient, should not be included
+	other := NewCGMEntry(start, 12.0)
+	other.PatientID = "p2"
+	cgms = append(cgms, other)
+	if _, err := store.SaveCGM(cgms...); err != nil {
+		t.Fatalf("failed to save CGM data: %v", err)
+	}
+
+	type TestCase struct {
+		from     time.Time
+		to       time.Time
+		limit    int
+		types    []MeasurementType
+		expected []Mmoll
+	}
+	tests := []TestCase{
+		{start, start.Add(time.Hour), 0, nil, []Mmoll{5.2, 5.8, 6.1, 6.6, 6.7}},
+		{start, start.Add(45 * time.Minute), 0, nil, []Mmoll{5.2, 5.8, 6.1}},
+		{start.Add(time.Minute), start.Add(time.Hour), 2, nil, []Mmoll{5.8, 6.1}},
+		{start.Add(time.Hour), start.Add(2 * time.Hour), 0, nil, []Mmoll{}},
+		{start, start.Add(time.Hour), 0, []MeasurementType{MeasurementTypeHistoric}, []Mmoll{5.2, 5.8, 6.1, 6.6}},
+		{start, start.Add(time.Hour), 0, []MeasurementType{MeasurementTypeCurrent}, []Mmoll{6.7}},
+		{start, start.Add(time.Hour), 0, []MeasurementType{MeasurementTypeHistoric, MeasurementTypeCurrent}, []Mmoll{5.2, 5.8, 6.1, 6.6, 6.7}},
+	}
+
+	for _, test := range tests {
+		actual, err := store.LoadCGMInterval("p1", test.from, test.to, test.limit, test.types...)
+		if err != nil {
+			t.Fatalf("failed to load CGM data: %v", err)
+		}
+		if len(actual) != len(test.expected) {
+			t.Fatalf("expected %v entries but got %v", len(test.expected), len(actual))
+		}
+		for i := range actual {
+			if actual[i].Mmoll != test.expected[i] {
+				t.Errorf("expected entry %v to be %v but got %v", i, test.expected[i], actual[i].Mmoll)
+			}
+		}
+	}
+
+	latest, err := store.LatestCGMInterval("p1", start.Add(time.Minute), start.Add(time.Hour), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 2 || latest[0].Mmoll != 6.7 || latest[1].Mmoll != 6.6 {
+		t.Errorf("expected the two latest entries latest first, got %v", latest)
+	}
+}
+
+func TestSaveCGMSameTimeDifferentType(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	ts := time.Date(2023, 06, 01, 10, 0, 0, 0, time.UTC)
+	historic := NewCGMEntry(ts, 5.2)
+	historic.PatientID = "p1"
+	current := NewCGMEntry(ts, 5.4)
+	current.PatientID = "p1"
+	current.Type = MeasurementTypeCurrent
+	saved, err := store.SaveCGM(historic, current)
+	if err != nil {
+		t.Fatalf("failed to save CGM data: %v", err)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("expected both readings to be saved but got %v", saved)
+	}
+
+	for _, expected := range []CGMEntry{historic, current} {
+		actual, err := store.LoadCGMInterval("p1", ts, ts.Add(time.Minute), 0, expected.Type)
+		if err != nil {
+			t.Fatalf("failed to load CGM data: %v", err)
+		}
+		if len(actual) != 1 || actual[0] != expected {
+			t.Errorf("expected only %s but got %v", expected, actual)
+		}
+	}
+	all, err := store.LoadCGMInterval("p1", ts, ts.Add(time.Minute), 0)
+	if err != nil {
+		t.Fatalf("failed to load CGM data: %v", err)
+	}
+	if len(all) != 2 || all[0] != historic || all[1] != current {
+		t.Errorf("expected both readings ordered by type but got %v", all)
+	}
+	after, err := store.LoadCGMAfter("p1", ts, MeasurementTypeHistoric, ts.Add(time.Minute), 0)
+	if err != nil {
+		t.Fatalf("failed to load CGM data: %v", err)
+	}
+	if len(after) != 1 || after[0] != current {
+		t.Errorf("expected only the current reading after the historic one but got %v", after)
+	}
+
+	// both readings are queued and uploaded separately
+	if err := store.EnqueueOutbox("sink", KeyHighWaterMark("sink"), historic, current); err != nil {
+		t.Fatalf("failed to enqueue entries: %v", err)
+	}
+	due, err := store.LoadOutbox("sink", ts, 0)
+	if err != nil {
+		t.Fatalf("failed to load outbox: %v", err)
+	}
+	if len(due) != 2 || due[0].CGM != historic || due[1].CGM != current {
+		t.Fatalf("expected both readings in the outbox but got %+v", due)
+	}
+	if err := store.DeleteOutbox(due[0]); err != nil {
+		t.Fatalf("failed to delete from outbox: %v", err)
+	}
+	if due, err := store.LoadOutbox("sink", ts, 0); err != nil || len(due) != 1 || due[0].CGM != current {
+		t.Fatalf("expected only the current reading left in the outbox but got %+v, %v", due, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	store, err := NewSQLiteStore("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("expected migration %v to have version %v but got %v", m.Description, i+1, m.Version)
+		}
+	}
+
+	if err := store.Migrate(LatestSchemaVersion()); err != nil {
+		t.Fatalf("failed to migrate up: %v", err)
+	}
+	// migrating to the current version should be a no-op
+	if err := store.Migrate(LatestSchemaVersion()); err != nil {
+		t.Fatalf("failed to migrate up a second time: %v", err)
+	}
+	version, err := store.SchemaVersion()
+	if err != nil {
+		t.Fatalf("failed to get schema version: %v", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatalf("expected schema version %v but got %v", LatestSchemaVersion(), version)
+	}
+
+	if err := store.Migrate(0); err != nil {
+		t.Fatalf("failed to migrate down: %v", err)
+	}
+	status, err := store.MigrationStatus()
+	if err != nil {
+		t.Fatalf("failed to get migration status: %v", err)
+	}
+	for _, ms := range status {
+		if ms.IsApplied() {
+			t.Errorf("expected migration %v to be reverted", ms.Version)
+		}
+	}
+
+	if err := store.Migrate(LatestSchemaVersion()); err != nil {
+		t.Fatalf("failed to migrate up after reverting: %v", err)
+	}
+	if _, err := store.db.Exec("INSERT INTO schema_version (version, applied) VALUES (?, ?)", LatestSchemaVersion()+1, time.Now().Unix()); err != nil {
+		t.Fatalf("failed to insert future schema version: %v", err)
+	}
+	if err := store.Migrate(LatestSchemaVersion()); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected %v but got %v", ErrSchemaTooNew, err)
+	}
+}
+
+func TestPatients(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	updated := time.Date(2023, 06, 01, 10, 0, 0, 0, time.UTC)
+	alice := Patient{ID: "p1", FirstName: "Alice", LastName: "Doe", TargetLow: 70, TargetHigh: 180, Updated: updated}
+	bob := Patient{ID: "p2", FirstName: "Bob", LastName: "Doe", TargetLow: 70, TargetHigh: 180, Updated: updated}
+	if err := store.SavePatients(bob, alice); err != nil {
+		t.Fatalf("failed to save patients: %v", err)
+	}
+	alice.TargetHigh = 200
+	if err := store.SavePatients(alice); err != nil {
+		t.Fatalf("failed to update patient: %v", err)
+	}
+	patients, err := store.Patients()
+	if err != nil {
+		t.Fatalf("failed to load patients: %v", err)
+	}
+	if len(patients) != 2 || patients[0] != alice || patients[1] != bob {
+		t.Fatalf("expected %+v and %+v but got %+v", alice, bob, patients)
+	}
+
+	orphan := NewCGMEntry(updated, 5.5)
+	if _, err := store.SaveCGM(orphan); err != nil {
+		t.Fatalf("failed to save, %s: %v", orphan, err)
+	}
+	n, err := store.AssignCGM(alice.ID)
+	if err != nil {
+		t.Fatalf("failed to assign CGM data: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 entry to be assigned but got %v", n)
+	}
+	if _, err := store.LatestCGM(alice.ID); err != nil {
+		t.Fatalf("expected assigned entry to belong to %s: %v", alice.ID, err)
+	}
+}
+
+func TestSensors(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	first := time.Date(2023, 06, 01, 10, 0, 0, 0, time.UTC)
+	old := Sensor{SerialNumber: "S1", PatientID: "p1", DeviceID: "d1", Activated: first, ExpectedEnd: first.Add(14 * 24 * time.Hour), LastSeen: first}
+	current := Sensor{SerialNumber: "S2", PatientID: "p1", DeviceID: "d1", Activated: first.Add(13 * 24 * time.Hour), ExpectedEnd: first.Add(27 * 24 * time.Hour), LastSeen: first.Add(13 * 24 * time.Hour)}
+	for _, s := range []Sensor{old, current} {
+		if err := store.SaveSensor(s); err != nil {
+			t.Fatalf("failed to save sensor %s: %v", s.SerialNumber, err)
+		}
+	}
+	// saving again should only move last seen forward
+	seen := current
+	seen.LastSeen = current.LastSeen.Add(time.Hour)
+	if err := store.SaveSensor(seen); err != nil {
+		t.Fatalf("failed to update sensor %s: %v", seen.SerialNumber, err)
+	}
+
+	sensors := []Sensor{old, current}
+	cgms := []CGMEntry{}
+	for _, ts := range []time.Time{first.Add(time.Hour), first.Add(12 * 24 * time.Hour), first.Add(14 * 24 * time.Hour)} {
+		cgm := NewCGMEntry(ts, 6.0)
+		cgm.PatientID = "p1"
+		cgm.SensorSerial = SensorAt(sensors, ts)
+		cgms = append(cgms, cgm)
+	}
+	if _, err := store.SaveCGM(cgms...); err != nil {
+		t.Fatalf("failed to save CGM data: %v", err)
+	}
+
+	actual, err := store.Sensors("p1")
+	if err != nil {
+		t.Fatalf("failed to load sensors: %v", err)
+	}
+	if len(actual) != 2 {
+		t.Fatalf("expected 2 sensors but got %v", len(actual))
+	}
+	if actual[0].SerialNumber != "S2" || actual[0].LastSeen != seen.LastSeen {
+		t.Errorf("expected most recent sensor S2 last seen %v but got %+v", seen.LastSeen, actual[0])
+	}
+	if actual[1].Lasted() != 12*24*time.Hour {
+		t.Errorf("expected sensor S1 to have lasted %v but got %v", 12*24*time.Hour, actual[1].Lasted())
+	}
+	if actual[0].FirstReading != first.Add(14*24*time.Hour) {
+		t.Errorf("expected first reading of S2 at %v but got %v", first.Add(14*24*time.Hour), actual[0].FirstReading)
+	}
+	if !actual[0].IsActive(first.Add(20*24*time.Hour)) || actual[1].IsActive(first.Add(20*24*time.Hour)) {
+		t.Errorf("expected only S2 to be active")
+	}
+	if SensorAt(sensors, first.Add(-time.Hour)) != "" {
+		t.Errorf("expected no sensor before the first activation")
+	}
+}
+
+func TestValues(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.GetValue("foo"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v but got %v", ErrNotFound, err)
+	}
+	for _, expected := range []string{"bar", "baz"} {
+		if err := store.SaveValue("foo", expected); err != nil {
+			t.Fatalf("failed to save value: %v", err)
+		}
+		actual, err := store.GetValue("foo")
+		if err != nil {
+			t.Fatalf("failed to get value: %v", err)
+		}
+		if actual != expected {
+			t.Fatalf("expected value %s but got %s", expected, actual)
+		}
+	}
+	if err := store.DeleteValue("foo"); err != nil {
+		t.Fatalf("failed to delete value: %v", err)
+	}
+	if _, err := store.GetValue("foo"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected %v after delete but got %v", ErrNotFound, err)
+	}
+}
+
+func TestAlarmEvents(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	low := AlarmEvent{PatientID: "p1", Timestamp: time.Date(2023, 06, 01, 3, 0, 0, 0, time.UTC), Kind: AlarmKindLow, Mmoll: 3.8, MgPerDl: 68}
+	high := AlarmEvent{PatientID: "p1", Timestamp: time.Date(2023, 06, 01, 15, 0, 0, 0, time.UTC), Kind: AlarmKindHigh, Mmoll: 13.4, MgPerDl: 241}
+	if _, err := store.SaveAlarmEvents(low); err != nil {
+		t.Fatalf("failed to save alarm event: %v", err)
+	}
+	saved, err := store.SaveAlarmEvents(low, high)
+	if err != nil {
+		t.Fatalf("failed to save alarm events: %v", err)
+	}
+	if len(saved) != 1 || saved[0] != high {
+		t.Fatalf("expected only %v to be saved but got %v", high, saved)
+	}
+	events, err := store.LoadAlarmEvents("p1", time.Date(2023, 06, 01, 0, 0, 0, 0, time.UTC), time.Date(2023, 06, 01, 15, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("failed to load alarm events: %v", err)
+	}
+	if len(events) != 1 || events[0] != low {
+		t.Fatalf("expected only %v in the interval but got %v", low, events)
+	}
+}
+
+func TestScrapeRuns(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	now := time.Now().UTC().Truncate(time.Second)
+	runs := []ScrapeRun{
+		{Source: "librelinkup", Kind: "backfill", Started: now.Add(-ScrapeRunRetention - time.Hour), Finished: now.Add(-ScrapeRunRetention - time.Hour)},
+		{Source: "librelinkup", Kind: "backfill", Started: now.Add(-2 * time.Minute), Finished: now.Add(-2 * time.Minute), Error: "network error"},
+		{Source: "librelinkup", Kind: "poll", Started: now.Add(-time.Minute), Finished: now.Add(-time.Minute), Readings: 1},
+		{Source: "nightscout", Kind: "backfill", Started: now, Finished: now, Readings: 12},
+	}
+	for _, run := range runs {
+		if err := store.SaveScrapeRun(run); err != nil {
+			t.Fatalf("failed to save scrape run: %v", err)
+		}
+	}
+
+	loaded, err := store.LoadScrapeRuns("librelinkup", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 2 || loaded[0].Kind != "poll" || loaded[0].Readings != 1 || !loaded[0].Started.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("expected the two recent runs latest first, got %+v", loaded)
+	}
+	if loaded, err := store.LoadScrapeRuns("", 1); err != nil || len(loaded) != 1 || loaded[0].Source != "nightscout" {
+		t.Errorf("expected the latest run of any source, got %+v, %v", loaded, err)
+	}
+	failed, err := store.LatestFailedScrapeRun("librelinkup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !failed.Failed() || failed.Error != "network error" {
+		t.Errorf("expected the failed run, got %+v", failed)
+	}
+	if _, err := store.LatestFailedScrapeRun("nightscout"); err != ErrNotFound {
+		t.Errorf("expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestRawPayloads(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	payloads := []RawPayload{
+		{Source: "librelinkup", Method: "GET", URL: "https://api.libreview.io/llu/connections", StatusCode: 200, Requested: now, Duration: 120 * time.Millisecond, Body: []byte("0123456789")},
+		{Source: "librelinkup", Method: "GET", URL: "https://api.libreview.io/llu/connections/p1/graph", StatusCode: 200, Requested: now, Body: []byte("0123456789")},
+		{Source: "nightscout", Method: "GET", URL: "https://ns.example.com/api/v1/entries.json", StatusCode: 200, Requested: now, Body: []byte("01234")},
+	}
+	ids := []int64{}
+	for _, p := range payloads {
+		// the first payload no longer fits when the last one is added
+		id, err := store.SaveRawPayload(p, 20)
+		if err != nil {
+			t.Fatalf("failed to save raw payload: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if _, err := store.RawPayload(ids[0]); err != ErrNotFound {
+		t.Errorf("expected the oldest payload to be removed, got %v", err)
+	}
+	loaded, err := store.RawPayload(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.URL != payloads[1].URL || string(loaded.Body) != "0123456789" || !loaded.Requested.Equal(now) || loaded.StatusCode != 200 {
+		t.Errorf("unexpected payload %+v", loaded)
+	}
+	all, err := store.LoadRawPayloads("", 0, 0)
+	if err != nil || len(all) != 2 || all[0].ID != ids[1] || all[1].ID != ids[2] {
+		t.Errorf("expected the remaining payloads oldest first, got %+v, %v", all, err)
+	}
+	if after, err := store.LoadRawPayloads("librelinkup", ids[1], 0); err != nil || len(after) != 0 {
+		t.Errorf("expected no LibreLinkUp payloads after the last one, got %+v, %v", after, err)
+	}
+}
+
+func TestTreatments(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	bolus := Treatment{PatientID: "p1", Identifier: "b1", Timestamp: time.Date(2023, 06, 01, 7, 0, 0, 0, time.UTC), EventType: "Correction Bolus", Insulin: 1.5, Source: "upload:xdrip", Document: []byte(`{"insulin":1.5}`)}
+	meal := Treatment{PatientID: "p1", Identifier: "m1", Timestamp: time.Date(2023, 06, 01, 12, 0, 0, 0, time.UTC), EventType: "Meal Bolus", Insulin: 4, Carbs: 45, UTCOffset: 7200, Document: []byte(`{}`)}
+	if _, err := store.SaveTreatments(bolus); err != nil {
+		t.Fatalf("failed to save treatment: %v", err)
+	}
+	saved, err := store.SaveTreatments(bolus, meal)
+	if err != nil {
+		t.Fatalf("failed to save treatments: %v", err)
+	}
+	if len(saved) != 1 || saved[0].Identifier != "m1" {
+		t.Fatalf("expected only %v to be saved but got %v", meal, saved)
+	}
+	treatments, err := store.LoadTreatments("p1", time.Date(2023, 06, 01, 0, 0, 0, 0, time.UTC), time.Date(2023, 06, 01, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("failed to load treatments: %v", err)
+	}
+	if len(treatments) != 1 || treatments[0].Identifier != "b1" || treatments[0].Insulin != 1.5 || treatments[0].Source != "upload:xdrip" || string(treatments[0].Document) != `{"insulin":1.5}` {
+		t.Fatalf("expected only %+v in the interval but got %+v", bolus, treatments)
+	}
+
+	status := DeviceStatus{PatientID: "p1", Identifier: "s1", Timestamp: time.Date(2023, 06, 01, 7, 0, 0, 0, time.UTC), Device: "xDrip-LibreReceiver", Document: []byte(`{"uploaderBattery":80}`)}
+	for i := 0; i < 2; i++ {
+		if _, err := store.SaveDeviceStatuses(status); err != nil {
+			t.Fatalf("failed to save device status: %v", err)
+		}
+	}
+	statuses, err := store.LoadDeviceStatuses("p1", time.Date(2023, 06, 01, 0, 0, 0, 0, time.UTC), time.Date(2023, 06, 02, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("failed to load device statuses: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].Device != status.Device || string(statuses[0].Document) != `{"uploaderBattery":80}` {
+		t.Fatalf("expected the status to be stored once but got %+v", statuses)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	store, err := setupStore()
+	if err != nil {
+		t.Fatalf("failed to setup store: %v", err)
+	}
+	defer store.Close()
+	start := time.Date(2023, 06, 01, 0, 0, 0, 0, time.UTC)
+	cgms := []CGMEntry{}
+	for i := 0; i < 3; i++ {
+		cgm := NewCGMEntry(start.Add(time.Duration(i)*5*time.Minute), Mmoll(5+i))
+		cgm.PatientID = "p1"
+		cgm.Source = "librelinkup"
+		cgms = append(cgms, cgm)
+	}
+	if _, err := store.SaveCGM(cgms...); err != nil {
+		t.Fatalf("failed to save entries: %v", err)
+	}
+	// entries are only added once, in any order
+	if err := store.EnqueueOutbox("sink", KeyHighWaterMark("sink"), cgms[2], cgms[0], cgms[1], cgms[0]); err != nil {
+		t.Fatalf("failed to enqueue entries: %v", err)
+	}
+	// entries at or before the high-water mark are left out
+	if err := store.SaveValue(KeyHighWaterMark("other"), strconv.FormatInt(cgms[1].Timestamp.UnixMilli(), 10)); err != nil {
+		t.Fatalf("failed to save high-water mark: %v", err)
+	}
+	if err := store.EnqueueOutbox("other", KeyHighWaterMark("other"), cgms...); err != nil {
+		t.Fatalf("failed to enqueue entries: %v", err)
+	}
+	if size, err := store.OutboxSize("other"); err != nil || size != 1 {
+		t.Fatalf("expected only the entry after the high-water mark in the outbox but got %v, %v", size, err)
+	}
+	if size, err := store.OutboxSize("sink"); err != nil || size != 3 {
+		t.Fatalf("expected 3 entries in the outbox but got %v, %v", size, err)
+	}
+
+	due, err := store.LoadOutbox("sink", start, 2)
+	if err != nil {
+		t.Fatalf("failed to load outbox: %v", err)
+	}
+	if len(due) != 2 || due[0].CGM != cgms[0] || due[1].CGM != cgms[1] || due[0].Sink != "sink" {
+		t.Fatalf("expected the two oldest entries but got %+v", due)
+	}
+
+	// a failed entry is not due until its next attempt
+	failed := due[0]
+	failed.Attempts, failed.NextAttempt, failed.Error = 1, start.Add(time.Hour), "unavailable"
+	if err := store.UpdateOutbox(failed); err != nil {
+		t.Fatalf("failed to update outbox: %v", err)
+	}
+	if err := store.DeleteOutbox(due[1]); err != nil {
+		t.Fatalf("failed to delete from outbox: %v", err)
+	}
+	due, err = store.LoadOutbox("sink", start, 0)
+	if err != nil {
+		t.Fatalf("failed to load outbox: %v", err)
+	}
+	if len(due) != 1 || due[0].CGM != cgms[2] {
+		t.Fatalf("expected only the last entry to be due but got %+v", due)
+	}
+	due, err = store.LoadOutbox("sink", start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatalf("failed to load outbox: %v", err)
+	}
+	if len(due) != 2 || due[0].Attempts != 1 || due[0].Error != "unavailable" || !due[0].NextAttempt.Equal(start.Add(time.Hour)) {
+		t.Fatalf("expected the failed entry to be due after its next attempt but got %+v", due)
+	}
+}
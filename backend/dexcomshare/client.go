@@ -0,0 +1,225 @@
+package dexcomshare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the time limit for requests made by a client created without WithTimeout
+// or WithHTTPClient
+const DefaultTimeout = 30 * time.Second
+
+const (
+	authenticatePath   = "/General/AuthenticatePublisherAccount"
+	loginByIDPath      = "/General/LoginPublisherAccountById"
+	latestGlucosePath  = "/Publisher/ReadPublisherLatestGlucoseValues"
+	dexcomShareAgent   = "Dexcom Share/3.0.2.11 CFNetwork/711.2.23 Darwin/14.0.0"
+	sessionExpiredCode = "SessionNotValid"
+	sessionMissingCode = "SessionIdNotFound"
+)
+
+var (
+	ErrLoginFailed    = errors.New("could not login to Dexcom Share, make sure the username and password is correct")
+	ErrSessionExpired = errors.New("Dexcom Share session has expired")
+	ErrNetwork        = errors.New("could not reach Dexcom Share")
+)
+
+// Error is an error reported by Dexcom Share. It wraps ErrLoginFailed or ErrSessionExpired when
+// the code maps to one of them.
+type Error struct {
+	StatusCode int
+	Code       string `json:"Code"`
+	Message    string `json:"Message"`
+	Err        error  `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Dexcom Share responded with status %v, code %s: %s: %v", e.StatusCode, e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("Dexcom Share responded with status %v, code %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns true if the error is likely to go away if the request is retried later.
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrNetwork) {
+		return true
+	}
+	var de *Error
+	return errors.As(err, &de) && de.Code == "" && de.StatusCode >= 500
+}
+
+// Client makes requests to Dexcom Share. It is safe for concurrent use.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+}
+
+// Option configures a Client.
+type Option func(*Client) error
+
+// WithHTTPClient makes the client use the given HTTP client for all requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) error {
+		c.httpClient = hc
+		return nil
+	}
+}
+
+// WithTimeout sets the time limit for each request, zero means no limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) error {
+		hc := *c.httpClient
+		hc.Timeout = timeout
+		c.httpClient = &hc
+		return nil
+	}
+}
+
+// WithBaseURL sends all requests to the given URL instead of the region's Dexcom Share server.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		u, err := url.Parse(baseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("base URL '%s' is not a valid absolute URL", baseURL)
+		}
+		c.baseURL = strings.TrimSuffix(u.String(), "/")
+		return nil
+	}
+}
+
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{httpClient: &http.Client{Timeout: DefaultTimeout}}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// url returns the URL of the path at the server.
+func (c *Client) url(server Server, path string) string {
+	if c.baseURL != "" {
+		return c.baseURL + path
+	}
+	return server.BaseURL + path
+}
+
+// Login signs in to the account and returns a new session.
+func (c *Client) Login(ctx context.Context, username, password string, server Server) (Session, error) {
+	var accountID string
+	err := c.post(ctx, c.url(server, authenticatePath), map[string]string{
+		"accountName":   username,
+		"password":      password,
+		"applicationId": server.ApplicationID,
+	}, &accountID)
+	if err != nil {
+		return Session{}, err
+	}
+	if accountID == "" || accountID == nullID {
+		return Session{}, ErrLoginFailed
+	}
+
+	var sessionID string
+	err = c.post(ctx, c.url(server, loginByIDPath), map[string]string{
+		"accountId":     accountID,
+		"password":      password,
+		"applicationId": server.ApplicationID,
+	}, &sessionID)
+	if err != nil {
+		return Session{}, err
+	}
+	if sessionID == "" || sessionID == nullID {
+		return Session{}, ErrLoginFailed
+	}
+	return Session{AccountID: accountID, SessionID: sessionID, Server: server}, nil
+}
+
+// LatestGlucoseValues returns at most maxCount readings made during the last minutes, the
+// latest reading first. Minutes and maxCount are capped at MaxMinutes and MaxCount.
+func (c *Client) LatestGlucoseValues(ctx context.Context, session Session, minutes, maxCount int) ([]GlucoseValue, error) {
+	minutes = clamp(minutes, 1, MaxMinutes)
+	maxCount = clamp(maxCount, 1, MaxCount)
+	query := url.Values{
+		"sessionId": {session.SessionID},
+		"minutes":   {strconv.Itoa(minutes)},
+		"maxCount":  {strconv.Itoa(maxCount)},
+	}
+	values := []GlucoseValue{}
+	if err := c.post(ctx, c.url(session.Server, latestGlucosePath)+"?"+query.Encode(), nil, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func (c *Client) post(ctx context.Context, url string, body any, response any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error marshaling request to JSON: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("error creating request to '%s': %w", url, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", dexcomShareAgent)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// do not leak the session identifier in the query to the logs
+		return fmt.Errorf("%w, error executing request to '%s': %w", ErrNetwork, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%w, error while reading response: %w", ErrNetwork, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newError(resp.StatusCode, result)
+	}
+	if err := json.Unmarshal(result, response); err != nil {
+		return fmt.Errorf("error while unmarshaling response from JSON: %w", err)
+	}
+	return nil
+}
+
+// newError creates an Error from the body of a response with an unexpected status.
+func newError(statusCode int, body []byte) *Error {
+	e := &Error{StatusCode: statusCode}
+	if err := json.Unmarshal(body, e); err != nil {
+		e.Message = http.StatusText(statusCode)
+	}
+	switch {
+	case e.Code == sessionExpiredCode || e.Code == sessionMissingCode:
+		e.Err = ErrSessionExpired
+	case strings.HasPrefix(e.Code, "SSO_Authenticate") || e.Code == "AccountPasswordInvalid":
+		e.Err = ErrLoginFailed
+	}
+	return e
+}
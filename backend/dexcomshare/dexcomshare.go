@@ -0,0 +1,139 @@
+// Package dexcomshare is a client for Dexcom Share, the service the Dexcom apps upload readings
+// to for followers.
+package dexcomshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+// Server is a Dexcom Share server, accounts are either on the US or the outside-US server.
+type Server struct {
+	Region        string
+	BaseURL       string
+	ApplicationID string
+}
+
+var (
+	ServerUS  = Server{Region: "us", BaseURL: "https://share2.dexcom.com/ShareWebServices/Services", ApplicationID: "d89443d2-327c-4a6f-89e5-496bbb0317db"}
+	ServerOUS = Server{Region: "ous", BaseURL: "https://shareous1.dexcom.com/ShareWebServices/Services", ApplicationID: "d89443d2-327c-4a6f-89e5-496bbb0317db"}
+
+	Servers = []Server{ServerUS, ServerOUS}
+)
+
+func ServerByRegion(region string) (Server, bool) {
+	for _, s := range Servers {
+		if s.Region == region {
+			return s, true
+		}
+	}
+	return Server{}, false
+}
+
+// nullID is returned instead of an account or session identifier when the login fails
+const nullID = "00000000-0000-0000-0000-000000000000"
+
+// MaxMinutes is how far back readings can be requested.
+const MaxMinutes = 24 * 60
+
+// MaxCount is the number of readings made in MaxMinutes, one every five minutes.
+const MaxCount = MaxMinutes / 5
+
+// Session is a signed in Dexcom Share account.
+type Session struct {
+	AccountID string
+	SessionID string
+	Server    Server
+}
+
+// GlucoseValue is a reading as returned by ReadPublisherLatestGlucoseValues.
+type GlucoseValue struct {
+	// WT is the time of the reading, in milliseconds since the Unix epoch, in the format Date(ms)
+	WT string `json:"WT"`
+	// ST is the system time of the reading
+	ST string `json:"ST"`
+	// DT is the display time of the reading, including the device's offset from UTC in the
+	// format Date(ms+hhmm)
+	DT    string `json:"DT"`
+	Value int    `json:"Value"`
+	Trend Trend  `json:"Trend"`
+}
+
+var dateExp = regexp.MustCompile(`^Date\((-?\d+)([+-]\d{4})?\)$`)
+
+// Time returns the time of the reading.
+func (gv GlucoseValue) Time() (time.Time, error) {
+	ms, _, err := parseDate(gv.WT)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(ms).UTC(), nil
+}
+
+// UTCOffset returns the offset, in seconds, from UTC of the device that made the reading.
+func (gv GlucoseValue) UTCOffset() int {
+	_, offset, err := parseDate(gv.DT)
+	if err != nil {
+		return 0
+	}
+	return offset
+}
+
+// parseDate returns the milliseconds and offset, in seconds, of a date in the format Date(ms+hhmm).
+func parseDate(date string) (int64, int, error) {
+	m := dateExp.FindStringSubmatch(date)
+	if m == nil {
+		return 0, 0, fmt.Errorf("'%s' is not a valid Dexcom date", date)
+	}
+	ms, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("'%s' is not a valid Dexcom date: %w", date, err)
+	}
+	offset := 0
+	if m[2] != "" {
+		hours, _ := strconv.Atoi(m[2][1:3])
+		minutes, _ := strconv.Atoi(m[2][3:5])
+		offset = hours*60*60 + minutes*60
+		if m[2][0] == '-' {
+			offset = -offset
+		}
+	}
+	return ms, offset, nil
+}
+
+// Trend is the trend of a reading. Newer servers send the trend name while older send its number,
+// both are accepted when unmarshaling.
+type Trend glucose.Trend
+
+func (t *Trend) UnmarshalJSON(b []byte) error {
+	var number int
+	if err := json.Unmarshal(b, &number); err == nil {
+		*t = Trend(number)
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return fmt.Errorf("trend must be a name or a number: %w", err)
+	}
+	*t = Trend(glucose.ParseTrend(trendName(name)))
+	return nil
+}
+
+// trendName returns the Nightscout name of the trend name used by Dexcom Share.
+func trendName(name string) string {
+	switch name {
+	case "None":
+		return "NONE"
+	case "NotComputable":
+		return "NOT COMPUTABLE"
+	case "RateOutOfRange":
+		return "RATE OUT OF RANGE"
+	default:
+		return name
+	}
+}
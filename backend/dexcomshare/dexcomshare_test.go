@@ -0,0 +1,65 @@
+package dexcomshare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		date   string
+		ms     int64
+		offset int
+	}{
+		{date: "Date(1687298517000)", ms: 1687298517000},
+		{date: "Date(1687298517000+0200)", ms: 1687298517000, offset: 2 * 60 * 60},
+		{date: "Date(1687298517000-0430)", ms: 1687298517000, offset: -(4*60*60 + 30*60)},
+	}
+	for _, test := range tests {
+		ms, offset, err := parseDate(test.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ms != test.ms || offset != test.offset {
+			t.Errorf("expected %v and %v from '%s', got %v and %v", test.ms, test.offset, test.date, ms, offset)
+		}
+	}
+	if _, _, err := parseDate("/Date(123)/"); err == nil {
+		t.Error("expected error for invalid date")
+	}
+}
+
+func TestUnmarshalTrend(t *testing.T) {
+	var values []GlucoseValue
+	body := `[{"Value":110,"Trend":"FortyFiveUp"},{"Value":99,"Trend":4},{"Value":98,"Trend":"NotComputable"}]`
+	if err := json.Unmarshal([]byte(body), &values); err != nil {
+		t.Fatal(err)
+	}
+	expected := []glucose.Trend{glucose.TrendFortyFiveUp, glucose.TrendFlat, glucose.TrendNotComputable}
+	for i, value := range values {
+		if glucose.Trend(value.Trend) != expected[i] {
+			t.Errorf("expected trend %v, got %v", expected[i], glucose.Trend(value.Trend))
+		}
+	}
+}
+
+func TestNetworkError(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	srv.Close()
+	c, err := NewClient(WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Login(context.Background(), "user", "password", ServerUS)
+	var urlErr *url.Error
+	if !errors.Is(err, ErrNetwork) || !errors.As(err, &urlErr) || strings.Contains(err.Error(), "%!") {
+		t.Errorf("expected a network error wrapping the cause, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package sharetest provides an in-process fake of the Dexcom Share API for use in tests.
+package sharetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spagettikod/opent1d/dexcomshare"
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+// Reading is a reading made by an account's sensor.
+type Reading struct {
+	Time  time.Time
+	Value int
+	Trend glucose.Trend
+	// UTCOffset is the offset, in seconds, from UTC of the device that made the reading
+	UTCOffset int
+}
+
+type account struct {
+	id       string
+	password string
+	readings []Reading
+}
+
+// Server is a fake Dexcom Share API, it serves both the US and outside-US server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	accounts map[string]*account
+	sessions map[string]*account
+	requests int
+}
+
+// NewServer starts a fake Dexcom Share API, it is stopped when Close is called.
+func NewServer() *Server {
+	s := &Server{accounts: map[string]*account{}, sessions: map[string]*account{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/General/AuthenticatePublisherAccount", s.authenticate)
+	mux.HandleFunc("/General/LoginPublisherAccountById", s.loginByID)
+	mux.HandleFunc("/Publisher/ReadPublisherLatestGlucoseValues", s.latestGlucoseValues)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns a Dexcom Share client sending all requests to the server.
+func (s *Server) Client() *dexcomshare.Client {
+	c, err := dexcomshare.NewClient(dexcomshare.WithBaseURL(s.URL))
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// AddAccount adds an account and returns its account identifier.
+func (s *Server) AddAccount(username, password string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := fmt.Sprintf("00000000-0000-0000-0000-%012d", len(s.accounts)+1)
+	s.accounts[username] = &account{id: id, password: password}
+	return id
+}
+
+// AddReadings adds readings to the account.
+func (s *Server) AddReadings(username string, readings ...Reading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[username].readings = append(s.accounts[username].readings, readings...)
+}
+
+// ExpireSessions invalidates all sessions.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]*account{}
+}
+
+// Requests returns the number of requests for readings.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	a, found := s.accounts[body["accountName"]]
+	if !found {
+		writeError(w, "SSO_AuthenticateAccountNotFound", "Account not found")
+		return
+	}
+	if a.password != body["password"] {
+		writeError(w, "AccountPasswordInvalid", "Password is not valid")
+		return
+	}
+	writeJSON(w, a.id)
+}
+
+func (s *Server) loginByID(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	for _, a := range s.accounts {
+		if a.id == body["accountId"] && a.password == body["password"] {
+			id := fmt.Sprintf("5e550000-0000-0000-0000-%012d", len(s.sessions)+1)
+			s.sessions[id] = a
+			writeJSON(w, id)
+			return
+		}
+	}
+	writeJSON(w, "00000000-0000-0000-0000-000000000000")
+}
+
+func (s *Server) latestGlucoseValues(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	a, found := s.sessions[r.URL.Query().Get("sessionId")]
+	if !found {
+		writeError(w, "SessionIdNotFound", "Session ID not found")
+		return
+	}
+	minutes, _ := strconv.Atoi(r.URL.Query().Get("minutes"))
+	maxCount, _ := strconv.Atoi(r.URL.Query().Get("maxCount"))
+	since := time.Now().Add(-time.Duration(minutes) * time.Minute)
+
+	values := []map[string]any{}
+	// latest reading first
+	for i := len(a.readings) - 1; i >= 0 && len(values) < maxCount; i-- {
+		reading := a.readings[i]
+		if reading.Time.Before(since) {
+			continue
+		}
+		ms := reading.Time.UnixMilli()
+		offset := reading.UTCOffset / 60
+		sign := "+"
+		if offset < 0 {
+			sign, offset = "-", -offset
+		}
+		values = append(values, map[string]any{
+			"WT":    fmt.Sprintf("Date(%d)", ms),
+			"ST":    fmt.Sprintf("Date(%d)", ms),
+			"DT":    fmt.Sprintf("Date(%d%s%02d%02d)", ms, sign, offset/60, offset%60),
+			"Value": reading.Value,
+			"Trend": trendNames[reading.Trend],
+		})
+	}
+	writeJSON(w, values)
+}
+
+// trendNames are the names Dexcom Share uses for the trends
+var trendNames = map[glucose.Trend]string{
+	glucose.TrendNone:           "None",
+	glucose.TrendDoubleUp:       "DoubleUp",
+	glucose.TrendSingleUp:       "SingleUp",
+	glucose.TrendFortyFiveUp:    "FortyFiveUp",
+	glucose.TrendFlat:           "Flat",
+	glucose.TrendFortyFiveDown:  "FortyFiveDown",
+	glucose.TrendSingleDown:     "SingleDown",
+	glucose.TrendDoubleDown:     "DoubleDown",
+	glucose.TrendNotComputable:  "NotComputable",
+	glucose.TrendRateOutOfRange: "RateOutOfRange",
+}
+
+func writeError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{"Code": code, "Message": message})
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
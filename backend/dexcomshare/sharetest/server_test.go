@@ -0,0 +1,59 @@
+package sharetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spagettikod/opent1d/dexcomshare"
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+func TestClient(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	accountID := srv.AddAccount("foo", "secret")
+	now := time.Now().UTC().Truncate(time.Second)
+	srv.AddReadings("foo",
+		Reading{Time: now.Add(-25 * time.Hour), Value: 80},
+		Reading{Time: now.Add(-5 * time.Minute), Value: 99, Trend: glucose.TrendFlat, UTCOffset: 2 * 60 * 60},
+		Reading{Time: now, Value: 110, Trend: glucose.TrendFortyFiveUp, UTCOffset: 2 * 60 * 60},
+	)
+	client := srv.Client()
+	ctx := context.Background()
+
+	if _, err := client.Login(ctx, "unknown", "secret", dexcomshare.ServerOUS); !errors.Is(err, dexcomshare.ErrLoginFailed) {
+		t.Errorf("expected %v for unknown account, got %v", dexcomshare.ErrLoginFailed, err)
+	}
+	if _, err := client.Login(ctx, "foo", "wrong", dexcomshare.ServerOUS); !errors.Is(err, dexcomshare.ErrLoginFailed) {
+		t.Errorf("expected %v for wrong password, got %v", dexcomshare.ErrLoginFailed, err)
+	}
+	session, err := client.Login(ctx, "foo", "secret", dexcomshare.ServerOUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.AccountID != accountID {
+		t.Errorf("expected account %s, got %s", accountID, session.AccountID)
+	}
+
+	values, err := client.LatestGlucoseValues(ctx, session, dexcomshare.MaxMinutes, dexcomshare.MaxCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected the 2 readings of the last 24 hours, got %v", len(values))
+	}
+	ts, err := values[0].Time()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts != now || values[0].UTCOffset() != 2*60*60 || glucose.Trend(values[0].Trend) != glucose.TrendFortyFiveUp {
+		t.Errorf("unexpected latest reading %+v", values[0])
+	}
+
+	srv.ExpireSessions()
+	if _, err := client.LatestGlucoseValues(ctx, session, 5, 1); !errors.Is(err, dexcomshare.ErrSessionExpired) || dexcomshare.IsTransient(err) {
+		t.Errorf("expected %v, got %v", dexcomshare.ErrSessionExpired, err)
+	}
+}
@@ -1,25 +1,69 @@
 package envctx
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/dexcomshare"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/pubsub"
 	"github.com/spagettikod/opent1d/scraper"
+	"github.com/spagettikod/opent1d/sealer"
 )
 
 type Context struct {
-	DB             datastore.Store
-	Logger         zerolog.Logger
-	Scraper        *scraper.LibreLinkupScraper
+	DB          datastore.Store
+	LibreLinkUp *librelinkup.Client
+	DexcomShare *dexcomshare.Client
+	Logger      zerolog.Logger
+	// Sources runs the sources glucose readings are fetched from
+	Sources *scraper.Supervisor
+	// ScrapeInterval is the time between fetches for sources without an interval of their own
+	// in the settings, each source's default interval is used if zero
 	ScrapeInterval time.Duration
+	// CGMBroker publishes CGM entries as they are added to the datastore
+	CGMBroker *pubsub.Broker[datastore.CGMEntry]
+	// Sealer encrypts secrets before they are stored in the datastore
+	Sealer *sealer.Sealer
 }
 
-func NewContext(db datastore.Store, log zerolog.Logger) *Context {
-	return &Context{
-		DB:             db,
-		Logger:         log,
-		Scraper:        nil,
-		ScrapeInterval: 6 * time.Hour,
+func NewContext(db datastore.Store, client *librelinkup.Client, dexcom *dexcomshare.Client, sealer *sealer.Sealer, log zerolog.Logger) *Context {
+	ctx := &Context{
+		DB:          db,
+		LibreLinkUp: client,
+		DexcomShare: dexcom,
+		Sealer:      sealer,
+		Logger:      log,
+		CGMBroker:   pubsub.NewBroker[datastore.CGMEntry](),
+	}
+	ctx.Sources = scraper.NewSupervisor(log, ctx.buildSources)
+	return ctx
+}
+
+// buildSources creates the sources configured in the current settings.
+func (ctx *Context) buildSources() ([]scraper.Source, error) {
+	settings, err := ctx.DB.GetSettings()
+	if err != nil {
+		return nil, err
+	}
+	sources, err := scraper.NewSources(ctx.SourceDeps(), settings)
+	if err == nil && len(sources) == 0 {
+		return nil, fmt.Errorf("no sources are configured, please update your settings")
+	}
+	return sources, err
+}
+
+// SourceDeps returns the dependencies sources are created with.
+func (ctx *Context) SourceDeps() scraper.Deps {
+	return scraper.Deps{
+		DB:          ctx.DB,
+		Sealer:      ctx.Sealer,
+		Logger:      ctx.Logger,
+		Broker:      ctx.CGMBroker,
+		LibreLinkUp: ctx.LibreLinkUp,
+		DexcomShare: ctx.DexcomShare,
+		Interval:    ctx.ScrapeInterval,
 	}
 }
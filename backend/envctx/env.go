@@ -1,13 +1,42 @@
 package envctx
 
 import (
+	"encoding/base64"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/dexcomshare"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/scraper"
 )
 
 const (
 	LOG_LEVEL = "OPENT1D_LOGLEVEL"
+	// ALLOWED_ORIGINS comma separated list of origins, besides the server itself, allowed to open WebSocket connections
+	ALLOWED_ORIGINS = "OPENT1D_ALLOWED_ORIGINS"
+	// SECRET_KEY base64 encoded 32 byte key used to encrypt secrets, such as auth tickets, in the database
+	SECRET_KEY = "OPENT1D_SECRET_KEY"
+	// LIBRELINKUP_URL base URL used for all LibreLinkUp requests instead of the region's host, useful for testing
+	LIBRELINKUP_URL = "OPENT1D_LIBRELINKUP_URL"
+	// DEXCOMSHARE_URL base URL used for all Dexcom Share requests instead of the region's server, useful for testing
+	DEXCOMSHARE_URL = "OPENT1D_DEXCOMSHARE_URL"
+	// SCRAPE_INTERVAL time between fetches, such as 5m, for sources without an interval in the settings
+	SCRAPE_INTERVAL = "OPENT1D_SCRAPE_INTERVAL"
+	// ARCHIVE_SIZE megabytes of raw LibreLinkUp responses kept in the database, 0 turns off the archive
+	ARCHIVE_SIZE = "OPENT1D_ARCHIVE_SIZE"
+	// API_SECRET secret of at least 12 characters granting access to the Nightscout API, the API is off if not set
+	API_SECRET = "OPENT1D_API_SECRET"
+	// API_TOKENS comma separated list of tokens granting read access to the Nightscout API
+	API_TOKENS = "OPENT1D_API_TOKENS"
+	// API_PATIENT patient served by the Nightscout API, required if more than one patient is followed
+	API_PATIENT = "OPENT1D_API_PATIENT"
+	// API_UNITS units Nightscout clients display readings in, mg/dl (default) or mmol
+	API_UNITS = "OPENT1D_API_UNITS"
 )
 
 func EnvToLogLevel() zerolog.Level {
@@ -24,3 +53,94 @@ func EnvToLogLevel() zerolog.Level {
 		return zerolog.ErrorLevel
 	}
 }
+
+func EnvToAllowedOrigins() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv(ALLOWED_ORIGINS), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// EnvToSecretKey returns the decoded secret key or nil if it is not set.
+func EnvToSecretKey() ([]byte, error) {
+	value, found := os.LookupEnv(SECRET_KEY)
+	if !found || value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid base64: %w", SECRET_KEY, err)
+	}
+	return key, nil
+}
+
+// EnvToLibreLinkUpOptions returns the LibreLinkUp client options configured in the environment.
+func EnvToLibreLinkUpOptions() []librelinkup.Option {
+	opts := []librelinkup.Option{}
+	if baseURL := strings.TrimSpace(os.Getenv(LIBRELINKUP_URL)); baseURL != "" {
+		opts = append(opts, librelinkup.WithBaseURL(baseURL))
+	}
+	return opts
+}
+
+// EnvToDexcomShareOptions returns the Dexcom Share client options configured in the environment.
+func EnvToDexcomShareOptions() []dexcomshare.Option {
+	opts := []dexcomshare.Option{}
+	if baseURL := strings.TrimSpace(os.Getenv(DEXCOMSHARE_URL)); baseURL != "" {
+		opts = append(opts, dexcomshare.WithBaseURL(baseURL))
+	}
+	return opts
+}
+
+// EnvToScrapeInterval returns the scrape interval or zero if it is not set.
+func EnvToScrapeInterval() (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(SCRAPE_INTERVAL))
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < time.Minute {
+		return 0, fmt.Errorf("%s must be a duration of at least one minute, such as 5m, got '%s'", SCRAPE_INTERVAL, value)
+	}
+	return interval, nil
+}
+
+// EnvToArchiveSize returns the size of the payload archive in bytes, the default size if it is not
+// set or zero if the archive is turned off.
+func EnvToArchiveSize() (int64, error) {
+	value := strings.TrimSpace(os.Getenv(ARCHIVE_SIZE))
+	if value == "" {
+		return scraper.DefaultArchiveSize, nil
+	}
+	mb, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || mb < 0 {
+		return 0, fmt.Errorf("%s must be a number of megabytes, or 0 to turn off the archive, got '%s'", ARCHIVE_SIZE, value)
+	}
+	return mb << 20, nil
+}
+
+// EnvToNightscoutServerConfig returns the configuration of the Nightscout API and if it is turned
+// on, which it is when an API secret is set.
+func EnvToNightscoutServerConfig() (nightscout.ServerConfig, bool, error) {
+	config := nightscout.ServerConfig{
+		APISecret: os.Getenv(API_SECRET),
+		Tokens:    []string{},
+		PatientID: strings.TrimSpace(os.Getenv(API_PATIENT)),
+		Units:     strings.ToLower(strings.TrimSpace(os.Getenv(API_UNITS))),
+	}
+	if config.APISecret == "" {
+		return config, false, nil
+	}
+	if len(config.APISecret) < nightscout.MinSecretLength {
+		return config, false, fmt.Errorf("%s must be at least %v characters", API_SECRET, nightscout.MinSecretLength)
+	}
+	for _, token := range strings.Split(os.Getenv(API_TOKENS), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			config.Tokens = append(config.Tokens, token)
+		}
+	}
+	return config, true, nil
+}
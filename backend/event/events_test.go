@@ -0,0 +1,60 @@
+package event
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/envctx"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/librelinkup/llutest"
+	"github.com/spagettikod/opent1d/scraper"
+)
+
+func TestConcurrentSettingsSaves(t *testing.T) {
+	srv := llutest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddAccount(llutest.Account{
+		Email:       "foo@bar.com",
+		Password:    "secret",
+		Region:      librelinkup.EndpointUS.Region,
+		Connections: []librelinkup.Connection{{ID: "c1", PatientID: "p1"}},
+	})
+	// a file, since every connection to an in-memory database opens a new database
+	store, err := datastore.NewSQLiteStore("file:" + t.TempDir() + "/opent1d.sqlite")
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+		t.Fatalf("failed to migrate store: %v", err)
+	}
+	ctx := envctx.NewContext(store, srv.Client(), nil, nil, zerolog.Nop())
+	t.Cleanup(ctx.Sources.Stop)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			settings := datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "us"}
+			if i%2 == 0 {
+				settings.LibreLinkUpPatients = []string{"p1"}
+			}
+			if err := store.SaveSettings(settings); err != nil {
+				t.Error(err)
+			}
+			if i == 0 {
+				OnStartup(ctx)
+			}
+			OnSettingsSaved(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	sources := ctx.Sources.Sources()
+	if len(sources) != 1 || sources[0].Name() != scraper.LibreLinkUpSource || !sources[0].IsRunning() {
+		t.Fatalf("expected a single running LibreLinkUp source, got %v", sources)
+	}
+}
@@ -39,3 +39,53 @@ func TestMgToMmol(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTrend(t *testing.T) {
+	type TestCase struct {
+		name     string
+		expected Trend
+	}
+
+	tests := []TestCase{
+		{"DoubleUp", TrendDoubleUp},
+		{"Flat", TrendFlat},
+		{"FortyFiveDown", TrendFortyFiveDown},
+		{"NOT COMPUTABLE", TrendNotComputable},
+		{"sideways", TrendNone},
+	}
+
+	for _, test := range tests {
+		actual := ParseTrend(test.name)
+		if actual != test.expected {
+			t.Errorf("expected %v but got %v", test.expected, actual)
+		}
+		if test.expected != TrendNone && actual.String() != test.name {
+			t.Errorf("expected name %v but got %v", test.name, actual.String())
+		}
+	}
+}
+
+func TestTrendFromRate(t *testing.T) {
+	type TestCase struct {
+		rate     float64
+		expected Trend
+	}
+
+	tests := []TestCase{
+		{3.5, TrendDoubleUp},
+		{2.5, TrendSingleUp},
+		{1.2, TrendFortyFiveUp},
+		{0, TrendFlat},
+		{-1, TrendFlat},
+		{-1.5, TrendFortyFiveDown},
+		{-2.5, TrendSingleDown},
+		{-4, TrendDoubleDown},
+	}
+
+	for _, test := range tests {
+		actual := TrendFromRate(test.rate)
+		if actual != test.expected {
+			t.Errorf("expected %v for %v but got %v", test.expected, test.rate, actual)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package glucose
+
+// Trend is the direction and rate the glucose level is changing in. The values and names follow
+// the ones used by Dexcom and Nightscout.
+type Trend int
+
+const (
+	TrendNone Trend = iota
+	TrendDoubleUp
+	TrendSingleUp
+	TrendFortyFiveUp
+	TrendFlat
+	TrendFortyFiveDown
+	TrendSingleDown
+	TrendDoubleDown
+	TrendNotComputable
+	TrendRateOutOfRange
+)
+
+var trendNames = []string{
+	"NONE",
+	"DoubleUp",
+	"SingleUp",
+	"FortyFiveUp",
+	"Flat",
+	"FortyFiveDown",
+	"SingleDown",
+	"DoubleDown",
+	"NOT COMPUTABLE",
+	"RATE OUT OF RANGE",
+}
+
+// String returns the Nightscout direction name of the trend.
+func (t Trend) String() string {
+	if t < TrendNone || int(t) >= len(trendNames) {
+		return trendNames[TrendNone]
+	}
+	return trendNames[t]
+}
+
+// ParseTrend returns the trend with the given Nightscout direction name, TrendNone is returned
+// for unknown names.
+func ParseTrend(name string) Trend {
+	for i, n := range trendNames {
+		if n == name {
+			return Trend(i)
+		}
+	}
+	return TrendNone
+}
+
+// TrendFromRate returns the trend of a glucose level changing by the given mg/dL per minute,
+// using the thresholds of the Dexcom arrows.
+func TrendFromRate(mgPerMin float64) Trend {
+	switch {
+	case mgPerMin > 3:
+		return TrendDoubleUp
+	case mgPerMin > 2:
+		return TrendSingleUp
+	case mgPerMin > 1:
+		return TrendFortyFiveUp
+	case mgPerMin >= -1:
+		return TrendFlat
+	case mgPerMin >= -2:
+		return TrendFortyFiveDown
+	case mgPerMin >= -3:
+		return TrendSingleDown
+	default:
+		return TrendDoubleDown
+	}
+}
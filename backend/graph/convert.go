@@ -0,0 +1,256 @@
+package graph
+
+import (
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/graph/model"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/scraper"
+)
+
+var (
+	trends = map[glucose.Trend]model.Trend{
+		glucose.TrendNone:           model.TrendNone,
+		glucose.TrendDoubleUp:       model.TrendDoubleUp,
+		glucose.TrendSingleUp:       model.TrendSingleUp,
+		glucose.TrendFortyFiveUp:    model.TrendFortyFiveUp,
+		glucose.TrendFlat:           model.TrendFlat,
+		glucose.TrendFortyFiveDown:  model.TrendFortyFiveDown,
+		glucose.TrendSingleDown:     model.TrendSingleDown,
+		glucose.TrendDoubleDown:     model.TrendDoubleDown,
+		glucose.TrendNotComputable:  model.TrendNotComputable,
+		glucose.TrendRateOutOfRange: model.TrendRateOutOfRange,
+	}
+	measurementColors = map[datastore.MeasurementColor]model.MeasurementColor{
+		datastore.MeasurementColorUnknown: model.MeasurementColorUnknown,
+		datastore.MeasurementColorGreen:   model.MeasurementColorGreen,
+		datastore.MeasurementColorYellow:  model.MeasurementColorYellow,
+		datastore.MeasurementColorOrange:  model.MeasurementColorOrange,
+		datastore.MeasurementColorRed:     model.MeasurementColorRed,
+	}
+	alarmKinds = map[datastore.AlarmKind]model.AlarmKind{
+		datastore.AlarmKindUnknown:   model.AlarmKindUnknown,
+		datastore.AlarmKindLow:       model.AlarmKindLow,
+		datastore.AlarmKindHigh:      model.AlarmKindHigh,
+		datastore.AlarmKindUrgentLow: model.AlarmKindUrgentLow,
+	}
+)
+
+// toSettings converts settings into the GraphQL model, the password is not included.
+func toSettings(settings datastore.Settings) *model.Settings {
+	patients := settings.LibreLinkUpPatients
+	if patients == nil {
+		patients = []string{}
+	}
+	return &model.Settings{
+		LibreLinkUpUsername:     settings.LibreLinkUpUsername,
+		LibreLinkUpRegion:       settings.LibreLinkUpRegion,
+		LibreLinkUpPatients:     patients,
+		DexcomUsername:          settings.DexcomUsername,
+		DexcomRegion:            settings.DexcomRegion,
+		NightscoutURL:           settings.NightscoutURL,
+		NightscoutUploadURL:     settings.NightscoutUploadURL,
+		NightscoutUploadPatient: settings.NightscoutUploadPatient,
+		LibreLinkUpInterval:     int(settings.LibreLinkUpInterval.Seconds()),
+		DexcomInterval:          int(settings.DexcomInterval.Seconds()),
+		NightscoutInterval:      int(settings.NightscoutInterval.Seconds()),
+	}
+}
+
+// toLibreLinkUpStep converts the type of a pending LibreLinkUp step into its GraphQL model.
+func toLibreLinkUpStep(stepType string) *model.LibreLinkUpStep {
+	return &model.LibreLinkUpStep{
+		Type:       stepType,
+		Acceptable: librelinkup.Step{Type: stepType}.Acceptable(),
+	}
+}
+
+// toPatient converts a patient into the GraphQL model, settings tells if the patient is scraped.
+func toPatient(patient datastore.Patient, settings datastore.Settings) *model.Patient {
+	return &model.Patient{
+		ID:         patient.ID,
+		FirstName:  patient.FirstName,
+		LastName:   patient.LastName,
+		TargetLow:  patient.TargetLow,
+		TargetHigh: patient.TargetHigh,
+		Scraped:    settings.ScrapesPatient(patient.ID),
+	}
+}
+
+// toSensor converts a sensor into the GraphQL model, remaining days are calculated from now.
+func toSensor(sensor datastore.Sensor, now time.Time) *model.Sensor {
+	day := 24 * time.Hour
+	s := &model.Sensor{
+		SerialNumber:  sensor.SerialNumber,
+		PatientID:     sensor.PatientID,
+		DeviceID:      sensor.DeviceID,
+		Activated:     sensor.Activated,
+		ExpectedEnd:   sensor.ExpectedEnd,
+		Active:        sensor.IsActive(now),
+		DaysRemaining: float64(sensor.Remaining(now)) / float64(day),
+		DaysLasted:    float64(sensor.Lasted()) / float64(day),
+	}
+	if !sensor.FirstReading.IsZero() {
+		s.FirstReading = &sensor.FirstReading
+		s.LastReading = &sensor.LastReading
+	}
+	return s
+}
+
+// toLatestGlucose converts the patient's latest entry into its GraphQL model, its age is
+// calculated from now.
+func toLatestGlucose(cgm datastore.CGMEntry, unit model.GlucoseUnit, now time.Time) *model.LatestGlucose {
+	age := now.Sub(cgm.Timestamp)
+	if age < 0 {
+		// the clocks of the sensor app and this server might differ slightly
+		age = 0
+	}
+	return &model.LatestGlucose{
+		Reading: toGlucoseReading(cgm, unit),
+		Age:     int(age / time.Second),
+		Stale:   cgm.IsStale(now),
+	}
+}
+
+// measurementTypes returns the datastore measurement type of the requested type, or none if no
+// type was requested.
+func measurementTypes(typ *model.MeasurementType) []datastore.MeasurementType {
+	if typ == nil {
+		return nil
+	}
+	if *typ == model.MeasurementTypeCurrent {
+		return []datastore.MeasurementType{datastore.MeasurementTypeCurrent}
+	}
+	return []datastore.MeasurementType{datastore.MeasurementTypeHistoric}
+}
+
+// glucoseUnit returns the requested unit or mmol/L if none was requested.
+func glucoseUnit(unit *model.GlucoseUnit) model.GlucoseUnit {
+	if unit == nil {
+		return model.GlucoseUnitMmoll
+	}
+	return *unit
+}
+
+// toGlucoseReading converts a datastore entry into its GraphQL model using the requested unit.
+func toGlucoseReading(cgm datastore.CGMEntry, unit model.GlucoseUnit) *model.GlucoseReading {
+	reading := &model.GlucoseReading{
+		PatientID:      cgm.PatientID,
+		Timestamp:      cgm.Timestamp,
+		LocalTimestamp: cgm.LocalTimestamp(),
+		UtcOffset:      cgm.UTCOffset,
+		Unit:           unit,
+		ValueInMgPerDl: cgm.MgPerDl,
+		Type:           model.MeasurementTypeHistoric,
+		Color:          measurementColors[cgm.Color],
+		IsHigh:         cgm.IsHigh,
+		IsLow:          cgm.IsLow,
+		Trend:          trends[cgm.Trend],
+		Source:         cgm.Source,
+	}
+	if cgm.SensorSerial != "" {
+		reading.SensorSerial = &cgm.SensorSerial
+	}
+	if cgm.Device != "" {
+		reading.Device = &cgm.Device
+	}
+	if cgm.Type == datastore.MeasurementTypeCurrent {
+		reading.Type = model.MeasurementTypeCurrent
+	}
+	if reading.Color == "" {
+		reading.Color = model.MeasurementColorUnknown
+	}
+	if reading.Trend == "" {
+		reading.Trend = model.TrendNone
+	}
+	if unit == model.GlucoseUnitMgdl {
+		reading.Value = float64(cgm.MgPerDl)
+	} else {
+		reading.Value = float64(cgm.Mmoll)
+	}
+	return reading
+}
+
+// toAlarmEvent converts a datastore alarm event into its GraphQL model using the requested unit.
+func toAlarmEvent(ae datastore.AlarmEvent, unit model.GlucoseUnit) *model.AlarmEvent {
+	event := &model.AlarmEvent{
+		PatientID:      ae.PatientID,
+		Timestamp:      ae.Timestamp,
+		LocalTimestamp: ae.LocalTimestamp(),
+		UtcOffset:      ae.UTCOffset,
+		Kind:           alarmKinds[ae.Kind],
+		Unit:           unit,
+		ValueInMgPerDl: ae.MgPerDl,
+		Trend:          trends[ae.Trend],
+		Source:         ae.Source,
+	}
+	if event.Kind == "" {
+		event.Kind = model.AlarmKindUnknown
+	}
+	if event.Trend == "" {
+		event.Trend = model.TrendNone
+	}
+	if unit == model.GlucoseUnitMgdl {
+		event.Value = float64(ae.MgPerDl)
+	} else {
+		event.Value = float64(ae.Mmoll)
+	}
+	return event
+}
+
+// toScrapeRun converts a recorded scrape run into its GraphQL model.
+func toScrapeRun(run datastore.ScrapeRun) *model.ScrapeRun {
+	sr := &model.ScrapeRun{
+		Source:     run.Source,
+		Kind:       run.Kind,
+		StartedAt:  run.Started,
+		FinishedAt: run.Finished,
+		Readings:   run.Readings,
+	}
+	if run.Failed() {
+		sr.Error = &run.Error
+	}
+	return sr
+}
+
+// toScraperStatus converts the status of a source into its GraphQL model. The recorded runs,
+// latest first, and the latest failed run, if any, fill in what the source has not seen since it
+// was started.
+func toScraperStatus(name string, status scraper.Status, runs []datastore.ScrapeRun, failed *datastore.ScrapeRun) *model.ScraperStatus {
+	ss := &model.ScraperStatus{
+		Source:     name,
+		Failures:   status.Failures,
+		LatestRuns: []*model.ScrapeRun{},
+	}
+	switch {
+	case !status.Running:
+		ss.State = model.ScraperStateStopped
+	case status.Paused:
+		ss.State = model.ScraperStatePaused
+	case status.State == scraper.HealthOK:
+		ss.State = model.ScraperStateHealthy
+	case status.State == scraper.HealthFailing:
+		ss.State = model.ScraperStateFailing
+	default:
+		ss.State = model.ScraperStateUnknown
+	}
+	if !status.NextRun.IsZero() {
+		ss.NextRun = &status.NextRun
+	}
+	if !status.LastSuccess.IsZero() {
+		ss.LastSuccess = &status.LastSuccess
+	}
+	for i, run := range runs {
+		if ss.LastSuccess == nil && !run.Failed() {
+			ss.LastSuccess = &runs[i].Finished
+		}
+		ss.LatestRuns = append(ss.LatestRuns, toScrapeRun(run))
+	}
+	if failed != nil {
+		ss.LastError = &failed.Error
+		ss.LastErrorAt = &failed.Finished
+	}
+	return ss
+}
@@ -0,0 +1,52 @@
+package graph
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spagettikod/opent1d/graph/model"
+	"github.com/spagettikod/opent1d/importer"
+)
+
+var ErrSchemaUnknownTimeZone = fmt.Errorf("time zone is not a known IANA time zone")
+
+// importOptions returns the import options, the time zone is the server's if none is given.
+func importOptions(timeZone *string, dryRun *bool) (importer.Options, error) {
+	opts := importer.Options{Location: time.Local, DryRun: dryRun != nil && *dryRun}
+	if timeZone != nil && strings.TrimSpace(*timeZone) != "" {
+		var err error
+		if opts.Location, err = time.LoadLocation(strings.TrimSpace(*timeZone)); err != nil {
+			return opts, fmt.Errorf("%w: '%s'", ErrSchemaUnknownTimeZone, *timeZone)
+		}
+	}
+	return opts, nil
+}
+
+func toImportReport(report importer.Report) *model.ImportReport {
+	conflicts := []*model.ImportConflict{}
+	for _, c := range report.Conflicts {
+		conflicts = append(conflicts, &model.ImportConflict{
+			Line:                 c.Line,
+			Timestamp:            c.Reading.Timestamp,
+			ValueInMgPerDl:       c.Reading.MgPerDl,
+			StoredValueInMgPerDl: c.Stored.MgPerDl,
+			StoredSource:         c.Stored.Source,
+		})
+	}
+	rejections := []*model.ImportRejection{}
+	for _, r := range report.Rejections {
+		rejections = append(rejections, &model.ImportRejection{Line: r.Line, Reason: r.Reason})
+	}
+	return &model.ImportReport{
+		DryRun:     report.DryRun,
+		Readings:   report.Readings,
+		Treatments: report.Treatments,
+		Alarms:     report.Alarms,
+		Skipped:    report.Skipped,
+		Conflicted: report.Conflicted,
+		Conflicts:  conflicts,
+		Rejected:   report.Rejected,
+		Rejections: rejections,
+	}
+}
@@ -2,8 +2,429 @@
 
 package model
 
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+type AlarmEvent struct {
+	PatientID      string      `json:"patientId"`
+	Timestamp      time.Time   `json:"timestamp"`
+	LocalTimestamp time.Time   `json:"localTimestamp"`
+	UtcOffset      int         `json:"utcOffset"`
+	Kind           AlarmKind   `json:"kind"`
+	Value          float64     `json:"value"`
+	Unit           GlucoseUnit `json:"unit"`
+	ValueInMgPerDl int         `json:"valueInMgPerDl"`
+	Trend          Trend       `json:"trend"`
+	Source         string      `json:"source"`
+}
+
+type GlucoseReading struct {
+	PatientID      string           `json:"patientId"`
+	Timestamp      time.Time        `json:"timestamp"`
+	LocalTimestamp time.Time        `json:"localTimestamp"`
+	UtcOffset      int              `json:"utcOffset"`
+	Value          float64          `json:"value"`
+	Unit           GlucoseUnit      `json:"unit"`
+	ValueInMgPerDl int              `json:"valueInMgPerDl"`
+	Type           MeasurementType  `json:"type"`
+	Color          MeasurementColor `json:"color"`
+	IsHigh         bool             `json:"isHigh"`
+	IsLow          bool             `json:"isLow"`
+	Trend          Trend            `json:"trend"`
+	SensorSerial   *string          `json:"sensorSerial,omitempty"`
+	Device         *string          `json:"device,omitempty"`
+	Source         string           `json:"source"`
+}
+
+type GlucoseReadingConnection struct {
+	Edges    []*GlucoseReadingEdge `json:"edges"`
+	PageInfo *PageInfo             `json:"pageInfo"`
+}
+
+type GlucoseReadingEdge struct {
+	Cursor string          `json:"cursor"`
+	Node   *GlucoseReading `json:"node"`
+}
+
+type ImportConflict struct {
+	Line                 int       `json:"line"`
+	Timestamp            time.Time `json:"timestamp"`
+	ValueInMgPerDl       int       `json:"valueInMgPerDl"`
+	StoredValueInMgPerDl int       `json:"storedValueInMgPerDl"`
+	StoredSource         string    `json:"storedSource"`
+}
+
+type ImportRejection struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type ImportReport struct {
+	DryRun     bool               `json:"dryRun"`
+	Readings   int                `json:"readings"`
+	Treatments int                `json:"treatments"`
+	Alarms     int                `json:"alarms"`
+	Skipped    int                `json:"skipped"`
+	Conflicted int                `json:"conflicted"`
+	Conflicts  []*ImportConflict  `json:"conflicts"`
+	Rejected   int                `json:"rejected"`
+	Rejections []*ImportRejection `json:"rejections"`
+}
+
+type LatestGlucose struct {
+	Reading *GlucoseReading `json:"reading"`
+	Age     int             `json:"age"`
+	Stale   bool            `json:"stale"`
+}
+
+type LibreLinkUpStep struct {
+	Type       string `json:"type"`
+	Acceptable bool   `json:"acceptable"`
+}
+
+type PageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor,omitempty"`
+	EndCursor       *string `json:"endCursor,omitempty"`
+}
+
+type Patient struct {
+	ID         string `json:"id"`
+	FirstName  string `json:"firstName"`
+	LastName   string `json:"lastName"`
+	TargetLow  int    `json:"targetLow"`
+	TargetHigh int    `json:"targetHigh"`
+	Scraped    bool   `json:"scraped"`
+}
+
+type ScrapeRun struct {
+	Source     string    `json:"source"`
+	Kind       string    `json:"kind"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Readings   int       `json:"readings"`
+	Error      *string   `json:"error,omitempty"`
+}
+
+type ScraperStatus struct {
+	Source      string       `json:"source"`
+	State       ScraperState `json:"state"`
+	LastSuccess *time.Time   `json:"lastSuccess,omitempty"`
+	LastError   *string      `json:"lastError,omitempty"`
+	LastErrorAt *time.Time   `json:"lastErrorAt,omitempty"`
+	NextRun     *time.Time   `json:"nextRun,omitempty"`
+	Failures    int          `json:"failures"`
+	Pending     *int         `json:"pending,omitempty"`
+	LatestRuns  []*ScrapeRun `json:"latestRuns"`
+}
+
+type Sensor struct {
+	SerialNumber  string     `json:"serialNumber"`
+	PatientID     string     `json:"patientId"`
+	DeviceID      string     `json:"deviceId"`
+	Activated     time.Time  `json:"activated"`
+	ExpectedEnd   time.Time  `json:"expectedEnd"`
+	Active        bool       `json:"active"`
+	DaysRemaining float64    `json:"daysRemaining"`
+	FirstReading  *time.Time `json:"firstReading,omitempty"`
+	LastReading   *time.Time `json:"lastReading,omitempty"`
+	DaysLasted    float64    `json:"daysLasted"`
+}
+
 type Settings struct {
-	LibreLinkUpUsername string `json:"LibreLinkUpUsername"`
-	LibreLinkUpPassword string `json:"LibreLinkUpPassword"`
-	LibreLinkUpRegion   string `json:"LibreLinkUpRegion"`
+	LibreLinkUpUsername     string   `json:"LibreLinkUpUsername"`
+	LibreLinkUpPassword     string   `json:"LibreLinkUpPassword"`
+	LibreLinkUpRegion       string   `json:"LibreLinkUpRegion"`
+	LibreLinkUpPatients     []string `json:"LibreLinkUpPatients"`
+	DexcomUsername          string   `json:"DexcomUsername"`
+	DexcomRegion            string   `json:"DexcomRegion"`
+	NightscoutURL           string   `json:"NightscoutURL"`
+	NightscoutUploadURL     string   `json:"NightscoutUploadURL"`
+	NightscoutUploadPatient string   `json:"NightscoutUploadPatient"`
+	LibreLinkUpInterval     int      `json:"LibreLinkUpInterval"`
+	DexcomInterval          int      `json:"DexcomInterval"`
+	NightscoutInterval      int      `json:"NightscoutInterval"`
+}
+
+type AlarmKind string
+
+const (
+	AlarmKindUnknown   AlarmKind = "UNKNOWN"
+	AlarmKindLow       AlarmKind = "LOW"
+	AlarmKindHigh      AlarmKind = "HIGH"
+	AlarmKindUrgentLow AlarmKind = "URGENT_LOW"
+)
+
+var AllAlarmKind = []AlarmKind{
+	AlarmKindUnknown,
+	AlarmKindLow,
+	AlarmKindHigh,
+	AlarmKindUrgentLow,
+}
+
+func (e AlarmKind) IsValid() bool {
+	switch e {
+	case AlarmKindUnknown, AlarmKindLow, AlarmKindHigh, AlarmKindUrgentLow:
+		return true
+	}
+	return false
+}
+
+func (e AlarmKind) String() string {
+	return string(e)
+}
+
+func (e *AlarmKind) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = AlarmKind(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid AlarmKind", str)
+	}
+	return nil
+}
+
+func (e AlarmKind) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type GlucoseUnit string
+
+const (
+	GlucoseUnitMmoll GlucoseUnit = "MMOLL"
+	GlucoseUnitMgdl  GlucoseUnit = "MGDL"
+)
+
+var AllGlucoseUnit = []GlucoseUnit{
+	GlucoseUnitMmoll,
+	GlucoseUnitMgdl,
+}
+
+func (e GlucoseUnit) IsValid() bool {
+	switch e {
+	case GlucoseUnitMmoll, GlucoseUnitMgdl:
+		return true
+	}
+	return false
+}
+
+func (e GlucoseUnit) String() string {
+	return string(e)
+}
+
+func (e *GlucoseUnit) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = GlucoseUnit(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid GlucoseUnit", str)
+	}
+	return nil
+}
+
+func (e GlucoseUnit) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type MeasurementColor string
+
+const (
+	MeasurementColorUnknown MeasurementColor = "UNKNOWN"
+	MeasurementColorGreen   MeasurementColor = "GREEN"
+	MeasurementColorYellow  MeasurementColor = "YELLOW"
+	MeasurementColorOrange  MeasurementColor = "ORANGE"
+	MeasurementColorRed     MeasurementColor = "RED"
+)
+
+var AllMeasurementColor = []MeasurementColor{
+	MeasurementColorUnknown,
+	MeasurementColorGreen,
+	MeasurementColorYellow,
+	MeasurementColorOrange,
+	MeasurementColorRed,
+}
+
+func (e MeasurementColor) IsValid() bool {
+	switch e {
+	case MeasurementColorUnknown, MeasurementColorGreen, MeasurementColorYellow, MeasurementColorOrange, MeasurementColorRed:
+		return true
+	}
+	return false
+}
+
+func (e MeasurementColor) String() string {
+	return string(e)
+}
+
+func (e *MeasurementColor) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = MeasurementColor(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid MeasurementColor", str)
+	}
+	return nil
+}
+
+func (e MeasurementColor) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type MeasurementType string
+
+const (
+	MeasurementTypeHistoric MeasurementType = "HISTORIC"
+	MeasurementTypeCurrent  MeasurementType = "CURRENT"
+)
+
+var AllMeasurementType = []MeasurementType{
+	MeasurementTypeHistoric,
+	MeasurementTypeCurrent,
+}
+
+func (e MeasurementType) IsValid() bool {
+	switch e {
+	case MeasurementTypeHistoric, MeasurementTypeCurrent:
+		return true
+	}
+	return false
+}
+
+func (e MeasurementType) String() string {
+	return string(e)
+}
+
+func (e *MeasurementType) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = MeasurementType(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid MeasurementType", str)
+	}
+	return nil
+}
+
+func (e MeasurementType) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type ScraperState string
+
+const (
+	ScraperStateUnknown ScraperState = "UNKNOWN"
+	ScraperStateHealthy ScraperState = "HEALTHY"
+	ScraperStateFailing ScraperState = "FAILING"
+	ScraperStatePaused  ScraperState = "PAUSED"
+	ScraperStateStopped ScraperState = "STOPPED"
+)
+
+var AllScraperState = []ScraperState{
+	ScraperStateUnknown,
+	ScraperStateHealthy,
+	ScraperStateFailing,
+	ScraperStatePaused,
+	ScraperStateStopped,
+}
+
+func (e ScraperState) IsValid() bool {
+	switch e {
+	case ScraperStateUnknown, ScraperStateHealthy, ScraperStateFailing, ScraperStatePaused, ScraperStateStopped:
+		return true
+	}
+	return false
+}
+
+func (e ScraperState) String() string {
+	return string(e)
+}
+
+func (e *ScraperState) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = ScraperState(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid ScraperState", str)
+	}
+	return nil
+}
+
+func (e ScraperState) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+type Trend string
+
+const (
+	TrendNone           Trend = "NONE"
+	TrendDoubleUp       Trend = "DOUBLE_UP"
+	TrendSingleUp       Trend = "SINGLE_UP"
+	TrendFortyFiveUp    Trend = "FORTY_FIVE_UP"
+	TrendFlat           Trend = "FLAT"
+	TrendFortyFiveDown  Trend = "FORTY_FIVE_DOWN"
+	TrendSingleDown     Trend = "SINGLE_DOWN"
+	TrendDoubleDown     Trend = "DOUBLE_DOWN"
+	TrendNotComputable  Trend = "NOT_COMPUTABLE"
+	TrendRateOutOfRange Trend = "RATE_OUT_OF_RANGE"
+)
+
+var AllTrend = []Trend{
+	TrendNone,
+	TrendDoubleUp,
+	TrendSingleUp,
+	TrendFortyFiveUp,
+	TrendFlat,
+	TrendFortyFiveDown,
+	TrendSingleDown,
+	TrendDoubleDown,
+	TrendNotComputable,
+	TrendRateOutOfRange,
+}
+
+func (e Trend) IsValid() bool {
+	switch e {
+	case TrendNone, TrendDoubleUp, TrendSingleUp, TrendFortyFiveUp, TrendFlat, TrendFortyFiveDown, TrendSingleDown, TrendDoubleDown, TrendNotComputable, TrendRateOutOfRange:
+		return true
+	}
+	return false
+}
+
+func (e Trend) String() string {
+	return string(e)
+}
+
+func (e *Trend) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Trend(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Trend", str)
+	}
+	return nil
+}
+
+func (e Trend) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
 }
@@ -0,0 +1,80 @@
+package graph
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+)
+
+const (
+	// DefaultPageSize is the number of items returned when the caller does not specify a page size
+	DefaultPageSize = 100
+	// MaxPageSize is the largest page size a caller can request
+	MaxPageSize = 1000
+
+	cursorPrefix = "cgm:"
+)
+
+var (
+	ErrSchemaInvalidCursor   = errors.New("cursor is not valid")
+	ErrSchemaInvalidPageSize = fmt.Errorf("first must be between 1 and %v", MaxPageSize)
+	ErrSchemaInvalidInterval = errors.New("from must be before to")
+)
+
+// pageSize validates the requested page size and returns the default size if none was requested.
+func pageSize(first *int) (int, error) {
+	if first == nil {
+		return DefaultPageSize, nil
+	}
+	if *first < 1 || *first > MaxPageSize {
+		return 0, ErrSchemaInvalidPageSize
+	}
+	return *first, nil
+}
+
+// encodeCursor returns an opaque cursor pointing at the reading with the given timestamp and
+// measurement type.
+func encodeCursor(ts time.Time, typ datastore.MeasurementType) string {
+	return base64.StdEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatInt(ts.Unix(), 10) + ":" + strconv.Itoa(int(typ))))
+}
+
+// decodeCursor returns the timestamp and measurement type a cursor, created by encodeCursor,
+// points at.
+func decodeCursor(cursor string) (time.Time, datastore.MeasurementType, error) {
+	b, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, ErrSchemaInvalidCursor
+	}
+	key, found := strings.CutPrefix(string(b), cursorPrefix)
+	if !found {
+		return time.Time{}, 0, ErrSchemaInvalidCursor
+	}
+	unix, typ, found := strings.Cut(key, ":")
+	if !found {
+		return time.Time{}, 0, ErrSchemaInvalidCursor
+	}
+	ts, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrSchemaInvalidCursor
+	}
+	t, err := strconv.Atoi(typ)
+	if err != nil {
+		return time.Time{}, 0, ErrSchemaInvalidCursor
+	}
+	return time.Unix(ts, 0).UTC(), datastore.MeasurementType(t), nil
+}
+
+// hasReadingsBefore reports if the patient has readings of the given types from the start of the
+// interval up to and including the reading with timestamp ts and measurement type typ.
+func (r *Resolver) hasReadingsBefore(patientID string, from, ts time.Time, typ datastore.MeasurementType, types []datastore.MeasurementType) (bool, error) {
+	cgms, err := r.Context.DB.LoadCGMInterval(patientID, from, ts.Add(time.Second), 1, types...)
+	if err != nil {
+		return false, err
+	}
+	return len(cgms) > 0 && (cgms[0].Timestamp.Before(ts) || cgms[0].Type <= typ), nil
+}
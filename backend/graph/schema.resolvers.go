@@ -6,13 +6,20 @@ package graph
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/dexcomshare"
 	"github.com/spagettikod/opent1d/event"
 	"github.com/spagettikod/opent1d/graph/model"
+	"github.com/spagettikod/opent1d/importer"
 	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/scraper"
 )
 
 // SaveSettings is the resolver for the saveSettings field.
@@ -38,7 +45,7 @@ func (r *mutationResolver) SaveSettings(ctx context.Context, username *string, p
 	settings.LibreLinkUpPassword = strings.TrimSpace(*password)
 
 	lg.Debug().Msg("looking up region")
-	endpoint, err := librelinkup.FindEndpoint(settings.LibreLinkUpUsername, settings.LibreLinkUpPassword)
+	endpoint, err := r.Context.LibreLinkUp.FindEndpoint(ctx, settings.LibreLinkUpUsername, settings.LibreLinkUpPassword)
 	if err != nil {
 		lg.Err(err).Msgf("error occured while looking up user region")
 		return nil, err
@@ -53,7 +60,356 @@ func (r *mutationResolver) SaveSettings(ctx context.Context, username *string, p
 	// run event async, we don't need to wait for this to finish
 	go event.OnSettingsSaved(r.Context)
 	lg.Debug().Msg("done saving settings")
-	return &model.Settings{LibreLinkUpUsername: settings.LibreLinkUpUsername, LibreLinkUpRegion: settings.LibreLinkUpRegion}, nil
+	return toSettings(settings), nil
+}
+
+// SelectPatients is the resolver for the selectPatients field.
+func (r *mutationResolver) SelectPatients(ctx context.Context, patientIds []string) (*model.Settings, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.SelectPatients").Logger()
+	settings, err := r.Context.DB.GetSettings()
+	if err != nil {
+		lg.Err(err).Msg("could not load current settings")
+		return nil, err
+	}
+	patients, err := r.Context.DB.Patients()
+	if err != nil {
+		lg.Err(err).Msg("could not load patients")
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, p := range patients {
+		known[p.ID] = true
+	}
+	settings.LibreLinkUpPatients = []string{}
+	for _, id := range patientIds {
+		if !known[id] {
+			return nil, fmt.Errorf("%w: '%s'", ErrSchemaUnknownPatient, id)
+		}
+		settings.LibreLinkUpPatients = append(settings.LibreLinkUpPatients, id)
+	}
+
+	if err := r.Context.DB.SaveSettings(settings); err != nil {
+		lg.Err(err).Msgf("error occured while saving settings")
+		return nil, err
+	}
+	// run event async, we don't need to wait for this to finish
+	go event.OnSettingsSaved(r.Context)
+	lg.Debug().Msgf("selected %v patients", len(settings.LibreLinkUpPatients))
+	return toSettings(settings), nil
+}
+
+// SaveDexcomSettings is the resolver for the saveDexcomSettings field.
+func (r *mutationResolver) SaveDexcomSettings(ctx context.Context, username *string, password *string, region string) (*model.Settings, error) {
+	if username == nil || len(strings.TrimSpace(*username)) == 0 {
+		return nil, ErrSchemaUsernameEmpty
+	}
+	if password == nil || len(strings.TrimSpace(*password)) == 0 {
+		return nil, ErrSchemaPasswordEmpty
+	}
+	server, found := dexcomshare.ServerByRegion(region)
+	if !found {
+		return nil, fmt.Errorf("%w: '%s'", ErrSchemaUnknownRegion, region)
+	}
+	lg := r.Context.Logger.With().Str("function", "graph.SaveDexcomSettings").Str("username", *username).Logger()
+	settings, err := r.Context.DB.GetSettings()
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			lg.Debug().Msg("settings were not found in database, creating new")
+			settings = datastore.Settings{}
+		} else {
+			lg.Err(err).Msg("could not load current settings")
+			return nil, err
+		}
+	}
+	settings.DexcomUsername = strings.TrimSpace(*username)
+	settings.DexcomPassword = strings.TrimSpace(*password)
+	settings.DexcomRegion = server.Region
+
+	lg.Debug().Msg("verifying account")
+	if _, err := r.Context.DexcomShare.Login(ctx, settings.DexcomUsername, settings.DexcomPassword, server); err != nil {
+		lg.Err(err).Msgf("error occured while signing in to Dexcom Share")
+		return nil, err
+	}
+
+	if err := r.Context.DB.SaveSettings(settings); err != nil {
+		lg.Err(err).Msgf("error occured while saving settings")
+		return nil, err
+	}
+	// run event async, we don't need to wait for this to finish
+	go event.OnSettingsSaved(r.Context)
+	lg.Debug().Msg("done saving settings")
+	return toSettings(settings), nil
+}
+
+// SaveNightscoutSettings is the resolver for the saveNightscoutSettings field.
+func (r *mutationResolver) SaveNightscoutSettings(ctx context.Context, url string, apiSecret *string, token *string) (*model.Settings, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.SaveNightscoutSettings").Str("url", url).Logger()
+	settings, err := r.Context.DB.GetSettings()
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			lg.Debug().Msg("settings were not found in database, creating new")
+			settings = datastore.Settings{}
+		} else {
+			lg.Err(err).Msg("could not load current settings")
+			return nil, err
+		}
+	}
+	settings.NightscoutURL = strings.TrimSpace(url)
+	settings.NightscoutAPISecret = ""
+	if apiSecret != nil {
+		settings.NightscoutAPISecret = strings.TrimSpace(*apiSecret)
+	}
+	settings.NightscoutToken = ""
+	if token != nil {
+		settings.NightscoutToken = strings.TrimSpace(*token)
+	}
+
+	client, err := nightscout.NewClient(settings.NightscoutURL, nightscout.WithAPISecret(settings.NightscoutAPISecret), nightscout.WithToken(settings.NightscoutToken))
+	if err != nil {
+		return nil, err
+	}
+	lg.Debug().Msg("verifying site")
+	now := time.Now()
+	if _, err := client.Entries(ctx, now.Add(-time.Hour), now, 1); err != nil {
+		lg.Err(err).Msgf("error occured while reading entries from Nightscout")
+		return nil, err
+	}
+
+	if err := r.Context.DB.SaveSettings(settings); err != nil {
+		lg.Err(err).Msgf("error occured while saving settings")
+		return nil, err
+	}
+	// run event async, we don't need to wait for this to finish
+	go event.OnSettingsSaved(r.Context)
+	lg.Debug().Msg("done saving settings")
+	return toSettings(settings), nil
+}
+
+// SaveNightscoutUploadSettings is the resolver for the saveNightscoutUploadSettings field.
+func (r *mutationResolver) SaveNightscoutUploadSettings(ctx context.Context, url string, apiSecret *string, patientID *string) (*model.Settings, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.SaveNightscoutUploadSettings").Str("url", url).Logger()
+	settings, err := r.Context.DB.GetSettings()
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			lg.Debug().Msg("settings were not found in database, creating new")
+			settings = datastore.Settings{}
+		} else {
+			lg.Err(err).Msg("could not load current settings")
+			return nil, err
+		}
+	}
+	settings.NightscoutUploadURL = strings.TrimSpace(url)
+	settings.NightscoutUploadAPISecret = ""
+	if apiSecret != nil {
+		settings.NightscoutUploadAPISecret = strings.TrimSpace(*apiSecret)
+	}
+	settings.NightscoutUploadPatient = ""
+	if patientID != nil {
+		settings.NightscoutUploadPatient = strings.TrimSpace(*patientID)
+	}
+
+	if settings.NightscoutUploadURL != "" {
+		if settings.NightscoutUploadAPISecret == "" {
+			return nil, ErrSchemaAPISecretEmpty
+		}
+		if settings.NightscoutUploadPatient != "" {
+			patients, err := r.Context.DB.Patients()
+			if err != nil {
+				lg.Err(err).Msg("could not load patients")
+				return nil, err
+			}
+			known := false
+			for _, p := range patients {
+				known = known || p.ID == settings.NightscoutUploadPatient
+			}
+			if !known {
+				return nil, fmt.Errorf("%w: '%s'", ErrSchemaUnknownPatient, settings.NightscoutUploadPatient)
+			}
+		}
+		client, err := nightscout.NewClient(settings.NightscoutUploadURL, nightscout.WithAPISecret(settings.NightscoutUploadAPISecret))
+		if err != nil {
+			return nil, err
+		}
+		lg.Debug().Msg("verifying site")
+		now := time.Now()
+		if _, err := client.Entries(ctx, now.Add(-time.Hour), now, 1); err != nil {
+			lg.Err(err).Msgf("error occured while reading entries from Nightscout")
+			return nil, err
+		}
+	} else {
+		settings.NightscoutUploadAPISecret = ""
+		settings.NightscoutUploadPatient = ""
+	}
+
+	if err := r.Context.DB.SaveSettings(settings); err != nil {
+		lg.Err(err).Msgf("error occured while saving settings")
+		return nil, err
+	}
+	// run event async, we don't need to wait for this to finish
+	go event.OnSettingsSaved(r.Context)
+	lg.Debug().Msg("done saving settings")
+	return toSettings(settings), nil
+}
+
+// AcceptLibreLinkUpTerms is the resolver for the acceptLibreLinkUpTerms field.
+func (r *mutationResolver) AcceptLibreLinkUpTerms(ctx context.Context, step string) (*model.LibreLinkUpStep, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.AcceptLibreLinkUpTerms").Str("step", step).Logger()
+	settings, err := r.Context.DB.GetSettings()
+	if err != nil && err != datastore.ErrNotFound {
+		lg.Err(err).Msg("could not load current settings")
+		return nil, err
+	}
+	if !settings.LibreLinkUpConfigured() {
+		return nil, ErrSchemaNotConfigured
+	}
+	endpoint, found := librelinkup.EndpointByRegion(settings.LibreLinkUpRegion)
+	if !found {
+		return nil, fmt.Errorf("invalid endpoint region '%s'", settings.LibreLinkUpRegion)
+	}
+
+	// signing in returns the pending step together with a ticket only valid for completing it
+	_, err = r.Context.LibreLinkUp.Login(ctx, settings.LibreLinkUpUsername, settings.LibreLinkUpPassword, endpoint)
+	var stepErr *librelinkup.StepError
+	if errors.As(err, &stepErr) {
+		if stepErr.Step.Type != step {
+			return nil, fmt.Errorf("%w: '%s', pending step is '%s'", ErrSchemaStepNotPending, step, stepErr.Step.Type)
+		}
+		lg.Debug().Msg("completing step")
+		_, err = r.Context.LibreLinkUp.CompleteStep(ctx, &stepErr.Ticket, stepErr.Step)
+		if errors.As(err, &stepErr) {
+			lg.Info().Msgf("LibreLinkUp requires another step '%s'", stepErr.Step.Type)
+			if err := r.Context.DB.SaveValue(datastore.KeyLibreLinkUpStep, stepErr.Step.Type); err != nil {
+				lg.Err(err).Msg("could not save pending step")
+				return nil, err
+			}
+			return toLibreLinkUpStep(stepErr.Step.Type), nil
+		}
+	}
+	if err != nil {
+		lg.Err(err).Msg("error occured while completing step")
+		return nil, err
+	}
+
+	if err := r.Context.DB.DeleteValue(datastore.KeyLibreLinkUpStep); err != nil {
+		lg.Err(err).Msg("could not delete pending step")
+		return nil, err
+	}
+	// restart the scraper, it waits a full interval after a step is required
+	go event.OnSettingsSaved(r.Context)
+	lg.Debug().Msg("no steps remain, resuming scraping")
+	return nil, nil
+}
+
+// SetPollInterval is the resolver for the setPollInterval field.
+func (r *mutationResolver) SetPollInterval(ctx context.Context, source string, seconds int) (*model.Settings, error) {
+	if seconds != 0 && seconds < minPollInterval {
+		return nil, ErrSchemaIntervalTooShort
+	}
+	lg := r.Context.Logger.With().Str("function", "graph.SetPollInterval").Str("source", source).Logger()
+	settings, err := r.Context.DB.GetSettings()
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			lg.Debug().Msg("settings were not found in database, creating new")
+			settings = datastore.Settings{}
+		} else {
+			lg.Err(err).Msg("could not load current settings")
+			return nil, err
+		}
+	}
+	interval := time.Duration(seconds) * time.Second
+	switch source {
+	case scraper.LibreLinkUpSource:
+		settings.LibreLinkUpInterval = interval
+	case scraper.DexcomShareSource:
+		settings.DexcomInterval = interval
+	case scraper.NightscoutSource:
+		settings.NightscoutInterval = interval
+	default:
+		return nil, fmt.Errorf("%w: '%s'", ErrSchemaUnknownSource, source)
+	}
+
+	if err := r.Context.DB.SaveSettings(settings); err != nil {
+		lg.Err(err).Msgf("error occured while saving settings")
+		return nil, err
+	}
+	// run event async, we don't need to wait for this to finish
+	go event.OnSettingsSaved(r.Context)
+	lg.Debug().Msgf("poll interval set to %v", interval)
+	return toSettings(settings), nil
+}
+
+// ScrapeNow is the resolver for the scrapeNow field.
+func (r *mutationResolver) ScrapeNow(ctx context.Context, source *string) ([]*model.ScraperStatus, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.ScrapeNow").Logger()
+	sources, err := r.selectSources(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		s.ScrapeNow()
+	}
+	lg.Debug().Msgf("triggered %v sources", len(sources))
+	return r.scraperStatuses(sources)
+}
+
+// PauseScraper is the resolver for the pauseScraper field.
+func (r *mutationResolver) PauseScraper(ctx context.Context, source *string) ([]*model.ScraperStatus, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.PauseScraper").Logger()
+	sources, err := r.selectSources(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		s.Pause()
+	}
+	lg.Debug().Msgf("paused %v sources", len(sources))
+	return r.scraperStatuses(sources)
+}
+
+// ResumeScraper is the resolver for the resumeScraper field.
+func (r *mutationResolver) ResumeScraper(ctx context.Context, source *string) ([]*model.ScraperStatus, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.ResumeScraper").Logger()
+	sources, err := r.selectSources(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sources {
+		s.Resume()
+	}
+	lg.Debug().Msgf("resumed %v sources", len(sources))
+	return r.scraperStatuses(sources)
+}
+
+// ImportLibreView is the resolver for the importLibreView field.
+func (r *mutationResolver) ImportLibreView(ctx context.Context, patientID string, file graphql.Upload, timeZone *string, dryRun *bool) (*model.ImportReport, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.ImportLibreView").Str("patientID", patientID).Str("filename", file.Filename).Logger()
+	opts, err := importOptions(timeZone, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	report, err := importer.LibreView(r.Context.DB, file.File, patientID, opts)
+	if err != nil {
+		lg.Err(err).Msg("could not import LibreView export")
+		return nil, err
+	}
+	lg.Info().Bool("dryRun", report.DryRun).Msgf("imported %v readings and %v treatments, skipped %v and rejected %v records", report.Readings, report.Treatments, report.Skipped, report.Rejected)
+	return toImportReport(report), nil
+}
+
+// ImportDexcomClarity is the resolver for the importDexcomClarity field.
+func (r *mutationResolver) ImportDexcomClarity(ctx context.Context, patientID string, file graphql.Upload, timeZone *string, dryRun *bool) (*model.ImportReport, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.ImportDexcomClarity").Str("patientID", patientID).Str("filename", file.Filename).Logger()
+	opts, err := importOptions(timeZone, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	report, err := importer.Clarity(r.Context.DB, file.File, patientID, opts)
+	if err != nil {
+		lg.Err(err).Msg("could not import Dexcom Clarity export")
+		return nil, err
+	}
+	lg.Info().Bool("dryRun", report.DryRun).Msgf("imported %v readings and %v treatments, skipped %v and rejected %v records", report.Readings, report.Treatments, report.Skipped, report.Rejected)
+	return toImportReport(report), nil
 }
 
 // Settings is the resolver for the settings field.
@@ -68,11 +424,249 @@ func (r *queryResolver) Settings(ctx context.Context) (*model.Settings, error) {
 		lg.Err(err).Msg("error while loading settings")
 		return nil, err
 	}
-	return &model.Settings{
-		LibreLinkUpUsername: dbsettings.LibreLinkUpUsername,
-		LibreLinkUpPassword: "******",
-		LibreLinkUpRegion:   dbsettings.LibreLinkUpRegion,
-	}, nil
+	settings := toSettings(dbsettings)
+	settings.LibreLinkUpPassword = "******"
+	return settings, nil
+}
+
+// LibreLinkUpStep is the resolver for the libreLinkUpStep field.
+func (r *queryResolver) LibreLinkUpStep(ctx context.Context) (*model.LibreLinkUpStep, error) {
+	step, err := r.Context.DB.GetValue(datastore.KeyLibreLinkUpStep)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		r.Context.Logger.Err(err).Str("function", "graph.LibreLinkUpStep").Msg("error while loading pending step")
+		return nil, err
+	}
+	return toLibreLinkUpStep(step), nil
+}
+
+// Patients is the resolver for the patients field.
+func (r *queryResolver) Patients(ctx context.Context) ([]*model.Patient, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.Patients").Logger()
+	patients, err := r.Context.DB.Patients()
+	if err != nil {
+		lg.Err(err).Msg("error while loading patients")
+		return nil, err
+	}
+	settings, err := r.Context.DB.GetSettings()
+	if err != nil && err != datastore.ErrNotFound {
+		lg.Err(err).Msg("error while loading settings")
+		return nil, err
+	}
+	result := []*model.Patient{}
+	for _, p := range patients {
+		result = append(result, toPatient(p, settings))
+	}
+	return result, nil
+}
+
+// Sensors is the resolver for the sensors field.
+func (r *queryResolver) Sensors(ctx context.Context, patientID string) ([]*model.Sensor, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.Sensors").Logger()
+	sensors, err := r.Context.DB.Sensors(patientID)
+	if err != nil {
+		lg.Err(err).Msg("error while loading sensors")
+		return nil, err
+	}
+	now := time.Now()
+	result := []*model.Sensor{}
+	for _, s := range sensors {
+		result = append(result, toSensor(s, now))
+	}
+	return result, nil
+}
+
+// CurrentSensor is the resolver for the currentSensor field.
+func (r *queryResolver) CurrentSensor(ctx context.Context, patientID string) (*model.Sensor, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.CurrentSensor").Logger()
+	sensors, err := r.Context.DB.Sensors(patientID)
+	if err != nil {
+		lg.Err(err).Msg("error while loading sensors")
+		return nil, err
+	}
+	now := time.Now()
+	// sensors are ordered with the most recently activated first
+	if len(sensors) == 0 || !sensors[0].IsActive(now) {
+		return nil, nil
+	}
+	return toSensor(sensors[0], now), nil
+}
+
+// GlucoseReadings is the resolver for the glucoseReadings field.
+func (r *queryResolver) GlucoseReadings(ctx context.Context, patientID string, from time.Time, to time.Time, first *int, after *string, unit *model.GlucoseUnit, typeArg *model.MeasurementType) (*model.GlucoseReadingConnection, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.GlucoseReadings").Logger()
+	limit, err := pageSize(first)
+	if err != nil {
+		return nil, err
+	}
+	if !from.Before(to) {
+		return nil, ErrSchemaInvalidInterval
+	}
+	types := measurementTypes(typeArg)
+	// fetch one extra entry to find out if there is a next page
+	load := func() ([]datastore.CGMEntry, error) {
+		return r.Context.DB.LoadCGMInterval(patientID, from, to, limit+1, types...)
+	}
+	hasPrevious := false
+	if after != nil {
+		ts, typ, err := decodeCursor(*after)
+		if err != nil {
+			return nil, err
+		}
+		if !ts.Before(from) {
+			// continue with the first reading following the cursor
+			load = func() ([]datastore.CGMEntry, error) {
+				return r.Context.DB.LoadCGMAfter(patientID, ts, typ, to, limit+1, types...)
+			}
+			if hasPrevious, err = r.hasReadingsBefore(patientID, from, ts, typ, types); err != nil {
+				lg.Err(err).Msg("error while loading glucose readings")
+				return nil, err
+			}
+		}
+	}
+	cgms, err := load()
+	if err != nil {
+		lg.Err(err).Msg("error while loading glucose readings")
+		return nil, err
+	}
+	conn := &model.GlucoseReadingConnection{
+		Edges:    []*model.GlucoseReadingEdge{},
+		PageInfo: &model.PageInfo{HasNextPage: len(cgms) > limit, HasPreviousPage: hasPrevious},
+	}
+	if conn.PageInfo.HasNextPage {
+		cgms = cgms[:limit]
+	}
+	for _, cgm := range cgms {
+		conn.Edges = append(conn.Edges, &model.GlucoseReadingEdge{
+			Cursor: encodeCursor(cgm.Timestamp, cgm.Type),
+			Node:   toGlucoseReading(cgm, glucoseUnit(unit)),
+		})
+	}
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.StartCursor = &conn.Edges[0].Cursor
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
+	}
+	return conn, nil
+}
+
+// LatestGlucose is the resolver for the latestGlucose field.
+func (r *queryResolver) LatestGlucose(ctx context.Context, patientID string, unit *model.GlucoseUnit) (*model.LatestGlucose, error) {
+	latest, err := r.Context.DB.LatestCGM(patientID)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		r.Context.Logger.Err(err).Str("function", "graph.LatestGlucose").Msg("error while loading latest glucose reading")
+		return nil, err
+	}
+	return toLatestGlucose(latest, glucoseUnit(unit), time.Now()), nil
+}
+
+// AlarmEvents is the resolver for the alarmEvents field.
+func (r *queryResolver) AlarmEvents(ctx context.Context, patientID string, from time.Time, to time.Time, unit *model.GlucoseUnit) ([]*model.AlarmEvent, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.AlarmEvents").Logger()
+	if !from.Before(to) {
+		return nil, ErrSchemaInvalidInterval
+	}
+	events, err := r.Context.DB.LoadAlarmEvents(patientID, from, to)
+	if err != nil {
+		lg.Err(err).Msg("error while loading alarm events")
+		return nil, err
+	}
+	result := []*model.AlarmEvent{}
+	for _, ae := range events {
+		result = append(result, toAlarmEvent(ae, glucoseUnit(unit)))
+	}
+	return result, nil
+}
+
+// ScraperStatus is the resolver for the scraperStatus field.
+func (r *queryResolver) ScraperStatus(ctx context.Context) ([]*model.ScraperStatus, error) {
+	statuses, err := r.scraperStatuses(r.Context.Sources.Sources())
+	if err != nil {
+		r.Context.Logger.Err(err).Str("function", "graph.ScraperStatus").Msg("error while loading scraper status")
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// ScrapeRuns is the resolver for the scrapeRuns field.
+func (r *queryResolver) ScrapeRuns(ctx context.Context, source *string, limit *int) ([]*model.ScrapeRun, error) {
+	name := ""
+	if source != nil {
+		name = *source
+	}
+	n := defaultRunsLimit
+	if limit != nil {
+		n = *limit
+	}
+	if n < 1 || n > MaxPageSize {
+		return nil, ErrSchemaInvalidLimit
+	}
+	runs, err := r.Context.DB.LoadScrapeRuns(name, n)
+	if err != nil {
+		r.Context.Logger.Err(err).Str("function", "graph.ScrapeRuns").Msg("error while loading scrape runs")
+		return nil, err
+	}
+	result := []*model.ScrapeRun{}
+	for _, run := range runs {
+		result = append(result, toScrapeRun(run))
+	}
+	return result, nil
+}
+
+// GlucoseReadingAdded is the resolver for the glucoseReadingAdded field.
+func (r *subscriptionResolver) GlucoseReadingAdded(ctx context.Context, patientID *string, unit *model.GlucoseUnit) (<-chan *model.GlucoseReading, error) {
+	readings := make(chan *model.GlucoseReading)
+	cgms := r.Context.CGMBroker.Subscribe(ctx)
+	go func() {
+		defer close(readings)
+		for cgm := range cgms {
+			if patientID != nil && cgm.PatientID != *patientID {
+				continue
+			}
+			select {
+			case readings <- toGlucoseReading(cgm, glucoseUnit(unit)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return readings, nil
+}
+
+// LatestGlucose is the resolver for the latestGlucose field.
+func (r *subscriptionResolver) LatestGlucose(ctx context.Context, patientID string, unit *model.GlucoseUnit) (<-chan *model.GlucoseReading, error) {
+	lg := r.Context.Logger.With().Str("function", "graph.LatestGlucose").Logger()
+	// subscribe before loading the latest entry to not miss entries added in between
+	cgms := r.Context.CGMBroker.Subscribe(ctx)
+	latest, err := r.Context.DB.LatestCGM(patientID)
+	if err != nil && err != datastore.ErrNotFound {
+		lg.Err(err).Msg("error while loading latest glucose reading")
+		return nil, err
+	}
+
+	readings := make(chan *model.GlucoseReading, 1)
+	if err == nil {
+		readings <- toGlucoseReading(latest, glucoseUnit(unit))
+	}
+	go func() {
+		defer close(readings)
+		for cgm := range cgms {
+			if cgm.PatientID != patientID || !cgm.Timestamp.After(latest.Timestamp) {
+				continue
+			}
+			latest = cgm
+			select {
+			case readings <- toGlucoseReading(cgm, glucoseUnit(unit)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return readings, nil
 }
 
 // Mutation returns MutationResolver implementation.
@@ -81,8 +675,12 @@ func (r *Resolver) Mutation() MutationResolver { return &mutationResolver{r} }
 // Query returns QueryResolver implementation.
 func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
 
+// Subscription returns SubscriptionResolver implementation.
+func (r *Resolver) Subscription() SubscriptionResolver { return &subscriptionResolver{r} }
+
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
 
 // !!! WARNING !!!
 // The code below was going to be deleted when updating resolvers. It has been copied here so you have
@@ -91,6 +689,15 @@ type queryResolver struct{ *Resolver }
 //     it when you're done.
 //   - You have helper methods in this file. Move them out to keep these resolver files clean.
 var (
-	ErrSchemaUsernameEmpty = fmt.Errorf("username must have a value")
-	ErrSchemaPasswordEmpty = fmt.Errorf("password must have a value")
+	ErrSchemaUsernameEmpty    = fmt.Errorf("username must have a value")
+	ErrSchemaPasswordEmpty    = fmt.Errorf("password must have a value")
+	ErrSchemaAPISecretEmpty   = fmt.Errorf("API secret must have a value")
+	ErrSchemaUnknownPatient   = fmt.Errorf("patient is not followed by the LibreLinkUp account")
+	ErrSchemaUnknownRegion    = fmt.Errorf("region is not a known Dexcom Share region")
+	ErrSchemaNotConfigured    = fmt.Errorf("LibreLinkUp account is not configured")
+	ErrSchemaStepNotPending   = fmt.Errorf("step is not pending")
+	ErrSchemaUnknownSource    = fmt.Errorf("source is not known")
+	ErrSchemaIntervalTooShort = fmt.Errorf("interval must be at least %v seconds", minPollInterval)
 )
+
+const minPollInterval = 60
@@ -0,0 +1,436 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/envctx"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/graph/model"
+	"github.com/spagettikod/opent1d/importer"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/librelinkup/llutest"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/pubsub"
+	"github.com/spagettikod/opent1d/scraper"
+	"github.com/spagettikod/opent1d/sealer"
+)
+
+func setupResolver(t *testing.T) (*Resolver, *llutest.Server) {
+	srv := llutest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddAccount(llutest.Account{
+		Email:       "foo@bar.com",
+		Password:    "secret",
+		Region:      librelinkup.EndpointUS.Region,
+		Connections: []librelinkup.Connection{{ID: "c1", PatientID: "p1"}},
+	})
+
+	// sources write from their own goroutines, an in-memory database is per connection
+	store, err := datastore.NewSQLiteStore("file:" + t.TempDir() + "/opent1d.sqlite")
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+		t.Fatalf("failed to migrate store: %v", err)
+	}
+	key, err := sealer.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slr, err := sealer.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Resolver{Context: envctx.NewContext(store, srv.Client(), nil, slr, zerolog.Nop())}, srv
+}
+
+func TestSaveSettings(t *testing.T) {
+	r, _ := setupResolver(t)
+	mutation := r.Mutation()
+	username, password := "foo@bar.com", "wrong"
+
+	if _, err := mutation.SaveSettings(context.Background(), &username, &password); !errors.Is(err, librelinkup.ErrLoginFailed) {
+		t.Fatalf("expected %v, got %v", librelinkup.ErrLoginFailed, err)
+	}
+	if _, err := r.Context.DB.GetSettings(); err != datastore.ErrNotFound {
+		t.Fatalf("expected settings not to be saved after failed login, got %v", err)
+	}
+
+	password = "secret"
+	settings, err := mutation.SaveSettings(context.Background(), &username, &password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.LibreLinkUpRegion != "us" {
+		t.Errorf("expected region 'us', got '%s'", settings.LibreLinkUpRegion)
+	}
+	stored, err := r.Context.DB.GetSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LibreLinkUpRegion != "us" || stored.LibreLinkUpUsername != username {
+		t.Errorf("unexpected stored settings %+v", stored)
+	}
+}
+
+func TestAcceptLibreLinkUpTerms(t *testing.T) {
+	r, srv := setupResolver(t)
+	ctx := context.Background()
+	username, password := "foo@bar.com", "secret"
+	if _, err := r.Mutation().SaveSettings(ctx, &username, &password); err != nil {
+		t.Fatal(err)
+	}
+	srv.RequireSteps(username, librelinkup.StepTermsOfUse, librelinkup.StepPrivacyPolicy)
+	if err := r.Context.DB.SaveValue(datastore.KeyLibreLinkUpStep, librelinkup.StepTermsOfUse); err != nil {
+		t.Fatal(err)
+	}
+
+	step, err := r.Query().LibreLinkUpStep(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step == nil || step.Type != librelinkup.StepTermsOfUse || !step.Acceptable {
+		t.Fatalf("expected pending terms of use, got %+v", step)
+	}
+	if _, err := r.Mutation().AcceptLibreLinkUpTerms(ctx, librelinkup.StepPrivacyPolicy); !errors.Is(err, ErrSchemaStepNotPending) {
+		t.Fatalf("expected %v, got %v", ErrSchemaStepNotPending, err)
+	}
+	step, err = r.Mutation().AcceptLibreLinkUpTerms(ctx, librelinkup.StepTermsOfUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step == nil || step.Type != librelinkup.StepPrivacyPolicy {
+		t.Fatalf("expected privacy policy to follow, got %+v", step)
+	}
+	step, err = r.Mutation().AcceptLibreLinkUpTerms(ctx, librelinkup.StepPrivacyPolicy)
+	if err != nil || step != nil {
+		t.Fatalf("expected no remaining steps, got %+v, %v", step, err)
+	}
+	if step, err := r.Query().LibreLinkUpStep(ctx); err != nil || step != nil {
+		t.Errorf("expected pending step to be cleared, got %+v, %v", step, err)
+	}
+	if _, err := srv.Client().Login(ctx, username, password, librelinkup.EndpointUS); err != nil {
+		t.Errorf("expected login to succeed after accepting the terms, got %v", err)
+	}
+}
+
+func TestSetPollInterval(t *testing.T) {
+	r, _ := setupResolver(t)
+	ctx := context.Background()
+
+	if _, err := r.Mutation().SetPollInterval(ctx, "librelinkup", 10); !errors.Is(err, ErrSchemaIntervalTooShort) {
+		t.Errorf("expected %v, got %v", ErrSchemaIntervalTooShort, err)
+	}
+	if _, err := r.Mutation().SetPollInterval(ctx, "unknown", 300); !errors.Is(err, ErrSchemaUnknownSource) {
+		t.Errorf("expected %v, got %v", ErrSchemaUnknownSource, err)
+	}
+	settings, err := r.Mutation().SetPollInterval(ctx, "dexcomshare", 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.DexcomInterval != 300 || settings.LibreLinkUpInterval != 0 {
+		t.Errorf("expected only the Dexcom Share interval to be set, got %+v", settings)
+	}
+	if stored, err := r.Context.DB.GetSettings(); err != nil || stored.DexcomInterval != 5*time.Minute {
+		t.Errorf("expected interval to be saved, got %v, %v", stored.DexcomInterval, err)
+	}
+}
+
+func TestScraperControl(t *testing.T) {
+	r, _ := setupResolver(t)
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	t.Cleanup(srv.Close)
+	client, err := nightscout.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Context.Sources = scraper.NewSupervisor(zerolog.Nop(), func() ([]scraper.Source, error) {
+		s, err := scraper.NewNightscoutScraper(r.Context.DB, client, datastore.Settings{NightscoutURL: srv.URL}, zerolog.Nop(), time.Hour, pubsub.NewBroker[datastore.CGMEntry]())
+		return []scraper.Source{s}, err
+	})
+	if err := r.Context.Sources.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Context.Sources.Stop)
+
+	// waitForRuns waits until the source has recorded n runs and returns its status
+	waitForRuns := func(n int) *model.ScraperStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			statuses, err := r.Query().ScraperStatus(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(statuses) != 1 {
+				t.Fatalf("expected status of one scraper, got %v", len(statuses))
+			}
+			if len(statuses[0].LatestRuns) == n {
+				return statuses[0]
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %v runs, got %+v", n, statuses[0])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	status := waitForRuns(1)
+	if status.Source != scraper.NightscoutSource || status.State != model.ScraperStateHealthy || status.LastSuccess == nil || status.LastError != nil {
+		t.Errorf("expected healthy Nightscout scraper, got %+v", status)
+	}
+	if status.NextRun == nil || status.NextRun.Before(time.Now().Add(50*time.Minute)) {
+		t.Errorf("expected next run within the hour, got %v", status.NextRun)
+	}
+
+	statuses, err := r.Mutation().PauseScraper(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[0].State != model.ScraperStatePaused || statuses[0].NextRun != nil {
+		t.Errorf("expected paused scraper without next run, got %+v", statuses[0])
+	}
+	source := scraper.NightscoutSource
+	if _, err := r.Mutation().ScrapeNow(ctx, &source); err != nil {
+		t.Fatal(err)
+	}
+	if status := waitForRuns(2); status.State != model.ScraperStatePaused || status.LatestRuns[0].Kind != scraper.RunBackfill {
+		t.Errorf("expected scraper to stay paused after scraping now, got %+v", status)
+	}
+	if statuses, err := r.Mutation().ResumeScraper(ctx, &source); err != nil || statuses[0].State != model.ScraperStateHealthy {
+		t.Errorf("expected resumed scraper, got %+v, %v", statuses, err)
+	}
+
+	unknown := "unknown"
+	if _, err := r.Mutation().PauseScraper(ctx, &unknown); !errors.Is(err, ErrSchemaUnknownSource) {
+		t.Errorf("expected %v, got %v", ErrSchemaUnknownSource, err)
+	}
+	limit := 0
+	if _, err := r.Query().ScrapeRuns(ctx, nil, &limit); !errors.Is(err, ErrSchemaInvalidLimit) {
+		t.Errorf("expected %v, got %v", ErrSchemaInvalidLimit, err)
+	}
+	if runs, err := r.Query().ScrapeRuns(ctx, &source, nil); err != nil || len(runs) < 2 {
+		t.Errorf("expected the recorded runs, got %v, %v", len(runs), err)
+	}
+}
+
+func TestSaveNightscoutUploadSettings(t *testing.T) {
+	r, _ := setupResolver(t)
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("API-SECRET") != nightscout.HashSecret("abcdefghijkl") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(r.Context.Sources.Stop)
+	if err := r.Context.DB.SavePatients(datastore.Patient{ID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	secret, wrong, patient, unknown := "abcdefghijkl", "wrong", "p1", "p2"
+
+	if _, err := r.Mutation().SaveNightscoutUploadSettings(ctx, srv.URL, nil, nil); !errors.Is(err, ErrSchemaAPISecretEmpty) {
+		t.Errorf("expected %v, got %v", ErrSchemaAPISecretEmpty, err)
+	}
+	if _, err := r.Mutation().SaveNightscoutUploadSettings(ctx, srv.URL, &secret, &unknown); !errors.Is(err, ErrSchemaUnknownPatient) {
+		t.Errorf("expected %v, got %v", ErrSchemaUnknownPatient, err)
+	}
+	if _, err := r.Mutation().SaveNightscoutUploadSettings(ctx, srv.URL, &wrong, nil); !errors.Is(err, nightscout.ErrUnauthorized) {
+		t.Errorf("expected %v, got %v", nightscout.ErrUnauthorized, err)
+	}
+	settings, err := r.Mutation().SaveNightscoutUploadSettings(ctx, srv.URL, &secret, &patient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.NightscoutUploadURL != srv.URL || settings.NightscoutUploadPatient != "p1" {
+		t.Errorf("expected upload settings to be returned, got %+v", settings)
+	}
+
+	// the sink is started with the new settings and reports the readings waiting to be uploaded
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses, err := r.Query().ScraperStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) == 1 && statuses[0].Source == scraper.NightscoutUploadSource {
+			if statuses[0].Pending == nil || *statuses[0].Pending != 0 {
+				t.Errorf("expected no pending readings, got %v", statuses[0].Pending)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the upload sink to be started, got %+v", statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// an empty url stops uploading
+	if settings, err := r.Mutation().SaveNightscoutUploadSettings(ctx, "", &secret, &patient); err != nil || settings.NightscoutUploadURL != "" || settings.NightscoutUploadPatient != "" {
+		t.Errorf("expected upload settings to be cleared, got %+v, %v", settings, err)
+	}
+	if stored, err := r.Context.DB.GetSettings(); err != nil || stored.NightscoutUploadConfigured() {
+		t.Errorf("expected uploading to be turned off, got %+v, %v", stored, err)
+	}
+}
+
+func TestImportLibreView(t *testing.T) {
+	r, _ := setupResolver(t)
+	ctx := context.Background()
+	t.Cleanup(r.Context.Sources.Stop)
+	if err := r.Context.DB.SavePatients(datastore.Patient{ID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	csv := "Glucose Data,Generated on,04-02-2023 10:00 AM UTC,Generated by,Jane Doe\n" +
+		"Device,Serial Number,Device Timestamp,Record Type,Historic Glucose mg/dL,Scan Glucose mg/dL,Non-numeric Rapid-Acting Insulin,Rapid-Acting Insulin (units),Non-numeric Food,Carbohydrates (grams),Carbohydrates (servings),Non-numeric Long-Acting Insulin,Long-Acting Insulin Value (units),Notes,Strip Glucose mg/dL,Ketone mmol/L\n" +
+		"FreeStyle LibreLink,ABC,04-01-2023 08:00 AM,0,100,,,,,,,,,,,\n" +
+		"FreeStyle LibreLink,ABC,04-01-2023 08:20 AM,5,,,,,,45,,,,,,\n" +
+		"FreeStyle LibreLink,ABC,04-01-2023 08:30 AM,0,,,,,,,,,,,,\n"
+	upload := func() graphql.Upload {
+		return graphql.Upload{File: strings.NewReader(csv), Filename: "export.csv"}
+	}
+	unknown, utc, invalid, dryRun := "p2", "UTC", "Nowhere/Nothing", true
+
+	if _, err := r.Mutation().ImportLibreView(ctx, unknown, upload(), nil, nil); !errors.Is(err, importer.ErrUnknownPatient) {
+		t.Errorf("expected %v, got %v", importer.ErrUnknownPatient, err)
+	}
+	if _, err := r.Mutation().ImportLibreView(ctx, "p1", upload(), &invalid, nil); !errors.Is(err, ErrSchemaUnknownTimeZone) {
+		t.Errorf("expected %v, got %v", ErrSchemaUnknownTimeZone, err)
+	}
+	report, err := r.Mutation().ImportLibreView(ctx, "p1", upload(), &utc, &dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Readings != 1 {
+		t.Errorf("unexpected dry run report %+v", report)
+	}
+	if _, err := r.Context.DB.LatestCGM("p1"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("expected dry run to store nothing, got %v", err)
+	}
+	report, err = r.Mutation().ImportLibreView(ctx, "p1", upload(), &utc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Readings != 1 || report.Treatments != 1 || report.Rejected != 1 || len(report.Rejections) != 1 || report.Rejections[0].Line != 5 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	cgm, err := r.Context.DB.LatestCGM("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cgm.Timestamp.Equal(time.Date(2023, 4, 1, 8, 0, 0, 0, time.UTC)) || cgm.MgPerDl != 100 {
+		t.Errorf("unexpected reading %+v", cgm)
+	}
+}
+
+func TestLatestGlucose(t *testing.T) {
+	r, _ := setupResolver(t)
+	ctx := context.Background()
+	if latest, err := r.Query().LatestGlucose(ctx, "p1", nil); err != nil || latest != nil {
+		t.Fatalf("expected no reading before any are stored, got %+v, %v", latest, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	historic := datastore.NewCGMEntry(now.Add(-20*time.Minute), 5.5)
+	historic.PatientID = "p1"
+	current := datastore.NewCGMEntry(now.Add(-time.Minute), 6.2)
+	current.PatientID = "p1"
+	current.Type = datastore.MeasurementTypeCurrent
+	current.Trend = glucose.TrendFortyFiveUp
+	if _, err := r.Context.DB.SaveCGM(historic, current); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := r.Query().LatestGlucose(ctx, "p1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Reading.Type != model.MeasurementTypeCurrent || latest.Reading.Trend != model.TrendFortyFiveUp || latest.Stale {
+		t.Errorf("expected the fresh current reading, got %+v, %+v", latest, latest.Reading)
+	}
+	if latest.Age < 60 || latest.Age > 120 {
+		t.Errorf("expected the reading to be about a minute old, got %v seconds", latest.Age)
+	}
+	if latest := toLatestGlucose(current, model.GlucoseUnitMmoll, now.Add(datastore.StaleAfter)); !latest.Stale {
+		t.Errorf("expected reading to be stale after %v", datastore.StaleAfter)
+	}
+
+	typ := model.MeasurementTypeHistoric
+	conn, err := r.Query().GlucoseReadings(ctx, "p1", now.Add(-time.Hour), now, nil, nil, nil, &typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Edges) != 1 || conn.Edges[0].Node.Type != model.MeasurementTypeHistoric {
+		t.Errorf("expected only the historic reading, got %v readings", len(conn.Edges))
+	}
+}
+
+func TestGlucoseReadingsPagination(t *testing.T) {
+	r, _ := setupResolver(t)
+	ctx := context.Background()
+	start := time.Date(2023, 06, 01, 10, 0, 0, 0, time.UTC)
+	cgms := []datastore.CGMEntry{}
+	for i := 0; i < 3; i++ {
+		historic := datastore.NewCGMEntry(start.Add(time.Duration(i)*5*time.Minute), datastore.Mmoll(5+i))
+		historic.PatientID = "p1"
+		current := historic
+		current.Type = datastore.MeasurementTypeCurrent
+		cgms = append(cgms, historic, current)
+	}
+	if _, err := r.Context.DB.SaveCGM(cgms...); err != nil {
+		t.Fatal(err)
+	}
+
+	first := 4
+	var after *string
+	read := []*model.GlucoseReading{}
+	for page := 0; ; page++ {
+		conn, err := r.Query().GlucoseReadings(ctx, "p1", start, start.Add(time.Hour), &first, after, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.PageInfo.HasPreviousPage != (page > 0) {
+			t.Errorf("expected hasPreviousPage %v on page %v", page > 0, page)
+		}
+		for _, e := range conn.Edges {
+			read = append(read, e.Node)
+		}
+		if !conn.PageInfo.HasNextPage {
+			break
+		}
+		after = conn.PageInfo.EndCursor
+	}
+	if len(read) != len(cgms) {
+		t.Fatalf("expected %v readings but got %v", len(cgms), len(read))
+	}
+	for i, reading := range read {
+		if !reading.Timestamp.Equal(cgms[i].Timestamp) || (reading.Type == model.MeasurementTypeCurrent) != (cgms[i].Type == datastore.MeasurementTypeCurrent) {
+			t.Errorf("expected reading %v at %v of type %v but got %v of type %v", i, cgms[i].Timestamp, cgms[i].Type, reading.Timestamp, reading.Type)
+		}
+	}
+
+	// a cursor before the interval starts from the beginning of it
+	cursor := encodeCursor(start.Add(-time.Hour), datastore.MeasurementTypeCurrent)
+	conn, err := r.Query().GlucoseReadings(ctx, "p1", start, start.Add(time.Hour), &first, &cursor, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.Edges) != first || conn.PageInfo.HasPreviousPage {
+		t.Errorf("expected the first page, got %v readings, hasPreviousPage %v", len(conn.Edges), conn.PageInfo.HasPreviousPage)
+	}
+}
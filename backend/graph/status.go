@@ -0,0 +1,60 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/graph/model"
+	"github.com/spagettikod/opent1d/scraper"
+)
+
+const (
+	// latestRunsLimit is the number of runs included in the status of a scraper
+	latestRunsLimit = 10
+	// defaultRunsLimit is the number of runs returned by scrapeRuns if no limit is given
+	defaultRunsLimit = 20
+)
+
+var ErrSchemaInvalidLimit = fmt.Errorf("limit must be between 1 and %v", MaxPageSize)
+
+// selectSources returns the running source with the given name, or all running sources if no
+// name is given.
+func (r *Resolver) selectSources(name *string) ([]scraper.Source, error) {
+	if name == nil {
+		return r.Context.Sources.Sources(), nil
+	}
+	source, ok := r.Context.Sources.Source(*name)
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrSchemaUnknownSource, *name)
+	}
+	return []scraper.Source{source}, nil
+}
+
+// scraperStatuses returns the status of the sources along with their recorded runs.
+func (r *Resolver) scraperStatuses(sources []scraper.Source) ([]*model.ScraperStatus, error) {
+	result := []*model.ScraperStatus{}
+	for _, source := range sources {
+		runs, err := r.Context.DB.LoadScrapeRuns(source.Name(), latestRunsLimit)
+		if err != nil {
+			return nil, fmt.Errorf("could not load scrape runs of %s: %w", source.Name(), err)
+		}
+		var failed *datastore.ScrapeRun
+		run, err := r.Context.DB.LatestFailedScrapeRun(source.Name())
+		if err == nil {
+			failed = &run
+		} else if !errors.Is(err, datastore.ErrNotFound) {
+			return nil, fmt.Errorf("could not load latest failed scrape run of %s: %w", source.Name(), err)
+		}
+		status := toScraperStatus(source.Name(), source.Status(), runs, failed)
+		if sink, ok := source.(scraper.Sink); ok {
+			pending, err := sink.Pending()
+			if err != nil {
+				return nil, fmt.Errorf("could not count pending readings of %s: %w", source.Name(), err)
+			}
+			status.Pending = &pending
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
@@ -0,0 +1,253 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+// ClaritySource is the source of readings and treatments imported from Dexcom Clarity.
+const ClaritySource = "clarity"
+
+// Columns of the Dexcom Clarity CSV export.
+const (
+	clIndex = iota
+	clTimestamp
+	clEventType
+	clEventSubtype
+	clPatientInfo
+	clDeviceInfo
+	clSourceDevice
+	clGlucose
+	clInsulin
+	clCarbs
+	clDuration
+	clRate
+	clTransmitterTime
+	clTransmitterID
+)
+
+// Event types and subtypes of the Clarity export.
+const (
+	clEventEGV         = "EGV"
+	clEventCalibration = "Calibration"
+	clEventInsulin     = "Insulin"
+	clEventCarbs       = "Carbs"
+	clEventExercise    = "Exercise"
+	clEventHealth      = "Health"
+	clEventDevice      = "Device"
+	clEventAlert       = "Alert"
+	clSubtypeLong      = "Long-Acting"
+)
+
+// clAlarmKinds are the alarm kinds of the alert subtypes, other alerts such as signal loss and
+// rise are imported as notes.
+var clAlarmKinds = map[string]datastore.AlarmKind{
+	"High":       datastore.AlarmKindHigh,
+	"Low":        datastore.AlarmKindLow,
+	"Urgent Low": datastore.AlarmKindUrgentLow,
+}
+
+// Glucose values outside of the range the sensor can measure are exported as Low and High, they
+// are stored as the limits of the range.
+const (
+	clLowMgPerDl  = 40
+	clHighMgPerDl = 400
+)
+
+// clLayouts are the timestamp formats of the export.
+var clLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// Clarity imports a Dexcom Clarity CSV export of the patient. Timestamps are in the local time of
+// the receiver or app, which is assumed to be the location of the options. Rows without a
+// timestamp, such as patient info and alert settings, are skipped while alerts that went off are
+// imported as alarm events.
+func Clarity(db datastore.Store, r io.Reader, patientID string, opts Options) (Report, error) {
+	report := newReport(opts)
+	if err := checkPatient(db, patientID); err != nil {
+		return report, err
+	}
+	rows, err := readRows(r)
+	if err != nil {
+		return report, err
+	}
+	if len(rows) == 0 || len(rows[0].fields) <= clTransmitterID {
+		return report, fmt.Errorf("file is not a Dexcom Clarity export")
+	}
+	var mmol bool
+	switch unit := strings.ToLower(rows[0].field(clGlucose)); {
+	case strings.Contains(unit, "mmol"):
+		mmol = true
+	case strings.Contains(unit, "mg"):
+		mmol = false
+	default:
+		return report, fmt.Errorf("unknown glucose unit in header %q", rows[0].field(clGlucose))
+	}
+
+	// device rows name the receiver or app of the source device IDs used by the other rows
+	devices := map[string]string{}
+	data := []row{}
+	timestamps := []string{}
+	for _, row := range rows[1:] {
+		if strings.TrimSpace(strings.Join(row.fields, "")) == "" {
+			continue
+		}
+		if row.field(clEventType) == clEventDevice && row.field(clSourceDevice) != "" {
+			devices[row.field(clSourceDevice)] = row.field(clDeviceInfo)
+		}
+		if ts := row.field(clTimestamp); ts != "" {
+			timestamps = append(timestamps, ts)
+		}
+		data = append(data, row)
+	}
+	layout, err := detectLayout(timestamps, clLayouts)
+	if err != nil {
+		return report, err
+	}
+
+	recs := records{}
+	for _, row := range data {
+		if row.field(clTimestamp) == "" {
+			report.Skipped++
+			continue
+		}
+		ts, err := time.ParseInLocation(layout, row.field(clTimestamp), opts.location())
+		if err != nil {
+			report.reject(row.line, "invalid timestamp %q", row.field(clTimestamp))
+			continue
+		}
+		_, utcOffset := ts.Zone()
+		device := row.field(clSourceDevice)
+		if name := devices[device]; name != "" {
+			device = name
+		}
+		treatment := func(eventType string, fields map[string]any) {
+			t, err := newTreatment(patientID, ClaritySource, row.field(clSourceDevice), eventType, ts, utcOffset, fields)
+			if err != nil {
+				report.reject(row.line, "%v", err)
+				return
+			}
+			recs.treatments = append(recs.treatments, t)
+		}
+
+		switch row.field(clEventType) {
+		case clEventEGV:
+			cgm, err := clReading(row, mmol)
+			if err != nil {
+				report.reject(row.line, "%v", err)
+				continue
+			}
+			cgm.PatientID = patientID
+			cgm.Timestamp = ts.UTC()
+			cgm.UTCOffset = utcOffset
+			cgm.Source = ClaritySource
+			cgm.Device = device
+			recs.readings = append(recs.readings, reading{line: row.line, cgm: cgm})
+		case clEventCalibration:
+			_, mg, err := parseGlucose(row.field(clGlucose), mmol)
+			if err != nil {
+				report.reject(row.line, "%v", err)
+				continue
+			}
+			treatment(EventBGCheck, map[string]any{"glucose": float64(mg), "glucoseType": "Finger", "units": "mg/dl", "notes": "Calibration"})
+		case clEventInsulin:
+			units, err := parseNumber(row.field(clInsulin))
+			if err != nil || units <= 0 {
+				report.reject(row.line, "invalid insulin units %q", row.field(clInsulin))
+				continue
+			}
+			eventType := EventCorrection
+			if row.field(clEventSubtype) == clSubtypeLong {
+				eventType = EventLongActing
+			}
+			treatment(eventType, map[string]any{"insulin": units})
+		case clEventCarbs:
+			carbs, err := parseNumber(row.field(clCarbs))
+			if err != nil || carbs < 0 {
+				report.reject(row.line, "invalid carbohydrates %q", row.field(clCarbs))
+				continue
+			}
+			treatment(EventCarbCorrection, map[string]any{"carbs": carbs})
+		case clEventExercise:
+			fields := map[string]any{"notes": row.field(clEventSubtype)}
+			if d, err := parseDuration(row.field(clDuration)); err == nil {
+				fields["duration"] = d.Minutes()
+			}
+			treatment(EventExercise, fields)
+		case clEventHealth:
+			treatment(EventNote, map[string]any{"notes": row.field(clEventSubtype)})
+		case clEventAlert:
+			kind, ok := clAlarmKinds[row.field(clEventSubtype)]
+			if !ok {
+				treatment(EventNote, map[string]any{"notes": strings.TrimSpace("Alert " + row.field(clEventSubtype))})
+				continue
+			}
+			ae := datastore.AlarmEvent{PatientID: patientID, Timestamp: ts.UTC(), Kind: kind, UTCOffset: utcOffset, Source: ClaritySource}
+			if row.field(clGlucose) != "" {
+				cgm, err := clReading(row, mmol)
+				if err != nil {
+					report.reject(row.line, "%v", err)
+					continue
+				}
+				ae.Mmoll, ae.MgPerDl, ae.Trend = cgm.Mmoll, cgm.MgPerDl, cgm.Trend
+			}
+			recs.alarms = append(recs.alarms, ae)
+		default:
+			// device info and event types added after this was written
+			report.Skipped++
+		}
+	}
+	if err := save(db, patientID, recs, opts, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// clReading returns the glucose value, trend and transmitter of an EGV row.
+func clReading(row row, mmol bool) (datastore.CGMEntry, error) {
+	cgm := datastore.CGMEntry{SensorSerial: row.field(clTransmitterID)}
+	switch value := row.field(clGlucose); strings.ToLower(value) {
+	case "low":
+		cgm.MgPerDl, cgm.IsLow = clLowMgPerDl, true
+		cgm.Mmoll = datastore.Mmoll(glucose.MgToMmol(cgm.MgPerDl))
+	case "high":
+		cgm.MgPerDl, cgm.IsHigh = clHighMgPerDl, true
+		cgm.Mmoll = datastore.Mmoll(glucose.MgToMmol(cgm.MgPerDl))
+	default:
+		mmoll, mg, err := parseGlucose(value, mmol)
+		if err != nil {
+			return cgm, err
+		}
+		cgm.Mmoll, cgm.MgPerDl = mmoll, mg
+	}
+	if value := row.field(clRate); value != "" {
+		rate, err := parseNumber(value)
+		if err != nil {
+			return cgm, fmt.Errorf("invalid rate of change %q", value)
+		}
+		if mmol {
+			// mmol/L per minute into mg/dL per minute
+			rate = rate * 18
+		}
+		cgm.Trend = glucose.TrendFromRate(rate)
+	}
+	return cgm, nil
+}
+
+// parseDuration parses a duration in the hh:mm:ss format of the export.
+func parseDuration(value string) (time.Duration, error) {
+	var h, m, s int
+	if _, err := fmt.Sscanf(value, "%d:%d:%d", &h, &m, &s); err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second, nil
+}
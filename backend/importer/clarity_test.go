@@ -0,0 +1,98 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+const clarityExport = `Index,Timestamp (YYYY-MM-DDThh:mm:ss),Event Type,Event Subtype,Patient Info,Device Info,Source Device ID,Glucose Value (mg/dL),Insulin Value (u),Carb Value (grams),Duration (hh:mm:ss),Glucose Rate of Change (mg/dL/min),Transmitter Time (Long Integer),Transmitter ID
+1,,FirstName,,Jane,,,,,,,,,
+2,,LastName,,Doe,,,,,,,,,
+3,,Device,,,Dexcom G6 Mobile App,Android G6,,,,,,,
+4,,Alert,High,,,Android G6,250,,,,,,
+5,2023-03-01T08:00:12,EGV,,,,Android G6,120,,,,1.5,1000,8ABC12
+6,2023-03-01T08:05:12,EGV,,,,Android G6,Low,,,,,1300,8ABC12
+7,2023-03-01T08:10:12,EGV,,,,Android G6,abc,,,,,1600,8ABC12
+8,2023-03-01T08:12:00,Calibration,,,,Android G6,118,,,,,,8ABC12
+9,2023-03-01T08:15:00,Insulin,Fast-Acting,,,Android G6,,4.5,,,,,
+10,2023-03-01T22:00:00,Insulin,Long-Acting,,,Android G6,,12,,,,,
+11,2023-03-01T08:15:00,Carbs,,,,Android G6,,,40,,,,
+12,2023-03-01T17:00:00,Exercise,Medium,,,Android G6,,,,00:30:00,,,
+13,2023-03-01T18:00:00,Health,Illness,,,Android G6,,,,,,,
+14,2023-03-01T19:00:00,Alert,Urgent Low,,,Android G6,54,,,,-2.5,,8ABC12
+15,2023-03-01T19:30:00,Alert,Signal Loss,,,Android G6,,,,,,,8ABC12
+16,2023-03-0,EGV,,,,Android G6,130,,,,,1900,8ABC12
+`
+
+func TestClarity(t *testing.T) {
+	store := setupStore(t)
+	opts := Options{Location: time.UTC, DryRun: true}
+
+	report, err := Clarity(store, strings.NewReader(clarityExport), "p1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.Readings != 2 || report.Treatments != 7 || report.Alarms != 1 || report.Skipped != 4 || report.Rejected != 2 || report.Rejections[0].Line != 8 || report.Rejections[1].Line != 17 {
+		t.Fatalf("unexpected dry run report %+v", report)
+	}
+	if cgms, err := store.LoadCGMInterval("p1", time.Time{}, time.Now(), 0); err != nil || len(cgms) != 0 {
+		t.Fatalf("expected dry run to store nothing, got %v, %v", cgms, err)
+	}
+
+	opts.DryRun = false
+	report, err = Clarity(store, strings.NewReader(clarityExport), "p1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DryRun || report.Readings != 2 || report.Treatments != 7 || report.Alarms != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	cgms, err := store.LoadCGMInterval("p1", time.Time{}, time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cgms) != 2 {
+		t.Fatalf("expected 2 readings, got %v", len(cgms))
+	}
+	if got := cgms[0]; got.MgPerDl != 120 || got.Trend != glucose.TrendFortyFiveUp || got.SensorSerial != "8ABC12" || got.Device != "Dexcom G6 Mobile App" || got.Source != ClaritySource || !got.Timestamp.Equal(time.Date(2023, 3, 1, 8, 0, 12, 0, time.UTC)) {
+		t.Errorf("unexpected reading %+v", got)
+	}
+	if got := cgms[1]; got.MgPerDl != clLowMgPerDl || !got.IsLow {
+		t.Errorf("expected a low reading, got %+v", got)
+	}
+	treatments, err := store.LoadTreatments("p1", time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	insulin := map[string]float64{}
+	for _, tr := range treatments {
+		insulin[tr.EventType] += tr.Insulin
+	}
+	if insulin[EventCorrection] != 4.5 || insulin[EventLongActing] != 12 {
+		t.Errorf("unexpected insulin %v", insulin)
+	}
+	alarms, err := store.LoadAlarmEvents("p1", time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms) != 1 || alarms[0].Kind != datastore.AlarmKindUrgentLow || alarms[0].MgPerDl != 54 || alarms[0].Trend != glucose.TrendSingleDown || !alarms[0].Timestamp.Equal(time.Date(2023, 3, 1, 19, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected alarm events %+v", alarms)
+	}
+
+	// a reading of another value stored for the same minute is a conflict
+	if _, err := store.SaveCGM(datastore.CGMEntry{PatientID: "p1", Timestamp: time.Date(2023, 3, 1, 8, 10, 30, 0, time.UTC), MgPerDl: 130}); err != nil {
+		t.Fatal(err)
+	}
+	export := strings.Replace(clarityExport, "Android G6,abc", "Android G6,125", 1)
+	report, err = Clarity(store, strings.NewReader(export), "p1", Options{Location: time.UTC, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Readings != 0 || report.Treatments != 0 || report.Alarms != 0 || report.Conflicted != 1 || report.Conflicts[0].Line != 8 || report.Conflicts[0].Stored.MgPerDl != 130 {
+		t.Errorf("expected a conflict, got %+v", report)
+	}
+}
@@ -0,0 +1,432 @@
+// Package importer imports the history of glucose readings and treatments from the CSV files
+// exported by other diabetes services.
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+// MaxListed is the number of rejected records and conflicts described in a report.
+const MaxListed = 100
+
+// Event types of imported treatments, in the names Nightscout uses.
+const (
+	EventBGCheck        = "BG Check"
+	EventCorrection     = "Correction Bolus"
+	EventCarbCorrection = "Carb Correction"
+	EventExercise       = "Exercise"
+	EventNote           = "Note"
+	// EventLongActing is an injection of long-acting insulin, Nightscout has no name of its own
+	EventLongActing = "Long-Acting Insulin"
+)
+
+// ErrUnknownPatient is returned when importing for a patient OpenT1D does not follow. Patients are
+// added by the sources, such as LibreLinkUp, Dexcom Share and Nightscout, an import can not add one.
+var ErrUnknownPatient = errors.New("patient is not followed by OpenT1D")
+
+// Options changes how a file is imported.
+type Options struct {
+	// Location is the time zone of the local timestamps in the file, time.Local if nil
+	Location *time.Location
+	// DryRun makes the import report what it would store without storing anything
+	DryRun bool
+}
+
+func (o Options) location() *time.Location {
+	if o.Location == nil {
+		return time.Local
+	}
+	return o.Location
+}
+
+// Report tells what an import did.
+type Report struct {
+	// DryRun is true if nothing was stored, the report tells what the import would have done
+	DryRun bool
+	// Readings, Treatments and Alarms are the number of new readings, treatments and alarm
+	// events stored
+	Readings   int
+	Treatments int
+	Alarms     int
+	// Skipped is the number of records that were already stored or are of a kind OpenT1D does
+	// not keep, such as ketone readings
+	Skipped int
+	// Conflicted is the number of skipped readings made within the same minute as a stored
+	// reading of another value, the first MaxListed are described in Conflicts
+	Conflicted int
+	Conflicts  []Conflict
+	// Rejected is the number of records that could not be parsed, the first MaxListed are
+	// described in Rejections
+	Rejected   int
+	Rejections []Rejection
+}
+
+// Rejection is a record that could not be parsed.
+type Rejection struct {
+	// Line is the line of the file the record starts on
+	Line   int
+	Reason string
+}
+
+// Conflict is a reading that was skipped since another value is stored for the same minute.
+type Conflict struct {
+	// Line is the line of the file the record starts on
+	Line    int
+	Reading datastore.CGMEntry
+	Stored  datastore.CGMEntry
+}
+
+func newReport(opts Options) Report {
+	return Report{DryRun: opts.DryRun, Conflicts: []Conflict{}, Rejections: []Rejection{}}
+}
+
+func (r *Report) reject(line int, format string, args ...any) {
+	r.Rejected++
+	if len(r.Rejections) < MaxListed {
+		r.Rejections = append(r.Rejections, Rejection{Line: line, Reason: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (r *Report) conflict(line int, reading, stored datastore.CGMEntry) {
+	r.Conflicted++
+	if len(r.Conflicts) < MaxListed {
+		r.Conflicts = append(r.Conflicts, Conflict{Line: line, Reading: reading, Stored: stored})
+	}
+}
+
+// reading is a parsed reading and the line of the file it is on.
+type reading struct {
+	line int
+	cgm  datastore.CGMEntry
+}
+
+// records is what an export is parsed into before it is stored.
+type records struct {
+	readings   []reading
+	treatments []datastore.Treatment
+	alarms     []datastore.AlarmEvent
+}
+
+// checkPatient returns ErrUnknownPatient if the patient is not stored.
+func checkPatient(db datastore.Store, patientID string) error {
+	patients, err := db.Patients()
+	if err != nil {
+		return fmt.Errorf("could not load patients from datastore: %w", err)
+	}
+	for _, p := range patients {
+		if p.ID == patientID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: '%s'", ErrUnknownPatient, patientID)
+}
+
+// save stores the records not already stored and counts them in the report, nothing is stored
+// on a dry run.
+func save(db datastore.Store, patientID string, recs records, opts Options, report *Report) error {
+	readings, err := newReadings(db, patientID, recs.readings, report)
+	if err != nil {
+		return err
+	}
+	treatments, err := newTreatments(db, patientID, recs.treatments)
+	if err != nil {
+		return err
+	}
+	alarms, err := newAlarms(db, patientID, recs.alarms)
+	if err != nil {
+		return err
+	}
+	report.Skipped += len(recs.readings) - len(readings) + len(recs.treatments) - len(treatments) + len(recs.alarms) - len(alarms)
+	if opts.DryRun {
+		report.Readings += len(readings)
+		report.Treatments += len(treatments)
+		report.Alarms += len(alarms)
+		return nil
+	}
+
+	saved, err := db.SaveCGM(readings...)
+	if err != nil {
+		return fmt.Errorf("could not save CGM data to datastore: %w", err)
+	}
+	report.Readings += len(saved)
+	report.Skipped += len(readings) - len(saved)
+	savedTreatments, err := db.SaveTreatments(treatments...)
+	if err != nil {
+		return fmt.Errorf("could not save treatments to datastore: %w", err)
+	}
+	report.Treatments += len(savedTreatments)
+	report.Skipped += len(treatments) - len(savedTreatments)
+	savedAlarms, err := db.SaveAlarmEvents(alarms...)
+	if err != nil {
+		return fmt.Errorf("could not save alarm events to datastore: %w", err)
+	}
+	report.Alarms += len(savedAlarms)
+	report.Skipped += len(alarms) - len(savedAlarms)
+	return nil
+}
+
+// newReadings returns the readings that are not already stored. Exports only give the minute of
+// a reading, a reading within the same minute as a stored one of the same measurement type is a
+// duplicate and a conflict if the values differ.
+func newReadings(db datastore.Store, patientID string, readings []reading, report *Report) ([]datastore.CGMEntry, error) {
+	if len(readings) == 0 {
+		return []datastore.CGMEntry{}, nil
+	}
+	from, to := readings[0].cgm.Timestamp, readings[0].cgm.Timestamp
+	for _, r := range readings {
+		if r.cgm.Timestamp.Before(from) {
+			from = r.cgm.Timestamp
+		}
+		if r.cgm.Timestamp.After(to) {
+			to = r.cgm.Timestamp
+		}
+	}
+	stored, err := db.LoadCGMInterval(patientID, from.Truncate(time.Minute), to.Truncate(time.Minute).Add(time.Minute), 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not load CGM data from datastore: %w", err)
+	}
+	minutes := map[minuteKey]datastore.CGMEntry{}
+	for _, cgm := range stored {
+		minutes[newMinuteKey(cgm)] = cgm
+	}
+	sensors, err := db.Sensors(patientID)
+	if err != nil {
+		return nil, fmt.Errorf("could not load sensors from datastore: %w", err)
+	}
+	imported := map[minuteKey]bool{}
+	cgms := []datastore.CGMEntry{}
+	for _, r := range readings {
+		minute := newMinuteKey(r.cgm)
+		if s, ok := minutes[minute]; ok {
+			if s.MgPerDl != r.cgm.MgPerDl {
+				report.conflict(r.line, r.cgm, s)
+			}
+			continue
+		}
+		if imported[minute] {
+			continue
+		}
+		imported[minute] = true
+		if r.cgm.SensorSerial == "" {
+			r.cgm.SensorSerial = datastore.SensorAt(sensors, r.cgm.Timestamp)
+		}
+		cgms = append(cgms, r.cgm)
+	}
+	return cgms, nil
+}
+
+// minuteKey identifies readings of a measurement type within the same minute.
+type minuteKey struct {
+	minute int64
+	typ    datastore.MeasurementType
+}
+
+func newMinuteKey(cgm datastore.CGMEntry) minuteKey {
+	return minuteKey{minute: cgm.Timestamp.Truncate(time.Minute).Unix(), typ: cgm.Type}
+}
+
+// newTreatments returns the treatments whose identifiers are not already stored.
+func newTreatments(db datastore.Store, patientID string, treatments []datastore.Treatment) ([]datastore.Treatment, error) {
+	if len(treatments) == 0 {
+		return []datastore.Treatment{}, nil
+	}
+	from, to := treatments[0].Timestamp, treatments[0].Timestamp
+	for _, t := range treatments {
+		if t.Timestamp.Before(from) {
+			from = t.Timestamp
+		}
+		if t.Timestamp.After(to) {
+			to = t.Timestamp
+		}
+	}
+	stored, err := db.LoadTreatments(patientID, from, to.Add(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("could not load treatments from datastore: %w", err)
+	}
+	identifiers := map[string]bool{}
+	for _, t := range stored {
+		identifiers[t.Identifier] = true
+	}
+	result := []datastore.Treatment{}
+	for _, t := range treatments {
+		if !identifiers[t.Identifier] {
+			identifiers[t.Identifier] = true
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+// newAlarms returns the alarm events not already stored, an event is stored once per time and
+// kind.
+func newAlarms(db datastore.Store, patientID string, alarms []datastore.AlarmEvent) ([]datastore.AlarmEvent, error) {
+	if len(alarms) == 0 {
+		return []datastore.AlarmEvent{}, nil
+	}
+	from, to := alarms[0].Timestamp, alarms[0].Timestamp
+	for _, ae := range alarms {
+		if ae.Timestamp.Before(from) {
+			from = ae.Timestamp
+		}
+		if ae.Timestamp.After(to) {
+			to = ae.Timestamp
+		}
+	}
+	stored, err := db.LoadAlarmEvents(patientID, from, to.Add(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("could not load alarm events from datastore: %w", err)
+	}
+	key := func(ae datastore.AlarmEvent) string {
+		return fmt.Sprintf("%v:%v", ae.Timestamp.Unix(), ae.Kind)
+	}
+	seen := map[string]bool{}
+	for _, ae := range stored {
+		seen[key(ae)] = true
+	}
+	result := []datastore.AlarmEvent{}
+	for _, ae := range alarms {
+		if !seen[key(ae)] {
+			seen[key(ae)] = true
+			result = append(result, ae)
+		}
+	}
+	return result, nil
+}
+
+// newTreatment returns a treatment with a Nightscout document of the fields, the identifier is
+// made from the source, device, event type and time so the same export can be imported again.
+func newTreatment(patientID, source, device, eventType string, ts time.Time, utcOffset int, fields map[string]any) (datastore.Treatment, error) {
+	doc := map[string]any{
+		"eventType":  eventType,
+		"created_at": ts.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"utcOffset":  utcOffset / 60,
+		"enteredBy":  source,
+	}
+	for k, v := range fields {
+		if s, ok := v.(string); ok && s == "" {
+			continue
+		}
+		doc[k] = v
+	}
+	document, err := json.Marshal(doc)
+	if err != nil {
+		return datastore.Treatment{}, fmt.Errorf("error while marshaling treatment to JSON: %w", err)
+	}
+	t := datastore.Treatment{
+		PatientID:  patientID,
+		Identifier: strings.Join([]string{source, device, eventType, strconv.FormatInt(ts.Unix(), 10)}, ":"),
+		Timestamp:  ts.UTC(),
+		EventType:  eventType,
+		UTCOffset:  utcOffset,
+		Source:     source,
+		Document:   document,
+	}
+	if insulin, ok := fields["insulin"].(float64); ok {
+		t.Insulin = insulin
+	}
+	if carbs, ok := fields["carbs"].(float64); ok {
+		t.Carbs = carbs
+	}
+	return t, nil
+}
+
+// row is a record of a CSV file and the line it starts on.
+type row struct {
+	line   int
+	fields []string
+}
+
+// field returns the trimmed field at the index, or an empty string if the row is shorter.
+func (r row) field(i int) string {
+	if i < 0 || i >= len(r.fields) {
+		return ""
+	}
+	return strings.TrimSpace(r.fields[i])
+}
+
+// readRows reads all records of a CSV file, which is separated by commas, semicolons or tabs,
+// whichever the first line has most of.
+func readRows(r io.Reader) ([]row, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file: %w", err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	first, _, _ := bytes.Cut(data, []byte("\n"))
+	comma, most := ',', 0
+	for _, c := range []rune{',', ';', '\t'} {
+		if n := bytes.Count(first, []byte(string(c))); n > most {
+			comma, most = c, n
+		}
+	}
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.Comma = comma
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	rows := []row{}
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("file is not valid CSV: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		rows = append(rows, row{line: line, fields: fields})
+	}
+}
+
+// parseNumber parses a decimal number, with a decimal point or a decimal comma.
+func parseNumber(value string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(strings.TrimSpace(value), ",", ".", 1), 64)
+}
+
+// detectLayout returns the layout most of the values are in, the first of the layouts if more
+// than one matches as many. Values are local times in exports, ambiguous dates are told apart by
+// the values that are not, and values in none of the layouts are rejected when parsed.
+func detectLayout(values []string, layouts []string) (string, error) {
+	best, matched := "", 0
+	for _, layout := range layouts {
+		n := 0
+		for _, v := range values {
+			if _, err := time.Parse(layout, v); err == nil {
+				n++
+			}
+		}
+		if n > matched {
+			best, matched = layout, n
+		}
+	}
+	if len(values) == 0 {
+		return layouts[0], nil
+	}
+	if matched == 0 {
+		return "", fmt.Errorf("timestamps are not in a known format")
+	}
+	return best, nil
+}
+
+// parseGlucose parses a glucose value in mmol/L or mg/dL.
+func parseGlucose(value string, mmol bool) (datastore.Mmoll, int, error) {
+	v, err := parseNumber(value)
+	if err != nil || v <= 0 {
+		return 0, 0, fmt.Errorf("invalid glucose value %q", value)
+	}
+	if mmol {
+		return datastore.Mmoll(v), glucose.MmolToMg(float32(v)), nil
+	}
+	mg := int(v + 0.5)
+	return datastore.Mmoll(glucose.MgToMmol(mg)), mg, nil
+}
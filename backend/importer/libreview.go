@@ -0,0 +1,239 @@
+package importer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+)
+
+// LibreViewSource is the source of readings and treatments imported from LibreView.
+const LibreViewSource = "libreview"
+
+// Columns of the LibreView "Glucose Data" export. Headers are translated to the language of the
+// account but the columns keep their order, older exports lack the last three.
+const (
+	lvDevice = iota
+	lvSerial
+	lvTimestamp
+	lvRecordType
+	lvHistoric
+	lvScan
+	lvNonNumericRapid
+	lvRapid
+	lvNonNumericFood
+	lvCarbs
+	lvServings
+	lvNonNumericLong
+	lvLong
+	lvNotes
+	lvStrip
+	lvKetone
+	lvMealInsulin
+	lvCorrectionInsulin
+	lvUserChangeInsulin
+)
+
+// Record types of the LibreView export.
+const (
+	lvRecordHistoric = iota
+	lvRecordScan
+	lvRecordStrip
+	lvRecordKetone
+	lvRecordInsulin
+	lvRecordFood
+	lvRecordNotes
+)
+
+// lvLayouts are the device timestamp formats of the export in the supported languages, day first
+// is tried before month first since it is used by most of them.
+var lvLayouts = []string{
+	"1-2-2006 3:04 PM",
+	"1/2/2006 3:04 PM",
+	"2-1-2006 15:04",
+	"1-2-2006 15:04",
+	"2/1/2006 15:04",
+	"1/2/2006 15:04",
+	"2.1.2006 15:04",
+	"2006-1-2 15:04",
+	"2006/1/2 15:04",
+	"2006.1.2 15:04",
+}
+
+// LibreView imports a LibreView "Glucose Data" CSV export of the patient. Timestamps are in the
+// local time of the devices, which is assumed to be the location of the options.
+func LibreView(db datastore.Store, r io.Reader, patientID string, opts Options) (Report, error) {
+	report := newReport(opts)
+	if err := checkPatient(db, patientID); err != nil {
+		return report, err
+	}
+	rows, err := readRows(r)
+	if err != nil {
+		return report, err
+	}
+	header := -1
+	for i, row := range rows {
+		if len(row.fields) > lvStrip {
+			header = i
+			break
+		}
+	}
+	if header == -1 {
+		return report, fmt.Errorf("file is not a LibreView glucose data export")
+	}
+	var mmol bool
+	switch unit := strings.ToLower(rows[header].field(lvHistoric)); {
+	case strings.Contains(unit, "mmol"):
+		mmol = true
+	case strings.Contains(unit, "mg"):
+		mmol = false
+	default:
+		return report, fmt.Errorf("unknown glucose unit in header %q", rows[header].field(lvHistoric))
+	}
+
+	data := []row{}
+	timestamps := []string{}
+	for _, row := range rows[header+1:] {
+		if strings.TrimSpace(strings.Join(row.fields, "")) == "" {
+			continue
+		}
+		data = append(data, row)
+		if ts := row.field(lvTimestamp); ts != "" {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	layout, err := detectLayout(timestamps, lvLayouts)
+	if err != nil {
+		return report, err
+	}
+
+	recs := records{}
+	for _, row := range data {
+		ts, err := time.ParseInLocation(layout, row.field(lvTimestamp), opts.location())
+		if err != nil {
+			report.reject(row.line, "invalid timestamp %q", row.field(lvTimestamp))
+			continue
+		}
+		_, utcOffset := ts.Zone()
+		recordType, err := strconv.Atoi(row.field(lvRecordType))
+		if err != nil {
+			report.reject(row.line, "invalid record type %q", row.field(lvRecordType))
+			continue
+		}
+		treatment := func(eventType string, fields map[string]any) {
+			t, err := newTreatment(patientID, LibreViewSource, row.field(lvSerial), eventType, ts, utcOffset, fields)
+			if err != nil {
+				report.reject(row.line, "%v", err)
+				return
+			}
+			recs.treatments = append(recs.treatments, t)
+		}
+
+		switch recordType {
+		case lvRecordHistoric, lvRecordScan:
+			column, measurementType := lvHistoric, datastore.MeasurementTypeHistoric
+			if recordType == lvRecordScan {
+				column, measurementType = lvScan, datastore.MeasurementTypeCurrent
+			}
+			mmoll, mg, err := parseGlucose(row.field(column), mmol)
+			if err != nil {
+				report.reject(row.line, "%v", err)
+				continue
+			}
+			recs.readings = append(recs.readings, reading{line: row.line, cgm: datastore.CGMEntry{
+				PatientID: patientID,
+				Timestamp: ts.UTC(),
+				Mmoll:     mmoll,
+				MgPerDl:   mg,
+				Type:      measurementType,
+				UTCOffset: utcOffset,
+				Source:    LibreViewSource,
+				Device:    row.field(lvDevice),
+			}})
+		case lvRecordStrip:
+			_, mg, err := parseGlucose(row.field(lvStrip), mmol)
+			if err != nil {
+				report.reject(row.line, "%v", err)
+				continue
+			}
+			treatment(EventBGCheck, map[string]any{"glucose": float64(mg), "glucoseType": "Finger", "units": "mg/dl"})
+		case lvRecordInsulin:
+			rapid, long, err := lvInsulin(row)
+			if err != nil {
+				report.reject(row.line, "%v", err)
+				continue
+			}
+			if rapid == 0 && long == 0 {
+				report.reject(row.line, "no insulin dose")
+				continue
+			}
+			if rapid > 0 {
+				treatment(EventCorrection, map[string]any{"insulin": rapid, "notes": row.field(lvNonNumericRapid)})
+			}
+			if long > 0 {
+				treatment(EventLongActing, map[string]any{"insulin": long, "notes": row.field(lvNonNumericLong)})
+			}
+		case lvRecordFood:
+			if row.field(lvCarbs) == "" {
+				// food without grams of carbohydrates, such as servings, has nothing to count on
+				report.Skipped++
+				continue
+			}
+			carbs, err := parseNumber(row.field(lvCarbs))
+			if err != nil || carbs < 0 {
+				report.reject(row.line, "invalid carbohydrates %q", row.field(lvCarbs))
+				continue
+			}
+			treatment(EventCarbCorrection, map[string]any{"carbs": carbs, "notes": row.field(lvNonNumericFood)})
+		case lvRecordNotes:
+			if row.field(lvNotes) == "" {
+				report.Skipped++
+				continue
+			}
+			treatment(EventNote, map[string]any{"notes": row.field(lvNotes)})
+		default:
+			// ketones and record types added after this was written
+			report.Skipped++
+		}
+	}
+	if err := save(db, patientID, recs, opts, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// lvInsulin returns the rapid-acting and long-acting insulin units of an insulin record. Newer
+// exports split rapid-acting insulin into meal, correction and user changed doses.
+func lvInsulin(row row) (float64, float64, error) {
+	units := func(column int) (float64, error) {
+		if row.field(column) == "" {
+			return 0, nil
+		}
+		v, err := parseNumber(row.field(column))
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid insulin units %q", row.field(column))
+		}
+		return v, nil
+	}
+	rapid, err := units(lvRapid)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rapid == 0 {
+		for _, column := range []int{lvMealInsulin, lvCorrectionInsulin, lvUserChangeInsulin} {
+			v, err := units(column)
+			if err != nil {
+				return 0, 0, err
+			}
+			rapid += v
+		}
+	}
+	long, err := units(lvLong)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rapid, long, nil
+}
@@ -0,0 +1,183 @@
+package importer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+)
+
+func setupStore(t *testing.T) datastore.Store {
+	store, err := datastore.NewSQLiteStore("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+		t.Fatalf("failed to migrate store: %v", err)
+	}
+	if err := store.SavePatients(datastore.Patient{ID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+const libreViewUS = `Glucose Data,Generated on,04-02-2023 10:00 AM UTC,Generated by,Jane Doe
+Device,Serial Number,Device Timestamp,Record Type,Historic Glucose mg/dL,Scan Glucose mg/dL,Non-numeric Rapid-Acting Insulin,Rapid-Acting Insulin (units),Non-numeric Food,Carbohydrates (grams),Carbohydrates (servings),Non-numeric Long-Acting Insulin,Long-Acting Insulin Value (units),Notes,Strip Glucose mg/dL,Ketone mmol/L,Meal Insulin (units),Correction Insulin (units),User Change Insulin (units)
+FreeStyle LibreLink,ABC,04-01-2023 08:00 AM,0,100,,,,,,,,,,,,,,
+FreeStyle LibreLink,ABC,04-01-2023 08:15 AM,0,110,,,,,,,,,,,,,,
+FreeStyle LibreLink,ABC,04-01-2023 08:17 AM,1,,115,,,,,,,,,,,,,
+FreeStyle LibreLink,ABC,04-01-2023 08:20 AM,4,,,,,,,,,,,,,3,1,
+FreeStyle LibreLink,ABC,04-01-2023 08:20 AM,5,,,,,,45,,,,,,,,,
+FreeStyle LibreLink,ABC,04-01-2023 09:00 PM,4,,,,,,,,,14,,,,,,
+FreeStyle LibreLink,ABC,04-01-2023 09:05 PM,2,,,,,,,,,,,98,,,,
+FreeStyle LibreLink,ABC,04-01-2023 09:06 PM,3,,,,,,,,,,,,0.2,,,
+FreeStyle LibreLink,ABC,04-01-2023 09:10 PM,6,,,,,,,,,,Walk,,,,,
+FreeStyle LibreLink,ABC,04-01-2023 09:15 PM,0,,,,,,,,,,,,,,,
+FreeStyle LibreLink,ABC,04-01-2023 09:30 PM,x,,,,,,,,,,,,,,,
+FreeStyle LibreLink,ABC,04-01-20,0,120,,,,,,,,,,,,,,
+`
+
+func TestLibreView(t *testing.T) {
+	store := setupStore(t)
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a reading already fetched from LibreLinkUp within the same minute as the first historic one
+	stored := datastore.NewCGMEntry(time.Date(2023, 4, 1, 12, 0, 42, 0, time.UTC), 5.6)
+	stored.PatientID = "p1"
+	if _, err := store.SaveCGM(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LibreView(store, strings.NewReader(libreViewUS), "p2", Options{Location: loc}); !errors.Is(err, ErrUnknownPatient) {
+		t.Fatalf("expected %v, got %v", ErrUnknownPatient, err)
+	}
+
+	// a dry run reports the same as the import without storing anything
+	for _, dryRun := range []bool{true, false} {
+		report, err := LibreView(store, strings.NewReader(libreViewUS), "p1", Options{Location: loc, DryRun: dryRun})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.DryRun != dryRun || report.Readings != 2 || report.Treatments != 5 || report.Skipped != 2 || report.Rejected != 3 {
+			t.Fatalf("unexpected report %+v", report)
+		}
+		if report.Rejections[0].Line != 12 || report.Rejections[1].Line != 13 || report.Rejections[2].Line != 14 || report.Rejections[2].Reason != `invalid timestamp "04-01-20"` {
+			t.Errorf("unexpected rejections %+v", report.Rejections)
+		}
+		if report.Conflicted != 1 || report.Conflicts[0].Line != 3 || report.Conflicts[0].Reading.MgPerDl != 100 || report.Conflicts[0].Stored.MgPerDl != stored.MgPerDl {
+			t.Errorf("unexpected conflicts %+v", report.Conflicts)
+		}
+		if dryRun {
+			if cgms, err := store.LoadCGMInterval("p1", time.Time{}, time.Now(), 0); err != nil || len(cgms) != 1 {
+				t.Errorf("expected dry run to store nothing, got %v, %v", cgms, err)
+			}
+		}
+	}
+
+	cgms, err := store.LoadCGMInterval("p1", time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 4, 2, 0, 0, 0, 0, time.UTC), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cgms) != 3 {
+		t.Fatalf("expected 3 readings, got %v", len(cgms))
+	}
+	if got := cgms[1]; got.MgPerDl != 110 || got.Type != datastore.MeasurementTypeHistoric || got.UTCOffset != -4*3600 || got.Source != LibreViewSource || !got.Timestamp.Equal(time.Date(2023, 4, 1, 12, 15, 0, 0, time.UTC)) {
+		t.Errorf("unexpected historic reading %+v", got)
+	}
+	if got := cgms[2]; got.MgPerDl != 115 || got.Type != datastore.MeasurementTypeCurrent {
+		t.Errorf("unexpected scan reading %+v", got)
+	}
+
+	treatments, err := store.LoadTreatments("p1", time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 4, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(treatments) != 5 {
+		t.Fatalf("expected 5 treatments, got %v", len(treatments))
+	}
+	for _, tr := range treatments {
+		switch tr.EventType {
+		case EventCorrection:
+			if tr.Insulin != 4 {
+				t.Errorf("expected 4 units of rapid-acting insulin, got %v", tr.Insulin)
+			}
+		case EventCarbCorrection:
+			if tr.Carbs != 45 {
+				t.Errorf("expected 45 g of carbohydrates, got %v", tr.Carbs)
+			}
+		case EventLongActing:
+			if tr.Insulin != 14 {
+				t.Errorf("expected 14 units of long-acting insulin, got %v", tr.Insulin)
+			}
+		}
+	}
+
+	// importing the same file again adds nothing
+	report, err := LibreView(store, strings.NewReader(libreViewUS), "p1", Options{Location: loc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Readings != 0 || report.Treatments != 0 || report.Skipped != 9 {
+		t.Errorf("expected all records to be skipped, got %+v", report)
+	}
+}
+
+func TestLibreViewSameMinute(t *testing.T) {
+	store := setupStore(t)
+	// a current reading already fetched from LibreLinkUp within the same minute as the historic row
+	stored := datastore.NewCGMEntry(time.Date(2023, 4, 1, 8, 0, 30, 0, time.UTC), 5.4)
+	stored.PatientID = "p1"
+	stored.Type = datastore.MeasurementTypeCurrent
+	if _, err := store.SaveCGM(stored); err != nil {
+		t.Fatal(err)
+	}
+	header := strings.SplitAfterN(libreViewUS, "\n", 3)
+	csv := header[0] + header[1] +
+		"FreeStyle LibreLink,ABC,04-01-2023 08:00 AM,0,100,,,,,,,,,,,,,,\n" +
+		"FreeStyle LibreLink,ABC,04-01-2023 08:05 AM,0,104,,,,,,,,,,,,,,\n" +
+		"FreeStyle LibreLink,ABC,04-01-2023 08:05 AM,1,,106,,,,,,,,,,,,,\n"
+	report, err := LibreView(store, strings.NewReader(csv), "p1", Options{Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the historic and scan rows are kept apart from each other and from the stored reading
+	if report.Readings != 3 || report.Skipped != 0 || report.Conflicted != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, typ := range []datastore.MeasurementType{datastore.MeasurementTypeHistoric, datastore.MeasurementTypeCurrent} {
+		cgms, err := store.LoadCGMInterval("p1", time.Date(2023, 4, 1, 8, 0, 0, 0, time.UTC), time.Date(2023, 4, 1, 8, 10, 0, 0, time.UTC), 0, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cgms) != 2 {
+			t.Errorf("expected 2 readings of type %v, got %v", typ, cgms)
+		}
+	}
+}
+
+func TestLibreViewLocalized(t *testing.T) {
+	store := setupStore(t)
+	csv := "Glukosedaten;Erstellt am;13.01.2023 10:00 UTC;Erstellt von;Max Mustermann\n" +
+		"Gerät;Seriennummer;Gerätezeitstempel;Aufzeichnungstyp;Glukosewert-Verlauf mmol/L;Glukose-Scan mmol/L;Nicht numerisches schnellwirkendes Insulin;Schnell wirkendes Insulin (Einheiten);Nicht numerische Nahrungsdaten;Kohlenhydrate (Gramm);Kohlenhydrate (Portionen);Nicht numerisches Depotinsulin;Depotinsulin (Einheiten);Notizen;Glukose-Teststreifen mmol/L;Keton mmol/L\n" +
+		"FreeStyle Libre 3;XYZ;12-01-2023 14:00;0;5,6;;;;;;;;;;;\n" +
+		"FreeStyle Libre 3;XYZ;13-01-2023 14:15;0;\"6,1\";;;;;;;;;;;\n"
+	report, err := LibreView(store, strings.NewReader(csv), "p1", Options{Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Readings != 2 || report.Rejected != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	cgms, err := store.LoadCGMInterval("p1", time.Date(2023, 1, 12, 0, 0, 0, 0, time.UTC), time.Date(2023, 1, 14, 0, 0, 0, 0, time.UTC), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cgms) != 2 || cgms[0].Mmoll != 5.6 || cgms[1].Mmoll != 6.1 || !cgms[1].Timestamp.Equal(time.Date(2023, 1, 13, 14, 15, 0, 0, time.UTC)) {
+		t.Errorf("unexpected readings %v", cgms)
+	}
+}
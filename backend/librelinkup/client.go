@@ -0,0 +1,323 @@
+package librelinkup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the time limit for requests made by a client created without WithTimeout
+	// or WithHTTPClient
+	DefaultTimeout = 30 * time.Second
+
+	loginPath       = "/llu/auth/login"
+	continuePath    = "/auth/continue/"
+	connectionsPath = "/llu/connections"
+)
+
+// Client makes requests to the LibreLinkUp API. It is safe for concurrent use.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	headers    http.Header
+	archive    func(Payload)
+}
+
+// Option configures a Client.
+type Option func(*Client) error
+
+// WithHTTPClient makes the client use the given HTTP client for all requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) error {
+		c.httpClient = hc
+		return nil
+	}
+}
+
+// WithTimeout sets the time limit for each request, zero means no limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) error {
+		hc := *c.httpClient
+		hc.Timeout = timeout
+		c.httpClient = &hc
+		return nil
+	}
+}
+
+// WithBaseURL sends all requests to the given URL instead of the region's LibreLinkUp host.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) error {
+		u, err := url.Parse(baseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("base URL '%s' is not a valid absolute URL", baseURL)
+		}
+		c.baseURL = strings.TrimSuffix(u.String(), "/")
+		return nil
+	}
+}
+
+// WithArchive passes the response of every data request, such as connections, graph and logbook,
+// to the archive function before it is parsed. Login responses are never archived since they
+// identify the account. The function is called on the requesting goroutine and should return
+// quickly.
+func WithArchive(archive func(Payload)) Option {
+	return func(c *Client) error {
+		c.archive = archive
+		return nil
+	}
+}
+
+// WithHeader adds a header to all requests, replacing any default value of the header.
+func WithHeader(key, value string) Option {
+	return func(c *Client) error {
+		c.headers.Set(key, value)
+		return nil
+	}
+}
+
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+		headers:    linkupHeaders.Clone(),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// url returns the URL of the path at the endpoint.
+func (c *Client) url(endpoint Endpoint, path string) string {
+	if c.baseURL != "" {
+		return c.baseURL + path
+	}
+	return endpoint.BaseURL() + path
+}
+
+func (c *Client) callLogin(ctx context.Context, email, password string, endpoint Endpoint) (LoginResponse, error) {
+	type Credentials struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	byteCredentials, err := json.Marshal(Credentials{Email: email, Password: password})
+	if err != nil {
+		return LoginResponse{}, fmt.Errorf("error marshaling credentials to JSON: %w", err)
+	}
+
+	loginURL := c.url(endpoint, loginPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginURL, bytes.NewBuffer(byteCredentials))
+	if err != nil {
+		return LoginResponse{}, fmt.Errorf("error creating request to '%s': %w", loginURL, err)
+	}
+
+	var lr LoginResponse
+	if err := c.doRequest(req, &Ticket{}, &lr); err != nil {
+		return LoginResponse{}, err
+	}
+	return lr, loginError(lr, email, endpoint)
+}
+
+// loginError returns the error of a login response, if any.
+func loginError(lr LoginResponse, email string, endpoint Endpoint) error {
+	switch {
+	case lr.Status == 0:
+		return nil
+	case lr.Status == 2:
+		return ErrLoginFailed
+	case lr.Status == statusStepRequired && lr.Data.Step != nil:
+		ticket := lr.Data.AuthTicket
+		ticket.Username = email
+		ticket.Endpoint = endpoint
+		return &StepError{Step: *lr.Data.Step, Ticket: ticket}
+	}
+	return fmt.Errorf("error during login, status code %v, message: %s", lr.Status, lr.Error.Message)
+}
+
+func (c *Client) Login(ctx context.Context, email, password string, endpoint Endpoint) (*Ticket, error) {
+	resp, err := c.callLogin(ctx, email, password, endpoint)
+	if err != nil {
+		return &Ticket{}, err
+	}
+
+	if resp.Data.Redirect {
+		return &Ticket{}, ErrWrongRegionEndpoint
+	}
+
+	t := resp.Data.AuthTicket
+	t.Username = email
+	t.Endpoint = endpoint
+	return &t, nil
+}
+
+// FindEndpoint returns the endpoint of the account's region. An account that must complete a
+// step before signing in belongs to the default region, since it was not redirected.
+func (c *Client) FindEndpoint(ctx context.Context, email, password string) (Endpoint, error) {
+	resp, err := c.callLogin(ctx, email, password, EndpointDefault)
+	if errors.Is(err, ErrStepRequired) {
+		return EndpointDefault, nil
+	}
+	if err != nil {
+		return EndpointDefault, err
+	}
+
+	if resp.Data.Redirect {
+		e, found := EndpointByRegion(resp.Data.Region)
+		if !found {
+			return Endpoint{}, fmt.Errorf("endpoint with region '%s' could not be found", resp.Data.Region)
+		}
+		return e, nil
+	}
+
+	return EndpointDefault, nil
+}
+
+// CompleteStep completes the step using the limited ticket of the StepError, such as accepting
+// new terms of use, and returns the auth ticket. A StepError is returned if LibreLinkUp requires
+// another step before signing in.
+func (c *Client) CompleteStep(ctx context.Context, ticket *Ticket, step Step) (*Ticket, error) {
+	if !step.Acceptable() {
+		return nil, fmt.Errorf("step '%s' can not be completed through the API, complete it in the LibreLinkUp app", step.Type)
+	}
+	stepURL := c.url(ticket.Endpoint, continuePath+url.PathEscape(step.Type))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stepURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request to '%s': %w", stepURL, err)
+	}
+
+	var lr LoginResponse
+	if err := c.doRequest(req, ticket, &lr); err != nil {
+		return nil, err
+	}
+	if err := loginError(lr, ticket.Username, ticket.Endpoint); err != nil {
+		return nil, err
+	}
+
+	t := lr.Data.AuthTicket
+	t.Username = ticket.Username
+	t.Endpoint = ticket.Endpoint
+	return &t, nil
+}
+
+func (c *Client) Connections(ctx context.Context, ticket *Ticket) ([]Connection, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(ticket.Endpoint, connectionsPath), nil)
+	if err != nil {
+		return []Connection{}, err
+	}
+
+	var cr ConnectionsResponse
+	if err := c.doRequest(req, ticket, &cr); err != nil {
+		return []Connection{}, err
+	}
+	if cr.Status != 0 {
+		return []Connection{}, fmt.Errorf("error occured, status code %v, message: %s", cr.Status, cr.Error.Message)
+	}
+
+	ticket.Token = cr.Ticket.Token
+	ticket.Expires = cr.Ticket.Expires
+	ticket.Duration = cr.Ticket.Duration
+
+	return cr.Data, nil
+}
+
+func (c *Client) Graph(ctx context.Context, ticket *Ticket, patientID string) (Graph, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(ticket.Endpoint, connectionsPath+"/"+url.PathEscape(patientID)+"/graph"), nil)
+	if err != nil {
+		return Graph{}, err
+	}
+
+	var gr GraphResponse
+	if err := c.doRequest(req, ticket, &gr); err != nil {
+		return Graph{}, err
+	}
+	if gr.Status != 0 {
+		return Graph{}, fmt.Errorf("error occured, status code %v, message: %s", gr.Status, gr.Error.Message)
+	}
+
+	ticket.Token = gr.AuthTicket.Token
+	ticket.Expires = gr.AuthTicket.Expires
+	ticket.Duration = gr.AuthTicket.Duration
+
+	return gr.Data, nil
+}
+
+// Logbook returns the patient's scanned readings and alarms from about the last two weeks.
+func (c *Client) Logbook(ctx context.Context, ticket *Ticket, patientID string) ([]LogbookEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(ticket.Endpoint, connectionsPath+"/"+url.PathEscape(patientID)+"/logbook"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var lr LogbookResponse
+	if err := c.doRequest(req, ticket, &lr); err != nil {
+		return nil, err
+	}
+	if lr.Status != 0 {
+		return nil, fmt.Errorf("error occured, status code %v, message: %s", lr.Status, lr.Error.Message)
+	}
+
+	ticket.Token = lr.AuthTicket.Token
+	ticket.Expires = lr.AuthTicket.Expires
+	ticket.Duration = lr.AuthTicket.Duration
+
+	if lr.Data == nil {
+		return []LogbookEntry{}, nil
+	}
+	return lr.Data, nil
+}
+
+func (c *Client) doRequest(req *http.Request, ticket *Ticket, response any) error {
+	req.Header = c.headers.Clone()
+	if ticket.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+ticket.Token)
+	}
+
+	if isDebug() {
+		printRequest(req)
+	}
+
+	requested := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w, error executing request to '%s': %w", ErrNetwork, req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newStatusError(resp)
+	}
+	result, err := bodyToString(resp)
+	if err != nil {
+		return fmt.Errorf("%w, error while reading response: %w", ErrNetwork, err)
+	}
+	if c.archive != nil && req.Method == http.MethodGet {
+		// archive before parsing, responses we fail to parse are the ones worth keeping
+		c.archive(Payload{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Requested:  requested.UTC(),
+			Duration:   time.Since(requested),
+			Body:       []byte(result),
+		})
+	}
+
+	if err := json.Unmarshal([]byte(result), response); err != nil {
+		return fmt.Errorf("error while unmarshaling response from JSON: %w", err)
+	}
+
+	if isDebug() {
+		printResponse(resp, result)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package librelinkup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientBaseURLAndHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/llu/connections/p1/graph" {
+			t.Errorf("unexpected path '%s'", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("expected bearer token, got '%s'", auth)
+		}
+		if v := r.Header.Get("X-Test"); v != "yes" {
+			t.Errorf("expected custom header, got '%s'", v)
+		}
+		if v := r.Header.Get("Product"); v != libreLinkUpProduct {
+			t.Errorf("expected default Product header, got '%s'", v)
+		}
+		w.Write([]byte(`{"status":0,"data":{"graphData":[{"Value":5.5}]},"ticket":{"token":"new","expires":1,"duration":2}}`))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(WithBaseURL(srv.URL+"/"), WithHeader("X-Test", "yes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := &Ticket{Token: "token", Endpoint: EndpointDefault}
+	graph, err := c.Graph(context.Background(), ticket, "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.GraphData) != 1 {
+		t.Errorf("expected 1 measurement, got %v", len(graph.GraphData))
+	}
+	if ticket.Token != "new" {
+		t.Errorf("expected ticket to be refreshed, got '%s'", ticket.Token)
+	}
+	if _, found := linkupHeaders["X-Test"]; found {
+		t.Error("custom header leaked into the default headers")
+	}
+	if _, found := linkupHeaders["Authorization"]; found {
+		t.Error("authorization header leaked into the default headers")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Connections(ctx, &Ticket{Token: "token"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	c, err = NewClient(WithBaseURL(srv.URL), WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Connections(context.Background(), &Ticket{Token: "token"}); !errors.Is(err, ErrNetwork) {
+		t.Errorf("expected %v, got %v", ErrNetwork, err)
+	}
+
+	if _, err := NewClient(WithBaseURL("not a url")); err == nil {
+		t.Error("expected error for invalid base URL")
+	}
+}
+
+func TestClientArchive(t *testing.T) {
+	body := `{"status":0,"data":{"graphData":"not a list"}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	archived := []Payload{}
+	c, err := NewClient(WithBaseURL(srv.URL), WithArchive(func(p Payload) { archived = append(archived, p) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// login responses identify the account and are never archived
+	c.Login(context.Background(), "foo@bar.com", "secret", EndpointDefault)
+	// the response is archived even though it can not be parsed
+	if _, err := c.Graph(context.Background(), &Ticket{Token: "token"}, "p 1"); err == nil {
+		t.Fatal("expected graph to fail")
+	}
+	if len(archived) != 1 {
+		t.Fatalf("expected only the graph response to be archived, got %v payloads", len(archived))
+	}
+	if p := archived[0]; string(p.Body) != body || p.Method != http.MethodGet || p.StatusCode != http.StatusOK || p.Requested.IsZero() {
+		t.Errorf("unexpected payload %+v", p)
+	}
+	kind, patientID, err := ParsePayloadURL(archived[0].URL)
+	if err != nil || kind != PayloadGraph || patientID != "p 1" {
+		t.Errorf("expected graph payload of 'p 1', got '%s', '%s', %v", kind, patientID, err)
+	}
+	if kind, _, err := ParsePayloadURL(srv.URL + connectionsPath); err != nil || kind != PayloadConnections {
+		t.Errorf("expected connections payload, got '%s', %v", kind, err)
+	}
+	if _, _, err := ParsePayloadURL(srv.URL + loginPath); err == nil {
+		t.Error("expected login URL not to be a data request")
+	}
+}
@@ -44,14 +44,7 @@ func EndpointByRegion(region string) (Endpoint, bool) {
 	return Endpoint{}, false
 }
 
-func (e Endpoint) LoginURL() string {
-	return fmt.Sprintf("https://%s/llu/auth/login", e.Hostname)
-}
-
-func (e Endpoint) ConnectionsURL() string {
-	return fmt.Sprintf("https://%s/llu/connections/", e.Hostname)
-}
-
-func (e Endpoint) GraphURL(patientID string) string {
-	return fmt.Sprintf("https://%s/llu/connections/%s/graph", e.Hostname, patientID)
+// BaseURL returns the URL requests to the endpoint are relative to.
+func (e Endpoint) BaseURL() string {
+	return fmt.Sprintf("https://%s", e.Hostname)
 }
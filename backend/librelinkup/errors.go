@@ -0,0 +1,89 @@
+package librelinkup
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("LibreLinkUp rejected the auth ticket")
+	ErrRateLimited  = errors.New("too many requests to LibreLinkUp")
+	ErrMaintenance  = errors.New("LibreLinkUp is unavailable, possibly down for maintenance")
+	ErrNetwork      = errors.New("could not reach LibreLinkUp")
+	ErrStepRequired = errors.New("LibreLinkUp requires a step to be completed before signing in")
+)
+
+// StepError is returned when LibreLinkUp requires the user to complete a step, such as accepting
+// new terms of use, before signing in. It wraps ErrStepRequired.
+type StepError struct {
+	Step Step
+	// Ticket is a limited ticket, only valid for completing the step
+	Ticket Ticket
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%v: '%s'", ErrStepRequired, e.Step.Type)
+}
+
+func (e *StepError) Unwrap() error {
+	return ErrStepRequired
+}
+
+// StatusError is returned when LibreLinkUp responds with an unexpected HTTP status. It wraps
+// ErrUnauthorized, ErrRateLimited or ErrMaintenance when the status maps to one of them.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is how long the server asked us to wait before retrying, zero if not given
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("server responded with status %v: %s: %v", e.StatusCode, e.Status, e.Err)
+	}
+	return fmt.Sprintf("server responded with status %v: %s", e.StatusCode, e.Status)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// newStatusError creates a StatusError from a response with an unexpected status.
+func newStatusError(resp *http.Response) *StatusError {
+	e := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		e.Err = ErrUnauthorized
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Err = ErrRateLimited
+	case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout:
+		e.Err = ErrMaintenance
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// IsTransient returns true if the error is likely to go away if the request is retried later.
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrNetwork) || errors.Is(err, ErrRateLimited) || errors.Is(err, ErrMaintenance) {
+		return true
+	}
+	var se *StatusError
+	return errors.As(err, &se) && se.StatusCode >= 500
+}
+
+// RetryAfter returns how long LibreLinkUp asked us to wait before retrying, zero if it did not.
+func RetryAfter(err error) time.Duration {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.RetryAfter
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package librelinkup
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStatusError(t *testing.T) {
+	type TestCase struct {
+		status     int
+		retryAfter string
+		expected   error
+		transient  bool
+	}
+	tests := []TestCase{
+		{http.StatusUnauthorized, "", ErrUnauthorized, false},
+		{http.StatusTooManyRequests, "120", ErrRateLimited, true},
+		{http.StatusServiceUnavailable, "", ErrMaintenance, true},
+		{http.StatusInternalServerError, "", nil, true},
+		{http.StatusNotFound, "", nil, false},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Status: http.StatusText(test.status), Header: http.Header{}}
+		resp.Header.Set("Retry-After", test.retryAfter)
+		err := fmt.Errorf("wrapped: %w", newStatusError(resp))
+		if test.expected != nil && !errors.Is(err, test.expected) {
+			t.Errorf("expected status %v to be %v, got %v", test.status, test.expected, err)
+		}
+		if IsTransient(err) != test.transient {
+			t.Errorf("expected status %v to be transient %v", test.status, test.transient)
+		}
+		if test.retryAfter != "" && RetryAfter(err) != 120*time.Second {
+			t.Errorf("expected retry after 120s, got %v", RetryAfter(err))
+		}
+	}
+	if !IsTransient(fmt.Errorf("%w: connection refused", ErrNetwork)) {
+		t.Error("expected network errors to be transient")
+	}
+}
@@ -1,9 +1,7 @@
 package librelinkup
 
 import (
-	"bytes"
 	"compress/gzip"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -21,7 +19,7 @@ const (
 var (
 	ErrLoginFailed         = errors.New("could not login to LibreLinkUp, make sure the username and password is correct")
 	ErrWrongRegionEndpoint = errors.New("user called wrong region")
-	linkupHeaders          = map[string][]string{
+	linkupHeaders          = http.Header{
 		"User-Agent":      {"LibreLink"},
 		"Content-Type":    {"application/json"},
 		"Version":         {libreLinkUpVersion},
@@ -41,6 +39,16 @@ type Ticket struct {
 	Endpoint Endpoint `json:"-"`
 }
 
+// ExpiresAt returns the time the ticket expires.
+func (ticket *Ticket) ExpiresAt() time.Time {
+	return time.Unix(ticket.Expires, 0)
+}
+
+// ExpiresWithin returns true if the ticket has expired or expires within the given duration.
+func (ticket *Ticket) ExpiresWithin(d time.Duration) bool {
+	return time.Until(ticket.ExpiresAt()) < d
+}
+
 type LibreLinkUpResponse struct {
 	Status int `json:"status"`
 	Error  struct {
@@ -57,9 +65,40 @@ type LoginResponse struct {
 		AuthTicket Ticket `json:"authTicket"`
 		Redirect   bool   `json:"redirect"`
 		Region     string `json:"region"`
+		// Step is set when the user must complete a step before signing in, the auth ticket is
+		// then only valid for completing the step
+		Step *Step `json:"step"`
 	} `json:"data"`
 }
 
+// statusStepRequired is the login status telling the user must complete a step, such as
+// accepting new terms of use, before signing in
+const statusStepRequired = 4
+
+// Types of the steps LibreLinkUp can require before signing in.
+const (
+	StepTermsOfUse    = "tou"
+	StepPrivacyPolicy = "pp"
+)
+
+// Step is an action LibreLinkUp requires the user to complete before signing in, usually
+// accepting a new version of the terms of use or the privacy policy.
+type Step struct {
+	Type          string `json:"type"`
+	ComponentName string `json:"componentName"`
+	Props         struct {
+		Reaccept bool   `json:"reaccept"`
+		TitleKey string `json:"titleKey"`
+		Type     string `json:"type"`
+	} `json:"props"`
+}
+
+// Acceptable returns true if the step is accepting a document, which can be done through the
+// API. Other steps, such as verifying the account, must be completed in the LibreLinkUp app.
+func (s Step) Acceptable() bool {
+	return s.Type == StepTermsOfUse || s.Type == StepPrivacyPolicy
+}
+
 type ConnectionsResponse struct {
 	LibreLinkUpResponse
 	Data   []Connection `json:"data"`
@@ -68,14 +107,55 @@ type ConnectionsResponse struct {
 
 type GraphResponse struct {
 	LibreLinkUpResponse
-	Data struct {
-		Connection    Connection           `json:"connection"`
-		ActiveSensors []ActiveSensor       `json:"activeSensors"`
-		GraphData     []GlucoseMeasurement `json:"graphData"`
-	} `json:"data"`
+	Data       Graph  `json:"data"`
 	AuthTicket Ticket `json:"ticket"`
 }
 
+type LogbookResponse struct {
+	LibreLinkUpResponse
+	Data       []LogbookEntry `json:"data"`
+	AuthTicket Ticket         `json:"ticket"`
+}
+
+// LogbookEntryType tells what a logbook entry records.
+type LogbookEntryType int
+
+const (
+	// LogbookScan is a reading the patient made by scanning the sensor
+	LogbookScan LogbookEntryType = 1
+	// LogbookAlarm is a high or low alarm that fired on the patient's phone
+	LogbookAlarm LogbookEntryType = 2
+)
+
+// AlarmType is the kind of alarm a logbook alarm entry records.
+type AlarmType int
+
+const (
+	AlarmLow AlarmType = iota
+	AlarmHigh
+	// AlarmFixedLow is the urgent low alarm at 55 mg/dL, which can not be turned off
+	AlarmFixedLow
+)
+
+// LogbookEntry is a scanned reading or an alarm, as shown in the logbook of the LibreLinkUp app.
+type LogbookEntry struct {
+	GlucoseMeasurement
+	// AlarmType is only set on alarm entries
+	AlarmType *AlarmType `json:"alarmType"`
+}
+
+// IsAlarm returns true if the entry records an alarm.
+func (e LogbookEntry) IsAlarm() bool {
+	return LogbookEntryType(e.Type) == LogbookAlarm || e.AlarmType != nil
+}
+
+// Graph is the patient's current state together with the measurements from about the last 12 hours.
+type Graph struct {
+	Connection    Connection           `json:"connection"`
+	ActiveSensors []ActiveSensor       `json:"activeSensors"`
+	GraphData     []GlucoseMeasurement `json:"graphData"`
+}
+
 type Connection struct {
 	ID                 string             `json:"id"`
 	PatientID          string             `json:"patientId"`
@@ -96,157 +176,38 @@ type GlucoseMeasurement struct {
 	Value            float64 `json:"Value"`
 	IsHigh           bool    `json:"isHigh"`
 	IsLow            bool    `json:"isLow"`
+	// TrendArrow is only set on the current measurement, 1 is falling quickly and 5 rising quickly
+	TrendArrow int `json:"TrendArrow"`
 }
 
 type ActiveSensor struct {
-	DeviceId       string    `json:"deviceId"`
-	SerialNumber   string    `json:"sn"`
-	ActivationTime time.Time `json:"a"`
+	Sensor Sensor `json:"sensor"`
 }
 
-func ToTime(libreTimestamp string) (time.Time, error) {
-	return time.Parse("1/2/2006 3:04:05 PM", libreTimestamp)
+type Sensor struct {
+	DeviceID     string `json:"deviceId"`
+	SerialNumber string `json:"sn"`
+	// Activated is the activation time in seconds since the Unix epoch
+	Activated int64 `json:"a"`
+	// WarmUp is the number of minutes the sensor needs after activation before it delivers readings
+	WarmUp      int `json:"w"`
+	ProductType int `json:"pt"`
 }
 
-func callLogin(email, password string, endpoint Endpoint) (LoginResponse, error) {
-	type Credentials struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-
-	byteCredentials, err := json.Marshal(Credentials{Email: email, Password: password})
-	if err != nil {
-		return LoginResponse{}, fmt.Errorf("error marshaling credentials to JSON: %w", err)
-	}
-
-	req, err := http.NewRequest(http.MethodPost, endpoint.LoginURL(), bytes.NewBuffer(byteCredentials))
-	if err != nil {
-		return LoginResponse{}, fmt.Errorf("error creating request to '%s': %w", endpoint.LoginURL(), err)
-	}
+// SensorLifetime is how long a FreeStyle Libre sensor lasts after it has been activated.
+const SensorLifetime = 14 * 24 * time.Hour
 
-	var lr LoginResponse
-	if err := doRequest(req, &Ticket{}, &lr); err != nil {
-		return LoginResponse{}, err
-	}
-	if lr.Status != 0 {
-		if lr.Status == 2 {
-			return LoginResponse{}, ErrLoginFailed
-		}
-		return LoginResponse{}, fmt.Errorf("error during login, status code %v, message: %s", lr.Status, lr.Error.Message)
-	}
-	return lr, nil
+func (s Sensor) ActivationTime() time.Time {
+	return time.Unix(s.Activated, 0).UTC()
 }
 
-func Login(email, password string, endpoint Endpoint) (*Ticket, error) {
-	resp, err := callLogin(email, password, endpoint)
-	if err != nil {
-		return &Ticket{}, err
-	}
-
-	if resp.Data.Redirect {
-		return &Ticket{}, ErrWrongRegionEndpoint
-	}
-
-	t := resp.Data.AuthTicket
-	t.Username = email
-	t.Endpoint = endpoint
-	return &t, nil
+// ExpectedEnd returns the time the sensor is expected to stop delivering readings.
+func (s Sensor) ExpectedEnd() time.Time {
+	return s.ActivationTime().Add(SensorLifetime)
 }
 
-func FindEndpoint(email, password string) (Endpoint, error) {
-	resp, err := callLogin(email, password, EndpointDefault)
-	if err != nil {
-		return EndpointDefault, err
-	}
-
-	if resp.Data.Redirect {
-		e, found := EndpointByRegion(resp.Data.Region)
-		if !found {
-			return Endpoint{}, fmt.Errorf("endpoint with region '%s' could not be found", resp.Data.Region)
-		}
-		return e, nil
-	}
-
-	return EndpointDefault, nil
-}
-
-func (ticket *Ticket) Connections() ([]Connection, error) {
-	req, err := http.NewRequest(http.MethodGet, ticket.Endpoint.ConnectionsURL(), nil)
-	if err != nil {
-		return []Connection{}, err
-	}
-
-	var cr ConnectionsResponse
-	if err := doRequest(req, ticket, &cr); err != nil {
-		return []Connection{}, err
-	}
-	if cr.Status != 0 {
-		return []Connection{}, fmt.Errorf("error occured, status code %v, message: %s", cr.Status, cr.Error.Message)
-	}
-
-	ticket.Token = cr.Ticket.Token
-	ticket.Expires = cr.Ticket.Expires
-	ticket.Duration = cr.Ticket.Duration
-
-	return cr.Data, nil
-}
-
-func (ticket *Ticket) Graph(patientID string) (Connection, []GlucoseMeasurement, error) {
-	req, err := http.NewRequest(http.MethodGet, ticket.Endpoint.GraphURL(patientID), nil)
-	if err != nil {
-		return Connection{}, []GlucoseMeasurement{}, err
-	}
-
-	var gr GraphResponse
-	if err := doRequest(req, ticket, &gr); err != nil {
-		return Connection{}, []GlucoseMeasurement{}, err
-	}
-	if gr.Status != 0 {
-		return Connection{}, []GlucoseMeasurement{}, fmt.Errorf("error occured, status code %v, message: %s", gr.Status, gr.Error.Message)
-	}
-
-	ticket.Token = gr.AuthTicket.Token
-	ticket.Expires = gr.AuthTicket.Expires
-	ticket.Duration = gr.AuthTicket.Duration
-
-	return gr.Data.Connection, gr.Data.GraphData, nil
-}
-
-func doRequest[T any](req *http.Request, ticket *Ticket, response T) error {
-	h := linkupHeaders
-	if ticket.Token != "" {
-		http.Header(h).Set("Authorization", "Bearer "+ticket.Token)
-	}
-	req.Header = h
-
-	if isDebug() {
-		printRequest(req)
-	}
-
-	client := http.DefaultClient
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("error executing request to '%s': %w", req.URL, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server responded with status %v: %s", resp.StatusCode, resp.Status)
-	}
-	result, err := bodyToString(resp)
-	if err != nil {
-		return fmt.Errorf("error while reading response: %w", err)
-	}
-
-	if err := json.Unmarshal([]byte(result), response); err != nil {
-		return fmt.Errorf("error while unmarshaling response from JSON: %w", err)
-	}
-
-	if isDebug() {
-		printResponse(resp, result)
-	}
-
-	return nil
+func ToTime(libreTimestamp string) (time.Time, error) {
+	return time.Parse("1/2/2006 3:04:05 PM", libreTimestamp)
 }
 
 func bodyToString(resp *http.Response) (string, error) {
@@ -1,6 +1,7 @@
 package librelinkup
 
 import (
+	"encoding/json"
 	"testing"
 	"time"
 )
@@ -39,3 +40,42 @@ func TestToTime(t *testing.T) {
 		}
 	}
 }
+
+func TestGraphResponseActiveSensors(t *testing.T) {
+	body := `{"status":0,"data":{"activeSensors":[{"sensor":{"deviceId":"d1","sn":"0M0008B8CM","a":1687856975,"w":60,"pt":4}}],"graphData":[]}}`
+	var gr GraphResponse
+	if err := json.Unmarshal([]byte(body), &gr); err != nil {
+		t.Fatal(err)
+	}
+	if len(gr.Data.ActiveSensors) != 1 {
+		t.Fatalf("expected 1 active sensor, got %v", len(gr.Data.ActiveSensors))
+	}
+	sensor := gr.Data.ActiveSensors[0].Sensor
+	if sensor.SerialNumber != "0M0008B8CM" || sensor.DeviceID != "d1" {
+		t.Errorf("unexpected sensor %+v", sensor)
+	}
+	expected := time.Date(2023, time.June, 27, 9, 9, 35, 0, time.UTC)
+	if sensor.ActivationTime() != expected {
+		t.Errorf("expected activation time %v, got %v", expected, sensor.ActivationTime())
+	}
+	if sensor.ExpectedEnd() != expected.Add(SensorLifetime) {
+		t.Errorf("expected end %v, got %v", expected.Add(SensorLifetime), sensor.ExpectedEnd())
+	}
+}
+
+func TestLogbookResponse(t *testing.T) {
+	body := `{"status":0,"data":[{"FactoryTimestamp":"6/20/2023 8:00:00 PM","type":2,"ValueInMgPerDl":241,"Value":13.4,"alarmType":1},{"FactoryTimestamp":"6/20/2023 9:00:00 PM","type":1,"ValueInMgPerDl":130,"Value":7.2}]}`
+	var lr LogbookResponse
+	if err := json.Unmarshal([]byte(body), &lr); err != nil {
+		t.Fatal(err)
+	}
+	if len(lr.Data) != 2 {
+		t.Fatalf("expected 2 logbook entries, got %v", len(lr.Data))
+	}
+	if !lr.Data[0].IsAlarm() || *lr.Data[0].AlarmType != AlarmHigh || lr.Data[0].ValueInMgPerDl != 241 {
+		t.Errorf("expected a high alarm, got %+v", lr.Data[0])
+	}
+	if lr.Data[1].IsAlarm() {
+		t.Errorf("expected a scanned reading, got %+v", lr.Data[1])
+	}
+}
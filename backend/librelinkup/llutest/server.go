@@ -0,0 +1,384 @@
+// Package llutest provides an in-process fake of the LibreLinkUp API for use in tests.
+package llutest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spagettikod/opent1d/librelinkup"
+)
+
+// Route identifies one of the emulated API calls.
+type Route string
+
+const (
+	RouteLogin       Route = "login"
+	RouteConnections Route = "connections"
+	RouteGraph       Route = "graph"
+	RouteLogbook     Route = "logbook"
+	RouteContinue    Route = "continue"
+)
+
+// DefaultTicketDuration is how long tickets issued by the server are valid, unless changed
+// with Server.TicketDuration.
+const DefaultTicketDuration = 180 * 24 * time.Hour
+
+// Account is a LibreLinkUp account known to the server.
+type Account struct {
+	Email    string
+	Password string
+	// Region the account belongs to, logins to other regions are redirected to it. Defaults to
+	// the region of librelinkup.EndpointDefault.
+	Region string
+	// Connections are the patients followed by the account
+	Connections []librelinkup.Connection
+	// Steps are the types of the steps, such as librelinkup.StepTermsOfUse, the user must
+	// complete before signing in, in order
+	Steps []string
+}
+
+// Failure is a scripted failure returned instead of the normal response.
+type Failure struct {
+	// StatusCode is the HTTP status of the response, defaults to 200
+	StatusCode int
+	// RetryAfter is sent in the Retry-After header if set
+	RetryAfter time.Duration
+	// Status is the LibreLinkUp status in the response body, only used when StatusCode is 200
+	Status int
+}
+
+// Server is a fake LibreLinkUp API. Requests are routed to a region by their Host header,
+// requests to hosts other than the LibreLinkUp endpoints, such as the server's own address,
+// are handled as if they were sent to the account's region.
+type Server struct {
+	*httptest.Server
+	// TicketDuration is how long issued tickets are valid
+	TicketDuration time.Duration
+
+	mu       sync.Mutex
+	accounts map[string]Account
+	graphs   map[string]librelinkup.Graph
+	logbooks map[string][]librelinkup.LogbookEntry
+	tokens   map[string]string
+	limited  map[string]string
+	failures map[Route][]Failure
+	requests map[Route]int
+}
+
+// NewServer starts a fake LibreLinkUp API, it is stopped when Close is called.
+func NewServer() *Server {
+	s := &Server{
+		TicketDuration: DefaultTicketDuration,
+		accounts:       map[string]Account{},
+		graphs:         map[string]librelinkup.Graph{},
+		logbooks:       map[string][]librelinkup.LogbookEntry{},
+		tokens:         map[string]string{},
+		limited:        map[string]string{},
+		failures:       map[Route][]Failure{},
+		requests:       map[Route]int{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns a LibreLinkUp client sending all requests to the server. Requests keep the
+// host of the region they were sent to, so region redirects work as against the real API.
+func (s *Server) Client(opts ...librelinkup.Option) *librelinkup.Client {
+	target, _ := url.Parse(s.URL)
+	hc := &http.Client{Transport: rewriteTransport{target: target, base: s.Server.Client().Transport}}
+	c, err := librelinkup.NewClient(append([]librelinkup.Option{librelinkup.WithHTTPClient(hc)}, opts...)...)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// AddAccount adds or replaces an account.
+func (s *Server) AddAccount(a Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.Region == "" {
+		a.Region = librelinkup.EndpointDefault.Region
+	}
+	s.accounts[a.Email] = a
+}
+
+// RequireSteps makes the account complete the steps before signing in again, as when Abbott
+// publishes new terms. Issued tokens stay valid like with the real API.
+func (s *Server) RequireSteps(email string, steps ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.accounts[email]
+	a.Steps = append(a.Steps, steps...)
+	s.accounts[email] = a
+}
+
+// SetGraph sets the graph returned for the patient.
+func (s *Server) SetGraph(patientID string, g librelinkup.Graph) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.graphs[patientID] = g
+}
+
+// SetLogbook sets the logbook returned for the patient.
+func (s *Server) SetLogbook(patientID string, entries ...librelinkup.LogbookEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logbooks[patientID] = entries
+}
+
+// Fail queues failures for the route, each request to the route consumes one failure until
+// none remain.
+func (s *Server) Fail(route Route, failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[route] = append(s.failures[route], failures...)
+}
+
+// RevokeTokens invalidates all issued tokens, as if the account signed in somewhere else.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = map[string]string{}
+}
+
+// Requests returns the number of requests made to the route.
+func (s *Server) Requests(route Route) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[route]
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && path == "/llu/auth/login":
+		s.handle(w, RouteLogin, func() any { return s.login(r) })
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/auth/continue/"):
+		step := strings.TrimPrefix(path, "/auth/continue/")
+		s.handle(w, RouteContinue, func() any { return s.continueStep(w, r, step) })
+	case r.Method == http.MethodGet && path == "/llu/connections":
+		s.handle(w, RouteConnections, func() any { return s.connections(w, r) })
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/llu/connections/") && strings.HasSuffix(path, "/graph"):
+		patientID := strings.TrimSuffix(strings.TrimPrefix(path, "/llu/connections/"), "/graph")
+		s.handle(w, RouteGraph, func() any { return s.graph(w, r, patientID) })
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/llu/connections/") && strings.HasSuffix(path, "/logbook"):
+		patientID := strings.TrimSuffix(strings.TrimPrefix(path, "/llu/connections/"), "/logbook")
+		s.handle(w, RouteLogbook, func() any { return s.logbook(w, r, patientID) })
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handle counts the request and writes either the next scripted failure or the response.
+// The response function returns nil if it has already written an error.
+func (s *Server) handle(w http.ResponseWriter, route Route, response func() any) {
+	s.requests[route]++
+	if failures := s.failures[route]; len(failures) > 0 {
+		s.failures[route] = failures[1:]
+		writeFailure(w, failures[0])
+		return
+	}
+	if body := response(); body != nil {
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+func (s *Server) login(r *http.Request) any {
+	var credentials struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		return errorResponse(4, "badRequest")
+	}
+	account, found := s.accounts[credentials.Email]
+	if !found || account.Password != credentials.Password {
+		return errorResponse(2, "notAuthenticated")
+	}
+
+	resp := librelinkup.LoginResponse{}
+	if region, found := regionOf(r.Host); found && region != account.Region {
+		resp.Data.Redirect = true
+		resp.Data.Region = account.Region
+		return resp
+	}
+	return s.loginResponse(account)
+}
+
+// loginResponse returns the response of a successful login, or the next step the account must
+// complete together with a limited ticket.
+func (s *Server) loginResponse(account Account) librelinkup.LoginResponse {
+	resp := librelinkup.LoginResponse{}
+	resp.Data.User.ID = account.Email
+	if len(account.Steps) > 0 {
+		step := librelinkup.Step{Type: account.Steps[0], ComponentName: "AcceptDocument"}
+		step.Props.Reaccept = true
+		step.Props.Type = account.Steps[0]
+		resp.Status = 4
+		resp.Data.Step = &step
+		resp.Data.AuthTicket = s.issueLimitedTicket(account.Email)
+		return resp
+	}
+	resp.Data.AuthTicket = s.issueTicket(account.Email)
+	return resp
+}
+
+// continueStep completes the account's next step, the request must carry a limited ticket.
+func (s *Server) continueStep(w http.ResponseWriter, r *http.Request, step string) any {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	email, found := s.limited[token]
+	if !found {
+		writeJSON(w, http.StatusUnauthorized, errorResponse(401, "Unauthorized"))
+		return nil
+	}
+	account := s.accounts[email]
+	if len(account.Steps) == 0 || account.Steps[0] != step {
+		return errorResponse(4, "badRequest")
+	}
+	delete(s.limited, token)
+	account.Steps = account.Steps[1:]
+	s.accounts[email] = account
+	return s.loginResponse(account)
+}
+
+func (s *Server) connections(w http.ResponseWriter, r *http.Request) any {
+	account, found := s.authenticate(w, r)
+	if !found {
+		return nil
+	}
+	return librelinkup.ConnectionsResponse{
+		Data:   account.Connections,
+		Ticket: s.issueTicket(account.Email),
+	}
+}
+
+func (s *Server) graph(w http.ResponseWriter, r *http.Request, patientID string) any {
+	account, found := s.authenticate(w, r)
+	if !found {
+		return nil
+	}
+	for _, conn := range account.Connections {
+		if conn.PatientID == patientID {
+			g := s.graphs[patientID]
+			g.Connection = conn
+			if g.GraphData == nil {
+				g.GraphData = []librelinkup.GlucoseMeasurement{}
+			}
+			return librelinkup.GraphResponse{Data: g, AuthTicket: s.issueTicket(account.Email)}
+		}
+	}
+	http.NotFound(w, r)
+	return nil
+}
+
+func (s *Server) logbook(w http.ResponseWriter, r *http.Request, patientID string) any {
+	account, found := s.authenticate(w, r)
+	if !found {
+		return nil
+	}
+	for _, conn := range account.Connections {
+		if conn.PatientID == patientID {
+			entries := s.logbooks[patientID]
+			if entries == nil {
+				entries = []librelinkup.LogbookEntry{}
+			}
+			return librelinkup.LogbookResponse{Data: entries, AuthTicket: s.issueTicket(account.Email)}
+		}
+	}
+	http.NotFound(w, r)
+	return nil
+}
+
+// authenticate returns the account the request's token was issued to. If the token is not
+// valid an unauthorized response is written.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (Account, bool) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	email, found := s.tokens[token]
+	if !found {
+		writeJSON(w, http.StatusUnauthorized, errorResponse(401, "Unauthorized"))
+		return Account{}, false
+	}
+	return s.accounts[email], true
+}
+
+// issueTicket returns a new ticket for the account, every response carries a new ticket like
+// the real API. Previously issued tickets stay valid until revoked.
+func (s *Server) issueTicket(email string) librelinkup.Ticket {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	s.tokens[token] = email
+	return librelinkup.Ticket{
+		Token:    token,
+		Expires:  time.Now().Add(s.TicketDuration).Unix(),
+		Duration: s.TicketDuration.Milliseconds(),
+	}
+}
+
+// issueLimitedTicket returns a ticket only valid for completing the account's steps.
+func (s *Server) issueLimitedTicket(email string) librelinkup.Ticket {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	s.limited[token] = email
+	return librelinkup.Ticket{Token: token, Expires: time.Now().Add(time.Hour).Unix(), Duration: time.Hour.Milliseconds()}
+}
+
+// regionOf returns the region of the LibreLinkUp host.
+func regionOf(host string) (string, bool) {
+	for _, e := range librelinkup.Endpoints {
+		if e.Hostname == host {
+			return e.Region, true
+		}
+	}
+	return "", false
+}
+
+func errorResponse(status int, message string) librelinkup.LibreLinkUpResponse {
+	resp := librelinkup.LibreLinkUpResponse{Status: status}
+	resp.Error.Message = message
+	return resp
+}
+
+func writeFailure(w http.ResponseWriter, f Failure) {
+	if f.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(f.RetryAfter.Seconds())))
+	}
+	if f.StatusCode != 0 && f.StatusCode != http.StatusOK {
+		http.Error(w, http.StatusText(f.StatusCode), f.StatusCode)
+		return
+	}
+	writeJSON(w, http.StatusOK, errorResponse(f.Status, "scripted failure"))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// rewriteTransport sends all requests to the target while keeping the original Host header.
+type rewriteTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.Host = req.URL.Host
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,157 @@
+package llutest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spagettikod/opent1d/librelinkup"
+)
+
+func setupServer(t *testing.T) (*Server, *librelinkup.Client) {
+	srv := NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddAccount(Account{
+		Email:       "foo@bar.com",
+		Password:    "secret",
+		Region:      librelinkup.EndpointUS.Region,
+		Connections: []librelinkup.Connection{{ID: "c1", PatientID: "p1", FirstName: "Jane", TargetLow: 70, TargetHigh: 180}},
+	})
+	srv.SetGraph("p1", librelinkup.Graph{
+		GraphData: []librelinkup.GlucoseMeasurement{{FactoryTimestamp: "6/20/2023 10:01:57 PM", Value: 5.5, ValueInMgPerDl: 99}},
+	})
+	return srv, srv.Client()
+}
+
+func TestLogin(t *testing.T) {
+	srv, client := setupServer(t)
+	ctx := context.Background()
+
+	if _, err := client.Login(ctx, "foo@bar.com", "wrong", librelinkup.EndpointUS); !errors.Is(err, librelinkup.ErrLoginFailed) {
+		t.Errorf("expected %v, got %v", librelinkup.ErrLoginFailed, err)
+	}
+	if _, err := client.Login(ctx, "foo@bar.com", "secret", librelinkup.EndpointEU); !errors.Is(err, librelinkup.ErrWrongRegionEndpoint) {
+		t.Errorf("expected %v, got %v", librelinkup.ErrWrongRegionEndpoint, err)
+	}
+	endpoint, err := client.FindEndpoint(ctx, "foo@bar.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint != librelinkup.EndpointUS {
+		t.Fatalf("expected endpoint %v, got %v", librelinkup.EndpointUS, endpoint)
+	}
+	ticket, err := client.Login(ctx, "foo@bar.com", "secret", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Token == "" || ticket.ExpiresWithin(24*time.Hour) {
+		t.Errorf("expected a valid ticket, got %+v", ticket)
+	}
+	if srv.Requests(RouteLogin) != 4 {
+		t.Errorf("expected 4 login requests, got %v", srv.Requests(RouteLogin))
+	}
+}
+
+func TestConnectionsAndGraph(t *testing.T) {
+	srv, client := setupServer(t)
+	ctx := context.Background()
+
+	ticket, err := client.Login(ctx, "foo@bar.com", "secret", librelinkup.EndpointUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := ticket.Token
+	conns, err := client.Connections(ctx, ticket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || conns[0].PatientID != "p1" {
+		t.Fatalf("expected connection to patient p1, got %+v", conns)
+	}
+	if ticket.Token == token {
+		t.Error("expected token to be rotated")
+	}
+
+	graph, err := client.Graph(ctx, ticket, "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.GraphData) != 1 || graph.Connection.FirstName != "Jane" {
+		t.Errorf("unexpected graph %+v", graph)
+	}
+	if _, err := client.Graph(ctx, ticket, "unknown"); err == nil {
+		t.Error("expected error fetching graph of unknown patient")
+	}
+
+	srv.RevokeTokens()
+	if _, err := client.Connections(ctx, ticket); !errors.Is(err, librelinkup.ErrUnauthorized) {
+		t.Errorf("expected %v, got %v", librelinkup.ErrUnauthorized, err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	srv, client := setupServer(t)
+	ctx := context.Background()
+
+	ticket, err := client.Login(ctx, "foo@bar.com", "secret", librelinkup.EndpointUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Fail(RouteGraph,
+		Failure{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute},
+		Failure{StatusCode: http.StatusServiceUnavailable},
+		Failure{Status: 4},
+	)
+
+	_, err = client.Graph(ctx, ticket, "p1")
+	if !errors.Is(err, librelinkup.ErrRateLimited) || librelinkup.RetryAfter(err) != time.Minute {
+		t.Errorf("expected %v with retry after %v, got %v", librelinkup.ErrRateLimited, time.Minute, err)
+	}
+	if _, err := client.Graph(ctx, ticket, "p1"); !errors.Is(err, librelinkup.ErrMaintenance) {
+		t.Errorf("expected %v, got %v", librelinkup.ErrMaintenance, err)
+	}
+	if _, err := client.Graph(ctx, ticket, "p1"); err == nil || librelinkup.IsTransient(err) {
+		t.Errorf("expected permanent error, got %v", err)
+	}
+	if _, err := client.Graph(ctx, ticket, "p1"); err != nil {
+		t.Errorf("expected failures to be consumed, got %v", err)
+	}
+}
+
+func TestSteps(t *testing.T) {
+	srv, client := setupServer(t)
+	ctx := context.Background()
+	srv.RequireSteps("foo@bar.com", librelinkup.StepTermsOfUse, librelinkup.StepPrivacyPolicy)
+
+	_, err := client.Login(ctx, "foo@bar.com", "secret", librelinkup.EndpointUS)
+	var se *librelinkup.StepError
+	if !errors.As(err, &se) || se.Step.Type != librelinkup.StepTermsOfUse {
+		t.Fatalf("expected terms of use step, got %v", err)
+	}
+	if _, err := client.Connections(ctx, &se.Ticket); !errors.Is(err, librelinkup.ErrUnauthorized) {
+		t.Errorf("expected limited ticket to be rejected with %v, got %v", librelinkup.ErrUnauthorized, err)
+	}
+	if endpoint, err := client.FindEndpoint(ctx, "foo@bar.com", "secret"); err != nil || endpoint != librelinkup.EndpointUS {
+		t.Errorf("expected account's endpoint while a step is pending, got %v, %v", endpoint, err)
+	}
+
+	next, err := client.CompleteStep(ctx, &se.Ticket, se.Step)
+	if !errors.As(err, &se) || se.Step.Type != librelinkup.StepPrivacyPolicy || next != nil {
+		t.Fatalf("expected privacy policy step and no ticket, got %v, %v", next, err)
+	}
+	ticket, err := client.CompleteStep(ctx, &se.Ticket, se.Step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Username != "foo@bar.com" || ticket.Endpoint != librelinkup.EndpointUS {
+		t.Errorf("expected ticket for the account, got %+v", ticket)
+	}
+	if _, err := client.Connections(ctx, ticket); err != nil {
+		t.Errorf("expected ticket to be valid after completing the steps, got %v", err)
+	}
+	if next, err := client.CompleteStep(ctx, ticket, librelinkup.Step{Type: "verifyEmail"}); err == nil || next != nil {
+		t.Errorf("expected error and no ticket completing a step that is not acceptable, got %v", next)
+	}
+}
@@ -0,0 +1,49 @@
+package librelinkup
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Kinds of archived payloads, named after the request they answer.
+const (
+	PayloadConnections = "connections"
+	PayloadGraph       = "graph"
+	PayloadLogbook     = "logbook"
+)
+
+// Payload is a raw response from LibreLinkUp along with the request it answered.
+type Payload struct {
+	Method string
+	URL    string
+	// StatusCode is the HTTP status of the response
+	StatusCode int
+	Requested  time.Time
+	Duration   time.Duration
+	// Body is the response body, uncompressed
+	Body []byte
+}
+
+// ParsePayloadURL returns the kind of the data request made to the URL and the patient the
+// request was made for, the patient is empty for connections.
+func ParsePayloadURL(rawURL string) (kind string, patientID string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("payload URL '%s' is not valid: %w", rawURL, err)
+	}
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	if path == connectionsPath {
+		return PayloadConnections, "", nil
+	}
+	parts := strings.Split(strings.TrimPrefix(path, connectionsPath+"/"), "/")
+	if !strings.HasPrefix(path, connectionsPath+"/") || len(parts) != 2 || (parts[1] != PayloadGraph && parts[1] != PayloadLogbook) {
+		return "", "", fmt.Errorf("payload URL '%s' is not a known data request", rawURL)
+	}
+	patientID, err = url.PathUnescape(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("payload URL '%s' has an invalid patient: %w", rawURL, err)
+	}
+	return parts[1], patientID, nil
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -15,12 +17,20 @@ import (
 
 	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/gorilla/websocket"
 	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/dexcomshare"
 	"github.com/spagettikod/opent1d/envctx"
 	"github.com/spagettikod/opent1d/event"
 	"github.com/spagettikod/opent1d/graph"
 	"github.com/spagettikod/opent1d/handle"
 	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/scraper"
+	"github.com/spagettikod/opent1d/sealer"
 )
 
 const (
@@ -29,10 +39,13 @@ const (
 	DB_PATH_DIR = "OpenT1D"
 	// DB_FILENAME name of the database file
 	DB_FILENAME = "opent1d.sqlite"
+	// SECRET_KEY_FILENAME name of the file, next to the database, holding the generated secret key
+	SECRET_KEY_FILENAME = "opent1d.key"
 
 	PORT = "8080"
 
-	LOG_KEY_DB = "database"
+	LOG_KEY_DB         = "database"
+	LOG_KEY_SECRET_KEY = "secretKey"
 )
 
 func GetDBPath() string {
@@ -51,6 +64,74 @@ func GetDBPath() string {
 	return fmt.Sprintf("file:%s", filepath.Join(path, DB_FILENAME))
 }
 
+// GetSealer returns a sealer using the key from the environment. If no key is given the key is
+// read from a file next to the database, it is generated on first use. The key is never stored
+// in the database, a copy of the database alone can not unseal its secrets.
+func GetSealer(store datastore.Store) *sealer.Sealer {
+	key, err := envctx.EnvToSecretKey()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not read secret key, exiting")
+	}
+	if key == nil {
+		path := SecretKeyPath(GetDBPath())
+		if path == "" {
+			log.Warn().Msgf("%s is not set and the database is in memory, secrets are sealed with a key that is lost on exit", envctx.SECRET_KEY)
+			key, err = sealer.GenerateKey()
+		} else {
+			log.Warn().Str(LOG_KEY_SECRET_KEY, path).Msgf("%s is not set, using a key stored in a file next to the database to encrypt secrets", envctx.SECRET_KEY)
+			key, err = storedSecretKey(store, path)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Str(LOG_KEY_SECRET_KEY, path).Msg("could not load secret key, exiting")
+		}
+	}
+	s, err := sealer.New(key)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not setup encryption of secrets, exiting")
+	}
+	return s
+}
+
+// SecretKeyPath returns the path of the generated secret key, in the directory of the database,
+// or an empty string if the database is not a file.
+func SecretKeyPath(dbPath string) string {
+	path, _, _ := strings.Cut(strings.TrimPrefix(dbPath, "file:"), "?")
+	if path == "" || strings.HasPrefix(path, ":memory:") {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(path), SECRET_KEY_FILENAME)
+}
+
+// storedSecretKey reads the key from the file at path, creating it if it does not exist. A key
+// that earlier versions stored in the database is moved to the file.
+func storedSecretKey(store datastore.Store, path string) ([]byte, error) {
+	value, err := os.ReadFile(path)
+	if err == nil {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(value)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var key []byte
+	stored, err := store.GetValue(datastore.KeySecretKey)
+	switch {
+	case err == nil:
+		if key, err = base64.StdEncoding.DecodeString(stored); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, datastore.ErrNotFound):
+		if key, err = sealer.GenerateKey(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, store.DeleteValue(datastore.KeySecretKey)
+}
+
 func EnvOrDie(env string) string {
 	if val, ok := os.LookupEnv(env); ok {
 		if val != "" {
@@ -61,6 +142,32 @@ func EnvOrDie(env string) string {
 	return ""
 }
 
+// NewGraphQLServer returns a GraphQL server with the same transports and extensions as
+// handler.NewDefaultServer but with WebSocket keep-alives and origin checking configured.
+func NewGraphQLServer(ctx *envctx.Context) *handler.Server {
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{Context: ctx}}))
+
+	srv.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: 10 * time.Second,
+		PingPongInterval:      30 * time.Second,
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: handle.CheckOrigin(envctx.EnvToAllowedOrigins()),
+		},
+	})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{})
+
+	srv.SetQueryCache(lru.New(1000))
+
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.AutomaticPersistedQuery{
+		Cache: lru.New(100),
+	})
+	return srv
+}
+
 func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).Level(envctx.EnvToLogLevel())
 
@@ -69,21 +176,58 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err).Str(LOG_KEY_DB, dbPath).Msg("could not open OpenT1D database, exiting")
 	}
-	if err := store.Migrate(0); err != nil {
-		log.Fatal().Err(err).Str(LOG_KEY_DB, dbPath).Msg("could not migrate database, exiting")
+	// every command but migrate, which manages the schema itself, expects the latest schema
+	if len(os.Args) == 1 || os.Args[1] != "migrate" {
+		if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+			if errors.Is(err, datastore.ErrSchemaTooNew) {
+				log.Fatal().Err(err).Str(LOG_KEY_DB, dbPath).Msg("database was created by a newer version of OpenT1D, refusing to start")
+			}
+			log.Fatal().Err(err).Str(LOG_KEY_DB, dbPath).Msg("could not migrate database, exiting")
+		}
+	}
+	if len(os.Args) > 1 {
+		if err := RunCommand(store, os.Args[1:], os.Stdout); err != nil {
+			log.Fatal().Err(err).Str(LOG_KEY_DB, dbPath).Msg("command failed, exiting")
+		}
+		return
 	}
 
-	ctx := envctx.NewContext(store, log.Logger)
+	slr := GetSealer(store)
+	lluOpts := envctx.EnvToLibreLinkUpOptions()
+	archiveSize, err := envctx.EnvToArchiveSize()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid archive size, exiting")
+	}
+	if archiveSize > 0 {
+		archive := scraper.NewArchive(store, slr, archiveSize, log.Logger)
+		lluOpts = append(lluOpts, librelinkup.WithArchive(archive.SaveLibreLinkUp))
+	}
+	client, err := librelinkup.NewClient(lluOpts...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not setup LibreLinkUp client, exiting")
+	}
+	dexcom, err := dexcomshare.NewClient(envctx.EnvToDexcomShareOptions()...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not setup Dexcom Share client, exiting")
+	}
+	interval, err := envctx.EnvToScrapeInterval()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid scrape interval, exiting")
+	}
+	ctx := envctx.NewContext(store, client, dexcom, slr, log.Logger)
+	ctx.ScrapeInterval = interval
 
 	// this event can be async
 	go event.OnStartup(ctx)
 
-	srv := handler.NewDefaultServer(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{Context: ctx}}))
+	srv := NewGraphQLServer(ctx)
 	srv.SetErrorPresenter(func(ctx context.Context, e error) *gqlerror.Error {
 		err := graphql.DefaultErrorPresenter(ctx, e)
 
-		if errors.Is(err, librelinkup.ErrLoginFailed) {
+		if errors.Is(err, librelinkup.ErrLoginFailed) || errors.Is(err, dexcomshare.ErrLoginFailed) {
 			err.Message = "Login failed, please verify username and password"
+		} else if errors.Is(err, nightscout.ErrUnauthorized) {
+			err.Message = "Nightscout rejected the API secret or token"
 		} else if errors.Is(err, graph.ErrSchemaUsernameEmpty) {
 			err.Message = "Username must have a value"
 		} else if errors.Is(err, graph.ErrSchemaPasswordEmpty) {
@@ -94,6 +238,19 @@ func main() {
 	})
 
 	http.Handle("/query", handle.Middleware(srv))
+	nsConfig, nsEnabled, err := envctx.EnvToNightscoutServerConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid Nightscout API configuration, exiting")
+	}
+	if nsEnabled {
+		nsServer, err := nightscout.NewServer(store, ctx.CGMBroker, nsConfig, log.Logger)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not setup Nightscout API, exiting")
+		}
+		for _, path := range nsServer.Paths() {
+			http.Handle(path, handle.Middleware(nsServer))
+		}
+	}
 	http.Handle("/", http.FileServer(http.Dir("/www")))
 
 	log.Info().Msgf("http server is listening on port %s", PORT)
@@ -0,0 +1,188 @@
+package nightscout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the time limit for requests made by a client created without WithTimeout
+// or WithHTTPClient
+const DefaultTimeout = 30 * time.Second
+
+const entriesPath = "/api/v1/entries.json"
+
+var (
+	ErrUnauthorized = errors.New("Nightscout rejected the API secret or token")
+	ErrNetwork      = errors.New("could not reach Nightscout")
+)
+
+// StatusError is returned when Nightscout responds with an unexpected HTTP status. It wraps
+// ErrUnauthorized when the status is 401 or 403.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("server responded with status %v: %s: %v", e.StatusCode, e.Status, e.Err)
+	}
+	return fmt.Sprintf("server responded with status %v: %s", e.StatusCode, e.Status)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns true if the error is likely to go away if the request is retried later.
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrNetwork) {
+		return true
+	}
+	var se *StatusError
+	return errors.As(err, &se) && (se.StatusCode >= 500 || se.StatusCode == http.StatusTooManyRequests)
+}
+
+// Client reads entries from, and uploads entries to, a Nightscout site. It is safe for concurrent use.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	secretHash string
+	token      string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient makes the client use the given HTTP client for all requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithTimeout sets the time limit for each request, zero means no limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		hc := *c.httpClient
+		hc.Timeout = timeout
+		c.httpClient = &hc
+	}
+}
+
+// WithAPISecret authenticates requests with the site's API secret.
+func WithAPISecret(secret string) Option {
+	return func(c *Client) {
+		if secret != "" {
+			c.secretHash = HashSecret(secret)
+		}
+	}
+}
+
+// WithToken authenticates requests with an access token created in the site's admin tools.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// NewClient returns a client for the Nightscout site at the base URL, such as
+// https://example.herokuapp.com.
+func NewClient(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSpace(baseURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Nightscout URL '%s' is not a valid absolute URL", baseURL)
+	}
+	c := &Client{
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+		baseURL:    strings.TrimSuffix(u.String(), "/"),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Host returns the host of the Nightscout site.
+func (c *Client) Host() string {
+	u, _ := url.Parse(c.baseURL)
+	return u.Host
+}
+
+// Entries returns at most count sensor glucose entries made after, but not at, from and no later
+// than to. Entries are returned latest first, as Nightscout orders them.
+func (c *Client) Entries(ctx context.Context, from, to time.Time, count int) ([]Entry, error) {
+	query := url.Values{
+		"find[type]":       {EntryTypeSGV},
+		"find[date][$gt]":  {strconv.FormatInt(from.UnixMilli(), 10)},
+		"find[date][$lte]": {strconv.FormatInt(to.UnixMilli(), 10)},
+		"count":            {strconv.Itoa(count)},
+	}
+	resp, err := c.do(ctx, http.MethodGet, entriesPath, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	entries := []Entry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("error while unmarshaling entries from JSON: %w", err)
+	}
+	return entries, nil
+}
+
+// UploadEntries adds the entries to the site, Nightscout ignores entries it already has.
+func (c *Client) UploadEntries(ctx context.Context, entries []Entry) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("error while marshaling entries to JSON: %w", err)
+	}
+	resp, err := c.do(ctx, http.MethodPost, entriesPath, url.Values{}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do makes an authenticated request to the site and returns the response if the status is 200.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	if c.token != "" {
+		query.Set("token", c.token)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request to Nightscout: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.secretHash != "" {
+		req.Header.Set("API-SECRET", c.secretHash)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// do not leak the token in the query to the logs
+		return nil, fmt.Errorf("%w, error executing request to '%s': %w", ErrNetwork, c.baseURL+path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		se := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			se.Err = ErrUnauthorized
+		}
+		return nil, se
+	}
+	return resp, nil
+}
@@ -0,0 +1,103 @@
+package nightscout
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashSecret(t *testing.T) {
+	// sha1 of "abcdefghijkl"
+	if hash := HashSecret("abcdefghijkl"); hash != "eb4608cebfcfd4df81410cbd06507ea6af978d9c" {
+		t.Errorf("unexpected hash '%s'", hash)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	from := time.Date(2023, time.June, 20, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != entriesPath {
+			t.Errorf("unexpected path '%s'", r.URL.Path)
+		}
+		if r.Header.Get("API-SECRET") != HashSecret("secret") && r.URL.Query().Get("token") != "reader-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("find[date][$gt]") != "1687219200000" || q.Get("find[date][$lte]") != "1687222800000" || q.Get("count") != "10" || q.Get("find[type]") != "sgv" {
+			t.Errorf("unexpected query '%s'", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode([]Entry{{Type: EntryTypeSGV, SGV: 110, Date: from.Add(5 * time.Minute).UnixMilli(), Direction: "Flat", Device: "xDrip-DexcomG6"}})
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, opt := range []Option{WithAPISecret("secret"), WithToken("reader-token")} {
+		c, err := NewClient(srv.URL+"/", opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := c.Entries(ctx, from, to, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].SGV != 110 || !entries[0].Time().Equal(from.Add(5*time.Minute)) {
+			t.Errorf("unexpected entries %+v", entries)
+		}
+	}
+
+	c, err := NewClient(srv.URL, WithAPISecret("wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Entries(ctx, from, to, 10); !errors.Is(err, ErrUnauthorized) || IsTransient(err) {
+		t.Errorf("expected %v, got %v", ErrUnauthorized, err)
+	}
+	if _, err := NewClient("example.com"); err == nil {
+		t.Error("expected error for URL without scheme")
+	}
+}
+
+func TestUploadEntries(t *testing.T) {
+	srv, store, start := setupServer(t)
+	entries := []Entry{{Type: EntryTypeSGV, SGV: 140, Date: start.Add(15 * time.Minute).UnixMilli(), Direction: "SingleUp", Device: "opent1d-librelinkup"}}
+
+	c, err := NewClient(srv.URL, WithAPISecret("wrong secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UploadEntries(context.Background(), entries); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected %v, got %v", ErrUnauthorized, err)
+	}
+	c, err = NewClient(srv.URL, WithAPISecret("abcdefghijkl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UploadEntries(context.Background(), entries); err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := store.LatestCGM("p1"); err != nil || latest.MgPerDl != 140 || latest.Device != "opent1d-librelinkup" {
+		t.Errorf("expected the uploaded entry to be stored, got %+v, %v", latest, err)
+	}
+}
+
+func TestNetworkError(t *testing.T) {
+	srv := httptest.NewServer(nil)
+	srv.Close()
+	c, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Entries(context.Background(), time.Now().Add(-time.Hour), time.Now(), 1)
+	var urlErr *url.Error
+	if !errors.Is(err, ErrNetwork) || !errors.As(err, &urlErr) || strings.Contains(err.Error(), "%!") {
+		t.Errorf("expected a network error wrapping the cause, got %v", err)
+	}
+}
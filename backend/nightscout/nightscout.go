@@ -0,0 +1,43 @@
+// Package nightscout implements the parts of the Nightscout API OpenT1D uses to exchange glucose
+// readings with Nightscout.
+package nightscout
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"time"
+)
+
+// EntryTypeSGV is the type of entries holding sensor glucose values
+const EntryTypeSGV = "sgv"
+
+// Entry is a Nightscout entry, only sensor glucose value entries are used by OpenT1D.
+type Entry struct {
+	ID   string `json:"_id,omitempty"`
+	Type string `json:"type"`
+	// SGV is the sensor glucose value in mg/dL
+	SGV int `json:"sgv"`
+	// Date is the time of the reading in milliseconds since the Unix epoch
+	Date       int64  `json:"date"`
+	DateString string `json:"dateString,omitempty"`
+	SysTime    string `json:"sysTime,omitempty"`
+	// Trend is the numeric value of the direction, as in glucose.Trend
+	Trend int `json:"trend,omitempty"`
+	// Direction is the trend in the names used by glucose.Trend
+	Direction string `json:"direction,omitempty"`
+	Device    string `json:"device,omitempty"`
+	// UTCOffset is the offset, in minutes, from UTC of the device that made the reading
+	UTCOffset int `json:"utcOffset"`
+}
+
+// Time returns the time of the reading.
+func (e Entry) Time() time.Time {
+	return time.UnixMilli(e.Date).UTC()
+}
+
+// HashSecret returns the SHA1 hash of the API secret, Nightscout expects the hash in the
+// API-SECRET header.
+func HashSecret(secret string) string {
+	h := sha1.Sum([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
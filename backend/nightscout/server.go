@@ -0,0 +1,484 @@
+package nightscout
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+const (
+	// Units clients can be told to display readings in.
+	UnitsMgdl = "mg/dl"
+	UnitsMmol = "mmol"
+
+	// MinSecretLength is the shortest API secret accepted, the same as Nightscout requires
+	MinSecretLength = 12
+
+	// apiVersion is the version of Nightscout whose API is served, clients check it for features
+	apiVersion = "15.0.2"
+	// defaultCount is the number of entries returned if the request does not give a count
+	defaultCount = 10
+	// maxCount is the largest number of entries returned per request, larger counts are clamped
+	maxCount = 1000
+	// dateStringLayout is the layout of the dateString and sysTime of entries
+	dateStringLayout = "2006-01-02T15:04:05.000Z"
+
+	// thresholds reported when the patient has no target range, the Nightscout defaults
+	defaultBGHigh         = 260
+	defaultBGTargetTop    = 180
+	defaultBGTargetBottom = 80
+	defaultBGLow          = 55
+)
+
+var (
+	ErrNoPatient     = errors.New("no patient to serve, set the patient if more than one is followed")
+	errBadQuery      = errors.New("bad query")
+	errNotAuthorized = errors.New("not authorized")
+)
+
+// ServerConfig configures a Server.
+type ServerConfig struct {
+	// APISecret grants access to the API, clients send it SHA1 hashed in the API-SECRET header.
+	// Uploads require the API secret.
+	APISecret string
+	// Tokens grant read access, clients send them in the token query parameter or as a bearer token
+	Tokens []string
+	// PatientID is the patient whose readings are served, the only patient is served if empty
+	PatientID string
+	// Units is the unit clients display readings in, UnitsMgdl or UnitsMmol
+	Units string
+}
+
+// Server serves the readings of a patient in the dialect of the Nightscout REST API, so
+// Nightscout clients such as watchfaces and followers can read from OpenT1D, and uploaders such
+// as xDrip+ can send readings, treatments and device statuses to it. Nightscout sites have a
+// single patient, the server serves the configured patient.
+type Server struct {
+	db         datastore.Store
+	broker     *pubsub.Broker[datastore.CGMEntry]
+	config     ServerConfig
+	secretHash string
+	log        zerolog.Logger
+	// reads and uploads route GET and POST requests
+	reads   *http.ServeMux
+	uploads *http.ServeMux
+}
+
+// NewServer returns a server reading from the datastore, uploaded readings are published to the
+// broker. The config must have an API secret.
+func NewServer(db datastore.Store, broker *pubsub.Broker[datastore.CGMEntry], config ServerConfig, logger zerolog.Logger) (*Server, error) {
+	if len(config.APISecret) < MinSecretLength {
+		return nil, fmt.Errorf("API secret must be at least %v characters", MinSecretLength)
+	}
+	if config.Units == "" {
+		config.Units = UnitsMgdl
+	}
+	if config.Units != UnitsMgdl && config.Units != UnitsMmol {
+		return nil, fmt.Errorf("units must be %s or %s, got '%s'", UnitsMgdl, UnitsMmol, config.Units)
+	}
+	s := &Server{
+		db:         db,
+		broker:     broker,
+		config:     config,
+		secretHash: HashSecret(config.APISecret),
+		log:        logger.With().Str("component", "nightscout-api").Logger(),
+		reads:      http.NewServeMux(),
+		uploads:    http.NewServeMux(),
+	}
+	s.reads.HandleFunc("/api/v1/entries", s.entries)
+	s.reads.HandleFunc("/api/v1/entries/", s.entries)
+	s.reads.HandleFunc("/api/v1/entries.json", s.entries)
+	s.reads.HandleFunc("/api/v1/status", s.status)
+	s.reads.HandleFunc("/api/v1/status.json", s.status)
+	s.reads.HandleFunc("/pebble", s.pebble)
+	s.uploads.HandleFunc("/api/v1/entries", s.saveEntries)
+	s.uploads.HandleFunc("/api/v1/entries.json", s.saveEntries)
+	s.uploads.HandleFunc("/api/v1/treatments", s.saveTreatments)
+	s.uploads.HandleFunc("/api/v1/treatments.json", s.saveTreatments)
+	s.uploads.HandleFunc("/api/v1/devicestatus", s.saveDeviceStatuses)
+	s.uploads.HandleFunc("/api/v1/devicestatus.json", s.saveDeviceStatuses)
+	return s, nil
+}
+
+// Paths returns the paths the server handles, prefixes end with a slash.
+func (s *Server) Paths() []string {
+	return []string{"/api/v1/", "/pebble"}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if !s.readable(r) {
+			s.fail(w, http.StatusUnauthorized, errNotAuthorized)
+			return
+		}
+		s.reads.ServeHTTP(w, r)
+	case http.MethodPost:
+		// read tokens do not grant uploads
+		if !s.authorized(r) {
+			s.fail(w, http.StatusUnauthorized, errNotAuthorized)
+			return
+		}
+		s.uploads.ServeHTTP(w, r)
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not supported", r.Method))
+	}
+}
+
+// readable returns true if the request carries the API secret or a token.
+func (s *Server) readable(r *http.Request) bool {
+	if s.authorized(r) {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		token = bearer
+	}
+	for _, t := range s.config.Tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized returns true if the request carries the API secret, hashed or in plain text.
+func (s *Server) authorized(r *http.Request) bool {
+	secret := r.Header.Get("API-SECRET")
+	if secret == "" {
+		return false
+	}
+	if !strings.EqualFold(secret, s.secretHash) {
+		secret = HashSecret(secret)
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(secret)), []byte(s.secretHash)) == 1
+}
+
+// entries serves /api/v1/entries, optionally limited to a type as in /api/v1/entries/sgv.json,
+// and the latest entry at /api/v1/entries/current.
+func (s *Server) entries(w http.ResponseWriter, r *http.Request) {
+	spec := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/entries"), "/"), ".json")
+	query, err := parseEntriesQuery(r)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	switch spec {
+	case "", EntryTypeSGV:
+		if spec != "" && query.Type == "" {
+			query.Type = spec
+		}
+	case "current":
+		query.Count = 1
+	case "mbg", "cal":
+		// OpenT1D only has sensor readings
+		query.Type = spec
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	entries := []Entry{}
+	if query.Type == "" || query.Type == EntryTypeSGV {
+		patient, err := s.patient()
+		if err != nil {
+			s.failPatient(w, err)
+			return
+		}
+		cgms, err := s.db.LatestCGMInterval(patient.ID, query.From, query.To, query.Count)
+		if err != nil {
+			s.log.Err(err).Msg("could not load entries")
+			s.fail(w, http.StatusInternalServerError, errors.New("could not load entries"))
+			return
+		}
+		for _, cgm := range cgms {
+			entries = append(entries, ToEntry(cgm))
+		}
+	}
+	s.respond(w, entries)
+}
+
+// status serves /api/v1/status.json with the settings clients use to display readings.
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	thresholds := map[string]int{"bgHigh": defaultBGHigh, "bgTargetTop": defaultBGTargetTop, "bgTargetBottom": defaultBGTargetBottom, "bgLow": defaultBGLow}
+	name := "OpenT1D"
+	if patient, err := s.patient(); err == nil {
+		if patient.TargetHigh > 0 {
+			thresholds["bgTargetTop"] = patient.TargetHigh
+		}
+		if patient.TargetLow > 0 {
+			thresholds["bgTargetBottom"] = patient.TargetLow
+		}
+		if patient.FirstName != "" {
+			name = strings.TrimSpace(patient.FirstName + " " + patient.LastName)
+		}
+	}
+	s.respond(w, map[string]any{
+		"status":            "ok",
+		"name":              "OpenT1D",
+		"version":           apiVersion,
+		"serverTime":        now.Format(dateStringLayout),
+		"serverTimeEpoch":   now.UnixMilli(),
+		"apiEnabled":        true,
+		"careportalEnabled": false,
+		"boluscalcEnabled":  false,
+		"settings": map[string]any{
+			"units":       s.config.Units,
+			"customTitle": name,
+			"thresholds":  thresholds,
+			"enable":      []string{},
+		},
+		"extendedSettings": map[string]any{},
+		"authorized":       nil,
+	})
+}
+
+// pebbleBG is a reading in the /pebble format, values are strings in the requested unit.
+type pebbleBG struct {
+	SGV       string `json:"sgv"`
+	Trend     int    `json:"trend"`
+	Direction string `json:"direction"`
+	Datetime  int64  `json:"datetime"`
+	BGDelta   string `json:"bgdelta,omitempty"`
+	Battery   string `json:"battery"`
+}
+
+// pebble serves /pebble, the format read by the Pebble watchface and many widgets. The first
+// reading carries the change since the previous reading.
+func (s *Server) pebble(w http.ResponseWriter, r *http.Request) {
+	count := 1
+	if value := r.URL.Query().Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			s.fail(w, http.StatusBadRequest, fmt.Errorf("%w: count must be a positive number", errBadQuery))
+			return
+		}
+		count = n
+		if count > maxCount {
+			count = maxCount
+		}
+	}
+	mmol := s.config.Units == UnitsMmol
+	if units := r.URL.Query().Get("units"); units != "" {
+		mmol = units == UnitsMmol
+	}
+	patient, err := s.patient()
+	if err != nil {
+		s.failPatient(w, err)
+		return
+	}
+	// one more reading than requested gives the delta of the last one
+	cgms, err := s.db.LatestCGMInterval(patient.ID, time.Unix(0, 0), time.Now().Add(time.Hour), count+1)
+	if err != nil {
+		s.log.Err(err).Msg("could not load readings")
+		s.fail(w, http.StatusInternalServerError, errors.New("could not load readings"))
+		return
+	}
+	bgs := []pebbleBG{}
+	for i, cgm := range cgms {
+		if i == count {
+			break
+		}
+		bg := pebbleBG{SGV: formatValue(cgm.MgPerDl, mmol), Trend: int(cgm.Trend), Direction: cgm.Trend.String(), Datetime: cgm.Timestamp.UnixMilli()}
+		if i == 0 && len(cgms) > 1 {
+			bg.BGDelta = formatValue(cgm.MgPerDl-cgms[1].MgPerDl, mmol)
+		}
+		bgs = append(bgs, bg)
+	}
+	s.respond(w, map[string]any{
+		"status": []map[string]int64{{"now": time.Now().UnixMilli()}},
+		"bgs":    bgs,
+		"cals":   []any{},
+	})
+}
+
+// patient returns the configured patient, or the only patient if none is configured.
+func (s *Server) patient() (datastore.Patient, error) {
+	patients, err := s.db.Patients()
+	if err != nil {
+		return datastore.Patient{}, err
+	}
+	for _, p := range patients {
+		if p.ID == s.config.PatientID || (s.config.PatientID == "" && len(patients) == 1) {
+			return p, nil
+		}
+	}
+	return datastore.Patient{}, ErrNoPatient
+}
+
+func (s *Server) respond(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Err(err).Msg("could not write response")
+	}
+}
+
+// failPatient responds with the error of finding the patient, not found if there is no patient
+// to serve and an internal error if the datastore failed.
+func (s *Server) failPatient(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNoPatient) || errors.Is(err, datastore.ErrNotFound) {
+		s.fail(w, http.StatusNotFound, err)
+		return
+	}
+	s.log.Err(err).Msg("could not load patient")
+	s.fail(w, http.StatusInternalServerError, errors.New("could not load patient"))
+}
+
+// fail responds with the error in the format Nightscout uses.
+func (s *Server) fail(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "message": err.Error()})
+}
+
+// entriesQuery is the part of Nightscout's query syntax supported for entries.
+type entriesQuery struct {
+	Type  string
+	From  time.Time
+	To    time.Time
+	Count int
+}
+
+// parseEntriesQuery parses the count and the find conditions on type, date and dateString of
+// the request. Conditions on other fields are rejected rather than ignored, counts above
+// maxCount are clamped.
+func parseEntriesQuery(r *http.Request) (entriesQuery, error) {
+	q := entriesQuery{From: time.Unix(0, 0), To: time.Now().Add(24 * time.Hour), Count: defaultCount}
+	for key, values := range r.URL.Query() {
+		value := values[0]
+		switch {
+		case key == "count":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return q, fmt.Errorf("%w: count must be a positive number, got '%s'", errBadQuery, value)
+			}
+			q.Count = n
+			if q.Count > maxCount {
+				q.Count = maxCount
+			}
+		case key == "find[type]":
+			q.Type = value
+		case strings.HasPrefix(key, "find[date]["), strings.HasPrefix(key, "find[dateString]["):
+			field, op, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(key, "find["), "]"), "][")
+			ms, err := parseDate(field, value)
+			if err != nil {
+				return q, err
+			}
+			if err := q.restrict(op, ms); err != nil {
+				return q, err
+			}
+		case strings.HasPrefix(key, "find["):
+			return q, fmt.Errorf("%w: '%s' is not supported", errBadQuery, key)
+		}
+	}
+	return q, nil
+}
+
+// restrict narrows the interval by the comparison with the time in milliseconds. Readings are
+// stored by the second.
+func (q *entriesQuery) restrict(op string, ms int64) error {
+	floor := int64(math.Floor(float64(ms) / 1000))
+	ceil := int64(math.Ceil(float64(ms) / 1000))
+	var from, to time.Time
+	switch op {
+	case "$gt":
+		from = time.Unix(floor+1, 0)
+	case "$gte":
+		from = time.Unix(ceil, 0)
+	case "$lt":
+		to = time.Unix(ceil, 0)
+	case "$lte":
+		to = time.Unix(floor+1, 0)
+	default:
+		return fmt.Errorf("%w: operator '%s' is not supported", errBadQuery, op)
+	}
+	if from.After(q.From) {
+		q.From = from
+	}
+	if !to.IsZero() && to.Before(q.To) {
+		q.To = to
+	}
+	return nil
+}
+
+// parseDate returns the value of a date condition in milliseconds since the Unix epoch, date
+// conditions are given in milliseconds and dateString conditions as ISO 8601 times.
+func parseDate(field, value string) (int64, error) {
+	if field == "date" {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: date must be milliseconds since the epoch, got '%s'", errBadQuery, value)
+		}
+		return ms, nil
+	}
+	t, err := parseTime(value)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+// parseTime parses an ISO 8601 time, times without an offset are in UTC.
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: time must be in ISO 8601, got '%s'", errBadQuery, value)
+}
+
+// ToEntry converts a stored reading into a Nightscout entry. The ID is derived from the patient,
+// the time and the measurement type of the reading, in the format of a MongoDB ObjectId.
+func ToEntry(cgm datastore.CGMEntry) Entry {
+	ts := cgm.Timestamp.UTC()
+	device := cgm.Device
+	if device == "" {
+		device = "opent1d-" + cgm.Source
+	}
+	// a current and a historic reading can share the same time, historic IDs are kept as before
+	key := cgm.PatientID
+	if cgm.Type == datastore.MeasurementTypeCurrent {
+		key += ":current"
+	}
+	return Entry{
+		ID:         objectID(ts, key),
+		Type:       EntryTypeSGV,
+		SGV:        cgm.MgPerDl,
+		Date:       ts.UnixMilli(),
+		DateString: ts.Format(dateStringLayout),
+		SysTime:    ts.Format(dateStringLayout),
+		Trend:      int(cgm.Trend),
+		Direction:  cgm.Trend.String(),
+		Device:     device,
+		UTCOffset:  cgm.UTCOffset / 60,
+	}
+}
+
+// objectID returns an ID in the format of a MongoDB ObjectId, from the time and a hash of the key.
+func objectID(ts time.Time, key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%08x%016x", ts.Unix(), h.Sum64())
+}
+
+// formatValue returns the glucose value, or change, in mg/dL or in mmol/L with one decimal.
+func formatValue(mgdl int, mmol bool) string {
+	if mmol {
+		return strconv.FormatFloat(float64(glucose.MgToMmol(mgdl)), 'f', 1, 32)
+	}
+	return strconv.Itoa(mgdl)
+}
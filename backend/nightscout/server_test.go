@@ -0,0 +1,318 @@
+package nightscout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+func setupServer(t *testing.T) (*httptest.Server, datastore.Store, time.Time) {
+	// requests are served on several goroutines, an in-memory database is per connection
+	store, err := datastore.NewSQLiteStore("file:" + t.TempDir() + "/opent1d.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SavePatients(datastore.Patient{ID: "p1", FirstName: "Jane", TargetLow: 70, TargetHigh: 180}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, time.June, 20, 0, 0, 0, 0, time.UTC)
+	cgms := []datastore.CGMEntry{}
+	for i, mgdl := range []int{100, 110, 126} {
+		cgm := datastore.NewCGMEntry(start.Add(time.Duration(i)*5*time.Minute), datastore.Mmoll(glucose.MgToMmol(mgdl)))
+		cgm.PatientID = "p1"
+		cgm.MgPerDl = mgdl
+		cgm.Trend = glucose.TrendFortyFiveUp
+		cgm.UTCOffset = 2 * 60 * 60
+		cgm.Source = "librelinkup"
+		cgms = append(cgms, cgm)
+	}
+	if _, err := store.SaveCGM(cgms...); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(store, pubsub.NewBroker[datastore.CGMEntry](), ServerConfig{APISecret: "abcdefghijkl", Tokens: []string{"reader-token"}, Units: UnitsMmol}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv, store, start
+}
+
+// get makes a request with the given API-SECRET header, if any, and decodes the JSON response.
+func get(t *testing.T, url, secret string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		req.Header.Set("API-SECRET", secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServerEntries(t *testing.T) {
+	srv, _, start := setupServer(t)
+
+	// the client reads from the server the same way it reads from Nightscout
+	client, err := NewClient(srv.URL, WithAPISecret("abcdefghijkl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := client.Entries(context.Background(), start, start.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].SGV != 126 || entries[1].SGV != 110 {
+		t.Fatalf("expected the entries after the first one latest first, got %+v", entries)
+	}
+	e := entries[0]
+	if e.Direction != "FortyFiveUp" || e.Trend != 3 || e.UTCOffset != 120 || e.DateString != "2023-06-20T00:10:00.000Z" || e.Device != "opent1d-librelinkup" || len(e.ID) != 24 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	tests := []struct {
+		path     string
+		expected []int
+	}{
+		{"/api/v1/entries.json?count=2", []int{126, 110}},
+		{"/api/v1/entries/sgv.json?find[date][$gte]=" + ms(start.Add(5*time.Minute)), []int{126, 110}},
+		{"/api/v1/entries/sgv.json?find[dateString][$lt]=2023-06-20T00:10:00Z", []int{110, 100}},
+		{"/api/v1/entries/current.json", []int{126}},
+		{"/api/v1/entries/current", []int{126}},
+		{"/api/v1/entries/mbg.json", []int{}},
+		{"/api/v1/entries.json?token=reader-token", []int{126, 110, 100}},
+	}
+	for _, test := range tests {
+		entries := []Entry{}
+		if status := get(t, srv.URL+test.path, HashSecret("abcdefghijkl"), &entries); status != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %v", test.path, status)
+			continue
+		}
+		sgvs := []int{}
+		for _, e := range entries {
+			sgvs = append(sgvs, e.SGV)
+		}
+		if len(sgvs) != len(test.expected) || (len(sgvs) > 0 && sgvs[0] != test.expected[0]) {
+			t.Errorf("%s: expected %v, got %v", test.path, test.expected, sgvs)
+		}
+	}
+	if status := get(t, srv.URL+"/api/v1/entries.json?find[sgv][$gte]=100", "abcdefghijkl", nil); status != http.StatusBadRequest {
+		t.Errorf("expected unsupported conditions to be rejected, got status %v", status)
+	}
+}
+
+func TestParseEntriesQueryCount(t *testing.T) {
+	tests := map[string]int{
+		"":                 defaultCount,
+		"?count=2":         2,
+		"?count=100000000": maxCount,
+	}
+	for query, expected := range tests {
+		q, err := parseEntriesQuery(httptest.NewRequest(http.MethodGet, "/api/v1/entries.json"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Count != expected {
+			t.Errorf("expected count %v for '%s', got %v", expected, query, q.Count)
+		}
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	srv, _, _ := setupServer(t)
+	tests := []struct {
+		path   string
+		secret string
+		status int
+	}{
+		{"/api/v1/entries.json", "", http.StatusUnauthorized},
+		{"/api/v1/entries.json", "wrong secret", http.StatusUnauthorized},
+		{"/api/v1/entries.json?token=wrong", "", http.StatusUnauthorized},
+		{"/api/v1/entries.json", "abcdefghijkl", http.StatusOK},
+		{"/api/v1/entries.json", "EB4608CEBFCFD4DF81410CBD06507EA6AF978D9C", http.StatusOK},
+		{"/pebble?token=reader-token", "", http.StatusOK},
+		{"/api/v1/unknown", "abcdefghijkl", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if status := get(t, srv.URL+test.path, test.secret, nil); status != test.status {
+			t.Errorf("%s with secret '%s': expected status %v, got %v", test.path, test.secret, test.status, status)
+		}
+	}
+}
+
+func TestServerStatusAndPebble(t *testing.T) {
+	srv, _, start := setupServer(t)
+
+	status := struct {
+		Status   string `json:"status"`
+		Settings struct {
+			Units      string         `json:"units"`
+			Thresholds map[string]int `json:"thresholds"`
+		} `json:"settings"`
+	}{}
+	if code := get(t, srv.URL+"/api/v1/status.json", "abcdefghijkl", &status); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", code)
+	}
+	if status.Status != "ok" || status.Settings.Units != UnitsMmol || status.Settings.Thresholds["bgTargetTop"] != 180 || status.Settings.Thresholds["bgTargetBottom"] != 70 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	pebble := struct {
+		BGs []pebbleBG `json:"bgs"`
+	}{}
+	if code := get(t, srv.URL+"/pebble?count=2", "abcdefghijkl", &pebble); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", code)
+	}
+	if len(pebble.BGs) != 2 || pebble.BGs[0].SGV != "7.0" || pebble.BGs[0].BGDelta != "0.9" || pebble.BGs[0].Direction != "FortyFiveUp" || pebble.BGs[0].Datetime != start.Add(10*time.Minute).UnixMilli() {
+		t.Errorf("unexpected readings %+v", pebble.BGs)
+	}
+	if get(t, srv.URL+"/pebble?units=mg/dl", "abcdefghijkl", &pebble); len(pebble.BGs) != 1 || pebble.BGs[0].SGV != "126" || pebble.BGs[0].BGDelta != "16" {
+		t.Errorf("unexpected readings in mg/dL %+v", pebble.BGs)
+	}
+}
+
+// post sends the body with the given API-SECRET header, if any, and decodes the JSON response.
+func post(t *testing.T, url, secret, body string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set("API-SECRET", secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestServerUpload(t *testing.T) {
+	srv, store, start := setupServer(t)
+	secret := HashSecret("abcdefghijkl")
+
+	// the first entry is already stored and is left as it is, the calibration is ignored
+	entries := `[
+		{"type": "sgv", "sgv": 99, "date": ` + ms(start) + `, "direction": "Flat", "device": "xDrip-LibreReceiver"},
+		{"type": "sgv", "sgv": 140, "dateString": "2023-06-20T00:15:00.000Z", "direction": "SingleUp", "device": "xDrip-LibreReceiver", "utcOffset": 120},
+		{"type": "cal", "slope": 1000, "date": ` + ms(start) + `}
+	]`
+	accepted := []Entry{}
+	if status := post(t, srv.URL+"/api/v1/entries", secret, entries, &accepted); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", status)
+	}
+	if len(accepted) != 2 || accepted[1].ID == "" || accepted[1].SGV != 140 {
+		t.Errorf("expected both sensor readings to be accepted, got %+v", accepted)
+	}
+	cgms, err := store.LoadCGMInterval("p1", start, start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cgms) != 4 || cgms[0].MgPerDl != 100 || cgms[0].Source != "librelinkup" {
+		t.Fatalf("expected the stored reading to be kept and one reading added, got %+v", cgms)
+	}
+	if cgm := cgms[3]; cgm.MgPerDl != 140 || cgm.Trend != glucose.TrendSingleUp || cgm.UTCOffset != 2*60*60 || cgm.Source != "upload:xDrip-LibreReceiver" || cgm.Device != "xDrip-LibreReceiver" {
+		t.Errorf("unexpected uploaded reading %+v", cgm)
+	}
+
+	// treatments without an identifier are duplicates if they have the same event type and time
+	treatment := `{"eventType": "Meal Bolus", "created_at": "2023-06-20T02:00:00+02:00", "insulin": 4.5, "carbs": 40, "enteredBy": "AndroidAPS", "notes": "pasta"}`
+	for i := 0; i < 2; i++ {
+		response := []map[string]any{}
+		if status := post(t, srv.URL+"/api/v1/treatments.json", secret, treatment, &response); status != http.StatusOK {
+			t.Fatalf("expected status 200, got %v", status)
+		}
+		if len(response) != 1 || response[0]["_id"] == nil || response[0]["notes"] != "pasta" {
+			t.Errorf("expected the treatment to be given an _id, got %+v", response)
+		}
+	}
+	treatments, err := store.LoadTreatments("p1", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(treatments) != 1 {
+		t.Fatalf("expected the treatment to be stored once, got %+v", treatments)
+	}
+	if tr := treatments[0]; !tr.Timestamp.Equal(start) || tr.Insulin != 4.5 || tr.Carbs != 40 || tr.UTCOffset != 2*60*60 || tr.Source != "upload:AndroidAPS" {
+		t.Errorf("unexpected treatment %+v", tr)
+	}
+
+	statuses := `[{"device": "xDrip-LibreReceiver", "created_at": "2023-06-20T00:15:00Z", "uploader": {"battery": 80}}, {"device": "openaps://pump", "identifier": "s2", "date": ` + ms(start) + `}]`
+	if status := post(t, srv.URL+"/api/v1/devicestatus", secret, statuses, nil); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %v", status)
+	}
+	stored, err := store.LoadDeviceStatuses("p1", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored[0].Identifier != "s2" || stored[1].Source != "upload:xDrip-LibreReceiver" {
+		t.Errorf("unexpected device statuses %+v", stored)
+	}
+
+	tests := []struct {
+		path   string
+		secret string
+		body   string
+		status int
+	}{
+		{"/api/v1/entries?token=reader-token", "", entries, http.StatusUnauthorized},
+		{"/api/v1/entries", "wrong secret", entries, http.StatusUnauthorized},
+		{"/api/v1/entries", secret, `{"sgv": 100}`, http.StatusBadRequest},
+		{"/api/v1/treatments", secret, `not json`, http.StatusBadRequest},
+		{"/api/v1/treatments", secret, `{"created_at": "yesterday"}`, http.StatusBadRequest},
+		{"/api/v1/status.json", secret, `{}`, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if status := post(t, srv.URL+test.path, test.secret, test.body, nil); status != test.status {
+			t.Errorf("%s with body %s: expected status %v, got %v", test.path, test.body, test.status, status)
+		}
+	}
+}
+
+func TestServerUploadDatastoreError(t *testing.T) {
+	srv, store, _ := setupServer(t)
+	secret := HashSecret("abcdefghijkl")
+	// a failing datastore is not mistaken for an unknown patient
+	store.Close()
+	if status := post(t, srv.URL+"/api/v1/entries", secret, `{"sgv": 100, "date": 1687219200000}`, nil); status != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %v", status)
+	}
+}
+
+// ms returns the time in milliseconds since the epoch, as used in date conditions.
+func ms(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
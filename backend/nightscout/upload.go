@@ -0,0 +1,295 @@
+package nightscout
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+)
+
+const (
+	// UploadSource is the source of data uploaded to the API, the uploader is appended as in upload:xDrip-LibreReceiver
+	UploadSource = "upload"
+	// maxUploadSize is the largest request body accepted, uploaders send batches of a few hundred documents
+	maxUploadSize = 10 << 20
+)
+
+// uploadedTreatment holds the fields of an uploaded treatment OpenT1D uses, the whole document
+// is stored as uploaded.
+type uploadedTreatment struct {
+	ID         string   `json:"_id"`
+	Identifier string   `json:"identifier"`
+	EventType  string   `json:"eventType"`
+	CreatedAt  string   `json:"created_at"`
+	Date       int64    `json:"date"`
+	Insulin    *float64 `json:"insulin"`
+	Carbs      *float64 `json:"carbs"`
+	UTCOffset  *int     `json:"utcOffset"`
+	EnteredBy  string   `json:"enteredBy"`
+}
+
+// uploadedDeviceStatus holds the fields of an uploaded device status OpenT1D uses.
+type uploadedDeviceStatus struct {
+	ID         string `json:"_id"`
+	Identifier string `json:"identifier"`
+	Device     string `json:"device"`
+	CreatedAt  string `json:"created_at"`
+	Date       int64  `json:"date"`
+}
+
+// saveEntries stores uploaded sensor glucose values and responds with the accepted entries.
+// Entries already stored for the same time are duplicates and left as they are. OpenT1D only
+// has sensor readings, other types of entries are ignored.
+func (s *Server) saveEntries(w http.ResponseWriter, r *http.Request) {
+	docs, err := readDocuments(w, r)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	patientID, err := s.uploadPatient()
+	if err != nil {
+		s.failPatient(w, err)
+		return
+	}
+	cgms := []datastore.CGMEntry{}
+	for _, doc := range docs {
+		e := Entry{}
+		if err := json.Unmarshal(doc, &e); err != nil {
+			s.fail(w, http.StatusBadRequest, fmt.Errorf("%w: entry is not valid: %v", errBadQuery, err))
+			return
+		}
+		if (e.Type != "" && e.Type != EntryTypeSGV) || e.SGV <= 0 {
+			continue
+		}
+		if e.Date == 0 {
+			ts, err := parseTime(e.DateString)
+			if err != nil {
+				s.fail(w, http.StatusBadRequest, fmt.Errorf("%w: entry must have a date or a dateString", errBadQuery))
+				return
+			}
+			e.Date = ts.UnixMilli()
+		}
+		cgm := ToCGMEntry(e)
+		cgm.PatientID = patientID
+		cgm.Source = uploadSource(e.Device)
+		cgms = append(cgms, cgm)
+	}
+	saved, err := s.db.SaveCGM(cgms...)
+	if err != nil {
+		s.log.Err(err).Msg("could not save uploaded entries")
+		s.fail(w, http.StatusInternalServerError, errors.New("could not save entries"))
+		return
+	}
+	s.log.Debug().Msgf("saved %v of %v uploaded entries", len(saved), len(cgms))
+	s.broker.Publish(saved...)
+	entries := []Entry{}
+	for _, cgm := range cgms {
+		entries = append(entries, ToEntry(cgm))
+	}
+	s.respond(w, entries)
+}
+
+// saveTreatments stores uploaded treatments and responds with the documents given an _id.
+// Treatments are duplicates if they have the same identifier, or the same event type and time
+// if the uploader gives no identifier.
+func (s *Server) saveTreatments(w http.ResponseWriter, r *http.Request) {
+	docs, err := readDocuments(w, r)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	patientID, err := s.uploadPatient()
+	if err != nil {
+		s.failPatient(w, err)
+		return
+	}
+	treatments := []datastore.Treatment{}
+	for _, doc := range docs {
+		ut := uploadedTreatment{}
+		if err := json.Unmarshal(doc, &ut); err != nil {
+			s.fail(w, http.StatusBadRequest, fmt.Errorf("%w: treatment is not valid: %v", errBadQuery, err))
+			return
+		}
+		ts, offset, err := documentTime(ut.CreatedAt, ut.Date)
+		if err != nil {
+			s.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		t := datastore.Treatment{
+			PatientID:  patientID,
+			Identifier: identifier(ut.Identifier, ut.ID, ut.EventType, ts),
+			Timestamp:  ts,
+			EventType:  ut.EventType,
+			UTCOffset:  offset,
+			Source:     uploadSource(ut.EnteredBy),
+			Document:   doc,
+		}
+		if ut.Insulin != nil {
+			t.Insulin = *ut.Insulin
+		}
+		if ut.Carbs != nil {
+			t.Carbs = *ut.Carbs
+		}
+		if ut.UTCOffset != nil {
+			t.UTCOffset = *ut.UTCOffset * 60
+		}
+		treatments = append(treatments, t)
+	}
+	saved, err := s.db.SaveTreatments(treatments...)
+	if err != nil {
+		s.log.Err(err).Msg("could not save uploaded treatments")
+		s.fail(w, http.StatusInternalServerError, errors.New("could not save treatments"))
+		return
+	}
+	s.log.Debug().Msgf("saved %v of %v uploaded treatments", len(saved), len(treatments))
+	response := []map[string]any{}
+	for _, t := range treatments {
+		response = append(response, withID(t.Document, objectID(t.Timestamp, t.PatientID+t.Identifier)))
+	}
+	s.respond(w, response)
+}
+
+// saveDeviceStatuses stores uploaded device statuses and responds with the documents given an
+// _id. Statuses are duplicates if they have the same identifier, or the same device and time if
+// the uploader gives no identifier.
+func (s *Server) saveDeviceStatuses(w http.ResponseWriter, r *http.Request) {
+	docs, err := readDocuments(w, r)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	patientID, err := s.uploadPatient()
+	if err != nil {
+		s.failPatient(w, err)
+		return
+	}
+	statuses := []datastore.DeviceStatus{}
+	for _, doc := range docs {
+		uds := uploadedDeviceStatus{}
+		if err := json.Unmarshal(doc, &uds); err != nil {
+			s.fail(w, http.StatusBadRequest, fmt.Errorf("%w: device status is not valid: %v", errBadQuery, err))
+			return
+		}
+		ts, _, err := documentTime(uds.CreatedAt, uds.Date)
+		if err != nil {
+			s.fail(w, http.StatusBadRequest, err)
+			return
+		}
+		statuses = append(statuses, datastore.DeviceStatus{
+			PatientID:  patientID,
+			Identifier: identifier(uds.Identifier, uds.ID, uds.Device, ts),
+			Timestamp:  ts,
+			Device:     uds.Device,
+			Source:     uploadSource(uds.Device),
+			Document:   doc,
+		})
+	}
+	saved, err := s.db.SaveDeviceStatuses(statuses...)
+	if err != nil {
+		s.log.Err(err).Msg("could not save uploaded device statuses")
+		s.fail(w, http.StatusInternalServerError, errors.New("could not save device statuses"))
+		return
+	}
+	s.log.Debug().Msgf("saved %v of %v uploaded device statuses", len(saved), len(statuses))
+	response := []map[string]any{}
+	for _, ds := range statuses {
+		response = append(response, withID(ds.Document, objectID(ds.Timestamp, ds.PatientID+ds.Identifier)))
+	}
+	s.respond(w, response)
+}
+
+// uploadPatient returns the patient uploads are stored for. A configured patient that is not
+// stored yet is added, so an uploader can be the only source of readings.
+func (s *Server) uploadPatient() (string, error) {
+	patient, err := s.patient()
+	if errors.Is(err, ErrNoPatient) && s.config.PatientID != "" {
+		if err := s.db.SavePatients(datastore.Patient{ID: s.config.PatientID, Updated: time.Now().UTC()}); err != nil {
+			return "", fmt.Errorf("could not save patient: %w", err)
+		}
+		return s.config.PatientID, nil
+	}
+	return patient.ID, err
+}
+
+// readDocuments returns the documents of the request body, uploaders post a single document or
+// a batch of documents in an array.
+func readDocuments(w http.ResponseWriter, r *http.Request) ([]json.RawMessage, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read body: %v", errBadQuery, err)
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] != '[' {
+		body = append(append([]byte{'['}, body...), ']')
+	}
+	docs := []json.RawMessage{}
+	if err := json.Unmarshal(body, &docs); err != nil {
+		return nil, fmt.Errorf("%w: body must be a JSON document or an array of documents: %v", errBadQuery, err)
+	}
+	return docs, nil
+}
+
+// documentTime returns the time of a treatment or device status from its created_at, or from
+// its date in milliseconds, and the offset in seconds from UTC created_at was given in. Documents
+// without a time were created now, as in Nightscout.
+func documentTime(createdAt string, date int64) (time.Time, int, error) {
+	if createdAt != "" {
+		ts, err := parseTime(createdAt)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		_, offset := ts.Zone()
+		return ts.UTC(), offset, nil
+	}
+	if date > 0 {
+		return time.UnixMilli(date).UTC(), 0, nil
+	}
+	return time.Now().UTC(), 0, nil
+}
+
+// identifier returns the identifier the uploader gave the document, or one made from the kind
+// and time of the document which Nightscout uses to find duplicates.
+func identifier(identifier, id, kind string, ts time.Time) string {
+	if identifier != "" {
+		return identifier
+	}
+	if id != "" {
+		return id
+	}
+	return kind + "@" + strconv.FormatInt(ts.UnixMilli(), 10)
+}
+
+// withID returns the document with an _id, if it did not have one.
+func withID(doc []byte, id string) map[string]any {
+	m := map[string]any{}
+	json.Unmarshal(doc, &m)
+	if _, found := m["_id"]; !found {
+		m["_id"] = id
+	}
+	return m
+}
+
+// uploadSource returns the source of data sent by the uploader.
+func uploadSource(uploader string) string {
+	if uploader == "" {
+		return UploadSource
+	}
+	return UploadSource + ":" + uploader
+}
+
+// ToCGMEntry converts a Nightscout entry into a reading, the patient and source are not set.
+func ToCGMEntry(e Entry) datastore.CGMEntry {
+	cgm := datastore.NewCGMEntry(e.Time(), datastore.Mmoll(glucose.MgToMmol(e.SGV)))
+	cgm.MgPerDl = e.SGV
+	cgm.Trend = glucose.ParseTrend(e.Direction)
+	cgm.UTCOffset = e.UTCOffset * 60
+	cgm.Device = e.Device
+	return cgm
+}
@@ -0,0 +1,59 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// SubscriberBuffer is the number of messages buffered for each subscriber. Messages published
+// to a subscriber with a full buffer are dropped for that subscriber.
+const SubscriberBuffer = 16
+
+// Broker fans out published messages to all current subscribers.
+type Broker[T any] struct {
+	mu   sync.Mutex
+	subs map[chan T]struct{}
+}
+
+func NewBroker[T any]() *Broker[T] {
+	return &Broker[T]{subs: map[chan T]struct{}{}}
+}
+
+// Subscribe returns a channel receiving all messages published after the call. The channel is
+// closed when ctx is done.
+func (b *Broker[T]) Subscribe(ctx context.Context) <-chan T {
+	ch := make(chan T, SubscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, ch)
+		close(ch)
+		b.mu.Unlock()
+	}()
+	return ch
+}
+
+// Publish sends the messages to all subscribers without blocking.
+func (b *Broker[T]) Publish(msgs ...T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		for _, msg := range msgs {
+			select {
+			case ch <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// Subscribers returns the number of current subscribers.
+func (b *Broker[T]) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
@@ -0,0 +1,44 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker[int]()
+	ctx, cancel := context.WithCancel(context.Background())
+	first := broker.Subscribe(ctx)
+	second := broker.Subscribe(context.Background())
+
+	broker.Publish(1, 2)
+	for _, ch := range []<-chan int{first, second} {
+		for _, expected := range []int{1, 2} {
+			if actual := <-ch; actual != expected {
+				t.Fatalf("expected %v but got %v", expected, actual)
+			}
+		}
+	}
+
+	cancel()
+	select {
+	case _, open := <-first:
+		if open {
+			t.Fatal("expected channel to be closed after context was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel was not closed after context was cancelled")
+	}
+	if broker.Subscribers() != 1 {
+		t.Fatalf("expected 1 subscriber but got %v", broker.Subscribers())
+	}
+
+	// publishing to a full subscriber must not block
+	for i := 0; i < SubscriberBuffer*2; i++ {
+		broker.Publish(i)
+	}
+	if len(second) != SubscriberBuffer {
+		t.Fatalf("expected %v buffered messages but got %v", SubscriberBuffer, len(second))
+	}
+}
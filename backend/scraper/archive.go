@@ -0,0 +1,256 @@
+package scraper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/sealer"
+)
+
+// DefaultArchiveSize is the number of bytes of payloads kept if no archive size is set.
+const DefaultArchiveSize = 100 << 20
+
+// reprocessPageSize is the number of payloads loaded at a time when reprocessing
+const reprocessPageSize = 100
+
+// Archive keeps the raw LibreLinkUp responses so readings can be rebuilt after a parser fix.
+// Payloads are compressed and encrypted, data responses carry a fresh auth ticket, and the
+// oldest payloads are removed when the archive grows larger than its size.
+type Archive struct {
+	db     datastore.Store
+	sealer *sealer.Sealer
+	size   int64
+	log    zerolog.Logger
+}
+
+// NewArchive returns an archive keeping at most size bytes of payloads, a size less than one
+// means no limit.
+func NewArchive(db datastore.Store, sealer *sealer.Sealer, size int64, logger zerolog.Logger) *Archive {
+	return &Archive{db: db, sealer: sealer, size: size, log: logger.With().Str("component", "archive").Logger()}
+}
+
+// SaveLibreLinkUp archives a LibreLinkUp response, it is passed to the client with
+// librelinkup.WithArchive. Errors are logged, a payload that is not archived does not fail the
+// request.
+func (a *Archive) SaveLibreLinkUp(p librelinkup.Payload) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(p.Body); err != nil {
+		a.log.Err(err).Msg("could not compress payload")
+		return
+	}
+	if err := zw.Close(); err != nil {
+		a.log.Err(err).Msg("could not compress payload")
+		return
+	}
+	sealed, err := a.sealer.Seal(buf.Bytes())
+	if err != nil {
+		a.log.Err(err).Msg("could not encrypt payload")
+		return
+	}
+	_, err = a.db.SaveRawPayload(datastore.RawPayload{
+		Source:     LibreLinkUpSource,
+		Method:     p.Method,
+		URL:        p.URL,
+		StatusCode: p.StatusCode,
+		Requested:  p.Requested,
+		Duration:   p.Duration,
+		Body:       []byte(sealed),
+	}, a.size)
+	if err != nil {
+		a.log.Err(err).Msg("could not save payload")
+	}
+}
+
+// Open returns the body of the archived payload as it was received.
+func (a *Archive) Open(p datastore.RawPayload) ([]byte, error) {
+	compressed, err := a.sealer.Open(string(p.Body))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt payload %v: %w", p.ID, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress payload %v: %w", p.ID, err)
+	}
+	defer zr.Close()
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress payload %v: %w", p.ID, err)
+	}
+	return body, nil
+}
+
+// Replay is what an archived payload is parsed into by the current version of the parser.
+type Replay struct {
+	Payload datastore.RawPayload
+	// Kind is the kind of request the payload answered, such as graph
+	Kind     string
+	Body     []byte
+	Sensors  []datastore.Sensor
+	Readings []datastore.CGMEntry
+	Alarms   []datastore.AlarmEvent
+}
+
+// Replay parses the archived payload without storing anything, for debugging the parser.
+func (a *Archive) Replay(id int64) (Replay, error) {
+	p, err := a.db.RawPayload(id)
+	if err != nil {
+		return Replay{}, err
+	}
+	settings, err := a.settings()
+	if err != nil {
+		return Replay{}, err
+	}
+	return a.parse(p, settings)
+}
+
+// ReprocessResult counts what Reprocess did.
+type ReprocessResult struct {
+	Payloads int
+	// Failed is the number of payloads that could not be parsed
+	Failed int
+	// Readings and Alarms are the number of new readings and alarm events stored
+	Readings int
+	Alarms   int
+}
+
+// Reprocess parses all archived LibreLinkUp payloads, in the order they were received, and stores
+// sensors, readings and alarm events that are not already stored. Stored entries are left as
+// they are, so only what an earlier version of the parser dropped is added.
+func (a *Archive) Reprocess() (ReprocessResult, error) {
+	result := ReprocessResult{}
+	settings, err := a.settings()
+	if err != nil {
+		return result, err
+	}
+	for afterID := int64(0); ; {
+		payloads, err := a.db.LoadRawPayloads(LibreLinkUpSource, afterID, reprocessPageSize)
+		if err != nil {
+			return result, err
+		}
+		if len(payloads) == 0 {
+			return result, nil
+		}
+		for _, p := range payloads {
+			afterID = p.ID
+			result.Payloads++
+			replay, err := a.parse(p, settings)
+			if err != nil {
+				a.log.Err(err).Msgf("could not reprocess payload %v", p.ID)
+				result.Failed++
+				continue
+			}
+			for _, sensor := range replay.Sensors {
+				if err := a.db.SaveSensor(sensor); err != nil {
+					return result, fmt.Errorf("could not save sensor to datastore: %w", err)
+				}
+			}
+			readings, err := a.db.SaveCGM(replay.Readings...)
+			if err != nil {
+				return result, fmt.Errorf("could not save CGM data to datastore: %w", err)
+			}
+			alarms, err := a.db.SaveAlarmEvents(replay.Alarms...)
+			if err != nil {
+				return result, fmt.Errorf("could not save alarm events to datastore: %w", err)
+			}
+			result.Readings += len(readings)
+			result.Alarms += len(alarms)
+		}
+	}
+}
+
+// settings returns the stored settings, deciding which patients' current readings are kept.
+func (a *Archive) settings() (datastore.Settings, error) {
+	settings, err := a.db.GetSettings()
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return datastore.Settings{}, err
+	}
+	return settings, nil
+}
+
+// parse converts the archived payload the same way the LibreLinkUp scraper converts responses.
+func (a *Archive) parse(p datastore.RawPayload, settings datastore.Settings) (Replay, error) {
+	body, err := a.Open(p)
+	if err != nil {
+		return Replay{}, err
+	}
+	kind, patientID, err := librelinkup.ParsePayloadURL(p.URL)
+	if err != nil {
+		return Replay{}, err
+	}
+	replay := Replay{Payload: p, Kind: kind, Body: body, Sensors: []datastore.Sensor{}, Readings: []datastore.CGMEntry{}, Alarms: []datastore.AlarmEvent{}}
+	log := a.log.With().Int64("payload", p.ID).Logger()
+	switch kind {
+	case librelinkup.PayloadConnections:
+		var cr librelinkup.ConnectionsResponse
+		if err := unmarshalPayload(body, &cr, &cr.LibreLinkUpResponse); err != nil {
+			return Replay{}, err
+		}
+		for _, conn := range cr.Data {
+			if !settings.ScrapesPatient(conn.PatientID) || conn.GlucoseMeasurement.FactoryTimestamp == "" {
+				continue
+			}
+			sensors, err := a.db.Sensors(conn.PatientID)
+			if err != nil {
+				return Replay{}, fmt.Errorf("could not load sensors from datastore: %w", err)
+			}
+			cgm, err := toCurrentCGMEntry(conn, sensors)
+			if err != nil {
+				log.Err(err).Str("patientID", conn.PatientID).Msg("error while converting current measurement")
+				continue
+			}
+			replay.Readings = append(replay.Readings, cgm)
+		}
+	case librelinkup.PayloadGraph:
+		var gr librelinkup.GraphResponse
+		if err := unmarshalPayload(body, &gr, &gr.LibreLinkUpResponse); err != nil {
+			return Replay{}, err
+		}
+		sensors, err := a.sensors(patientID, gr.Data.ActiveSensors, p.Requested)
+		if err != nil {
+			return Replay{}, err
+		}
+		replay.Sensors = toSensors(patientID, gr.Data.ActiveSensors, p.Requested)
+		replay.Readings = graphCGMEntries(patientID, gr.Data, sensors, log)
+	case librelinkup.PayloadLogbook:
+		var lr librelinkup.LogbookResponse
+		if err := unmarshalPayload(body, &lr, &lr.LibreLinkUpResponse); err != nil {
+			return Replay{}, err
+		}
+		sensors, err := a.sensors(patientID, nil, p.Requested)
+		if err != nil {
+			return Replay{}, err
+		}
+		replay.Alarms, replay.Readings = logbookEvents(patientID, lr.Data, sensors, log)
+	}
+	return replay, nil
+}
+
+// sensors returns the patient's stored sensors along with the active sensors of a payload,
+// which might not be stored yet.
+func (a *Archive) sensors(patientID string, active []librelinkup.ActiveSensor, seen time.Time) ([]datastore.Sensor, error) {
+	sensors, err := a.db.Sensors(patientID)
+	if err != nil {
+		return nil, fmt.Errorf("could not load sensors from datastore: %w", err)
+	}
+	return append(sensors, toSensors(patientID, active, seen)...), nil
+}
+
+// unmarshalPayload parses the body into the response and fails if LibreLinkUp reported an error.
+func unmarshalPayload(body []byte, response any, status *librelinkup.LibreLinkUpResponse) error {
+	if err := json.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("error while unmarshaling payload from JSON: %w", err)
+	}
+	if status.Status != 0 {
+		return fmt.Errorf("payload is an error response, status code %v, message: %s", status.Status, status.Error.Message)
+	}
+	return nil
+}
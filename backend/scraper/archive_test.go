@@ -0,0 +1,71 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/librelinkup"
+)
+
+func TestArchiveReprocess(t *testing.T) {
+	s, srv := setupFakeLibreLinkUp(t, datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "us"})
+	archive := NewArchive(s.db, s.sealer, 0, zerolog.Nop())
+	s.client = srv.Client(librelinkup.WithArchive(archive.SaveLibreLinkUp))
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := s.db.LoadRawPayloads(LibreLinkUpSource, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]int64{}
+	for _, p := range payloads {
+		kind, _, err := librelinkup.ParsePayloadURL(p.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds[kind] = p.ID
+		if bytes.Contains(p.Body, []byte("data")) {
+			t.Errorf("expected payload %v to be stored encrypted", p.ID)
+		}
+	}
+	if len(kinds) != 3 {
+		t.Fatalf("expected connections, graph and logbook payloads, got %v", kinds)
+	}
+
+	replay, err := archive.Replay(kinds[librelinkup.PayloadGraph])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replay.Sensors) != 1 || len(replay.Readings) != 2 || replay.Readings[0].SensorSerial != "SN1" || !bytes.Contains(replay.Body, []byte("graphData")) {
+		t.Errorf("expected the graph's sensor and readings, got %+v", replay)
+	}
+
+	// a database where the readings were lost is rebuilt from the archived payloads
+	rebuilt := setupScraper(t, datastore.Settings{}).db
+	for _, p := range payloads {
+		if _, err := rebuilt.SaveRawPayload(p, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive = NewArchive(rebuilt, s.sealer, 0, zerolog.Nop())
+	result, err := archive.Reprocess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Payloads != 3 || result.Failed != 0 || result.Readings != 3 || result.Alarms != 1 {
+		t.Errorf("expected the graph readings, the scan and the alarm to be stored, got %+v", result)
+	}
+	from, to := time.Date(2023, time.June, 20, 0, 0, 0, 0, time.UTC), time.Date(2023, time.June, 22, 0, 0, 0, 0, time.UTC)
+	if cgms, err := rebuilt.LoadCGMInterval("p1", from, to, 0); err != nil || len(cgms) != 3 || cgms[0].SensorSerial != "SN1" {
+		t.Errorf("expected the readings to be rebuilt, got %+v, %v", cgms, err)
+	}
+	if result, err := archive.Reprocess(); err != nil || result.Readings != 0 || result.Alarms != 0 {
+		t.Errorf("expected nothing new when reprocessing again, got %+v, %v", result, err)
+	}
+}
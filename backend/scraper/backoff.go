@@ -0,0 +1,48 @@
+package scraper
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff calculates exponentially growing delays, with jitter, between retries.
+type Backoff struct {
+	// Initial is the delay before the first retry
+	Initial time.Duration
+	// Max caps the delay
+	Max time.Duration
+	// Multiplier is the factor the delay grows with for each retry
+	Multiplier float64
+	// Jitter is the fraction, between 0 and 1, of the delay that is randomized
+	Jitter  float64
+	attempt int
+	random  func() float64
+}
+
+func NewBackoff(initial, max time.Duration) *Backoff {
+	return &Backoff{Initial: initial, Max: max, Multiplier: 2, Jitter: 0.5, random: rand.Float64}
+}
+
+// Next returns the delay before the next retry.
+func (b *Backoff) Next() time.Duration {
+	d := float64(b.Initial)
+	for i := 0; i < b.attempt && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	b.attempt++
+	// remove up to Jitter of the delay to spread out retries
+	return time.Duration(d - d*b.Jitter*b.random())
+}
+
+// Attempts returns the number of delays handed out since the last reset.
+func (b *Backoff) Attempts() int {
+	return b.attempt
+}
+
+// Reset starts over from the initial delay, call when an attempt succeeds.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
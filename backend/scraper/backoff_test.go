@@ -0,0 +1,23 @@
+package scraper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Minute, 10*time.Minute)
+	b.random = func() float64 { return 0 }
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, e := range expected {
+		if actual := b.Next(); actual != e {
+			t.Errorf("expected delay %v to be %v, got %v", i, e, actual)
+		}
+	}
+
+	b.Reset()
+	b.random = func() float64 { return 1 }
+	if actual := b.Next(); actual != 30*time.Second {
+		t.Errorf("expected full jitter to halve the delay to %v, got %v", 30*time.Second, actual)
+	}
+}
@@ -0,0 +1,152 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/dexcomshare"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+// DexcomShareSource is the name of the Dexcom Share source.
+const DexcomShareSource = "dexcomshare"
+
+// DefaultDexcomInterval is the time between Dexcom Share scrapes if no interval is set, Dexcom
+// sensors deliver a reading every five minutes
+const DefaultDexcomInterval = 5 * time.Minute
+
+func init() {
+	Register(DexcomShareSource, newDexcomShareSource)
+}
+
+// newDexcomShareSource is the Factory of the Dexcom Share source.
+func newDexcomShareSource(deps Deps, settings datastore.Settings) (Source, error) {
+	if !settings.DexcomConfigured() {
+		return nil, ErrNotConfigured
+	}
+	return NewDexcomShareScraper(deps.DB, deps.DexcomShare, settings, deps.Logger, intervalOr(settings.DexcomInterval, intervalOr(deps.Interval, DefaultDexcomInterval)), deps.Broker)
+}
+
+// DexcomShareScraper is the Source fetching readings of a Dexcom Share account. The account is
+// stored as a patient identified by its Dexcom account identifier.
+type DexcomShareScraper struct {
+	runner
+	db       datastore.Store
+	client   *dexcomshare.Client
+	broker   *pubsub.Broker[datastore.CGMEntry]
+	settings datastore.Settings
+	session  *dexcomshare.Session
+}
+
+func (s *DexcomShareScraper) scrape(ctx context.Context) error {
+	s.log.Debug().Msg("starting scrape")
+	if s.session == nil {
+		if err := s.login(ctx); err != nil {
+			return fmt.Errorf("error occured trying to login to Dexcom Share: %w", err)
+		}
+	}
+	patientID := s.session.AccountID
+	minutes := dexcomshare.MaxMinutes
+	if latest, err := s.db.LatestCGM(patientID); err == nil {
+		// fetch a few minutes extra to not miss readings uploaded late
+		minutes = int(time.Since(latest.Timestamp).Minutes()) + 5
+	} else if !errors.Is(err, datastore.ErrNotFound) {
+		return fmt.Errorf("could not load latest CGM entry from datastore: %w", err)
+	}
+	s.log.Debug().Msgf("fetching readings from the last %v minutes", minutes)
+	values, err := s.client.LatestGlucoseValues(ctx, *s.session, minutes, minutes/5+1)
+	if err != nil {
+		return fmt.Errorf("error while fetching readings: %w", err)
+	}
+	cgms := []datastore.CGMEntry{}
+	for _, gv := range values {
+		cgm, err := dexcomToCGMEntry(gv)
+		if err != nil {
+			s.log.Err(err).Msgf("error while converting reading at '%s'", gv.WT)
+			continue
+		}
+		cgm.PatientID = patientID
+		cgms = append(cgms, cgm)
+	}
+	saved, err := s.db.SaveCGM(cgms...)
+	if err != nil {
+		return fmt.Errorf("could not save CGM data to datastore: %w", err)
+	}
+	s.log.Debug().Msgf("saved %v new CGM entries", len(saved))
+	s.broker.Publish(saved...)
+	s.ingested(len(saved))
+	return nil
+}
+
+func (s *DexcomShareScraper) login(ctx context.Context) error {
+	server, found := dexcomshare.ServerByRegion(s.settings.DexcomRegion)
+	if !found {
+		return fmt.Errorf("invalid Dexcom Share region '%s', can not connect", s.settings.DexcomRegion)
+	}
+	s.log.Debug().Msg("signing in to Dexcom Share")
+	session, err := s.client.Login(ctx, s.settings.DexcomUsername, s.settings.DexcomPassword, server)
+	if err != nil {
+		return err
+	}
+	patient := datastore.Patient{ID: session.AccountID, FirstName: s.settings.DexcomUsername, Updated: time.Now().UTC()}
+	if err := s.db.SavePatients(patient); err != nil {
+		return fmt.Errorf("could not save patient to datastore: %w", err)
+	}
+	s.session = &session
+	s.log.Debug().Msg("successfully signed into Dexcom Share")
+	return nil
+}
+
+// recover prepares the scraper to retry after the error and returns how long to wait before
+// retrying.
+func (s *DexcomShareScraper) recover(err error) time.Duration {
+	switch {
+	case errors.Is(err, dexcomshare.ErrLoginFailed):
+		s.backoff.Reset()
+		return s.interval
+	case errors.Is(err, dexcomshare.ErrSessionExpired):
+		s.log.Info().Msg("session has expired, signing in again")
+		s.session = nil
+	case dexcomshare.IsTransient(err):
+	default:
+		if s.backoff.Attempts() >= maxUnknownRetries {
+			s.backoff.Reset()
+			return s.interval
+		}
+	}
+	return s.backoff.Next()
+}
+
+// dexcomToCGMEntry converts a Dexcom Share reading into a CGM entry.
+func dexcomToCGMEntry(gv dexcomshare.GlucoseValue) (datastore.CGMEntry, error) {
+	ts, err := gv.Time()
+	if err != nil {
+		return datastore.CGMEntry{}, err
+	}
+	cgm := datastore.NewCGMEntry(ts, datastore.Mmoll(glucose.MgToMmol(gv.Value)))
+	cgm.MgPerDl = gv.Value
+	cgm.Trend = glucose.Trend(gv.Trend)
+	cgm.UTCOffset = gv.UTCOffset()
+	cgm.Source = DexcomShareSource
+	return cgm, nil
+}
+
+func NewDexcomShareScraper(db datastore.Store, client *dexcomshare.Client, settings datastore.Settings, logger zerolog.Logger, interval time.Duration, broker *pubsub.Broker[datastore.CGMEntry]) (*DexcomShareScraper, error) {
+	scraper := &DexcomShareScraper{
+		runner:   newRunner(DexcomShareSource, db, logger.With().Str("scraper", "DexcomShare").Logger(), interval),
+		db:       db,
+		client:   client,
+		broker:   broker,
+		settings: settings,
+	}
+	scraper.fetchFn = scraper.scrape
+	scraper.recoverFn = scraper.recover
+	scraper.log = scraper.log.With().Str("username", settings.DexcomUsername).Str("region", settings.DexcomRegion).Logger()
+	scraper.log.Info().Msg("initializing scraper")
+	return scraper, nil
+}
@@ -0,0 +1,62 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/dexcomshare"
+	"github.com/spagettikod/opent1d/dexcomshare/sharetest"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+func TestDexcomShareScrape(t *testing.T) {
+	srv := sharetest.NewServer()
+	t.Cleanup(srv.Close)
+	accountID := srv.AddAccount("foo", "secret")
+	now := time.Now().UTC().Truncate(time.Second)
+	srv.AddReadings("foo",
+		sharetest.Reading{Time: now.Add(-5 * time.Minute), Value: 99, Trend: glucose.TrendFlat},
+		sharetest.Reading{Time: now, Value: 110, Trend: glucose.TrendFortyFiveUp},
+	)
+
+	store := setupScraper(t, datastore.Settings{}).db
+	settings := datastore.Settings{DexcomUsername: "foo", DexcomPassword: "secret", DexcomRegion: "us"}
+	s, err := NewDexcomShareScraper(store, srv.Client(), settings, zerolog.Nop(), time.Hour, pubsub.NewBroker[datastore.CGMEntry]())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := store.LatestCGM(accountID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest.Timestamp.Equal(now) || latest.MgPerDl != 110 || latest.Trend != glucose.TrendFortyFiveUp || latest.Source != DexcomShareSource {
+		t.Errorf("unexpected latest entry %+v", latest)
+	}
+	patients, err := store.Patients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patients) != 1 || patients[0].ID != accountID {
+		t.Errorf("expected the account to be stored as a patient, got %+v", patients)
+	}
+
+	// an expired session is replaced by a new one
+	srv.ExpireSessions()
+	err = s.Fetch(context.Background())
+	if !errors.Is(err, dexcomshare.ErrSessionExpired) {
+		t.Fatalf("expected %v, got %v", dexcomshare.ErrSessionExpired, err)
+	}
+	s.recover(err)
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
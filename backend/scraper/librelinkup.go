@@ -1,134 +1,469 @@
 package scraper
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
 	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/pubsub"
+	"github.com/spagettikod/opent1d/sealer"
 )
 
-type LibreLinkupScraper struct {
-	db        datastore.Store
-	ticket    *librelinkup.Ticket
-	username  string
-	password  string
-	region    string
-	patientID string
-	running   bool
-	log       zerolog.Logger
-	interval  time.Duration
-	stopCh    chan struct{}
-	doneCh    chan struct{}
+// LibreLinkUpSource is the name of the LibreLinkUp source.
+const LibreLinkUpSource = "librelinkup"
+
+const (
+	// DefaultLibreLinkUpInterval is the time between polls of the current readings if no
+	// interval is set, LibreLinkUp updates the current reading every minute
+	DefaultLibreLinkUpInterval = time.Minute
+	// DefaultLibreLinkUpBackfill is the time between fetches of the graph and logbook if no
+	// backfill interval is set, the graph covers about the last 12 hours
+	DefaultLibreLinkUpBackfill = time.Hour
+)
+
+func init() {
+	Register(LibreLinkUpSource, newLibreLinkUpSource)
 }
 
-func (s *LibreLinkupScraper) IsRunning() bool {
-	return s.running
+// newLibreLinkUpSource is the Factory of the LibreLinkUp source.
+func newLibreLinkUpSource(deps Deps, settings datastore.Settings) (Source, error) {
+	if !settings.LibreLinkUpConfigured() {
+		return nil, ErrNotConfigured
+	}
+	return NewLibreLinkUpScraper(deps.DB, deps.LibreLinkUp, deps.Sealer, settings, deps.Logger, intervalOr(settings.LibreLinkUpInterval, intervalOr(deps.Interval, DefaultLibreLinkUpInterval)), deps.Broker)
 }
 
-func (s *LibreLinkupScraper) Stop() {
-	s.log.Debug().Msg("stopping scraper")
-	close(s.stopCh)
-	<-s.doneCh
-	s.running = false
+// LibreLinkupScraper is the Source fetching readings of the patients followed by a LibreLinkUp
+// account. The current readings are polled from the connections at the interval, while the graph
+// and logbook are fetched at the backfill interval or when polls missed readings.
+type LibreLinkupScraper struct {
+	runner
+	db         datastore.Store
+	client     *librelinkup.Client
+	broker     *pubsub.Broker[datastore.CGMEntry]
+	sealer     *sealer.Sealer
+	ticket     *librelinkup.Ticket
+	savedToken string
+	settings   datastore.Settings
+	patientIDs []string
 }
 
-func (s *LibreLinkupScraper) Start() {
-	s.log.Debug().Msgf("starting scraper")
-	go s.run()
-	s.running = true
+func (s *LibreLinkupScraper) scrape(ctx context.Context) error {
+	s.log.Debug().Msg("starting scrape")
+	if s.ticket == nil || s.patientIDs == nil || s.ticket.ExpiresWithin(s.refreshMargin()) {
+		s.log.Debug().Msg("ticket is empty or about to expire, trying to login")
+		if err := s.login(ctx); err != nil {
+			return fmt.Errorf("error occured trying to login to LibreLinkUp: %w", err)
+		}
+	}
+	errs := []error{}
+	for _, patientID := range s.patientIDs {
+		if err := s.scrapePatient(ctx, patientID); err != nil {
+			if errors.Is(err, librelinkup.ErrUnauthorized) || errors.Is(err, librelinkup.ErrWrongRegionEndpoint) {
+				// no use trying the other patients
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	// every response carries a new ticket
+	s.saveTicket()
+	return errors.Join(errs...)
 }
 
-func (s *LibreLinkupScraper) run() {
-	defer close(s.doneCh)
+// poll stores the current reading of the scraped patients and returns true if readings were
+// missed since the latest stored reading, which the graph has to fill in.
+func (s *LibreLinkupScraper) poll(ctx context.Context) (bool, error) {
+	s.log.Debug().Msg("polling current readings")
+	if s.ticket == nil || s.patientIDs == nil || s.ticket.ExpiresWithin(s.refreshMargin()) {
+		s.log.Debug().Msg("ticket is empty or about to expire, trying to login")
+		if err := s.login(ctx); err != nil {
+			return false, fmt.Errorf("error occured trying to login to LibreLinkUp: %w", err)
+		}
+	}
+	conns, err := s.client.Connections(ctx, s.ticket)
+	if err != nil {
+		return false, fmt.Errorf("error while fetching connections: %w", err)
+	}
+	s.saveTicket()
 
-	s.scrape()
+	backfill := false
+	cgms := []datastore.CGMEntry{}
+	for _, conn := range conns {
+		if !s.scrapes(conn.PatientID) {
+			continue
+		}
+		cgm, err := s.currentCGMEntry(conn)
+		if err != nil {
+			s.log.Err(err).Str("patientID", conn.PatientID).Msgf("error while converting current measurement at '%v'", conn.GlucoseMeasurement.FactoryTimestamp)
+			continue
+		}
+		latest, err := s.db.LatestCGM(conn.PatientID)
+		switch {
+		case errors.Is(err, datastore.ErrNotFound):
+			backfill = true
+		case err != nil:
+			return false, fmt.Errorf("could not load latest CGM entry from datastore: %w", err)
+		case cgm.Timestamp.Sub(latest.Timestamp) > s.maxPollGap():
+			s.log.Debug().Str("patientID", conn.PatientID).Msgf("no reading stored since %v", latest.Timestamp)
+			backfill = true
+		}
+		cgms = append(cgms, cgm)
+	}
+	saved, err := s.db.SaveCGM(cgms...)
+	if err != nil {
+		return false, fmt.Errorf("could not save CGM data to datastore: %w", err)
+	}
+	s.log.Debug().Msgf("saved %v new current readings", len(saved))
+	s.broker.Publish(saved...)
+	s.ingested(len(saved))
+	return backfill, nil
+}
 
-	ticker := time.NewTicker(s.interval)
-	defer ticker.Stop()
+// maxPollGap is the longest expected time between two stored readings while polling, a longer
+// gap means readings were missed.
+func (s *LibreLinkupScraper) maxPollGap() time.Duration {
+	return 2*s.interval + time.Minute
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			s.scrape()
-		case <-s.stopCh:
-			s.log.Debug().Msgf("received stop signal, stopping scrape")
-			return
+// scrapes returns true if the patient is scraped.
+func (s *LibreLinkupScraper) scrapes(patientID string) bool {
+	for _, id := range s.patientIDs {
+		if id == patientID {
+			return true
 		}
 	}
+	return false
 }
 
-func (s *LibreLinkupScraper) scrape() {
-	s.log.Debug().Msg("starting scrape")
-	if s.ticket == nil {
-		s.log.Debug().Msg("ticket is empty, trying to login")
-		if err := s.login(); err != nil {
-			s.log.Err(err).Msgf("error occured trying to login to LibreLinkUp, trying again in %v", s.interval)
-			return
-		}
+// currentCGMEntry converts the connection's current measurement into a CGM entry.
+func (s *LibreLinkupScraper) currentCGMEntry(conn librelinkup.Connection) (datastore.CGMEntry, error) {
+	sensors, err := s.db.Sensors(conn.PatientID)
+	if err != nil {
+		return datastore.CGMEntry{}, fmt.Errorf("could not load sensors from datastore: %w", err)
 	}
-	scrapeLog := s.log.With().Str("patientID", s.patientID).Logger()
+	return toCurrentCGMEntry(conn, sensors)
+}
+
+// toCurrentCGMEntry converts the connection's current measurement into a CGM entry made by one
+// of the given sensors.
+func toCurrentCGMEntry(conn librelinkup.Connection, sensors []datastore.Sensor) (datastore.CGMEntry, error) {
+	cgm, err := toCGMEntry(conn.GlucoseMeasurement)
+	if err != nil {
+		return datastore.CGMEntry{}, err
+	}
+	cgm.PatientID = conn.PatientID
+	cgm.Type = datastore.MeasurementTypeCurrent
+	cgm.SensorSerial = datastore.SensorAt(sensors, cgm.Timestamp)
+	cgm.Source = LibreLinkUpSource
+	return cgm, nil
+}
+
+func (s *LibreLinkupScraper) scrapePatient(ctx context.Context, patientID string) error {
+	scrapeLog := s.log.With().Str("patientID", patientID).Logger()
 	scrapeLog.Debug().Msg("fetching graph data")
-	_, graph, err := s.ticket.Graph(s.patientID)
+	graph, err := s.client.Graph(ctx, s.ticket, patientID)
 	if err != nil {
-		scrapeLog.Err(err).Msgf("error while fetching graph data, aborting")
-	} else {
-		cgms := []datastore.CGMEntry{}
-		for _, bg := range graph {
-			ts, err := librelinkup.ToTime(bg.FactoryTimestamp)
-			if err != nil {
-				scrapeLog.Err(err).Msgf("error while converting '%v' into a timestamp", bg.FactoryTimestamp)
-			} else {
-				cgms = append(cgms, datastore.NewCGMEntry(ts, datastore.Mmoll(bg.Value)))
-			}
+		return fmt.Errorf("error while fetching graph data for patient '%s': %w", patientID, err)
+	}
+	sensors, err := saveSensors(s.db, patientID, graph.ActiveSensors, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("could not save sensors to datastore: %w", err)
+	}
+	saved, err := s.db.SaveCGM(graphCGMEntries(patientID, graph, sensors, scrapeLog)...)
+	if err != nil {
+		return fmt.Errorf("could not save CGM data to datastore: %w", err)
+	}
+	scrapeLog.Debug().Msgf("saved %v new CGM entries", len(saved))
+	s.broker.Publish(saved...)
+	s.ingested(len(saved))
+
+	if err := s.scrapeLogbook(ctx, patientID, sensors); err != nil {
+		if errors.Is(err, librelinkup.ErrUnauthorized) {
+			return err
+		}
+		// the graph data is already saved, a missing logbook is retried on the next scrape
+		scrapeLog.Err(err).Msg("could not fetch logbook")
+	}
+	return nil
+}
+
+// scrapeLogbook stores the patient's alarms and scanned readings from the logbook.
+func (s *LibreLinkupScraper) scrapeLogbook(ctx context.Context, patientID string, sensors []datastore.Sensor) error {
+	logbook, err := s.client.Logbook(ctx, s.ticket, patientID)
+	if err != nil {
+		return fmt.Errorf("error while fetching logbook for patient '%s': %w", patientID, err)
+	}
+	alarms, scans := logbookEvents(patientID, logbook, sensors, s.log)
+	savedAlarms, err := s.db.SaveAlarmEvents(alarms...)
+	if err != nil {
+		return fmt.Errorf("could not save alarm events to datastore: %w", err)
+	}
+	savedScans, err := s.db.SaveCGM(scans...)
+	if err != nil {
+		return fmt.Errorf("could not save scanned readings to datastore: %w", err)
+	}
+	s.log.Debug().Str("patientID", patientID).Msgf("saved %v new alarm events and %v new scanned readings", len(savedAlarms), len(savedScans))
+	s.broker.Publish(savedScans...)
+	s.ingested(len(savedScans))
+	return nil
+}
+
+// graphCGMEntries converts the historic measurements and the current measurement of the graph
+// into CGM entries made by the given sensors. Measurements that can not be converted are logged
+// and skipped.
+func graphCGMEntries(patientID string, graph librelinkup.Graph, sensors []datastore.Sensor, log zerolog.Logger) []datastore.CGMEntry {
+	cgms := []datastore.CGMEntry{}
+	for _, bg := range graph.GraphData {
+		cgm, err := toCGMEntry(bg)
+		if err != nil {
+			log.Err(err).Msgf("error while converting measurement at '%v'", bg.FactoryTimestamp)
+			continue
 		}
-		if err := s.db.SaveCGM(cgms...); err != nil {
-			scrapeLog.Err(err).Msg("could not save CGM data to datastore")
+		cgm.PatientID = patientID
+		cgm.SensorSerial = datastore.SensorAt(sensors, cgm.Timestamp)
+		cgm.Source = LibreLinkUpSource
+		cgms = append(cgms, cgm)
+	}
+	if graph.Connection.GlucoseMeasurement.FactoryTimestamp != "" {
+		conn := graph.Connection
+		conn.PatientID = patientID
+		if cgm, err := toCurrentCGMEntry(conn, sensors); err != nil {
+			log.Err(err).Msg("error while converting current measurement")
+		} else {
+			cgms = append(cgms, cgm)
 		}
 	}
-	scrapeLog.Debug().Msgf("finished fetching data, sleeping for %v", s.interval)
+	return cgms
 }
 
-func (scraper *LibreLinkupScraper) login() error {
-	scraper.log.Debug().Msg("signing in to LibreLinkUp")
-	endpoint, found := librelinkup.EndpointByRegion(scraper.region)
-	if !found {
-		return fmt.Errorf("invalid endpoint region '%s', can not connectp", scraper.region)
+// logbookEvents converts the logbook into alarm events and scanned readings made by the given
+// sensors. Entries that can not be converted are logged and skipped.
+func logbookEvents(patientID string, logbook []librelinkup.LogbookEntry, sensors []datastore.Sensor, log zerolog.Logger) ([]datastore.AlarmEvent, []datastore.CGMEntry) {
+	alarms := []datastore.AlarmEvent{}
+	scans := []datastore.CGMEntry{}
+	for _, entry := range logbook {
+		cgm, err := toCGMEntry(entry.GlucoseMeasurement)
+		if err != nil {
+			log.Err(err).Msgf("error while converting logbook entry at '%v'", entry.FactoryTimestamp)
+			continue
+		}
+		if entry.IsAlarm() {
+			alarms = append(alarms, datastore.AlarmEvent{
+				PatientID: patientID,
+				Timestamp: cgm.Timestamp,
+				Kind:      toAlarmKind(entry.AlarmType),
+				Mmoll:     cgm.Mmoll,
+				MgPerDl:   cgm.MgPerDl,
+				Trend:     cgm.Trend,
+				UTCOffset: cgm.UTCOffset,
+				Source:    LibreLinkUpSource,
+			})
+			continue
+		}
+		cgm.PatientID = patientID
+		cgm.SensorSerial = datastore.SensorAt(sensors, cgm.Timestamp)
+		cgm.Source = LibreLinkUpSource
+		scans = append(scans, cgm)
 	}
-	var err error
-	if scraper.ticket, err = librelinkup.Login(scraper.username, scraper.password, endpoint); err != nil {
-		return err
+	return alarms, scans
+}
+
+// toAlarmKind converts a LibreLinkUp alarm type into an alarm kind.
+func toAlarmKind(alarmType *librelinkup.AlarmType) datastore.AlarmKind {
+	if alarmType == nil {
+		return datastore.AlarmKindUnknown
+	}
+	switch *alarmType {
+	case librelinkup.AlarmLow:
+		return datastore.AlarmKindLow
+	case librelinkup.AlarmHigh:
+		return datastore.AlarmKindHigh
+	case librelinkup.AlarmFixedLow:
+		return datastore.AlarmKindUrgentLow
+	default:
+		return datastore.AlarmKindUnknown
+	}
+}
+
+// saveSensors stores the patient's active sensors, seen at the given time, and returns all the
+// patient's known sensors.
+func saveSensors(db datastore.Store, patientID string, active []librelinkup.ActiveSensor, seen time.Time) ([]datastore.Sensor, error) {
+	for _, sensor := range toSensors(patientID, active, seen) {
+		if err := db.SaveSensor(sensor); err != nil {
+			return nil, err
+		}
 	}
-	scraper.log.Debug().Msg("successfully signed into LibreLinkUp")
-	scraper.log.Debug().Msg("fetching patient identifier")
-	conn, err := scraper.ticket.Connections()
+	return db.Sensors(patientID)
+}
+
+// toSensors converts the patient's active sensors, seen at the given time, into sensors.
+// Sensors without a serial number are skipped.
+func toSensors(patientID string, active []librelinkup.ActiveSensor, seen time.Time) []datastore.Sensor {
+	sensors := []datastore.Sensor{}
+	for _, as := range active {
+		if as.Sensor.SerialNumber == "" {
+			continue
+		}
+		sensors = append(sensors, datastore.Sensor{
+			SerialNumber: as.Sensor.SerialNumber,
+			PatientID:    patientID,
+			DeviceID:     as.Sensor.DeviceID,
+			Activated:    as.Sensor.ActivationTime(),
+			ExpectedEnd:  as.Sensor.ExpectedEnd(),
+			LastSeen:     seen,
+		})
+	}
+	return sensors
+}
+
+// toCGMEntry converts a LibreLinkUp measurement into a CGM entry.
+func toCGMEntry(gm librelinkup.GlucoseMeasurement) (datastore.CGMEntry, error) {
+	ts, err := librelinkup.ToTime(gm.FactoryTimestamp)
+	if err != nil {
+		return datastore.CGMEntry{}, err
+	}
+	cgm := datastore.NewCGMEntry(ts, datastore.Mmoll(gm.Value))
+	if gm.ValueInMgPerDl > 0 {
+		cgm.MgPerDl = gm.ValueInMgPerDl
+	}
+	cgm.Type = datastore.MeasurementType(gm.Type)
+	cgm.Color = datastore.MeasurementColor(gm.MeasurementColor)
+	cgm.IsHigh = gm.IsHigh
+	cgm.IsLow = gm.IsLow
+	cgm.Trend = trendFromArrow(gm.TrendArrow)
+	// Timestamp is the phone's local time, the difference to the factory timestamp (UTC)
+	// is the phone's offset from UTC
+	if local, err := librelinkup.ToTime(gm.Timestamp); err == nil {
+		cgm.UTCOffset = int(local.Sub(ts).Round(time.Minute).Seconds())
+	}
+	return cgm, nil
+}
+
+// trendFromArrow converts a LibreLinkUp trend arrow into a trend.
+func trendFromArrow(arrow int) glucose.Trend {
+	switch arrow {
+	case 1:
+		return glucose.TrendSingleDown
+	case 2:
+		return glucose.TrendFortyFiveDown
+	case 3:
+		return glucose.TrendFlat
+	case 4:
+		return glucose.TrendFortyFiveUp
+	case 5:
+		return glucose.TrendSingleUp
+	default:
+		return glucose.TrendNone
+	}
+}
+
+func (scraper *LibreLinkupScraper) login(ctx context.Context) error {
+	if scraper.ticket == nil {
+		scraper.ticket = scraper.loadTicket()
+	}
+	if scraper.ticket != nil && !scraper.ticket.ExpiresWithin(scraper.refreshMargin()) {
+		scraper.log.Debug().Msgf("reusing ticket expiring %v", scraper.ticket.ExpiresAt())
+	} else {
+		scraper.log.Debug().Msg("signing in to LibreLinkUp")
+		endpoint, found := librelinkup.EndpointByRegion(scraper.settings.LibreLinkUpRegion)
+		if !found {
+			return fmt.Errorf("invalid endpoint region '%s', can not connectp", scraper.settings.LibreLinkUpRegion)
+		}
+		ticket, err := scraper.client.Login(ctx, scraper.settings.LibreLinkUpUsername, scraper.settings.LibreLinkUpPassword, endpoint)
+		var stepErr *librelinkup.StepError
+		if errors.As(err, &stepErr) {
+			scraper.log.Warn().Msgf("LibreLinkUp requires step '%s' to be completed before scraping can continue", stepErr.Step.Type)
+			if err := scraper.db.SaveValue(datastore.KeyLibreLinkUpStep, stepErr.Step.Type); err != nil {
+				scraper.log.Err(err).Msg("could not save pending step")
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := scraper.db.DeleteValue(datastore.KeyLibreLinkUpStep); err != nil {
+			scraper.log.Err(err).Msg("could not delete pending step")
+		}
+		scraper.ticket = ticket
+		scraper.log.Debug().Msg("successfully signed into LibreLinkUp")
+	}
+	scraper.log.Debug().Msg("fetching patient identifiers")
+	conns, err := scraper.client.Connections(ctx, scraper.ticket)
 	if err != nil {
 		scraper.log.Err(err).Msg("error while fetching connections")
+		// the ticket might have been revoked, sign in again next time
+		scraper.clearTicket()
 		return err
 	}
-	if len(conn) != 1 {
-		err := fmt.Errorf("expected to find one connection but found %v, quiting scraper", len(conn))
+	scraper.saveTicket()
+	return scraper.updatePatients(conns)
+}
+
+// updatePatients stores the patients followed by the account and selects the ones to scrape.
+func (scraper *LibreLinkupScraper) updatePatients(conns []librelinkup.Connection) error {
+	if len(conns) == 0 {
+		err := fmt.Errorf("account does not follow any patients, quiting scraper")
 		scraper.log.Err(err).Send()
 		return err
 	}
-	scraper.patientID = conn[0].PatientID
-	scraper.log.Debug().Msgf("successfully fetched patient identifier, '%s'", scraper.patientID)
+	patients := []datastore.Patient{}
+	scraper.patientIDs = []string{}
+	for _, conn := range conns {
+		patients = append(patients, toPatient(conn))
+		if scraper.settings.ScrapesPatient(conn.PatientID) {
+			scraper.patientIDs = append(scraper.patientIDs, conn.PatientID)
+		}
+	}
+	if err := scraper.db.SavePatients(patients...); err != nil {
+		scraper.log.Err(err).Msg("error while saving patients")
+		return err
+	}
+	// entries stored before patients were tracked can only belong to the single patient
+	if len(conns) == 1 {
+		n, err := scraper.db.AssignCGM(conns[0].PatientID)
+		if err != nil {
+			scraper.log.Err(err).Msg("error while assigning CGM data to patient")
+			return err
+		}
+		if n > 0 {
+			scraper.log.Info().Msgf("assigned %v previously stored CGM entries to patient '%s'", n, conns[0].PatientID)
+		}
+	}
+	scraper.log.Debug().Msgf("successfully fetched patient identifiers, scraping %v of %v patients", len(scraper.patientIDs), len(conns))
 	return nil
 }
 
-func NewLibreLinkUpScraper(db datastore.Store, username, password, region string, logger zerolog.Logger, interval time.Duration) (*LibreLinkupScraper, error) {
+// toPatient converts a LibreLinkUp connection into a patient.
+func toPatient(conn librelinkup.Connection) datastore.Patient {
+	return datastore.Patient{
+		ID:         conn.PatientID,
+		FirstName:  conn.FirstName,
+		LastName:   conn.LastName,
+		TargetLow:  conn.TargetLow,
+		TargetHigh: conn.TargetHigh,
+		Updated:    time.Now().UTC(),
+	}
+}
+
+func NewLibreLinkUpScraper(db datastore.Store, client *librelinkup.Client, sealer *sealer.Sealer, settings datastore.Settings, logger zerolog.Logger, interval time.Duration, broker *pubsub.Broker[datastore.CGMEntry]) (*LibreLinkupScraper, error) {
 	scraper := &LibreLinkupScraper{
+		runner:   newRunner(LibreLinkUpSource, db, logger.With().Str("scraper", "LibreLinkUp").Logger(), interval),
 		db:       db,
-		username: username,
-		password: password,
-		region:   region,
-		stopCh:   make(chan struct{}),
-		doneCh:   make(chan struct{}),
-		log:      logger.With().Str("scraper", "LibreLinkUp").Logger(),
-		interval: interval,
-	}
-	scraper.log = scraper.log.With().Str("username", scraper.username).Str("region", scraper.region).Logger()
+		client:   client,
+		sealer:   sealer,
+		broker:   broker,
+		settings: settings,
+	}
+	scraper.fetchFn = scraper.scrape
+	scraper.pollFn = scraper.poll
+	scraper.recoverFn = scraper.recover
+	scraper.backfillInterval = intervalOr(settings.LibreLinkUpBackfillInterval, DefaultLibreLinkUpBackfill)
+	scraper.log = scraper.log.With().Str("username", settings.LibreLinkUpUsername).Str("region", settings.LibreLinkUpRegion).Logger()
 	scraper.log.Info().Msg("initializing scraper")
 	return scraper, nil
 }
@@ -0,0 +1,44 @@
+package scraper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/librelinkup"
+)
+
+func TestToCGMEntry(t *testing.T) {
+	gm := librelinkup.GlucoseMeasurement{
+		FactoryTimestamp: "6/20/2023 8:01:57 PM",
+		Timestamp:        "6/20/2023 10:01:57 PM",
+		Type:             1,
+		ValueInMgPerDl:   196,
+		MeasurementColor: 2,
+		Value:            10.9,
+		IsHigh:           true,
+		TrendArrow:       4,
+	}
+	expected := datastore.CGMEntry{
+		Timestamp: time.Date(2023, time.June, 20, 20, 1, 57, 0, time.UTC),
+		Mmoll:     10.9,
+		MgPerDl:   196,
+		Type:      datastore.MeasurementTypeCurrent,
+		Color:     datastore.MeasurementColorYellow,
+		IsHigh:    true,
+		UTCOffset: 2 * 60 * 60,
+		Trend:     glucose.TrendFortyFiveUp,
+	}
+
+	actual, err := toCGMEntry(gm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != expected {
+		t.Fatalf("expected %+v, got %+v", expected, actual)
+	}
+	if local := actual.LocalTimestamp(); local.Hour() != 22 {
+		t.Errorf("expected local hour 22, got %v", local.Hour())
+	}
+}
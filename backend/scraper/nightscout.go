@@ -0,0 +1,194 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+// NightscoutSource is the name of the Nightscout source.
+const NightscoutSource = "nightscout"
+
+const (
+	// DefaultNightscoutInterval is the time between Nightscout polls if no interval is set,
+	// Nightscout is usually updated every five minutes
+	DefaultNightscoutInterval = 5 * time.Minute
+	// DefaultNightscoutBackfill is how far back entries are fetched on the first poll if no
+	// backfill is set
+	DefaultNightscoutBackfill = 30 * 24 * time.Hour
+
+	// nightscoutPageSize is the number of entries requested per page
+	nightscoutPageSize = 1000
+	// nightscoutPageSpan is the time span requested per page, a full page is split in halves
+	nightscoutPageSpan = 24 * time.Hour
+	// nightscoutLateUpload is how long uploaders might take to upload an entry, empty pages more
+	// recent than this do not move the high-water mark
+	nightscoutLateUpload = time.Hour
+)
+
+func init() {
+	Register(NightscoutSource, newNightscoutSource)
+}
+
+// newNightscoutSource is the Factory of the Nightscout source.
+func newNightscoutSource(deps Deps, settings datastore.Settings) (Source, error) {
+	if !settings.NightscoutConfigured() {
+		return nil, ErrNotConfigured
+	}
+	client, err := nightscout.NewClient(settings.NightscoutURL, nightscout.WithAPISecret(settings.NightscoutAPISecret), nightscout.WithToken(settings.NightscoutToken))
+	if err != nil {
+		return nil, err
+	}
+	return NewNightscoutScraper(deps.DB, client, settings, deps.Logger, intervalOr(settings.NightscoutInterval, intervalOr(deps.Interval, DefaultNightscoutInterval)), deps.Broker)
+}
+
+// NightscoutScraper is the Source polling a Nightscout site for entries. The site is stored as
+// a patient identified by the site's host. Entries are fetched in pages from the high-water
+// mark, the time of the latest fetched entry, which is kept in the kv-table for each site.
+type NightscoutScraper struct {
+	runner
+	db        datastore.Store
+	client    *nightscout.Client
+	broker    *pubsub.Broker[datastore.CGMEntry]
+	settings  datastore.Settings
+	patientID string
+	backfill  time.Duration
+}
+
+func (s *NightscoutScraper) scrape(ctx context.Context) error {
+	s.log.Debug().Msg("starting scrape")
+	if err := s.db.SavePatients(datastore.Patient{ID: s.patientID, FirstName: s.client.Host(), Updated: time.Now().UTC()}); err != nil {
+		return fmt.Errorf("could not save patient to datastore: %w", err)
+	}
+	hwm, err := s.highWaterMark()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	span := nightscoutPageSpan
+	for from := hwm; from.Before(now); {
+		to := from.Add(span)
+		if to.After(now) {
+			to = now
+		}
+		entries, err := s.client.Entries(ctx, from, to, nightscoutPageSize)
+		if err != nil {
+			return fmt.Errorf("error while fetching entries after %v: %w", from, err)
+		}
+		if len(entries) >= nightscoutPageSize && span > time.Minute {
+			// some entries did not fit the page, request a shorter span instead
+			span /= 2
+			continue
+		}
+		latest, err := s.save(entries)
+		if err != nil {
+			return err
+		}
+		if latest.After(hwm) {
+			hwm = latest
+		} else if to.Before(now.Add(-nightscoutLateUpload)) {
+			hwm = to
+		}
+		if err := s.db.SaveValue(datastore.KeyHighWaterMark(s.patientID), strconv.FormatInt(hwm.UnixMilli(), 10)); err != nil {
+			return fmt.Errorf("could not save high-water mark: %w", err)
+		}
+		from = to
+		span = nightscoutPageSpan
+	}
+	return nil
+}
+
+// highWaterMark returns the time of the latest fetched entry, or the start of the backfill if
+// no entries have been fetched.
+func (s *NightscoutScraper) highWaterMark() (time.Time, error) {
+	value, err := s.db.GetValue(datastore.KeyHighWaterMark(s.patientID))
+	if errors.Is(err, datastore.ErrNotFound) {
+		s.log.Info().Msgf("no entries fetched before, fetching entries from the last %v", s.backfill)
+		return time.Now().UTC().Add(-s.backfill), nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not load high-water mark: %w", err)
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("high-water mark '%s' is not valid: %w", value, err)
+	}
+	return time.UnixMilli(ms).UTC(), nil
+}
+
+// save stores the entries and returns the time of the latest entry.
+func (s *NightscoutScraper) save(entries []nightscout.Entry) (time.Time, error) {
+	latest := time.Time{}
+	cgms := []datastore.CGMEntry{}
+	for _, e := range entries {
+		if e.SGV <= 0 {
+			continue
+		}
+		cgm := nightscoutToCGMEntry(e)
+		cgm.PatientID = s.patientID
+		cgms = append(cgms, cgm)
+		if cgm.Timestamp.After(latest) {
+			latest = cgm.Timestamp
+		}
+	}
+	saved, err := s.db.SaveCGM(cgms...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not save CGM data to datastore: %w", err)
+	}
+	s.log.Debug().Msgf("saved %v new CGM entries", len(saved))
+	s.broker.Publish(saved...)
+	s.ingested(len(saved))
+	return latest, nil
+}
+
+// recover returns how long to wait before retrying after the error.
+func (s *NightscoutScraper) recover(err error) time.Duration {
+	switch {
+	case errors.Is(err, nightscout.ErrUnauthorized):
+		// retrying with the same secret will not help, wait for new settings
+		s.backoff.Reset()
+		return s.interval
+	case nightscout.IsTransient(err):
+	default:
+		if s.backoff.Attempts() >= maxUnknownRetries {
+			s.backoff.Reset()
+			return s.interval
+		}
+	}
+	return s.backoff.Next()
+}
+
+// nightscoutToCGMEntry converts a Nightscout entry into a CGM entry.
+func nightscoutToCGMEntry(e nightscout.Entry) datastore.CGMEntry {
+	cgm := nightscout.ToCGMEntry(e)
+	cgm.Source = NightscoutSource
+	return cgm
+}
+
+func NewNightscoutScraper(db datastore.Store, client *nightscout.Client, settings datastore.Settings, logger zerolog.Logger, interval time.Duration, broker *pubsub.Broker[datastore.CGMEntry]) (*NightscoutScraper, error) {
+	scraper := &NightscoutScraper{
+		runner:    newRunner(NightscoutSource, db, logger.With().Str("scraper", "Nightscout").Logger(), interval),
+		db:        db,
+		client:    client,
+		broker:    broker,
+		settings:  settings,
+		patientID: "nightscout:" + client.Host(),
+		backfill:  DefaultNightscoutBackfill,
+	}
+	if settings.NightscoutBackfillDays > 0 {
+		scraper.backfill = time.Duration(settings.NightscoutBackfillDays) * 24 * time.Hour
+	}
+	scraper.fetchFn = scraper.scrape
+	scraper.recoverFn = scraper.recover
+	scraper.log = scraper.log.With().Str("site", client.Host()).Logger()
+	scraper.log.Info().Msg("initializing scraper")
+	return scraper, nil
+}
@@ -0,0 +1,144 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/glucose"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+// fakeNightscout serves the entries the way Nightscout does, latest first and limited by count.
+// Uploaded entries are added, failUploads is the number of uploads that fail before they succeed.
+type fakeNightscout struct {
+	mu          sync.Mutex
+	entries     []nightscout.Entry
+	requests    int
+	uploads     int
+	failUploads int
+}
+
+func (f *fakeNightscout) add(entries ...nightscout.Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, entries...)
+	sort.Slice(f.entries, func(i, j int) bool { return f.entries[i].Date > f.entries[j].Date })
+}
+
+func (f *fakeNightscout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if r.Method == http.MethodPost {
+		f.uploads++
+		if f.failUploads > 0 {
+			f.failUploads--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		entries := []nightscout.Entry{}
+		json.NewDecoder(r.Body).Decode(&entries)
+		f.entries = append(f.entries, entries...)
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+	q := r.URL.Query()
+	gt, _ := strconv.ParseInt(q.Get("find[date][$gt]"), 10, 64)
+	lte, _ := strconv.ParseInt(q.Get("find[date][$lte]"), 10, 64)
+	count, _ := strconv.Atoi(q.Get("count"))
+	result := []nightscout.Entry{}
+	for _, e := range f.entries {
+		if e.Date > gt && e.Date <= lte && len(result) < count {
+			result = append(result, e)
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func TestNightscoutScrape(t *testing.T) {
+	fake := &fakeNightscout{}
+	now := time.Now().UTC().Truncate(time.Minute)
+	// three days of readings every 5 minutes, more than fits a page per day
+	for ts := now.Add(-72 * time.Hour); !ts.After(now); ts = ts.Add(5 * time.Minute) {
+		fake.add(nightscout.Entry{Type: nightscout.EntryTypeSGV, SGV: 100, Date: ts.UnixMilli(), Direction: "FortyFiveDown", Device: "xDrip-DexcomG6", UTCOffset: 120})
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client, err := nightscout.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := setupScraper(t, datastore.Settings{}).db
+	s, err := NewNightscoutScraper(store, client, datastore.Settings{NightscoutURL: srv.URL, NightscoutBackfillDays: 2}, zerolog.Nop(), time.Minute, pubsub.NewBroker[datastore.CGMEntry]())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cgms, err := store.LoadCGMInterval(s.patientID, now.Add(-72*time.Hour), now.Add(time.Minute), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 48 * 12; len(cgms) != expected {
+		t.Fatalf("expected %v entries from the two days of backfill, got %v", expected, len(cgms))
+	}
+	latest := cgms[len(cgms)-1]
+	if !latest.Timestamp.Equal(now) || latest.Trend != glucose.TrendFortyFiveDown || latest.Device != "xDrip-DexcomG6" || latest.UTCOffset != 2*60*60 || latest.Source != NightscoutSource {
+		t.Errorf("unexpected latest entry %+v", latest)
+	}
+	hwm, err := store.GetValue(datastore.KeyHighWaterMark(s.patientID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwm != strconv.FormatInt(now.UnixMilli(), 10) {
+		t.Errorf("expected high-water mark at the latest entry, got %s", hwm)
+	}
+
+	// later polls only fetch entries after the high-water mark
+	fake.add(nightscout.Entry{Type: nightscout.EntryTypeSGV, SGV: 120, Date: now.Add(time.Second).UnixMilli()})
+	requests := fake.requests
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fake.requests != requests+1 {
+		t.Errorf("expected a single request after the high-water mark, got %v", fake.requests-requests)
+	}
+	if latest, err := store.LatestCGM(s.patientID); err != nil || latest.MgPerDl != 120 {
+		t.Errorf("expected the new entry to be stored, got %+v, %v", latest, err)
+	}
+
+	// another site has a high-water mark of its own and starts with the backfill
+	other := httptest.NewServer(fake)
+	t.Cleanup(other.Close)
+	otherClient, err := nightscout.NewClient(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewNightscoutScraper(store, otherClient, datastore.Settings{NightscoutURL: other.URL, NightscoutBackfillDays: 2}, zerolog.Nop(), time.Minute, pubsub.NewBroker[datastore.CGMEntry]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cgms, err = store.LoadCGMInterval(o.patientID, now.Add(-72*time.Hour), now.Add(time.Minute), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 48*12 + 1; len(cgms) != expected {
+		t.Errorf("expected %v entries from the backfill of the other site, got %v", expected, len(cgms))
+	}
+}
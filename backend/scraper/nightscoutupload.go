@@ -0,0 +1,262 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+// NightscoutUploadSource is the name of the sink uploading LibreLinkUp readings to Nightscout.
+const NightscoutUploadSource = "nightscout-upload"
+
+const (
+	// DefaultUploadInterval is the time between uploads of readings that were not uploaded when
+	// they were stored, such as readings that failed to upload
+	DefaultUploadInterval = 5 * time.Minute
+	// DefaultUploadBackfill is how far back readings are uploaded the first time
+	DefaultUploadBackfill = 24 * time.Hour
+
+	// uploadBatchSize is the number of readings uploaded per request
+	uploadBatchSize = 500
+	// readings that failed to upload are retried after a delay growing from uploadRetryInitial
+	// to uploadRetryMax with the number of attempts
+	uploadRetryInitial = time.Minute
+	uploadRetryMax     = time.Hour
+)
+
+func init() {
+	Register(NightscoutUploadSource, newNightscoutUploadSink)
+}
+
+// newNightscoutUploadSink is the Factory of the Nightscout upload sink.
+func newNightscoutUploadSink(deps Deps, settings datastore.Settings) (Source, error) {
+	if !settings.NightscoutUploadConfigured() {
+		return nil, ErrNotConfigured
+	}
+	client, err := nightscout.NewClient(settings.NightscoutUploadURL, nightscout.WithAPISecret(settings.NightscoutUploadAPISecret))
+	if err != nil {
+		return nil, err
+	}
+	return NewNightscoutUploader(deps.DB, client, settings, deps.Logger, DefaultUploadInterval, deps.Broker)
+}
+
+// NightscoutUploader is the Sink uploading the readings stored by the LibreLinkUp scraper to a
+// Nightscout site. Published readings are added to the outbox and uploaded right away. Every
+// upload also adds readings stored after the latest uploaded reading, the high-water mark kept
+// in the kv-table for each site and patient, so readings stored while the uploader was stopped
+// are uploaded as well. Readings that fail to upload stay in the outbox and are retried with a
+// growing delay.
+type NightscoutUploader struct {
+	runner
+	db     datastore.Store
+	client *nightscout.Client
+	broker *pubsub.Broker[datastore.CGMEntry]
+	// patientID is the patient whose readings are uploaded, all patients if empty
+	patientID string
+	// markKey is the kv-table key of the high-water mark of the site and patient
+	markKey  string
+	backfill time.Duration
+	// retry is the delay before the first retry of a reading that failed to upload
+	retry time.Duration
+}
+
+func NewNightscoutUploader(db datastore.Store, client *nightscout.Client, settings datastore.Settings, logger zerolog.Logger, interval time.Duration, broker *pubsub.Broker[datastore.CGMEntry]) (*NightscoutUploader, error) {
+	uploader := &NightscoutUploader{
+		runner:    newRunner(NightscoutUploadSource, db, logger.With().Str("sink", "Nightscout").Logger(), interval),
+		db:        db,
+		client:    client,
+		broker:    broker,
+		patientID: settings.NightscoutUploadPatient,
+		markKey:   uploadMarkKey(client.Host(), settings.NightscoutUploadPatient),
+		backfill:  DefaultUploadBackfill,
+		retry:     uploadRetryInitial,
+	}
+	uploader.fetchFn = uploader.upload
+	uploader.recoverFn = uploader.recover
+	uploader.watchFn = uploader.watch
+	uploader.fetchKind = RunUpload
+	uploader.log = uploader.log.With().Str("site", client.Host()).Logger()
+	uploader.log.Info().Msg("initializing uploader")
+	return uploader, nil
+}
+
+// uploadMarkKey returns the key of the high-water mark of uploads to the site, a new site or
+// patient starts over with the backfill.
+func uploadMarkKey(host, patientID string) string {
+	key := NightscoutUploadSource + "_" + host
+	if patientID != "" {
+		key += "_" + patientID
+	}
+	return datastore.KeyHighWaterMark(key)
+}
+
+// Pending returns the number of readings waiting to be uploaded.
+func (u *NightscoutUploader) Pending() (int, error) {
+	return u.db.OutboxSize(NightscoutUploadSource)
+}
+
+// watch adds readings to the outbox as they are published and triggers an upload, unless the
+// uploader is paused.
+func (u *NightscoutUploader) watch(ctx context.Context) {
+	for cgm := range u.broker.Subscribe(ctx) {
+		if !u.uploads(cgm) {
+			continue
+		}
+		if err := u.db.EnqueueOutbox(NightscoutUploadSource, u.markKey, cgm); err != nil {
+			u.log.Err(err).Msg("could not add reading to outbox")
+			continue
+		}
+		if !u.Status().Paused {
+			u.ScrapeNow()
+		}
+	}
+}
+
+// uploads returns true if the reading is one the uploader uploads.
+func (u *NightscoutUploader) uploads(cgm datastore.CGMEntry) bool {
+	return cgm.Source == LibreLinkUpSource && (u.patientID == "" || cgm.PatientID == u.patientID)
+}
+
+func (u *NightscoutUploader) upload(ctx context.Context) error {
+	u.log.Debug().Msg("starting upload")
+	if err := u.catchUp(); err != nil {
+		return err
+	}
+	for {
+		due, err := u.db.LoadOutbox(NightscoutUploadSource, time.Now().UTC(), uploadBatchSize)
+		if err != nil {
+			return fmt.Errorf("could not load outbox: %w", err)
+		}
+		if len(due) == 0 {
+			return nil
+		}
+		entries := []nightscout.Entry{}
+		latest := time.Time{}
+		for _, e := range due {
+			entry := nightscout.ToEntry(e.CGM)
+			// Nightscout assigns its own identifiers
+			entry.ID = ""
+			entries = append(entries, entry)
+			if e.CGM.Timestamp.After(latest) {
+				latest = e.CGM.Timestamp
+			}
+		}
+		if err := u.client.UploadEntries(ctx, entries); err != nil {
+			if ctx.Err() == nil {
+				u.retryLater(due, err)
+			}
+			return fmt.Errorf("error while uploading %v readings: %w", len(entries), err)
+		}
+		// the mark is moved first so a reading published after it was uploaded is not added to
+		// the outbox again
+		if err := u.saveHighWaterMark(latest); err != nil {
+			return err
+		}
+		if err := u.db.DeleteOutbox(due...); err != nil {
+			return fmt.Errorf("could not remove uploaded readings from outbox: %w", err)
+		}
+		u.ingested(len(due))
+		u.log.Debug().Msgf("uploaded %v readings", len(due))
+		if len(due) < uploadBatchSize {
+			return nil
+		}
+	}
+}
+
+// catchUp adds readings stored after the high-water mark to the outbox.
+func (u *NightscoutUploader) catchUp() error {
+	hwm, err := u.highWaterMark()
+	if err != nil {
+		return err
+	}
+	patientIDs := []string{u.patientID}
+	if u.patientID == "" {
+		patients, err := u.db.Patients()
+		if err != nil {
+			return fmt.Errorf("could not load patients from datastore: %w", err)
+		}
+		patientIDs = []string{}
+		for _, p := range patients {
+			patientIDs = append(patientIDs, p.ID)
+		}
+	}
+	// readings are stored by the second, the reading at the high-water mark is uploaded
+	from, to := hwm.Add(time.Second), time.Now().UTC().Add(time.Hour)
+	for _, patientID := range patientIDs {
+		cgms, err := u.db.LoadCGMInterval(patientID, from, to, 0)
+		if err != nil {
+			return fmt.Errorf("could not load CGM data from datastore: %w", err)
+		}
+		missed := []datastore.CGMEntry{}
+		for _, cgm := range cgms {
+			if u.uploads(cgm) {
+				missed = append(missed, cgm)
+			}
+		}
+		if err := u.db.EnqueueOutbox(NightscoutUploadSource, u.markKey, missed...); err != nil {
+			return fmt.Errorf("could not add readings to outbox: %w", err)
+		}
+	}
+	return nil
+}
+
+// retryLater records the failed upload of the readings and when they are retried.
+func (u *NightscoutUploader) retryLater(entries []datastore.OutboxEntry, err error) {
+	now := time.Now().UTC()
+	for i := range entries {
+		b := Backoff{Initial: u.retry, Max: uploadRetryMax, Multiplier: 2, attempt: entries[i].Attempts, random: rand.Float64}
+		entries[i].Attempts++
+		entries[i].NextAttempt = now.Add(b.Next())
+		entries[i].Error = err.Error()
+	}
+	if err := u.db.UpdateOutbox(entries...); err != nil {
+		u.log.Err(err).Msg("could not save failed upload in outbox")
+	}
+}
+
+// highWaterMark returns the time of the latest uploaded reading, or the start of the backfill
+// if nothing has been uploaded.
+func (u *NightscoutUploader) highWaterMark() (time.Time, error) {
+	value, err := u.db.GetValue(u.markKey)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return time.Now().UTC().Add(-u.backfill), nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not load high-water mark: %w", err)
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("high-water mark '%s' is not valid: %w", value, err)
+	}
+	return time.UnixMilli(ms).UTC(), nil
+}
+
+// saveHighWaterMark moves the high-water mark to the time of the reading, if it is later.
+func (u *NightscoutUploader) saveHighWaterMark(latest time.Time) error {
+	hwm, err := u.highWaterMark()
+	if err != nil || !latest.After(hwm) {
+		return err
+	}
+	if err := u.db.SaveValue(u.markKey, strconv.FormatInt(latest.UnixMilli(), 10)); err != nil {
+		return fmt.Errorf("could not save high-water mark: %w", err)
+	}
+	return nil
+}
+
+// recover returns how long to wait before retrying after the error.
+func (u *NightscoutUploader) recover(err error) time.Duration {
+	if errors.Is(err, nightscout.ErrUnauthorized) {
+		// retrying with the same secret will not help, wait for new settings
+		u.backoff.Reset()
+		return u.interval
+	}
+	return u.backoff.Next()
+}
@@ -0,0 +1,164 @@
+package scraper
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/nightscout"
+	"github.com/spagettikod/opent1d/pubsub"
+)
+
+func TestNightscoutUpload(t *testing.T) {
+	fake := &fakeNightscout{failUploads: 1}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	// the watcher writes on its own goroutine, an in-memory database is per connection
+	store, err := datastore.NewSQLiteStore("file:" + t.TempDir() + "/opent1d.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SavePatients(datastore.Patient{ID: "p1"}, datastore.Patient{ID: "p2"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	reading := func(patientID, source string, age time.Duration) datastore.CGMEntry {
+		cgm := datastore.NewCGMEntry(now.Add(-age), 6.5)
+		cgm.PatientID = patientID
+		cgm.Source = source
+		return cgm
+	}
+	// only LibreLinkUp readings of the patient from the last day are uploaded
+	if _, err := store.SaveCGM(
+		reading("p1", LibreLinkUpSource, 30*time.Minute),
+		reading("p1", LibreLinkUpSource, 25*time.Minute),
+		reading("p1", LibreLinkUpSource, 48*time.Hour),
+		reading("p1", NightscoutSource, 20*time.Minute),
+		reading("p2", LibreLinkUpSource, 20*time.Minute),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := nightscout.NewClient(srv.URL, nightscout.WithAPISecret("abcdefghijkl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := pubsub.NewBroker[datastore.CGMEntry]()
+	u, err := NewNightscoutUploader(store, client, datastore.Settings{NightscoutUploadPatient: "p1"}, zerolog.Nop(), time.Hour, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.retry = 0
+	ctx := context.Background()
+
+	// a failed upload keeps the readings in the outbox
+	if err := u.Fetch(ctx); !nightscout.IsTransient(err) {
+		t.Fatalf("expected a transient error, got %v", err)
+	}
+	if pending, err := u.Pending(); err != nil || pending != 2 {
+		t.Fatalf("expected 2 pending readings, got %v, %v", pending, err)
+	}
+	outbox, err := store.LoadOutbox(NightscoutUploadSource, now.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outbox) != 2 || outbox[0].Attempts != 1 || outbox[0].Error == "" {
+		t.Errorf("expected the failed upload to be recorded, got %+v", outbox)
+	}
+	if h := u.Health(); h.State != HealthFailing || h.Failures != 1 {
+		t.Errorf("expected failing sink, got %+v", h)
+	}
+
+	if err := u.Fetch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := u.Pending(); err != nil || pending != 0 {
+		t.Fatalf("expected no pending readings, got %v, %v", pending, err)
+	}
+	fake.mu.Lock()
+	uploaded := append([]nightscout.Entry{}, fake.entries...)
+	fake.mu.Unlock()
+	if len(uploaded) != 2 || uploaded[0].Date != now.Add(-30*time.Minute).UnixMilli() || uploaded[0].Device != "opent1d-librelinkup" || uploaded[0].ID != "" {
+		t.Fatalf("expected the two recent LibreLinkUp readings of p1 to be uploaded, got %+v", uploaded)
+	}
+	runs, err := store.LoadScrapeRuns(NightscoutUploadSource, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Kind != RunUpload || runs[0].Readings != 2 {
+		t.Errorf("expected the upload to be recorded, got %+v", runs)
+	}
+
+	// published readings are uploaded right away
+	u.Start()
+	t.Cleanup(u.Stop)
+	published := reading("p1", LibreLinkUpSource, 10*time.Minute)
+	if _, err := store.SaveCGM(published); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Subscribers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("uploader did not subscribe to readings")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	broker.Publish(published)
+	// wait until no more uploads are made, a reading uploaded twice shows up as a fourth entry
+	count, stable := 0, time.Now()
+	for count < 3 || time.Since(stable) < 200*time.Millisecond {
+		fake.mu.Lock()
+		n := len(fake.entries)
+		fake.mu.Unlock()
+		if n != count {
+			count, stable = n, time.Now()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("published reading was not uploaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	u.Stop()
+	if count != 3 {
+		t.Fatalf("expected the published reading to be uploaded once, got %v entries", count)
+	}
+
+	// readings stored while stopped are uploaded on the next upload
+	if _, err := store.SaveCGM(reading("p1", LibreLinkUpSource, 5*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Fetch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	if len(fake.entries) != 4 || fake.entries[3].Date != now.Add(-5*time.Minute).UnixMilli() {
+		t.Errorf("expected the reading stored while stopped to be uploaded, got %+v", fake.entries)
+	}
+	fake.mu.Unlock()
+	hwm, err := store.GetValue(uploadMarkKey(client.Host(), "p1"))
+	if err != nil || hwm != strconv.FormatInt(now.Add(-5*time.Minute).UnixMilli(), 10) {
+		t.Errorf("expected high-water mark at the latest upload, got %v, %v", hwm, err)
+	}
+
+	// another patient has a high-water mark of its own and starts with the backfill
+	other, err := NewNightscoutUploader(store, client, datastore.Settings{NightscoutUploadPatient: "p2"}, zerolog.Nop(), time.Hour, broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Fetch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.entries) != 5 || fake.entries[4].Date != now.Add(-20*time.Minute).UnixMilli() {
+		t.Errorf("expected the reading of the other patient to be uploaded, got %+v", fake.entries)
+	}
+}
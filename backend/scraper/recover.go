@@ -0,0 +1,67 @@
+package scraper
+
+import (
+	"errors"
+	"time"
+
+	"github.com/spagettikod/opent1d/librelinkup"
+)
+
+// retryInitialDelay is the delay before the first retry after a failed scrape
+const retryInitialDelay = 30 * time.Second
+
+// recover prepares the scraper to retry after the error and returns how long to wait before
+// retrying. Failures that will not go away by retrying, such as wrong credentials, wait a full
+// interval.
+func (s *LibreLinkupScraper) recover(err error) time.Duration {
+	switch {
+	case errors.Is(err, librelinkup.ErrLoginFailed):
+		// retrying with the same credentials will not help, wait for new settings
+		s.backoff.Reset()
+		return s.interval
+	case errors.Is(err, librelinkup.ErrStepRequired):
+		// the user must complete the step, wait for acceptLibreLinkUpTerms to restart the scraper
+		s.backoff.Reset()
+		return s.interval
+	case errors.Is(err, librelinkup.ErrUnauthorized):
+		s.log.Info().Msg("ticket was rejected, signing in again")
+		s.clearTicket()
+	case errors.Is(err, librelinkup.ErrWrongRegionEndpoint):
+		s.log.Info().Msg("account belongs to another region, looking up region")
+		if err := s.redetectRegion(); err != nil {
+			s.log.Err(err).Msg("could not look up region")
+		}
+	case librelinkup.IsTransient(err):
+	default:
+		// unknown errors might be transient as well, but do not retry them more than a few times
+		if s.backoff.Attempts() >= maxUnknownRetries {
+			s.backoff.Reset()
+			return s.interval
+		}
+	}
+	wait := s.backoff.Next()
+	if retryAfter := librelinkup.RetryAfter(err); retryAfter > wait {
+		wait = retryAfter
+	}
+	return wait
+}
+
+// maxUnknownRetries is how many times errors not known to be transient are retried
+const maxUnknownRetries = 3
+
+// redetectRegion looks up the account's region and stores it in the settings.
+func (s *LibreLinkupScraper) redetectRegion() error {
+	endpoint, err := s.client.FindEndpoint(s.ctx, s.settings.LibreLinkUpUsername, s.settings.LibreLinkUpPassword)
+	if err != nil {
+		return err
+	}
+	s.clearTicket()
+	s.settings.LibreLinkUpRegion = endpoint.Region
+	settings, err := s.db.GetSettings()
+	if err != nil {
+		return err
+	}
+	settings.LibreLinkUpRegion = endpoint.Region
+	s.log.Info().Msgf("account moved to region '%s'", endpoint.Region)
+	return s.db.SaveSettings(settings)
+}
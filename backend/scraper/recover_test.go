@@ -0,0 +1,47 @@
+package scraper
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/librelinkup"
+)
+
+func TestRecover(t *testing.T) {
+	s := setupScraper(t, datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "eu"})
+	s.backoff.random = func() float64 { return 0 }
+
+	if wait := s.recover(librelinkup.ErrLoginFailed); wait != s.interval {
+		t.Errorf("expected failed login to wait %v, got %v", s.interval, wait)
+	}
+
+	s.ticket = &librelinkup.Ticket{Token: "revoked"}
+	if wait := s.recover(fmt.Errorf("graph: %w", librelinkup.ErrUnauthorized)); wait != retryInitialDelay {
+		t.Errorf("expected unauthorized to wait %v, got %v", retryInitialDelay, wait)
+	}
+	if s.ticket != nil {
+		t.Error("expected ticket to be cleared after unauthorized")
+	}
+
+	if wait := s.recover(fmt.Errorf("%w: connection reset", librelinkup.ErrNetwork)); wait != 2*retryInitialDelay {
+		t.Errorf("expected second retry to wait %v, got %v", 2*retryInitialDelay, wait)
+	}
+
+	rateLimited := &librelinkup.StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: 10 * time.Minute, Err: librelinkup.ErrRateLimited}
+	if wait := s.recover(rateLimited); wait != 10*time.Minute {
+		t.Errorf("expected rate limit to wait %v, got %v", 10*time.Minute, wait)
+	}
+
+	s.backoff.Reset()
+	for i := 0; i < maxUnknownRetries; i++ {
+		if wait := s.recover(fmt.Errorf("unknown")); wait == s.interval {
+			t.Errorf("expected unknown error %v to be retried", i)
+		}
+	}
+	if wait := s.recover(fmt.Errorf("unknown")); wait != s.interval {
+		t.Errorf("expected unknown error to wait %v after %v retries, got %v", s.interval, maxUnknownRetries, wait)
+	}
+}
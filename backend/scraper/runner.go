@@ -0,0 +1,368 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+)
+
+// ErrPanicked is recorded in the health of a source whose fetch loop panicked, the loop is
+// restarted after a backoff.
+var ErrPanicked = errors.New("source panicked")
+
+// Kinds of scrape runs.
+const (
+	// RunPoll is a poll of the latest readings
+	RunPoll = "poll"
+	// RunBackfill is a full fetch of all readings since the latest stored one
+	RunBackfill = "backfill"
+	// RunUpload is an upload of waiting readings by a sink
+	RunUpload = "upload"
+)
+
+// runner fetches readings in the background, at an interval, until stopped. Failed fetches are
+// retried after the delay returned by recoverFn. Sources embed a runner to implement the
+// lifecycle methods of Source.
+//
+// Start and Stop are idempotent and safe for concurrent use, a stopped runner can be started
+// again. The fetch functions themselves only ever run on the runner's goroutine. Every fetch is
+// recorded as a scrape run in the datastore, if there is one.
+//
+// Sources that can fetch the latest reading cheaper than a full fetch set pollFn, which then
+// runs at the interval while fetchFn only runs as a backfill every backfill interval, when the
+// runner starts and when pollFn reports that readings were missed.
+//
+// Sources that need to react to events between fetches set watchFn, which runs on a goroutine of
+// its own while the runner is running.
+type runner struct {
+	healthTracker
+	name      string
+	db        datastore.Store
+	log       zerolog.Logger
+	interval  time.Duration
+	backoff   *Backoff
+	fetchFn   func(ctx context.Context) error
+	pollFn    func(ctx context.Context) (backfill bool, err error)
+	recoverFn func(err error) time.Duration
+	watchFn   func(ctx context.Context)
+	// fetchKind is the kind of run recorded for fetchFn, RunBackfill if empty
+	fetchKind string
+	// backfillInterval is the time between backfills, only used if pollFn is set
+	backfillInterval time.Duration
+	lastBackfill     time.Time
+	// readings is the number of new readings stored by the current run
+	readings int
+	// ctx is the context of the current run, fetches started by it are cancelled on Stop
+	ctx context.Context
+	// trigger makes the runner fetch right away, wake makes it check if it is paused
+	trigger chan struct{}
+	wake    chan struct{}
+
+	// lifecycle serializes Start and Stop, mu guards the state read by Status, the loop takes
+	// mu so it must not be held while waiting for the loop to finish
+	lifecycle sync.Mutex
+	mu        sync.Mutex
+	running   bool
+	paused    bool
+	nextRun   time.Time
+	cancel    context.CancelFunc
+	doneCh    chan struct{}
+}
+
+func newRunner(name string, db datastore.Store, logger zerolog.Logger, interval time.Duration) runner {
+	return runner{
+		name:             name,
+		db:               db,
+		log:              logger,
+		interval:         interval,
+		backfillInterval: interval,
+		backoff:          NewBackoff(retryInitialDelay, interval),
+		ctx:              context.Background(),
+		trigger:          make(chan struct{}, 1),
+		wake:             make(chan struct{}, 1),
+	}
+}
+
+func (r *runner) Name() string {
+	return r.name
+}
+
+func (r *runner) IsRunning() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running
+}
+
+func (r *runner) Start() {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	if r.IsRunning() {
+		return
+	}
+	r.log.Debug().Msgf("starting scraper")
+	paused := r.loadPaused()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	r.mu.Lock()
+	r.paused, r.cancel, r.doneCh = paused, cancel, done
+	r.running = true
+	r.mu.Unlock()
+	r.ctx = ctx
+	go r.run(ctx, done)
+}
+
+func (r *runner) Stop() {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return
+	}
+	cancel, done := r.cancel, r.doneCh
+	r.mu.Unlock()
+	r.log.Debug().Msg("stopping scraper")
+	// cancelling also aborts any request in flight
+	cancel()
+	<-done
+	r.mu.Lock()
+	r.running = false
+	r.mu.Unlock()
+}
+
+// Pause stops scheduled fetches until Resume is called, also after the source is restarted.
+func (r *runner) Pause() {
+	r.setPaused(true)
+}
+
+// Resume starts scheduled fetches again after Pause, fetches that became due while paused are
+// made right away.
+func (r *runner) Resume() {
+	r.setPaused(false)
+}
+
+func (r *runner) setPaused(paused bool) {
+	r.mu.Lock()
+	r.paused = paused
+	r.mu.Unlock()
+	if r.db != nil {
+		var err error
+		if paused {
+			err = r.db.SaveValue(datastore.KeyPaused(r.name), "true")
+		} else {
+			err = r.db.DeleteValue(datastore.KeyPaused(r.name))
+		}
+		if err != nil {
+			r.log.Err(err).Msg("could not save paused state")
+		}
+	}
+	notify(r.wake)
+}
+
+// loadPaused returns true if the source was paused when it was last running.
+func (r *runner) loadPaused() bool {
+	if r.db == nil {
+		return false
+	}
+	_, err := r.db.GetValue(datastore.KeyPaused(r.name))
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		r.log.Err(err).Msg("could not load paused state")
+	}
+	return err == nil
+}
+
+// ScrapeNow makes the running source backfill right away, even if it is paused.
+func (r *runner) ScrapeNow() {
+	notify(r.trigger)
+}
+
+// notify sends on the channel without blocking, a notification already waiting is enough.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the source's health and schedule.
+func (r *runner) Status() Status {
+	status := Status{Health: r.Health()}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status.Running = r.running
+	status.Paused = r.paused
+	if r.running && !r.paused {
+		status.NextRun = r.nextRun
+	}
+	return status
+}
+
+func (r *runner) setNextRun(next time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextRun = next
+}
+
+// ingested counts the new readings stored by the current run.
+func (r *runner) ingested(n int) {
+	r.readings += n
+}
+
+// Fetch fetches readings once and records the outcome in the source's health.
+func (r *runner) Fetch(ctx context.Context) error {
+	kind := r.fetchKind
+	if kind == "" {
+		kind = RunBackfill
+	}
+	err := r.runOnce(ctx, kind, r.fetchFn)
+	if err == nil {
+		r.lastBackfill = time.Now()
+	}
+	return err
+}
+
+// runOnce runs the fetch function and records the run, runs cancelled by Stop are not recorded.
+func (r *runner) runOnce(ctx context.Context, kind string, fn func(ctx context.Context) error) error {
+	r.readings = 0
+	started := time.Now().UTC()
+	err := fn(ctx)
+	if ctx.Err() != nil {
+		return err
+	}
+	r.record(err)
+	if r.db != nil {
+		run := datastore.ScrapeRun{Source: r.name, Kind: kind, Started: started, Finished: time.Now().UTC(), Readings: r.readings}
+		if err != nil {
+			run.Error = err.Error()
+		}
+		if err := r.db.SaveScrapeRun(run); err != nil {
+			r.log.Err(err).Msg("could not save scrape run")
+		}
+	}
+	return err
+}
+
+// next polls for the latest readings, or fetches all readings if a backfill is due or the poll
+// reports that readings were missed.
+func (r *runner) next(ctx context.Context) error {
+	if r.pollFn != nil && !r.backfillDue() {
+		backfill := false
+		err := r.runOnce(ctx, RunPoll, func(ctx context.Context) error {
+			var err error
+			backfill, err = r.pollFn(ctx)
+			return err
+		})
+		if err != nil || !backfill {
+			return err
+		}
+		r.log.Info().Msg("readings were missed since the last poll, backfilling")
+	}
+	return r.Fetch(ctx)
+}
+
+// backfillDue returns true if no backfill has succeeded within the backfill interval.
+func (r *runner) backfillDue() bool {
+	return r.lastBackfill.IsZero() || time.Since(r.lastBackfill) >= r.backfillInterval
+}
+
+// run runs the fetch loop until the context is cancelled, restarting it after a backoff if it
+// panics.
+func (r *runner) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	if r.watchFn != nil {
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			r.watchFn(ctx)
+		}()
+		defer func() { <-watched }()
+	}
+	for r.loop(ctx) {
+		wait := r.backoff.Next()
+		r.log.Error().Msgf("restarting %s in %v", r.name, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// loop fetches readings until the context is cancelled, it returns true if it panicked.
+func (r *runner) loop(ctx context.Context) (panicked bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.log.Error().Str("stack", string(debug.Stack())).Msgf("%s panicked: %v", r.name, p)
+			r.record(fmt.Errorf("%w: %v", ErrPanicked, p))
+			panicked = true
+		}
+	}()
+
+	r.setNextRun(time.Now())
+	for {
+		if !r.sleep(ctx) {
+			r.log.Debug().Msgf("received stop signal, stopping scrape")
+			return false
+		}
+		wait := r.interval
+		err := r.next(ctx)
+		if ctx.Err() != nil {
+			r.log.Debug().Msgf("received stop signal, stopping scrape")
+			return false
+		}
+		if err != nil {
+			wait = r.recoverFn(err)
+			r.log.Err(err).Msgf("error occured while fetching from %s, trying again in %v", r.name, wait)
+		} else {
+			r.backoff.Reset()
+			r.log.Debug().Msgf("finished fetching data, sleeping for %v", wait)
+		}
+		r.setNextRun(time.Now().Add(wait))
+	}
+}
+
+// sleep waits until the next run is due or ScrapeNow is called, nothing is due while the source
+// is paused. It returns false if the context was cancelled.
+func (r *runner) sleep(ctx context.Context) bool {
+	for {
+		r.mu.Lock()
+		paused, next := r.paused, r.nextRun
+		r.mu.Unlock()
+
+		var due <-chan time.Time
+		var timer *time.Timer
+		if !paused {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		select {
+		case <-due:
+			return true
+		case <-r.trigger:
+			// a triggered run fetches everything
+			r.lastBackfill = time.Time{}
+			stopTimer(timer)
+			return true
+		case <-r.wake:
+			// paused or resumed, check again
+			stopTimer(timer)
+		case <-ctx.Done():
+			stopTimer(timer)
+			return false
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
@@ -0,0 +1,184 @@
+package scraper
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+)
+
+func TestRunnerSchedule(t *testing.T) {
+	r := newRunner("test", nil, zerolog.Nop(), time.Minute)
+	r.backfillInterval = time.Hour
+	polls, fetches, missed := 0, 0, false
+	r.pollFn = func(ctx context.Context) (bool, error) {
+		polls++
+		return missed, nil
+	}
+	r.fetchFn = func(ctx context.Context) error {
+		fetches++
+		return nil
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		name             string
+		missed           bool
+		lastBackfill     time.Time
+		polls, fetches   int
+		keepLastBackfill bool
+	}{
+		{name: "backfill when started", polls: 0, fetches: 1},
+		{name: "poll between backfills", polls: 1, fetches: 1, keepLastBackfill: true},
+		{name: "backfill when readings were missed", missed: true, polls: 2, fetches: 2, keepLastBackfill: true},
+		{name: "backfill when due", lastBackfill: time.Now().Add(-2 * time.Hour), polls: 2, fetches: 3},
+	}
+	for _, tt := range tests {
+		missed = tt.missed
+		if !tt.keepLastBackfill {
+			r.lastBackfill = tt.lastBackfill
+		}
+		if err := r.next(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if polls != tt.polls || fetches != tt.fetches {
+			t.Errorf("%s: expected %v polls and %v fetches, got %v and %v", tt.name, tt.polls, tt.fetches, polls, fetches)
+		}
+	}
+}
+
+// testSource is a source running the given fetch function.
+type testSource struct {
+	runner
+}
+
+func newTestSource(fetch func(ctx context.Context) error) *testSource {
+	s := &testSource{runner: newRunner("test", nil, zerolog.Nop(), time.Hour)}
+	s.fetchFn = fetch
+	s.recoverFn = func(err error) time.Duration { return time.Hour }
+	return s
+}
+
+func TestRunnerLifecycle(t *testing.T) {
+	fetched := make(chan struct{}, 2)
+	s := newTestSource(func(ctx context.Context) error {
+		fetched <- struct{}{}
+		return nil
+	})
+
+	// stopping a source that was never started does nothing
+	s.Stop()
+	s.Start()
+	s.Start()
+	<-fetched
+	s.Stop()
+	s.Stop()
+	if s.IsRunning() {
+		t.Fatal("expected source to be stopped")
+	}
+
+	// a stopped source can be started again
+	s.Start()
+	<-fetched
+	if !s.IsRunning() {
+		t.Fatal("expected source to be running")
+	}
+	s.Stop()
+}
+
+func TestRunnerPanic(t *testing.T) {
+	fetched := make(chan struct{})
+	calls := 0
+	s := newTestSource(func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		close(fetched)
+		return nil
+	})
+	s.backoff = NewBackoff(time.Millisecond, time.Millisecond)
+
+	s.Start()
+	defer s.Stop()
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the loop to be restarted after panicking")
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 fetches, got %v", calls)
+	}
+}
+
+// eventually fails the test if the condition does not become true within a few seconds.
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunnerControl(t *testing.T) {
+	// the runner writes from its own goroutine, an in-memory database is per connection
+	store, err := datastore.NewSQLiteStore("file:" + t.TempDir() + "/opent1d.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	fetches := 0
+	s := newTestSource(nil)
+	s.fetchFn = func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		s.ingested(2)
+		return nil
+	}
+	s.db = store
+	fetched := func(n int) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return fetches == n
+		}
+	}
+
+	s.Start()
+	eventually(t, "expected a fetch when started", fetched(1))
+	eventually(t, "expected the next run to be scheduled", func() bool { return s.Status().NextRun.After(time.Now().Add(50 * time.Minute)) })
+
+	s.Pause()
+	if status := s.Status(); !status.Paused || !status.NextRun.IsZero() {
+		t.Errorf("expected paused source without a next run, got %+v", status)
+	}
+	s.ScrapeNow()
+	eventually(t, "expected ScrapeNow to fetch while paused", fetched(2))
+
+	// the source stays paused when restarted
+	s.Stop()
+	s.Start()
+	time.Sleep(50 * time.Millisecond)
+	if !s.Status().Paused || !fetched(2)() {
+		t.Fatal("expected source to stay paused after a restart")
+	}
+	s.Resume()
+	eventually(t, "expected a fetch when resumed", fetched(3))
+	s.Stop()
+
+	eventually(t, "expected the runs to be recorded", func() bool {
+		runs, err := store.LoadScrapeRuns("test", 0)
+		return err == nil && len(runs) == 3 && runs[0].Kind == RunBackfill && runs[0].Readings == 2
+	})
+}
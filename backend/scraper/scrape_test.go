@@ -0,0 +1,221 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/librelinkup/llutest"
+)
+
+func setupFakeLibreLinkUp(t *testing.T, settings datastore.Settings) (*LibreLinkupScraper, *llutest.Server) {
+	srv := llutest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddAccount(llutest.Account{
+		Email:       "foo@bar.com",
+		Password:    "secret",
+		Region:      librelinkup.EndpointUS.Region,
+		Connections: []librelinkup.Connection{{ID: "c1", PatientID: "p1", FirstName: "Jane", TargetLow: 70, TargetHigh: 180}},
+	})
+	srv.SetGraph("p1", librelinkup.Graph{
+		ActiveSensors: []librelinkup.ActiveSensor{{Sensor: librelinkup.Sensor{DeviceID: "d1", SerialNumber: "SN1", Activated: time.Date(2023, time.June, 15, 0, 0, 0, 0, time.UTC).Unix()}}},
+		GraphData: []librelinkup.GlucoseMeasurement{
+			{FactoryTimestamp: "6/20/2023 10:01:57 PM", Timestamp: "6/21/2023 12:01:57 AM", Value: 5.5, ValueInMgPerDl: 99},
+			{FactoryTimestamp: "6/20/2023 10:16:57 PM", Timestamp: "6/21/2023 12:16:57 AM", Value: 6.1, ValueInMgPerDl: 110},
+		},
+	})
+	high := librelinkup.AlarmHigh
+	srv.SetLogbook("p1",
+		librelinkup.LogbookEntry{GlucoseMeasurement: librelinkup.GlucoseMeasurement{FactoryTimestamp: "6/20/2023 8:00:00 PM", Timestamp: "6/20/2023 10:00:00 PM", Type: 2, Value: 13.4, ValueInMgPerDl: 241}, AlarmType: &high},
+		librelinkup.LogbookEntry{GlucoseMeasurement: librelinkup.GlucoseMeasurement{FactoryTimestamp: "6/21/2023 12:30:00 AM", Timestamp: "6/21/2023 2:30:00 AM", Type: 1, Value: 7.2, ValueInMgPerDl: 130, TrendArrow: 3}},
+	)
+	s := setupScraper(t, settings)
+	if err := s.db.SaveSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	s.client = srv.Client()
+	return s, srv
+}
+
+func TestScrape(t *testing.T) {
+	s, srv := setupFakeLibreLinkUp(t, datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "us"})
+
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cgms, err := s.db.LoadCGMInterval("p1", time.Date(2023, time.June, 20, 0, 0, 0, 0, time.UTC), time.Date(2023, time.June, 21, 0, 0, 0, 0, time.UTC), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cgms) != 2 || cgms[0].SensorSerial != "SN1" || cgms[0].UTCOffset != 2*60*60 || cgms[0].Source != LibreLinkUpSource {
+		t.Fatalf("expected 2 LibreLinkUp entries from sensor SN1, got %+v", cgms)
+	}
+	if h := s.Health(); h.State != HealthOK || h.LastSuccess.IsZero() {
+		t.Errorf("expected healthy source, got %+v", h)
+	}
+	alarms, err := s.db.LoadAlarmEvents("p1", time.Date(2023, time.June, 20, 0, 0, 0, 0, time.UTC), time.Date(2023, time.June, 21, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms) != 1 || alarms[0].Kind != datastore.AlarmKindHigh || alarms[0].MgPerDl != 241 || alarms[0].UTCOffset != 2*60*60 {
+		t.Errorf("expected the high alarm from the logbook, got %+v", alarms)
+	}
+	if scan, err := s.db.LatestCGM("p1"); err != nil || scan.MgPerDl != 130 || scan.SensorSerial != "SN1" {
+		t.Errorf("expected the scanned reading from the logbook, got %+v, %v", scan, err)
+	}
+	patients, err := s.db.Patients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patients) != 1 || patients[0].FirstName != "Jane" {
+		t.Errorf("expected patient Jane to be stored, got %+v", patients)
+	}
+
+	// the stored ticket is reused on the next scrape
+	s.ticket = nil
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Requests(llutest.RouteLogin) != 1 {
+		t.Errorf("expected stored ticket to be reused, got %v logins", srv.Requests(llutest.RouteLogin))
+	}
+
+	// a revoked ticket is cleared and the scraper signs in again
+	srv.RevokeTokens()
+	err = s.Fetch(context.Background())
+	if !errors.Is(err, librelinkup.ErrUnauthorized) {
+		t.Fatalf("expected %v, got %v", librelinkup.ErrUnauthorized, err)
+	}
+	if h := s.Health(); h.State != HealthFailing || h.Failures != 1 {
+		t.Errorf("expected failing source, got %+v", h)
+	}
+	s.recover(err)
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Requests(llutest.RouteLogin) != 2 {
+		t.Errorf("expected scraper to sign in again, got %v logins", srv.Requests(llutest.RouteLogin))
+	}
+}
+
+func TestScrapePoll(t *testing.T) {
+	s, srv := setupFakeLibreLinkUp(t, datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "us"})
+	setCurrent := func(factoryTimestamp string, mgdl int) {
+		srv.AddAccount(llutest.Account{
+			Email:    "foo@bar.com",
+			Password: "secret",
+			Region:   librelinkup.EndpointUS.Region,
+			Connections: []librelinkup.Connection{{ID: "c1", PatientID: "p1", FirstName: "Jane", GlucoseMeasurement: librelinkup.GlucoseMeasurement{
+				FactoryTimestamp: factoryTimestamp, Type: 1, ValueInMgPerDl: mgdl, Value: float64(mgdl) / 18, TrendArrow: 3,
+			}}},
+		})
+	}
+	setCurrent("6/21/2023 12:40:00 AM", 120)
+	s.interval = time.Minute
+	ctx := context.Background()
+
+	backfill, err := s.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !backfill {
+		t.Fatal("expected a backfill when no readings are stored")
+	}
+	latest, err := s.db.LatestCGM("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.MgPerDl != 120 || latest.Type != datastore.MeasurementTypeCurrent || latest.Source != LibreLinkUpSource {
+		t.Errorf("expected the current reading to be stored, got %v (type %v, source '%s')", latest, latest.Type, latest.Source)
+	}
+
+	setCurrent("6/21/2023 12:41:00 AM", 122)
+	if backfill, err := s.poll(ctx); err != nil || backfill {
+		t.Errorf("expected no backfill a minute after the latest reading, got %v, %v", backfill, err)
+	}
+	setCurrent("6/21/2023 1:30:00 AM", 140)
+	if backfill, err := s.poll(ctx); err != nil || !backfill {
+		t.Errorf("expected a backfill after missed readings, got %v, %v", backfill, err)
+	}
+	if srv.Requests(llutest.RouteGraph) != 0 {
+		t.Errorf("expected polls not to fetch the graph, got %v requests", srv.Requests(llutest.RouteGraph))
+	}
+}
+
+func TestScrapeStepRequired(t *testing.T) {
+	s, srv := setupFakeLibreLinkUp(t, datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "us"})
+	srv.RequireSteps("foo@bar.com", librelinkup.StepTermsOfUse)
+
+	err := s.Fetch(context.Background())
+	if !errors.Is(err, librelinkup.ErrStepRequired) {
+		t.Fatalf("expected %v, got %v", librelinkup.ErrStepRequired, err)
+	}
+	if step, err := s.db.GetValue(datastore.KeyLibreLinkUpStep); err != nil || step != librelinkup.StepTermsOfUse {
+		t.Fatalf("expected pending step to be stored, got '%s', %v", step, err)
+	}
+	if wait := s.recover(err); wait != s.interval {
+		t.Errorf("expected to wait a full interval for the step to be completed, got %v", wait)
+	}
+
+	// the step is completed elsewhere, the next scrape signs in and clears the pending step
+	_, stepErr := srv.Client().Login(context.Background(), "foo@bar.com", "secret", librelinkup.EndpointUS)
+	var se *librelinkup.StepError
+	if !errors.As(stepErr, &se) {
+		t.Fatalf("expected step error, got %v", stepErr)
+	}
+	if _, err := srv.Client().CompleteStep(context.Background(), &se.Ticket, se.Step); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.GetValue(datastore.KeyLibreLinkUpStep); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("expected pending step to be cleared, got %v", err)
+	}
+}
+
+func TestScrapeWrongRegion(t *testing.T) {
+	s, _ := setupFakeLibreLinkUp(t, datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "eu"})
+
+	err := s.Fetch(context.Background())
+	if !errors.Is(err, librelinkup.ErrWrongRegionEndpoint) {
+		t.Fatalf("expected %v, got %v", librelinkup.ErrWrongRegionEndpoint, err)
+	}
+	s.recover(err)
+	settings, err := s.db.GetSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.LibreLinkUpRegion != "us" {
+		t.Fatalf("expected region to be updated to 'us', got '%s'", settings.LibreLinkUpRegion)
+	}
+	if err := s.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScraperRun(t *testing.T) {
+	s, srv := setupFakeLibreLinkUp(t, datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "us"})
+	s.backoff.Initial = time.Millisecond
+	srv.Fail(llutest.RouteGraph, llutest.Failure{StatusCode: 503})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entries := s.broker.Subscribe(ctx)
+	s.Start()
+	select {
+	case cgm := <-entries:
+		if cgm.PatientID != "p1" {
+			t.Errorf("expected entry for patient p1, got %+v", cgm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no entries were published")
+	}
+	s.Stop()
+	if srv.Requests(llutest.RouteGraph) != 2 {
+		t.Errorf("expected graph to be retried once, got %v requests", srv.Requests(llutest.RouteGraph))
+	}
+}
@@ -0,0 +1,189 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/dexcomshare"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/pubsub"
+	"github.com/spagettikod/opent1d/sealer"
+)
+
+// ErrNotConfigured is returned by a Factory when the settings needed by the source are not set.
+var ErrNotConfigured = errors.New("source is not configured")
+
+// Source fetches glucose readings from a service and stores them in the datastore. Every entry
+// stored by a source is tagged with the source's name.
+type Source interface {
+	// Name uniquely identifies the source
+	Name() string
+	// Start fetches readings in the background, at the source's interval, until stopped. Starting
+	// a running source does nothing.
+	Start()
+	// Stop stops fetching readings and waits for any fetch in progress to be cancelled. Stopping
+	// a stopped source does nothing.
+	Stop()
+	IsRunning() bool
+	// Health returns the outcome of the latest fetches
+	Health() Health
+	// Status returns the source's health and schedule
+	Status() Status
+	// Pause stops scheduled fetches until Resume is called, the source stays paused when it is
+	// restarted
+	Pause()
+	Resume()
+	// ScrapeNow makes a running source fetch all readings right away, even if it is paused
+	ScrapeNow()
+	// Fetch fetches and stores the latest readings once
+	Fetch(ctx context.Context) error
+}
+
+// Sink is a Source that forwards readings to another service instead of fetching them. Readings
+// wait in an outbox until they are uploaded, uploads are fetches in the Source methods.
+type Sink interface {
+	Source
+	// Pending returns the number of readings waiting to be uploaded
+	Pending() (int, error)
+}
+
+// HealthState summarizes how well a source is doing.
+type HealthState int
+
+const (
+	// HealthUnknown is the state before the first fetch has finished
+	HealthUnknown HealthState = iota
+	HealthOK
+	HealthFailing
+)
+
+func (h HealthState) String() string {
+	switch h {
+	case HealthOK:
+		return "ok"
+	case HealthFailing:
+		return "failing"
+	default:
+		return "unknown"
+	}
+}
+
+// Health is the outcome of a source's latest fetches.
+type Health struct {
+	State       HealthState
+	LastAttempt time.Time
+	LastSuccess time.Time
+	// LastError is the error of the latest fetch, nil if it succeeded
+	LastError error
+	// Failures is the number of fetches that have failed in a row
+	Failures int
+}
+
+// Status is the health of a source together with its schedule.
+type Status struct {
+	Health
+	Running bool
+	Paused  bool
+	// NextRun is when the next fetch is scheduled, zero if the source is stopped or paused
+	NextRun time.Time
+}
+
+// healthTracker records the outcome of fetches, it is safe for concurrent use.
+type healthTracker struct {
+	mu     sync.Mutex
+	health Health
+}
+
+func (t *healthTracker) Health() Health {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.health
+}
+
+func (t *healthTracker) record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.health.LastAttempt = time.Now().UTC()
+	t.health.LastError = err
+	if err != nil {
+		t.health.State = HealthFailing
+		t.health.Failures++
+		return
+	}
+	t.health.State = HealthOK
+	t.health.LastSuccess = t.health.LastAttempt
+	t.health.Failures = 0
+}
+
+// Deps are the dependencies shared by all sources.
+type Deps struct {
+	DB          datastore.Store
+	Sealer      *sealer.Sealer
+	Logger      zerolog.Logger
+	Broker      *pubsub.Broker[datastore.CGMEntry]
+	LibreLinkUp *librelinkup.Client
+	DexcomShare *dexcomshare.Client
+	// Interval is the time between fetches for sources without an interval of their own
+	Interval time.Duration
+}
+
+// Factory creates a source from the settings, ErrNotConfigured is returned if the source's
+// settings are not set.
+type Factory func(deps Deps, settings datastore.Settings) (Source, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes a source available to NewSources, registering the same name twice panics.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, found := factories[name]; found {
+		panic(fmt.Sprintf("source '%s' is already registered", name))
+	}
+	factories[name] = factory
+}
+
+// NewSources creates all registered sources that are configured in the settings, sorted by name.
+func NewSources(deps Deps, settings datastore.Settings) ([]Source, error) {
+	factoriesMu.Lock()
+	registered := map[string]Factory{}
+	names := []string{}
+	for name, factory := range factories {
+		registered[name] = factory
+		names = append(names, name)
+	}
+	factoriesMu.Unlock()
+	sort.Strings(names)
+
+	sources := []Source{}
+	errs := []error{}
+	for _, name := range names {
+		source, err := registered[name](deps, settings)
+		if errors.Is(err, ErrNotConfigured) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not create source '%s': %w", name, err))
+			continue
+		}
+		sources = append(sources, source)
+	}
+	return sources, errors.Join(errs...)
+}
+
+// intervalOr returns the interval if set, otherwise the fallback.
+func intervalOr(interval, fallback time.Duration) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+	return fallback
+}
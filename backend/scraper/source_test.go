@@ -0,0 +1,36 @@
+package scraper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+)
+
+func TestNewSources(t *testing.T) {
+	deps := Deps{Logger: zerolog.Nop(), Interval: time.Hour}
+
+	sources, err := NewSources(deps, datastore.Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 0 {
+		t.Fatalf("expected no sources without settings, got %v", len(sources))
+	}
+
+	settings := datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "eu", LibreLinkUpInterval: time.Minute}
+	sources, err = NewSources(deps, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0].Name() != LibreLinkUpSource {
+		t.Fatalf("expected the LibreLinkUp source, got %v", sources)
+	}
+	if interval := sources[0].(*LibreLinkupScraper).interval; interval != time.Minute {
+		t.Errorf("expected the source's own interval %v, got %v", time.Minute, interval)
+	}
+	if h := sources[0].Health(); h.State != HealthUnknown {
+		t.Errorf("expected unknown health before the first fetch, got %v", h.State)
+	}
+}
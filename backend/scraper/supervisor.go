@@ -0,0 +1,94 @@
+package scraper
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// BuildFunc creates the sources to run, usually from the current settings.
+type BuildFunc func() ([]Source, error)
+
+// Supervisor owns the running sources. Start, Stop and Restart are idempotent and run one at a
+// time, sources are built while holding the lock so the latest settings always win and no more
+// than one set of sources is ever running. It is safe for concurrent use.
+type Supervisor struct {
+	mu      sync.Mutex
+	build   BuildFunc
+	sources []Source
+	started bool
+	log     zerolog.Logger
+}
+
+func NewSupervisor(logger zerolog.Logger, build BuildFunc) *Supervisor {
+	return &Supervisor{build: build, log: logger.With().Str("component", "scraper.Supervisor").Logger()}
+}
+
+// Start builds and starts the sources, it does nothing if they are already started. Sources that
+// could be built are started even if an error is returned.
+func (s *Supervisor) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return nil
+	}
+	return s.start()
+}
+
+// Stop stops all running sources, it does nothing if they are already stopped.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+}
+
+// Restart stops the running sources and starts new ones built from the current settings.
+func (s *Supervisor) Restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stop()
+	return s.start()
+}
+
+func (s *Supervisor) start() error {
+	sources, err := s.build()
+	s.sources = sources
+	s.started = true
+	for _, source := range s.sources {
+		s.log.Debug().Msgf("starting source '%s'", source.Name())
+		source.Start()
+	}
+	return err
+}
+
+func (s *Supervisor) stop() {
+	var wg sync.WaitGroup
+	for _, source := range s.sources {
+		s.log.Debug().Msgf("stopping source '%s'", source.Name())
+		wg.Add(1)
+		go func(source Source) {
+			defer wg.Done()
+			source.Stop()
+		}(source)
+	}
+	wg.Wait()
+	s.sources = nil
+	s.started = false
+}
+
+// Sources returns the running sources.
+func (s *Supervisor) Sources() []Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Source{}, s.sources...)
+}
+
+// Source returns the running source with the given name.
+func (s *Supervisor) Source(name string) (Source, bool) {
+	for _, source := range s.Sources() {
+		if source.Name() == name {
+			return source, true
+		}
+	}
+	return nil, false
+}
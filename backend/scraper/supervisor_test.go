@@ -0,0 +1,89 @@
+package scraper
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// builder builds test sources and keeps track of every source built.
+type builder struct {
+	mu    sync.Mutex
+	built []*testSource
+}
+
+func (b *builder) build() ([]Source, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := newTestSource(func(ctx context.Context) error { return nil })
+	b.built = append(b.built, s)
+	return []Source{s}, nil
+}
+
+func TestSupervisor(t *testing.T) {
+	b := &builder{}
+	sup := NewSupervisor(zerolog.Nop(), b.build)
+
+	if err := sup.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sup.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.built) != 1 || !b.built[0].IsRunning() {
+		t.Fatalf("expected a single running source after starting twice, got %v", len(b.built))
+	}
+	if s, found := sup.Source("test"); !found || s != b.built[0] {
+		t.Fatalf("expected to find the running source, got %v", s)
+	}
+
+	if err := sup.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if b.built[0].IsRunning() || !b.built[1].IsRunning() {
+		t.Fatal("expected the first source to be replaced by the second")
+	}
+	sup.Stop()
+	sup.Stop()
+	if b.built[1].IsRunning() || len(sup.Sources()) != 0 {
+		t.Fatal("expected all sources to be stopped")
+	}
+}
+
+func TestSupervisorConcurrentRestarts(t *testing.T) {
+	b := &builder{}
+	sup := NewSupervisor(zerolog.Nop(), b.build)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				sup.Start()
+			case 1:
+				sup.Stop()
+			default:
+				sup.Restart()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := sup.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	running := 0
+	for _, s := range b.built {
+		if s.IsRunning() {
+			running++
+		}
+	}
+	if running != 1 || !b.built[len(b.built)-1].IsRunning() {
+		t.Fatalf("expected only the latest source to be running, got %v running of %v built", running, len(b.built))
+	}
+	sup.Stop()
+}
@@ -0,0 +1,106 @@
+package scraper
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/librelinkup"
+)
+
+// ticketRefreshMargin is how long before the next scrape would find the ticket expired a new
+// ticket is requested
+const ticketRefreshMargin = time.Hour
+
+// storedTicket is the auth ticket together with the account and region it is valid for.
+type storedTicket struct {
+	Username string `json:"username"`
+	Region   string `json:"region"`
+	Token    string `json:"token"`
+	Expires  int64  `json:"expires"`
+	Duration int64  `json:"duration"`
+}
+
+// refreshMargin returns how long before it expires the ticket should be replaced, a ticket must
+// outlast the next scheduled scrape.
+func (s *LibreLinkupScraper) refreshMargin() time.Duration {
+	return s.interval + ticketRefreshMargin
+}
+
+// loadTicket returns the stored ticket if it belongs to the current account and does not expire
+// soon, otherwise nil.
+func (s *LibreLinkupScraper) loadTicket() *librelinkup.Ticket {
+	if s.sealer == nil {
+		return nil
+	}
+	sealed, err := s.db.GetValue(datastore.KeyLibreLinkUpTicket)
+	if err != nil {
+		if !errors.Is(err, datastore.ErrNotFound) {
+			s.log.Err(err).Msg("could not load stored ticket")
+		}
+		return nil
+	}
+	plaintext, err := s.sealer.Open(sealed)
+	if err != nil {
+		s.log.Err(err).Msg("could not decrypt stored ticket, ignoring it")
+		return nil
+	}
+	st := storedTicket{}
+	if err := json.Unmarshal(plaintext, &st); err != nil {
+		s.log.Err(err).Msg("could not parse stored ticket, ignoring it")
+		return nil
+	}
+	if st.Username != s.settings.LibreLinkUpUsername || st.Region != s.settings.LibreLinkUpRegion {
+		s.log.Debug().Msg("stored ticket belongs to another account, ignoring it")
+		return nil
+	}
+	endpoint, found := librelinkup.EndpointByRegion(st.Region)
+	if !found {
+		return nil
+	}
+	ticket := &librelinkup.Ticket{Token: st.Token, Expires: st.Expires, Duration: st.Duration, Username: st.Username, Endpoint: endpoint}
+	if ticket.ExpiresWithin(s.refreshMargin()) {
+		s.log.Debug().Msgf("stored ticket expires %v, ignoring it", ticket.ExpiresAt())
+		return nil
+	}
+	return ticket
+}
+
+// saveTicket stores the current ticket, encrypted, if it changed since it was last stored.
+func (s *LibreLinkupScraper) saveTicket() {
+	if s.sealer == nil || s.ticket == nil || s.ticket.Token == "" || s.ticket.Token == s.savedToken {
+		return
+	}
+	plaintext, err := json.Marshal(storedTicket{
+		Username: s.settings.LibreLinkUpUsername,
+		Region:   s.ticket.Endpoint.Region,
+		Token:    s.ticket.Token,
+		Expires:  s.ticket.Expires,
+		Duration: s.ticket.Duration,
+	})
+	if err != nil {
+		s.log.Err(err).Msg("could not marshal ticket")
+		return
+	}
+	sealed, err := s.sealer.Seal(plaintext)
+	if err != nil {
+		s.log.Err(err).Msg("could not encrypt ticket")
+		return
+	}
+	if err := s.db.SaveValue(datastore.KeyLibreLinkUpTicket, sealed); err != nil {
+		s.log.Err(err).Msg("could not save ticket")
+		return
+	}
+	s.savedToken = s.ticket.Token
+	s.log.Debug().Msgf("saved ticket expiring %v", s.ticket.ExpiresAt())
+}
+
+// clearTicket forgets the current ticket, forcing a new login on the next scrape.
+func (s *LibreLinkupScraper) clearTicket() {
+	s.ticket = nil
+	s.savedToken = ""
+	if err := s.db.DeleteValue(datastore.KeyLibreLinkUpTicket); err != nil {
+		s.log.Err(err).Msg("could not delete stored ticket")
+	}
+}
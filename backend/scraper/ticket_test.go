@@ -0,0 +1,78 @@
+package scraper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spagettikod/opent1d/datastore"
+	"github.com/spagettikod/opent1d/librelinkup"
+	"github.com/spagettikod/opent1d/pubsub"
+	"github.com/spagettikod/opent1d/sealer"
+)
+
+func setupScraper(t *testing.T, settings datastore.Settings) *LibreLinkupScraper {
+	store, err := datastore.NewSQLiteStore("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(datastore.LatestSchemaVersion()); err != nil {
+		t.Fatalf("failed to migrate store: %v", err)
+	}
+	key, err := sealer.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slr, err := sealer.New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := librelinkup.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewLibreLinkUpScraper(store, client, slr, settings, zerolog.Nop(), time.Hour, pubsub.NewBroker[datastore.CGMEntry]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTicketPersistence(t *testing.T) {
+	settings := datastore.Settings{LibreLinkUpUsername: "foo@bar.com", LibreLinkUpPassword: "secret", LibreLinkUpRegion: "eu"}
+	s := setupScraper(t, settings)
+	s.ticket = &librelinkup.Ticket{Token: "token", Expires: time.Now().Add(30 * 24 * time.Hour).Unix(), Endpoint: librelinkup.EndpointEU}
+	s.saveTicket()
+
+	loaded := s.loadTicket()
+	if loaded == nil || loaded.Token != "token" || loaded.Endpoint != librelinkup.EndpointEU {
+		t.Fatalf("expected stored ticket to be loaded, got %+v", loaded)
+	}
+	stored, err := s.db.GetValue(datastore.KeyLibreLinkUpTicket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == "token" {
+		t.Fatal("expected ticket to be stored encrypted")
+	}
+
+	// a ticket belonging to another account must not be reused
+	s.settings.LibreLinkUpUsername = "other@bar.com"
+	if s.loadTicket() != nil {
+		t.Fatal("expected ticket of another account to be ignored")
+	}
+	s.settings = settings
+
+	// a ticket expiring before the next scrape must not be reused
+	s.ticket = &librelinkup.Ticket{Token: "expiring", Expires: time.Now().Add(s.interval).Unix(), Endpoint: librelinkup.EndpointEU}
+	s.saveTicket()
+	if s.loadTicket() != nil {
+		t.Fatal("expected expiring ticket to be ignored")
+	}
+
+	s.clearTicket()
+	if _, err := s.db.GetValue(datastore.KeyLibreLinkUpTicket); err != datastore.ErrNotFound {
+		t.Fatalf("expected stored ticket to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package sealer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.Seal([]byte("secret token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := s.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "secret token" {
+		t.Errorf("expected 'secret token', got '%s'", plaintext)
+	}
+
+	otherKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(sealed); !errors.Is(err, ErrInvalidSealed) {
+		t.Errorf("expected %v opening with another key, got %v", ErrInvalidSealed, err)
+	}
+	if _, err := New([]byte("short")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected %v, got %v", ErrInvalidKey, err)
+	}
+}